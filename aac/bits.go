@@ -0,0 +1,64 @@
+package aac
+
+import (
+	"errors"
+)
+
+var ErrShortPacket = errors.New("aac: packet too short")
+
+// bitReader reads most significant bit first, the first read past the end
+// sets err and every next read returns zero.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) u(n int) uint {
+	if r.err != nil {
+		return 0
+	}
+	if n < 0 || r.pos+n > len(r.b)*8 {
+		r.err = ErrShortPacket
+		return 0
+	}
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint(r.b[r.pos>>3]>>(7-uint(r.pos&7)))&1
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+// bytes reads n bytes, not necessarily byte aligned
+func (r *bitReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n*8 > len(r.b)*8 {
+		r.err = ErrShortPacket
+		return nil
+	}
+	if r.pos&7 == 0 {
+		res := r.b[r.pos>>3 : r.pos>>3+n]
+		r.pos += n * 8
+		return res
+	}
+	res := make([]byte, n)
+	for i := range res {
+		res[i] = byte(r.u(8))
+	}
+	return res
+}
+
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+func (r *bitReader) left() int {
+	return len(r.b)*8 - r.pos
+}
@@ -0,0 +1,23 @@
+package aac
+
+// bitWriter writes most significant bit first
+type bitWriter struct {
+	b    []byte
+	bits int
+}
+
+func (w *bitWriter) put(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits&7 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.b[len(w.b)-1] |= 0x80 >> uint(w.bits&7)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) align() {
+	w.bits = (w.bits + 7) &^ 7
+}
@@ -0,0 +1,622 @@
+package aac
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+var ErrUnsupported = errors.New("aac: unsupported bitstream feature")
+
+// window sequences
+const (
+	onlyLongSequence = iota
+	longStartSequence
+	eightShortSequence
+	longStopSequence
+)
+
+// syntactic elements of a raw_data_block
+const (
+	elemSCE = iota
+	elemCPE
+	elemCCE
+	elemLFE
+	elemDSE
+	elemPCE
+	elemFIL
+	elemEND
+)
+
+var (
+	longWindows  = [2][]float64{sineWindow(2048), kbdWindow(2048, 4)}
+	shortWindows = [2][]float64{sineWindow(256), kbdWindow(256, 6)}
+)
+
+// Decoder decodes AAC LC access units to PCM. Streams with SBR or PS
+// are decoded at their core sample rate.
+type Decoder struct {
+	config aacparser.MPEG4AudioConfig
+	sfi    int
+
+	long, short *mdct
+	channels    []*channelState
+	ics         [2]ics
+	noise       *rand.Rand
+}
+
+// channelState keeps what a channel needs from the previous frame
+type channelState struct {
+	overlap []float64
+	shape   int
+}
+
+// ics is the decoded individual_channel_stream of an element
+type ics struct {
+	sequence    int
+	shape       int
+	maxSFB      int
+	groups      []int // window group lengths
+	bandTypes   [8][64]int
+	scale       [8][64]int
+	msUsed      [8][64]bool
+	tns         [8][]tnsFilter
+	spec        [1024]float32
+	numWindows  int
+	swb         []int
+	numSWB      int
+	tnsMaxBands int
+}
+
+type tnsFilter struct {
+	length    int
+	order     int
+	direction bool
+	lpc       [32]float64
+}
+
+// NewDecoder returns a decoder of the AudioSpecificConfig of the stream
+func NewDecoder(config aacparser.MPEG4AudioConfig) (*Decoder, error) {
+	switch config.ObjectType {
+	case aacparser.AOT_AAC_LC, aacparser.AOT_SBR, aacparser.AOT_PS:
+	default:
+		return nil, fmt.Errorf("aac: unsupported audio object type %d", config.ObjectType)
+	}
+	sfi := int(config.SampleRateIndex)
+	if sfi >= len(sampleRates) {
+		if sfi = sampleRateIndex(config.SampleRate); sfi < 0 {
+			return nil, fmt.Errorf("aac: unsupported sample rate %d", config.SampleRate)
+		}
+	}
+	return &Decoder{
+		config: config,
+		sfi:    sfi,
+		long:   newMDCT(2048),
+		short:  newMDCT(256),
+		noise:  rand.New(rand.NewSource(1)),
+	}, nil
+}
+
+// SampleRate of the decoded audio
+func (d *Decoder) SampleRate() int {
+	return sampleRates[d.sfi]
+}
+
+// Decode returns the 1024 samples of every channel of a raw access unit,
+// scaled to [-1, 1]. Coupling channels and programs with a PCE are not
+// supported, LFE channels are dropped.
+func (d *Decoder) Decode(au []byte) ([][]float32, error) {
+	r := &bitReader{b: au}
+	var out [][]float32
+	ch := 0
+	for r.err == nil {
+		id := int(r.u(3))
+		if r.err != nil {
+			break
+		}
+		switch id {
+		case elemEND:
+			return out, nil
+		case elemSCE, elemLFE:
+			r.u(4) // element_instance_tag
+			s := &d.ics[0]
+			if err := d.readICS(r, s, false); err != nil {
+				return out, err
+			}
+			if id == elemLFE {
+				continue
+			}
+			out = append(out, d.synthesize(ch, s))
+			ch++
+		case elemCPE:
+			r.u(4)
+			l, rt := &d.ics[0], &d.ics[1]
+			common := r.flag()
+			msMask := 0
+			if common {
+				if err := d.readICSInfo(r, l); err != nil {
+					return out, err
+				}
+				msMask = int(r.u(2))
+				for g := range l.groups {
+					for sfb := 0; sfb < l.maxSFB; sfb++ {
+						l.msUsed[g][sfb] = msMask == 2 || (msMask == 1 && r.flag())
+					}
+				}
+				copyInfo(rt, l)
+			}
+			if err := d.readICS(r, l, common); err != nil {
+				return out, err
+			}
+			if err := d.readICS(r, rt, common); err != nil {
+				return out, err
+			}
+			if common {
+				d.stereo(l, rt, msMask)
+			}
+			out = append(out, d.synthesize(ch, l), d.synthesize(ch+1, rt))
+			ch += 2
+		case elemDSE:
+			r.u(4)
+			align := r.flag()
+			n := int(r.u(8))
+			if n == 255 {
+				n += int(r.u(8))
+			}
+			if align {
+				r.align()
+			}
+			r.pos += 8 * n
+		case elemFIL:
+			n := int(r.u(4))
+			if n == 15 {
+				n += int(r.u(8)) - 1
+			}
+			r.pos += 8 * n // SBR and other extensions are ignored
+		default:
+			return out, ErrUnsupported
+		}
+		if r.pos > len(au)*8 {
+			r.err = ErrShortPacket
+		}
+	}
+	return out, ErrShortPacket
+}
+
+func copyInfo(dst, src *ics) {
+	dst.sequence, dst.shape, dst.maxSFB = src.sequence, src.shape, src.maxSFB
+	dst.groups = append(dst.groups[:0], src.groups...)
+	dst.numWindows, dst.swb, dst.numSWB, dst.tnsMaxBands = src.numWindows, src.swb, src.numSWB, src.tnsMaxBands
+}
+
+func (d *Decoder) readICSInfo(r *bitReader, s *ics) error {
+	r.u(1) // ics_reserved_bit
+	s.sequence = int(r.u(2))
+	s.shape = int(r.u(1))
+	s.groups = s.groups[:0]
+	if s.sequence == eightShortSequence {
+		s.maxSFB = int(r.u(4))
+		grouping := r.u(7)
+		s.groups = append(s.groups, 1)
+		for i := 6; i >= 0; i-- {
+			if grouping>>uint(i)&1 != 0 {
+				s.groups[len(s.groups)-1]++
+			} else {
+				s.groups = append(s.groups, 1)
+			}
+		}
+		s.numWindows = 8
+		s.swb = swbShort[d.sfi]
+		s.tnsMaxBands = tnsMaxBandsShort[d.sfi]
+	} else {
+		s.maxSFB = int(r.u(6))
+		if r.flag() { // predictor_data_present, not part of LC
+			return ErrUnsupported
+		}
+		s.groups = append(s.groups, 1)
+		s.numWindows = 1
+		s.swb = swbLong[d.sfi]
+		s.tnsMaxBands = tnsMaxBandsLong[d.sfi]
+	}
+	s.numSWB = len(s.swb) - 1
+	if s.maxSFB > s.numSWB {
+		return fmt.Errorf("aac: max_sfb %d above %d bands", s.maxSFB, s.numSWB)
+	}
+	return r.err
+}
+
+// readICS reads an individual_channel_stream and dequantizes its spectrum
+func (d *Decoder) readICS(r *bitReader, s *ics, common bool) error {
+	globalGain := int(r.u(8))
+	if !common {
+		if err := d.readICSInfo(r, s); err != nil {
+			return err
+		}
+		for g := range s.groups {
+			for sfb := range s.msUsed[g] {
+				s.msUsed[g][sfb] = false
+			}
+		}
+	}
+
+	// section_data
+	sectBits := 5
+	if s.sequence == eightShortSequence {
+		sectBits = 3
+	}
+	esc := 1<<uint(sectBits) - 1
+	for g := range s.groups {
+		for k := 0; k < s.maxSFB; {
+			cb := int(r.u(4))
+			if cb == 12 {
+				return fmt.Errorf("aac: reserved codebook")
+			}
+			n := 0
+			for {
+				incr := int(r.u(sectBits))
+				n += incr
+				if incr != esc || r.err != nil {
+					break
+				}
+			}
+			if k+n > s.maxSFB || r.err != nil {
+				return fmt.Errorf("aac: invalid section data")
+			}
+			for ; n > 0; n-- {
+				s.bandTypes[g][k] = cb
+				k++
+			}
+		}
+	}
+
+	// scale_factor_data
+	sf, noise, is := globalGain, globalGain-90, 0
+	noisePCM := true
+	for g := range s.groups {
+		for sfb := 0; sfb < s.maxSFB; sfb++ {
+			switch s.bandTypes[g][sfb] {
+			case zeroHCB:
+				s.scale[g][sfb] = 0
+			case intensityHCB, intensityHCB2:
+				is += hcbSF.decode(r) - 60
+				s.scale[g][sfb] = is
+			case noiseHCB:
+				if noisePCM {
+					noisePCM = false
+					noise += int(r.u(9)) - 256
+				} else {
+					noise += hcbSF.decode(r) - 60
+				}
+				s.scale[g][sfb] = noise
+			default:
+				sf += hcbSF.decode(r) - 60
+				if sf < 0 || sf > 255 {
+					return fmt.Errorf("aac: scalefactor %d out of range", sf)
+				}
+				s.scale[g][sfb] = sf
+			}
+		}
+	}
+
+	// pulse_data
+	var pulses [4][2]int // offset, amplitude
+	numPulses, pulseStart := 0, 0
+	if r.flag() {
+		if s.sequence == eightShortSequence {
+			return fmt.Errorf("aac: pulse data in short windows")
+		}
+		numPulses = int(r.u(2)) + 1
+		pulseStart = int(r.u(6))
+		for i := 0; i < numPulses; i++ {
+			pulses[i][0] = int(r.u(5))
+			pulses[i][1] = int(r.u(4))
+		}
+	}
+
+	// tns_data
+	for w := range s.tns {
+		s.tns[w] = s.tns[w][:0]
+	}
+	if r.flag() {
+		d.readTNS(r, s)
+	}
+
+	if r.flag() { // gain_control_data_present, SSR only
+		return ErrUnsupported
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// spectral_data, short windows of a group are interleaved by band
+	var q [1024]int
+	var v [4]int
+	win := 0
+	for g, glen := range s.groups {
+		for sfb := 0; sfb < s.maxSFB; sfb++ {
+			cb := s.bandTypes[g][sfb]
+			if cb == zeroHCB || cb >= noiseHCB {
+				continue
+			}
+			width := s.swb[sfb+1] - s.swb[sfb]
+			dim := bookDim(cb)
+			for w := 0; w < glen; w++ {
+				base := (win+w)*128 + s.swb[sfb]
+				for k := 0; k < width; k += dim {
+					if !readSpectral(r, cb, v[:dim]) {
+						return fmt.Errorf("aac: invalid spectral data")
+					}
+					copy(q[base+k:], v[:dim])
+				}
+			}
+		}
+		win += glen
+	}
+
+	if numPulses > 0 {
+		if pulseStart >= s.numSWB {
+			return fmt.Errorf("aac: invalid pulse data")
+		}
+		k := s.swb[pulseStart]
+		for i := 0; i < numPulses; i++ {
+			k += pulses[i][0]
+			if k >= 1024 {
+				return fmt.Errorf("aac: invalid pulse data")
+			}
+			if q[k] > 0 {
+				q[k] += pulses[i][1]
+			} else {
+				q[k] -= pulses[i][1]
+			}
+		}
+	}
+
+	d.dequantize(s, &q)
+	return nil
+}
+
+func (d *Decoder) readTNS(r *bitReader, s *ics) {
+	short := s.sequence == eightShortSequence
+	for w := 0; w < s.numWindows; w++ {
+		var nFilt int
+		if short {
+			nFilt = int(r.u(1))
+		} else {
+			nFilt = int(r.u(2))
+		}
+		if nFilt == 0 {
+			continue
+		}
+		res := 3 + int(r.u(1))
+		for f := 0; f < nFilt; f++ {
+			var t tnsFilter
+			if short {
+				t.length = int(r.u(4))
+				t.order = int(r.u(3))
+			} else {
+				t.length = int(r.u(6))
+				t.order = int(r.u(5))
+			}
+			if t.order > 0 {
+				t.direction = r.flag()
+				compress := int(r.u(1))
+				bits := res - compress
+				var parcor [32]float64
+				iqfac := (float64(int(1)<<uint(res-1)) - 0.5) / (math.Pi / 2)
+				iqfacM := (float64(int(1)<<uint(res-1)) + 0.5) / (math.Pi / 2)
+				for i := 0; i < t.order; i++ {
+					c := int(r.u(bits))
+					if c >= 1<<uint(bits-1) {
+						c -= 1 << uint(bits)
+					}
+					if c >= 0 {
+						parcor[i] = math.Sin(float64(c) / iqfac)
+					} else {
+						parcor[i] = math.Sin(float64(c) / iqfacM)
+					}
+				}
+				// parcor to LPC
+				var tmp [32]float64
+				for m := 1; m <= t.order; m++ {
+					for i := 1; i < m; i++ {
+						tmp[i] = t.lpc[i-1] + parcor[m-1]*t.lpc[m-i-1]
+					}
+					for i := 1; i < m; i++ {
+						t.lpc[i-1] = tmp[i]
+					}
+					t.lpc[m-1] = parcor[m-1]
+				}
+			}
+			s.tns[w] = append(s.tns[w], t)
+		}
+	}
+}
+
+// dequantize rebuilds the spectrum of the quantized values, noise bands
+// included, then applies TNS
+func (d *Decoder) dequantize(s *ics, q *[1024]int) {
+	for i := range s.spec {
+		s.spec[i] = 0
+	}
+	win := 0
+	for g, glen := range s.groups {
+		for sfb := 0; sfb < s.maxSFB; sfb++ {
+			cb := s.bandTypes[g][sfb]
+			start, end := s.swb[sfb], s.swb[sfb+1]
+			for w := win; w < win+glen; w++ {
+				base := w * 128
+				switch {
+				case cb == zeroHCB || cb == intensityHCB || cb == intensityHCB2:
+				case cb == noiseHCB:
+					var energy float64
+					for k := start; k < end; k++ {
+						v := d.noise.Float64()*2 - 1
+						s.spec[base+k] = float32(v)
+						energy += v * v
+					}
+					scale := math.Pow(2, 0.25*float64(s.scale[g][sfb])) / math.Sqrt(energy)
+					for k := start; k < end; k++ {
+						s.spec[base+k] *= float32(scale)
+					}
+				default:
+					gain := math.Pow(2, 0.25*float64(s.scale[g][sfb]-100))
+					for k := start; k < end; k++ {
+						x := q[base+k]
+						if x == 0 {
+							continue
+						}
+						v := math.Pow(math.Abs(float64(x)), 4.0/3) * gain
+						if x < 0 {
+							v = -v
+						}
+						s.spec[base+k] = float32(v)
+					}
+				}
+			}
+		}
+		win += glen
+	}
+}
+
+// stereo applies M/S and intensity stereo of a channel pair with a common window
+func (d *Decoder) stereo(l, r *ics, msMask int) {
+	win := 0
+	for g, glen := range l.groups {
+		for sfb := 0; sfb < l.maxSFB; sfb++ {
+			start, end := l.swb[sfb], l.swb[sfb+1]
+			cb := r.bandTypes[g][sfb]
+			for w := win; w < win+glen; w++ {
+				base := w * 128
+				switch {
+				case cb == intensityHCB || cb == intensityHCB2:
+					scale := math.Pow(0.5, 0.25*float64(r.scale[g][sfb]))
+					if cb == intensityHCB2 {
+						scale = -scale
+					}
+					if msMask == 1 && l.msUsed[g][sfb] {
+						scale = -scale
+					}
+					for k := start; k < end; k++ {
+						r.spec[base+k] = l.spec[base+k] * float32(scale)
+					}
+				case l.msUsed[g][sfb] && cb != noiseHCB && l.bandTypes[g][sfb] != noiseHCB:
+					for k := start; k < end; k++ {
+						m, s := l.spec[base+k], r.spec[base+k]
+						l.spec[base+k], r.spec[base+k] = m+s, m-s
+					}
+				}
+			}
+		}
+		win += glen
+	}
+}
+
+// applyTNS filters the spectrum of every window with its TNS filters
+func applyTNS(s *ics) {
+	for w := 0; w < s.numWindows; w++ {
+		top := s.numSWB
+		spec := s.spec[w*128:]
+		for _, f := range s.tns[w] {
+			bottom := top - f.length
+			if bottom < 0 {
+				bottom = 0
+			}
+			start := s.swb[minInt(bottom, s.tnsMaxBands, s.maxSFB)]
+			end := s.swb[minInt(top, s.tnsMaxBands, s.maxSFB)]
+			top = bottom
+			size := end - start
+			if f.order == 0 || size <= 0 {
+				continue
+			}
+			inc := 1
+			if f.direction {
+				inc = -1
+				start = end - 1
+			}
+			for m, k := 0, start; m < size; m, k = m+1, k+inc {
+				v := float64(spec[k])
+				for i := 1; i <= f.order && i <= m; i++ {
+					v -= float64(spec[k-i*inc]) * f.lpc[i-1]
+				}
+				spec[k] = float32(v)
+			}
+		}
+	}
+}
+
+func minInt(v ...int) int {
+	m := v[0]
+	for _, x := range v[1:] {
+		if x < m {
+			m = x
+		}
+	}
+	return m
+}
+
+// synthesize runs the filterbank of a channel, it returns its 1024 samples
+func (d *Decoder) synthesize(ch int, s *ics) []float32 {
+	for len(d.channels) <= ch {
+		d.channels = append(d.channels, &channelState{overlap: make([]float64, 1024)})
+	}
+	c := d.channels[ch]
+	applyTNS(s)
+
+	var buf [2048]float64
+	prevLong, prevShort := longWindows[c.shape], shortWindows[c.shape]
+	long, short := longWindows[s.shape], shortWindows[s.shape]
+	if s.sequence == eightShortSequence {
+		var tmp [256]float64
+		for w := 0; w < 8; w++ {
+			d.short.inverse(s.spec[w*128:w*128+128], tmp[:])
+			left := short
+			if w == 0 {
+				left = prevShort
+			}
+			off := 448 + 128*w
+			for i := 0; i < 128; i++ {
+				buf[off+i] += tmp[i] * left[i]
+				buf[off+128+i] += tmp[128+i] * short[127-i]
+			}
+		}
+	} else {
+		d.long.inverse(s.spec[:], buf[:])
+		switch s.sequence {
+		case longStopSequence:
+			for i := 0; i < 448; i++ {
+				buf[i] = 0
+			}
+			for i := 0; i < 128; i++ {
+				buf[448+i] *= prevShort[i]
+			}
+		default:
+			for i := 0; i < 1024; i++ {
+				buf[i] *= prevLong[i]
+			}
+		}
+		switch s.sequence {
+		case longStartSequence:
+			for i := 0; i < 128; i++ {
+				buf[1472+i] *= short[127-i]
+			}
+			for i := 1600; i < 2048; i++ {
+				buf[i] = 0
+			}
+		default:
+			for i := 0; i < 1024; i++ {
+				buf[1024+i] *= long[1023-i]
+			}
+		}
+	}
+
+	out := make([]float32, 1024)
+	for i := range out {
+		out[i] = float32((buf[i] + c.overlap[i]) / 32768)
+	}
+	copy(c.overlap, buf[1024:])
+	c.shape = s.shape
+	return out
+}
@@ -0,0 +1,97 @@
+package aac
+
+import (
+	"math"
+	"testing"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+// silent frames of the ffmpeg AAC LC encoder, the ones hls.js inserts in
+// audio gaps
+var ffmpegSilence = map[int][]byte{
+	1: {0x00, 0xc8, 0x00, 0x80, 0x23, 0x80},
+	2: {0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80},
+	3: {0x00, 0xc8, 0x00, 0x80, 0x20, 0x84, 0x01, 0x26, 0x40, 0x08, 0x64, 0x00, 0x8e},
+}
+
+func TestDecodeSilence(t *testing.T) {
+	for channels, au := range ffmpegSilence {
+		d, err := NewDecoder(aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRateIndex: 4, ChannelConfig: uint(channels)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 3; n++ {
+			frame, err := d.Decode(au)
+			if err != nil {
+				t.Fatalf("%d channels: %v", channels, err)
+			}
+			if len(frame) != channels {
+				t.Fatalf("%d channels: %d decoded", channels, len(frame))
+			}
+			for ch := range frame {
+				if len(frame[ch]) != 1024 {
+					t.Fatalf("%d channels: %d samples in channel %d", channels, len(frame[ch]), ch)
+				}
+				for i, v := range frame[ch] {
+					if v != 0 {
+						t.Fatalf("%d channels: sample %d of channel %d is %v", channels, i, ch, v)
+					}
+				}
+			}
+		}
+		if _, err := d.Decode(au[:len(au)-1]); err == nil {
+			t.Errorf("%d channels: truncated frame decoded", channels)
+		}
+	}
+}
+
+// singleLine is a mono long frame with one spectral line, the first one of
+// the first band at 2^20 (global gain 180)
+func singleLine() []byte {
+	w := &bitWriter{}
+	w.put(elemSCE, 3)
+	w.put(0, 4)    // element_instance_tag
+	w.put(180, 8)  // global_gain
+	w.put(0, 1)    // ics_reserved_bit
+	w.put(0, 2)    // ONLY_LONG_SEQUENCE
+	w.put(0, 1)    // sine window
+	w.put(1, 6)    // max_sfb
+	w.put(0, 1)    // predictor_data_present
+	w.put(1, 4)    // sect_cb
+	w.put(1, 5)    // sect_len
+	w.put(0, 1)    // scalefactor of the global gain
+	w.put(0, 1)    // pulse_data_present
+	w.put(0, 1)    // tns_data_present
+	w.put(0, 1)    // gain_control_data_present
+	w.put(0x10, 5) // codebook 1: 1, 0, 0, 0
+	w.put(elemEND, 3)
+	w.align()
+	return w.b
+}
+
+// The line decodes to the windowed IMDCT of ISO/IEC 14496-3 4.6.11, the
+// second half comes with the next frame, an ffmpeg silent one
+func TestDecodeSingleLine(t *testing.T) {
+	d, err := NewDecoder(aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRateIndex: 3, ChannelConfig: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []float32
+	for _, au := range [][]byte{singleLine(), ffmpegSilence[1]} {
+		frame, err := d.Decode(au)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, frame[0]...)
+	}
+	const N = 2048
+	for n, v := range out {
+		x := 2.0 / N * math.Pow(2, 20) * math.Cos(2*math.Pi/N*(float64(n)+(N/2+1)/2.0)*0.5)
+		window := math.Sin(math.Pi / N * (float64(n) + 0.5))
+		want := window * x / 32768
+		if math.Abs(float64(v)-want) > 1e-5 {
+			t.Fatalf("sample %d: %v, want %v", n, v, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package aac
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+// Encoder is a simple AAC LC encoder: long sine windows only, one
+// scalefactor for all bands and a bisection of it to meet the bitrate.
+// It is good enough for camera audio, it is not meant for music.
+type Encoder struct {
+	sampleRate int
+	channels   int
+	sfi        int
+	swb        []int
+	maxSFB     int
+	frameBits  int
+
+	mdct    *mdct
+	window  []float64
+	pending [][]float32 // input samples not encoded yet
+	prev    [][]float64 // previous 1024 samples of every channel
+	buf     []float64
+	spec    [2][1024]float64
+	q       [2][1024]int
+}
+
+// NewEncoder returns an encoder of 1 or 2 channels at a standard sample rate,
+// the bitrate is for all channels
+func NewEncoder(sampleRate, channels, bitrate int) (*Encoder, error) {
+	sfi := sampleRateIndex(sampleRate)
+	if sfi < 0 || sfi >= 12 {
+		return nil, fmt.Errorf("aac: unsupported encoder sample rate %d", sampleRate)
+	}
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("aac: unsupported encoder channel count %d", channels)
+	}
+	e := &Encoder{
+		sampleRate: sampleRate,
+		channels:   channels,
+		sfi:        sfi,
+		swb:        swbLong[sfi],
+		mdct:       newMDCT(2048),
+		window:     longWindows[0],
+		pending:    make([][]float32, channels),
+		prev:       make([][]float64, channels),
+		buf:        make([]float64, 2048),
+	}
+	for ch := range e.prev {
+		e.prev[ch] = make([]float64, 1024)
+	}
+	// 6144 bits per channel is the decoder input buffer
+	e.frameBits = bitrate*1024/sampleRate - 16 // section length escapes aren't counted
+	if max := 6144 * channels; e.frameBits > max {
+		e.frameBits = max
+	}
+	// drop the bands above the audio bandwidth the bitrate can afford
+	bandwidth := sampleRate / 2
+	if perChannel := bitrate / channels; bandwidth > perChannel/3 && perChannel/3 > 4000 {
+		bandwidth = perChannel / 3
+	}
+	limit := bandwidth * 2048 / sampleRate
+	e.maxSFB = len(e.swb) - 1
+	for e.maxSFB > 1 && e.swb[e.maxSFB-1] >= limit {
+		e.maxSFB--
+	}
+	return e, nil
+}
+
+// Config is the AudioSpecificConfig of the encoded stream
+func (e *Encoder) Config() aacparser.MPEG4AudioConfig {
+	c := aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: uint(e.sfi),
+		ChannelConfig:   uint(e.channels),
+	}
+	c.Complete()
+	return c
+}
+
+// Encode adds planar samples in [-1, 1] and returns the access units of
+// every complete frame of 1024 samples
+func (e *Encoder) Encode(pcm [][]float32) ([][]byte, error) {
+	if len(pcm) != e.channels {
+		return nil, fmt.Errorf("aac: encoder expects %d channels, got %d", e.channels, len(pcm))
+	}
+	for ch := range pcm {
+		e.pending[ch] = append(e.pending[ch], pcm[ch]...)
+	}
+	var aus [][]byte
+	for len(e.pending[0]) >= 1024 {
+		aus = append(aus, e.frame())
+		for ch := range e.pending {
+			e.pending[ch] = e.pending[ch][:copy(e.pending[ch], e.pending[ch][1024:])]
+		}
+	}
+	return aus, nil
+}
+
+func (e *Encoder) frame() []byte {
+	for ch := 0; ch < e.channels; ch++ {
+		for i := 0; i < 1024; i++ {
+			cur := float64(e.pending[ch][i]) * 32768
+			e.buf[i] = e.prev[ch][i] * e.window[i]
+			e.buf[1024+i] = cur * e.window[1023-i]
+			e.prev[ch][i] = cur
+		}
+		e.mdct.forward(e.buf, e.spec[ch][:])
+	}
+
+	// lowest scalefactor, the finest quantization, that fits the budget
+	lo, hi := 0, 255
+	for lo < hi {
+		sf := (lo + hi) / 2
+		if e.quantize(sf) <= e.frameBits {
+			hi = sf
+		} else {
+			lo = sf + 1
+		}
+	}
+	e.quantize(lo)
+
+	w := &bitWriter{}
+	if e.channels == 1 {
+		w.put(elemSCE, 3)
+		w.put(0, 4)
+		e.writeICS(w, 0, lo)
+	} else {
+		w.put(elemCPE, 3)
+		w.put(0, 4)
+		w.put(0, 1) // common_window
+		e.writeICS(w, 0, lo)
+		e.writeICS(w, 1, lo)
+	}
+	w.put(elemEND, 3)
+	w.align()
+	return w.b
+}
+
+// quantize all channels with a scalefactor, it returns the frame size in bits
+func (e *Encoder) quantize(sf int) int {
+	// |x|^(3/4) * 2^(-3/16 (sf-100)), the inverse of the decoder
+	scale := math.Pow(2, -0.1875*float64(sf-100))
+	bits := 3 + 3 // element id and END
+	for ch := 0; ch < e.channels; ch++ {
+		bits += 4
+		if e.channels == 2 {
+			bits++
+		}
+		for i := range e.q[ch] {
+			x := e.spec[ch][i]
+			v := int(math.Pow(math.Abs(x), 0.75)*scale + 0.4054)
+			if v > 8191 {
+				return math.MaxInt32
+			}
+			if x < 0 {
+				v = -v
+			}
+			e.q[ch][i] = v
+		}
+		bits += e.channelBits(ch)
+	}
+	return bits
+}
+
+// bandBook picks the codebook of a band and returns its size in bits
+func (e *Encoder) bandBook(ch, sfb int) (cb, bits int) {
+	band := e.q[ch][e.swb[sfb]:e.swb[sfb+1]]
+	max := 0
+	for _, v := range band {
+		if v = abs(v); v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		return zeroHCB, 0
+	}
+	first := escHCB
+	for c := 1; c < escHCB; c += 2 {
+		if max <= bookMax(c) {
+			first = c
+			break
+		}
+	}
+	cb, bits = 0, math.MaxInt32
+	for c := first; c <= first+1 && c <= escHCB; c++ {
+		n := 0
+		dim := bookDim(c)
+		for k := 0; k < len(band); k += dim {
+			n += spectralBits(c, band[k:k+dim])
+		}
+		if n < bits {
+			cb, bits = c, n
+		}
+	}
+	return cb, bits
+}
+
+// channelBits is the size of an individual_channel_stream
+func (e *Encoder) channelBits(ch int) int {
+	bits := 8 + 11 + 3 // global_gain, ics_info, pulse, tns and gain control flags
+	prev := -1
+	for sfb := 0; sfb < e.maxSFB; sfb++ {
+		cb, n := e.bandBook(ch, sfb)
+		if cb != prev {
+			bits += 4 + 5 // new section
+			prev = cb
+		}
+		bits += n
+		if cb != zeroHCB {
+			bits++ // scalefactor unchanged
+		}
+	}
+	return bits
+}
+
+func (e *Encoder) writeICS(w *bitWriter, ch, sf int) {
+	w.put(uint(sf), 8) // global_gain
+	// ics_info
+	w.put(0, 1)
+	w.put(onlyLongSequence, 2)
+	w.put(0, 1) // sine window
+	w.put(uint(e.maxSFB), 6)
+	w.put(0, 1) // predictor_data_present
+
+	// section_data, a section per run of the same codebook
+	books := make([]int, e.maxSFB)
+	for sfb := range books {
+		books[sfb], _ = e.bandBook(ch, sfb)
+	}
+	for start := 0; start < e.maxSFB; {
+		end := start + 1
+		for end < e.maxSFB && books[end] == books[start] {
+			end++
+		}
+		w.put(uint(books[start]), 4)
+		n := end - start
+		for ; n >= 31; n -= 31 {
+			w.put(31, 5)
+		}
+		w.put(uint(n), 5)
+		start = end
+	}
+
+	// scale_factor_data, every band uses the global gain
+	for sfb := 0; sfb < e.maxSFB; sfb++ {
+		if books[sfb] != zeroHCB {
+			hcbSF.write(w, 60)
+		}
+	}
+	w.put(0, 1) // pulse_data_present
+	w.put(0, 1) // tns_data_present
+	w.put(0, 1) // gain_control_data_present
+
+	for sfb := 0; sfb < e.maxSFB; sfb++ {
+		cb := books[sfb]
+		if cb == zeroHCB {
+			continue
+		}
+		dim := bookDim(cb)
+		band := e.q[ch][e.swb[sfb]:e.swb[sfb+1]]
+		for k := 0; k < len(band); k += dim {
+			writeSpectral(w, cb, band[k:k+dim])
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package aac
+
+import (
+	"math"
+	"testing"
+)
+
+// tones encoded and decoded back come out one frame late, the overlap of
+// the MDCT, within the noise of the quantization
+func TestEncodeDecode(t *testing.T) {
+	for _, c := range []struct {
+		rate, channels, bitrate int
+		minSNR                  float64
+	}{
+		{48000, 1, 64000, 45},
+		{44100, 2, 128000, 45},
+		{16000, 1, 32000, 45},
+		{8000, 1, 16000, 40},
+	} {
+		enc, err := NewEncoder(c.rate, c.channels, c.bitrate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := NewDecoder(enc.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec.SampleRate() != c.rate {
+			t.Fatalf("decoder rate %d, want %d", dec.SampleRate(), c.rate)
+		}
+		freqs := []float64{440, 1000}
+		n := c.rate / 1024 * 1024
+		pcm := make([][]float32, c.channels)
+		for ch := range pcm {
+			pcm[ch] = make([]float32, n)
+			for i := range pcm[ch] {
+				pcm[ch][i] = float32(0.3 * math.Sin(2*math.Pi*freqs[ch]*float64(i)/float64(c.rate)))
+			}
+		}
+		out := make([][]float32, c.channels)
+		for i := 0; i < n; i += 512 {
+			chunk := make([][]float32, c.channels)
+			for ch := range chunk {
+				chunk[ch] = pcm[ch][i : i+512]
+			}
+			aus, err := enc.Encode(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, au := range aus {
+				if bits := len(au) * 8; bits > c.bitrate*1024/c.rate*3/2 {
+					t.Errorf("%d Hz: %d bits in a frame", c.rate, bits)
+				}
+				frame, err := dec.Decode(au)
+				if err != nil {
+					t.Fatalf("%d Hz: %v", c.rate, err)
+				}
+				if len(frame) != c.channels {
+					t.Fatalf("%d Hz: %d channels decoded", c.rate, len(frame))
+				}
+				for ch := range frame {
+					out[ch] = append(out[ch], frame[ch]...)
+				}
+			}
+		}
+		if len(out[0]) != n {
+			t.Fatalf("%d Hz: %d samples decoded, want %d", c.rate, len(out[0]), n)
+		}
+		for ch := range out {
+			var signal, noise float64
+			// skip the first frame, the overlap of nothing
+			for i := 1024; i < n; i++ {
+				want := float64(pcm[ch][i-1024])
+				signal += want * want
+				noise += (float64(out[ch][i]) - want) * (float64(out[ch][i]) - want)
+			}
+			if snr := 10 * math.Log10(signal/noise); snr < c.minSNR {
+				t.Errorf("%d Hz channel %d: SNR %.1f dB", c.rate, ch, snr)
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package aac
+
+// huffTable is a codebook given by the length and codeword of every index,
+// the decoding tree is built on first use.
+type huffTable struct {
+	lens  []uint8
+	codes []uint32
+	tree  [][2]int32 // children, a leaf is -(index+1)
+}
+
+func (t *huffTable) build() {
+	t.tree = make([][2]int32, 1, 2*len(t.lens))
+	for i, l := range t.lens {
+		node := 0
+		for b := int(l) - 1; b >= 0; b-- {
+			bit := (t.codes[i] >> uint(b)) & 1
+			if b == 0 {
+				t.tree[node][bit] = -int32(i + 1)
+				break
+			}
+			next := t.tree[node][bit]
+			if next == 0 {
+				t.tree = append(t.tree, [2]int32{})
+				next = int32(len(t.tree) - 1)
+				t.tree[node][bit] = next
+			}
+			node = int(next)
+		}
+	}
+}
+
+// decode reads a codeword, it returns -1 on a short or invalid stream
+func (t *huffTable) decode(r *bitReader) int {
+	node := int32(0)
+	for {
+		next := t.tree[node][r.u(1)]
+		if r.err != nil || next == 0 {
+			return -1
+		}
+		if next < 0 {
+			return int(-next - 1)
+		}
+		node = next
+	}
+}
+
+func (t *huffTable) write(w *bitWriter, i int) {
+	w.put(uint(t.codes[i]), int(t.lens[i]))
+}
+
+// spectral codebooks by number, 0 is ZERO_HCB
+var spectralBooks = [12]*huffTable{nil, &hcb1, &hcb2, &hcb3, &hcb4, &hcb5, &hcb6, &hcb7, &hcb8, &hcb9, &hcb10, &hcb11}
+
+func init() {
+	for _, t := range spectralBooks[1:] {
+		t.build()
+	}
+	hcbSF.build()
+}
+
+const (
+	zeroHCB       = 0
+	escHCB        = 11
+	noiseHCB      = 13
+	intensityHCB2 = 14
+	intensityHCB  = 15
+)
+
+// bookDim is the number of values of a codeword
+func bookDim(cb int) int {
+	if cb < 5 {
+		return 4
+	}
+	return 2
+}
+
+// bookSigned reports whether the values of a codebook carry their sign
+func bookSigned(cb int) bool {
+	return cb == 1 || cb == 2 || cb == 5 || cb == 6
+}
+
+// bookMax is the largest magnitude of a codebook, 16 is the escape of book 11
+func bookMax(cb int) int {
+	return [12]int{0, 1, 1, 2, 2, 4, 4, 7, 7, 12, 12, 16}[cb]
+}
+
+// bookIndex of the values of a codeword, magnitudes for unsigned books
+func bookIndex(cb int, v []int) int {
+	switch cb {
+	case 1, 2:
+		return 27*(v[0]+1) + 9*(v[1]+1) + 3*(v[2]+1) + v[3] + 1
+	case 3, 4:
+		return 27*v[0] + 9*v[1] + 3*v[2] + v[3]
+	case 5, 6:
+		return 9*(v[0]+4) + v[1] + 4
+	}
+	mod := bookMax(cb) + 1
+	return mod*v[0] + v[1]
+}
+
+// bookValues are the values of a codebook index
+func bookValues(cb, idx int, v []int) {
+	switch cb {
+	case 1, 2:
+		v[0], v[1], v[2], v[3] = idx/27-1, idx/9%3-1, idx/3%3-1, idx%3-1
+	case 3, 4:
+		v[0], v[1], v[2], v[3] = idx/27, idx/9%3, idx/3%3, idx%3
+	case 5, 6:
+		v[0], v[1] = idx/9-4, idx%9-4
+	default:
+		mod := bookMax(cb) + 1
+		v[0], v[1] = idx/mod, idx%mod
+	}
+}
+
+// readSpectral decodes the values of one codeword into v
+func readSpectral(r *bitReader, cb int, v []int) bool {
+	idx := spectralBooks[cb].decode(r)
+	if idx < 0 {
+		return false
+	}
+	bookValues(cb, idx, v)
+	if !bookSigned(cb) {
+		for i := range v {
+			if v[i] != 0 && r.flag() {
+				v[i] = -v[i]
+			}
+		}
+	}
+	if cb == escHCB {
+		for i := range v {
+			if v[i] == 16 || v[i] == -16 {
+				n := 4
+				for r.flag() {
+					n++
+					if n > 12 {
+						return false
+					}
+				}
+				e := int(r.u(n)) | 1<<uint(n)
+				if v[i] < 0 {
+					e = -e
+				}
+				v[i] = e
+			}
+		}
+	}
+	return r.err == nil
+}
+
+// writeSpectral codes the values v, magnitudes above 15 need book 11
+func writeSpectral(w *bitWriter, cb int, v []int) {
+	var mag [4]int
+	for i, x := range v {
+		if !bookSigned(cb) {
+			x = abs(x)
+			if cb == escHCB && x > 16 {
+				x = 16
+			}
+		}
+		mag[i] = x
+	}
+	spectralBooks[cb].write(w, bookIndex(cb, mag[:len(v)]))
+	if bookSigned(cb) {
+		return
+	}
+	for _, x := range v {
+		if x < 0 {
+			w.put(1, 1)
+		} else if x > 0 {
+			w.put(0, 1)
+		}
+	}
+	if cb != escHCB {
+		return
+	}
+	for _, x := range v {
+		if x = abs(x); x >= 16 {
+			n := bitLen(x) - 1
+			for i := 4; i < n; i++ {
+				w.put(1, 1)
+			}
+			w.put(0, 1)
+			w.put(uint(x)&(1<<uint(n)-1), n)
+		}
+	}
+}
+
+// spectralBits is the size of the coded values v
+func spectralBits(cb int, v []int) int {
+	var mag [4]int
+	bits := 0
+	for i, x := range v {
+		if !bookSigned(cb) {
+			x = abs(x)
+			if x != 0 {
+				bits++ // sign
+			}
+			if cb == escHCB && x >= 16 {
+				bits += 2*bitLen(x) - 5
+				x = 16
+			}
+		}
+		mag[i] = x
+	}
+	return bits + int(spectralBooks[cb].lens[bookIndex(cb, mag[:len(v)])])
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func bitLen(x int) int {
+	n := 0
+	for ; x > 0; x >>= 1 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package aac
+
+import (
+	"fmt"
+	"testing"
+)
+
+// codewords of the tables of ISO/IEC 14496-3 4.A.1
+func TestHuffmanVectors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		table *huffTable
+		index int
+		len   uint8
+		code  uint32
+	}{
+		{"scalefactor", &hcbSF, 60, 1, 0x0},
+		{"scalefactor", &hcbSF, 59, 3, 0x4},
+		{"scalefactor", &hcbSF, 61, 4, 0xa},
+		{"scalefactor", &hcbSF, 0, 18, 0x3ffe8},
+		{"book 1", &hcb1, 40, 1, 0x0},
+		{"book 11", &hcb11, 0, 4, 0x0},
+	} {
+		if l, code := c.table.lens[c.index], c.table.codes[c.index]; l != c.len || code != c.code {
+			t.Errorf("%s index %d: %d bits %#x, want %d bits %#x", c.name, c.index, l, code, c.len, c.code)
+		}
+		w := &bitWriter{}
+		w.put(uint(c.code), int(c.len))
+		if got := c.table.decode(&bitReader{b: w.b}); got != c.index {
+			t.Errorf("%s: %d bits %#x decode to %d, want %d", c.name, c.len, c.code, got, c.index)
+		}
+	}
+}
+
+// every codebook is a complete prefix code, and every codeword decodes to
+// its index
+func TestHuffmanTables(t *testing.T) {
+	tables := map[string]*huffTable{"scalefactor": &hcbSF}
+	for cb, table := range spectralBooks[1:] {
+		tables[fmt.Sprint("book ", cb+1)] = table
+	}
+	for name, table := range tables {
+		var kraft float64
+		for i, l := range table.lens {
+			kraft += 1 / float64(uint64(1)<<l)
+			for j, m := range table.lens[:i] {
+				short, long, lb := table.codes[j], table.codes[i], l-m
+				if l < m {
+					short, long, lb = table.codes[i], table.codes[j], m-l
+				}
+				if long>>lb == short {
+					t.Errorf("%s: codeword %d is a prefix of %d", name, j, i)
+				}
+			}
+		}
+		if kraft != 1 {
+			t.Errorf("%s: Kraft sum %v", name, kraft)
+		}
+		w := &bitWriter{}
+		for i := range table.lens {
+			table.write(w, i)
+		}
+		r := &bitReader{b: w.b}
+		for i := range table.lens {
+			if got := table.decode(r); got != i {
+				t.Fatalf("%s: index %d decodes to %d", name, i, got)
+			}
+		}
+	}
+}
+
+// the values of every book, with the escapes of book 11, read back as
+// written in the bits counted by the encoder
+func TestSpectral(t *testing.T) {
+	for cb := 1; cb <= escHCB; cb++ {
+		max := bookMax(cb)
+		if cb == escHCB {
+			max = 8191
+		}
+		var values [][]int
+		for _, x := range []int{0, 1, -1, max / 2, -max, max, 15, 16, -17, 300, -8191} {
+			if abs(x) > max {
+				continue
+			}
+			v := make([]int, bookDim(cb))
+			for i := range v {
+				v[i] = x
+				if i%2 == 1 {
+					v[i] = -x / 2
+				}
+			}
+			values = append(values, v)
+		}
+		w := &bitWriter{}
+		bits := 0
+		for _, v := range values {
+			writeSpectral(w, cb, v)
+			bits += spectralBits(cb, v)
+		}
+		if bits != w.bits {
+			t.Errorf("book %d: %d bits written, %d counted", cb, w.bits, bits)
+		}
+		r := &bitReader{b: w.b}
+		for _, want := range values {
+			got := make([]int, len(want))
+			if !readSpectral(r, cb, got) {
+				t.Fatalf("book %d: %v does not decode", cb, want)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("book %d: %v decodes to %v", cb, want, got)
+			}
+		}
+	}
+}
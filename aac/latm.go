@@ -0,0 +1,233 @@
+package aac
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+var ErrUnsupportedLATM = errors.New("aac: unsupported LATM configuration")
+
+// StreamMuxConfig of a LATM stream (ISO/IEC 14496-3 1.7.3),
+// only one program with one layer is supported.
+type StreamMuxConfig struct {
+	AudioMuxVersion uint
+	NumSubFrames    int // payloads per AudioMuxElement
+	FrameLengthType uint
+	FrameLength     int // in bytes, for FrameLengthType 1
+	Config          aacparser.MPEG4AudioConfig
+}
+
+// ParseStreamMuxConfig parses the hex decoded "config" fmtp parameter
+func ParseStreamMuxConfig(b []byte) (*StreamMuxConfig, error) {
+	return readStreamMuxConfig(&bitReader{b: b})
+}
+
+func readStreamMuxConfig(r *bitReader) (*StreamMuxConfig, error) {
+	c := &StreamMuxConfig{}
+	c.AudioMuxVersion = r.u(1)
+	if c.AudioMuxVersion == 1 {
+		if r.u(1) != 0 { // audioMuxVersionA
+			return nil, ErrUnsupportedLATM
+		}
+		latmGetValue(r) // taraBufferFullness
+	}
+	r.u(1) // allStreamsSameTimeFraming
+	c.NumSubFrames = int(r.u(6)) + 1
+	if r.u(4) != 0 || r.u(3) != 0 { // numProgram, numLayer
+		return nil, ErrUnsupportedLATM
+	}
+	var err error
+	if c.AudioMuxVersion == 0 {
+		c.Config, err = readAudioSpecificConfig(r)
+	} else {
+		n := int(latmGetValue(r)) // ascLen, in bits
+		start := r.pos
+		c.Config, err = readAudioSpecificConfig(r)
+		r.pos = start
+		r.u(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.FrameLengthType = r.u(3)
+	switch c.FrameLengthType {
+	case 0:
+		r.u(8) // latmBufferFullness
+	case 1:
+		c.FrameLength = int(r.u(9)) + 20
+	case 3, 4, 5:
+		r.u(6) // CELPframeLengthTableIndex
+	case 6, 7:
+		r.u(1) // HVXCframeLengthTableIndex
+	}
+	if r.flag() { // otherDataPresent
+		if c.AudioMuxVersion == 1 {
+			latmGetValue(r)
+		} else {
+			for {
+				esc := r.flag()
+				r.u(8)
+				if !esc || r.err != nil {
+					break
+				}
+			}
+		}
+	}
+	if r.flag() { // crcCheckPresent
+		r.u(8)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if c.FrameLengthType != 0 && c.FrameLengthType != 1 {
+		return nil, fmt.Errorf("aac: unsupported LATM frameLengthType %d", c.FrameLengthType)
+	}
+	return c, nil
+}
+
+func latmGetValue(r *bitReader) uint {
+	n := r.u(2)
+	var v uint
+	for i := uint(0); i <= n; i++ {
+		v = v<<8 | r.u(8)
+	}
+	return v
+}
+
+func readObjectType(r *bitReader) uint {
+	t := r.u(5)
+	if t == 31 {
+		t = 32 + r.u(6)
+	}
+	return t
+}
+
+func readSampleRate(r *bitReader, c *aacparser.MPEG4AudioConfig) {
+	c.SampleRateIndex = r.u(4)
+	if c.SampleRateIndex == 0xF {
+		c.SampleRate = int(r.u(24))
+	}
+}
+
+// readAudioSpecificConfig reads an AudioSpecificConfig (ISO/IEC 14496-3 1.6.2.1).
+// With explicit SBR/PS signalling the core AAC configuration is returned,
+// decoders find the extension in the stream.
+func readAudioSpecificConfig(r *bitReader) (aacparser.MPEG4AudioConfig, error) {
+	var c aacparser.MPEG4AudioConfig
+	c.ObjectType = readObjectType(r)
+	readSampleRate(r, &c)
+	c.ChannelConfig = r.u(4)
+	if c.ObjectType == aacparser.AOT_SBR || c.ObjectType == aacparser.AOT_PS {
+		var ext aacparser.MPEG4AudioConfig
+		readSampleRate(r, &ext) // extensionSamplingFrequencyIndex
+		c.ObjectType = readObjectType(r)
+		if c.ObjectType == aacparser.AOT_ER_BSAC {
+			r.u(4) // extensionChannelConfiguration
+		}
+	}
+	switch c.ObjectType {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+		// GASpecificConfig
+		r.u(1)        // frameLengthFlag
+		if r.flag() { // dependsOnCoreCoder
+			r.u(14) // coreCoderDelay
+		}
+		extension := r.flag()
+		if c.ChannelConfig == 0 {
+			return c, errors.New("aac: program_config_element not supported")
+		}
+		if c.ObjectType == 6 || c.ObjectType == 20 {
+			r.u(3) // layerNr
+		}
+		if extension {
+			if c.ObjectType == 22 {
+				r.u(5)  // numOfSubFrame
+				r.u(11) // layer_length
+			}
+			if c.ObjectType == 17 || c.ObjectType == 19 || c.ObjectType == 20 || c.ObjectType == 23 {
+				r.u(3) // resilience flags
+			}
+			r.u(1) // extensionFlag3
+		}
+	default:
+		return c, fmt.Errorf("aac: unsupported audio object type %d", c.ObjectType)
+	}
+	if r.err != nil {
+		return c, r.err
+	}
+	c.Complete()
+	if c.SampleRateIndex == 0xF {
+		// escape value, the muxer looks the explicit rate up again
+		c.SampleRateIndex = 0
+	}
+	return c, nil
+}
+
+// LATMDepacketizer extracts the access units of MP4A-LATM payloads
+type LATMDepacketizer struct {
+	// Config from the SDP, or the last one received in-band
+	Config *StreamMuxConfig
+	// CPresent is set when the StreamMuxConfig is sent in-band (cpresent=1)
+	CPresent bool
+
+	buf []byte // AudioMuxElement fragments
+}
+
+// Push returns the access units of a RTP payload. An AudioMuxElement
+// may be fragmented across packets, the last one has the marker bit.
+// The returned slices are valid until the next call.
+func (d *LATMDepacketizer) Push(payload []byte, marker bool) ([][]byte, error) {
+	d.buf = append(d.buf, payload...)
+	if !marker {
+		if len(d.buf) > 1<<16 {
+			d.buf = d.buf[:0]
+			return nil, ErrShortPacket
+		}
+		return nil, nil
+	}
+	b := d.buf
+	d.buf = d.buf[:0]
+
+	r := &bitReader{b: b}
+	if d.CPresent {
+		if !r.flag() { // useSameStreamMux
+			c, err := readStreamMuxConfig(r)
+			if err != nil {
+				return nil, err
+			}
+			d.Config = c
+		}
+	}
+	if d.Config == nil {
+		return nil, errors.New("aac: LATM StreamMuxConfig not received")
+	}
+
+	var aus [][]byte
+	for i := 0; i < d.Config.NumSubFrames; i++ {
+		// PayloadLengthInfo
+		var n int
+		if d.Config.FrameLengthType == 1 {
+			n = d.Config.FrameLength
+		} else {
+			for {
+				v := int(r.u(8))
+				n += v
+				if v != 255 || r.err != nil {
+					break
+				}
+			}
+		}
+		// PayloadMux
+		au := r.bytes(n)
+		if r.err != nil {
+			return aus, r.err
+		}
+		if n == 0 {
+			continue
+		}
+		aus = append(aus, au)
+	}
+	return aus, nil
+}
@@ -0,0 +1,142 @@
+package aac
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+func TestParseStreamMuxConfig(t *testing.T) {
+	// the config of a 48 kHz stereo AAC LC stream
+	b, _ := hex.DecodeString("400023203fc0")
+	c, err := ParseStreamMuxConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AudioMuxVersion != 0 || c.NumSubFrames != 1 || c.FrameLengthType != 0 ||
+		c.Config.ObjectType != aacparser.AOT_AAC_LC || c.Config.SampleRate != 48000 || c.Config.ChannelConfig != 2 {
+		t.Fatalf("%+v", c)
+	}
+
+	// streamMuxConfig fields from audioMuxVersion, each malformed one
+	// breaks a valid config
+	config := func(version, versionA, programs, channels, frameLengthType uint, truncate int) []byte {
+		w := &bitWriter{}
+		w.put(version, 1)
+		if version == 1 {
+			w.put(versionA, 1)
+			w.put(0, 2) // taraBufferFullness in 1 byte
+			w.put(0xff, 8)
+		}
+		w.put(1, 1) // allStreamsSameTimeFraming
+		w.put(0, 6) // numSubFrames
+		w.put(programs, 4)
+		w.put(0, 3) // numLayer
+		if version == 1 {
+			w.put(0, 2) // ascLen in 1 byte
+			w.put(16, 8)
+		}
+		w.put(2, 5) // AAC LC
+		w.put(3, 4) // 48 kHz
+		w.put(channels, 4)
+		w.put(0, 3) // GASpecificConfig
+		w.put(frameLengthType, 3)
+		switch frameLengthType {
+		case 0:
+			w.put(0xff, 8)
+		case 1:
+			w.put(100, 9)
+		}
+		w.put(0, 2) // otherDataPresent, crcCheckPresent
+		return w.b[:len(w.b)-truncate]
+	}
+	for _, c := range []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"audioMuxVersion 0", config(0, 0, 0, 2, 0, 0), true},
+		{"audioMuxVersion 1", config(1, 0, 0, 2, 0, 0), true},
+		{"fixed frame length", config(0, 0, 0, 1, 1, 0), true},
+		{"empty", nil, false},
+		{"truncated", config(0, 0, 0, 2, 0, 3), false},
+		{"audioMuxVersionA", config(1, 1, 0, 2, 0, 0), false},
+		{"two programs", config(0, 0, 1, 2, 0, 0), false},
+		{"program_config_element", config(0, 0, 0, 0, 0, 0), false},
+		{"CELP frame length", config(0, 0, 0, 2, 3, 0), false},
+	} {
+		if _, err := ParseStreamMuxConfig(c.b); (err == nil) != c.ok {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+	}
+}
+
+func TestLATMDepacketizer(t *testing.T) {
+	b, _ := hex.DecodeString("400023203fc0")
+	config, err := ParseStreamMuxConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	au := bytes.Repeat([]byte{0x5a}, 600)
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		sizes   []int
+		err     error
+	}{
+		{"short AU", append([]byte{10}, au[:10]...), []int{10}, nil},
+		{"escaped length", append([]byte{255, 255, 10}, au[:520]...), []int{520}, nil},
+		{"zero length", []byte{0}, nil, nil},
+		{"empty", nil, nil, ErrShortPacket},
+		{"truncated AU", append([]byte{10}, au[:4]...), nil, ErrShortPacket},
+		{"truncated PayloadLengthInfo", []byte{255, 255}, nil, ErrShortPacket},
+	} {
+		d := &LATMDepacketizer{Config: config}
+		aus, err := d.Push(c.payload, true)
+		if err != c.err {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+		}
+		if len(aus) != len(c.sizes) {
+			t.Errorf("%s: %d AUs, want %d", c.name, len(aus), len(c.sizes))
+			continue
+		}
+		for i, a := range aus {
+			if len(a) != c.sizes[i] {
+				t.Errorf("%s: AU %d of %d bytes, want %d", c.name, i, len(a), c.sizes[i])
+			}
+		}
+	}
+
+	// an AudioMuxElement in two packets, with the config in-band
+	w := &bitWriter{}
+	w.put(0, 1) // useSameStreamMux
+	for _, c := range b {
+		w.put(uint(c), 8)
+	}
+	// the config is 44 bits, its last 4 are padding
+	w.bits -= 4
+	w.b = w.b[:(w.bits+7)/8]
+	w.put(100, 8)
+	for _, c := range au[:100] {
+		w.put(uint(c), 8)
+	}
+	d := &LATMDepacketizer{CPresent: true}
+	if aus, err := d.Push(w.b[:50], false); len(aus) != 0 || err != nil {
+		t.Fatalf("first fragment: %d AUs, %v", len(aus), err)
+	}
+	aus, err := d.Push(w.b[50:], true)
+	if err != nil || len(aus) != 1 || !bytes.Equal(aus[0], au[:100]) {
+		t.Fatalf("in-band config: %d AUs, %v", len(aus), err)
+	}
+	if d.Config == nil || d.Config.Config.SampleRate != 48000 {
+		t.Fatalf("in-band config %+v", d.Config)
+	}
+
+	// the same StreamMuxConfig is needed first
+	d = &LATMDepacketizer{CPresent: true}
+	if _, err := d.Push([]byte{0x80, 0}, true); err == nil {
+		t.Fatal("useSameStreamMux without a StreamMuxConfig")
+	}
+}
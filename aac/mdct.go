@@ -0,0 +1,169 @@
+package aac
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// mdct computes the MDCT and IMDCT of ISO/IEC 14496-3 4.6.11 for a window
+// of n samples, through a DCT-IV of n/2 points done with a n/4 point FFT.
+type mdct struct {
+	n     int
+	pre   []complex128 // rotations around the FFT
+	post  []complex128
+	fft   []complex128 // FFT roots
+	buf   []complex128
+	fold  []float64
+	coefs []float64
+}
+
+func newMDCT(n int) *mdct {
+	m := n / 2
+	t := &mdct{
+		n:     n,
+		pre:   make([]complex128, m/2),
+		post:  make([]complex128, m/2),
+		fft:   make([]complex128, m/4),
+		buf:   make([]complex128, m/2),
+		fold:  make([]float64, m),
+		coefs: make([]float64, m),
+	}
+	for k := range t.pre {
+		t.pre[k] = cmplx.Exp(complex(0, -math.Pi*(4*float64(k)+1)/(4*float64(m))))
+		t.post[k] = cmplx.Exp(complex(0, -math.Pi*float64(k)/float64(m)))
+	}
+	for k := range t.fft {
+		t.fft[k] = cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(m/2)))
+	}
+	return t
+}
+
+// dct4 computes y[n] = sum x[k] cos(pi/M (n+1/2)(k+1/2)) of M = len(x) points in place
+func (t *mdct) dct4(x []float64) {
+	m := len(x)
+	z := t.buf
+	for k := 0; k < m/2; k++ {
+		z[k] = complex(x[2*k], x[m-1-2*k]) * t.pre[k]
+	}
+	t.transform(z)
+	for k := 0; k < m/2; k++ {
+		w := z[k] * t.post[k]
+		x[2*k] = real(w)
+		x[m-1-2*k] = -imag(w)
+	}
+}
+
+// transform is an in place radix-2 FFT
+func (t *mdct) transform(z []complex128) {
+	n := len(z)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			z[i], z[j] = z[j], z[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := n / size
+		for start := 0; start < n; start += size {
+			for k := 0; k < size/2; k++ {
+				w := t.fft[k*step] * z[start+k+size/2]
+				z[start+k+size/2] = z[start+k] - w
+				z[start+k] += w
+			}
+		}
+	}
+}
+
+// inverse writes the n windowless time samples of n/2 spectral coefficients
+func (t *mdct) inverse(spec []float32, out []float64) {
+	m := t.n / 2
+	y := t.coefs
+	for k := range y {
+		y[k] = float64(spec[k])
+	}
+	t.dct4(y)
+	scale := 2 / float64(t.n)
+	for n := 0; n < t.n; n++ {
+		i := n + m/2
+		var v float64
+		switch {
+		case i < m:
+			v = y[i]
+		case i < 2*m:
+			v = -y[2*m-1-i]
+		default:
+			v = -y[i-2*m]
+		}
+		out[n] = v * scale
+	}
+}
+
+// forward writes the n/2 spectral coefficients of n windowed samples
+func (t *mdct) forward(in []float64, spec []float64) {
+	m := t.n / 2
+	u := t.fold
+	for i := range u {
+		u[i] = 0
+	}
+	for n := 0; n < t.n; n++ {
+		i := n + m/2
+		switch {
+		case i < m:
+			u[i] += in[n]
+		case i < 2*m:
+			u[2*m-1-i] -= in[n]
+		default:
+			u[i-2*m] -= in[n]
+		}
+	}
+	t.dct4(u)
+	for k := range u {
+		spec[k] = 2 * u[k]
+	}
+}
+
+// sineWindow is the rising half of a sine window of n samples
+func sineWindow(n int) []float64 {
+	w := make([]float64, n/2)
+	for i := range w {
+		w[i] = math.Sin(math.Pi / float64(n) * (float64(i) + 0.5))
+	}
+	return w
+}
+
+// kbdWindow is the rising half of a Kaiser-Bessel derived window of n samples
+func kbdWindow(n int, alpha float64) []float64 {
+	half := n / 2
+	kaiser := make([]float64, half+1)
+	for i := range kaiser {
+		x := 2*float64(i)/float64(half) - 1
+		kaiser[i] = besselI0(math.Pi * alpha * math.Sqrt(1-x*x))
+	}
+	var total float64
+	for _, v := range kaiser {
+		total += v
+	}
+	w := make([]float64, half)
+	var sum float64
+	for i := range w {
+		sum += kaiser[i]
+		w[i] = math.Sqrt(sum / total)
+	}
+	return w
+}
+
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
@@ -0,0 +1,140 @@
+package aac
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// the MDCT of ISO/IEC 14496-3 4.6.11 straight from its definition
+func directMDCT(in []float64) []float64 {
+	n := len(in)
+	n0 := (float64(n)/2 + 1) / 2
+	spec := make([]float64, n/2)
+	for k := range spec {
+		var sum float64
+		for i, x := range in {
+			sum += x * math.Cos(2*math.Pi/float64(n)*(float64(i)+n0)*(float64(k)+0.5))
+		}
+		spec[k] = 2 * sum
+	}
+	return spec
+}
+
+func directIMDCT(spec []float64) []float64 {
+	n := 2 * len(spec)
+	n0 := (float64(n)/2 + 1) / 2
+	out := make([]float64, n)
+	for i := range out {
+		var sum float64
+		for k, x := range spec {
+			sum += x * math.Cos(2*math.Pi/float64(n)*(float64(i)+n0)*(float64(k)+0.5))
+		}
+		out[i] = 2 / float64(n) * sum
+	}
+	return out
+}
+
+func TestDCT4(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{256, 2048} {
+		m := newMDCT(n)
+		x := make([]float64, n/2)
+		for i := range x {
+			x[i] = rnd.Float64()*2 - 1
+		}
+		want := make([]float64, len(x))
+		for i := range want {
+			for k, v := range x {
+				want[i] += v * math.Cos(math.Pi/float64(len(x))*(float64(i)+0.5)*(float64(k)+0.5))
+			}
+		}
+		m.dct4(x)
+		for i := range x {
+			if math.Abs(x[i]-want[i]) > 1e-9 {
+				t.Fatalf("%d points: y[%d] = %v, want %v", n/2, i, x[i], want[i])
+			}
+		}
+	}
+}
+
+func TestMDCT(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, n := range []int{256, 2048} {
+		m := newMDCT(n)
+		in := make([]float64, n)
+		for i := range in {
+			in[i] = rnd.Float64()*2 - 1
+		}
+		spec := make([]float64, n/2)
+		m.forward(in, spec)
+		for k, want := range directMDCT(in) {
+			if math.Abs(spec[k]-want) > 1e-9 {
+				t.Fatalf("%d forward: X[%d] = %v, want %v", n, k, spec[k], want)
+			}
+		}
+
+		coefs := make([]float32, n/2)
+		for k := range coefs {
+			coefs[k] = float32(rnd.Float64()*2 - 1)
+		}
+		out := make([]float64, n)
+		m.inverse(coefs, out)
+		spec64 := make([]float64, len(coefs))
+		for k, v := range coefs {
+			spec64[k] = float64(v)
+		}
+		for i, want := range directIMDCT(spec64) {
+			if math.Abs(out[i]-want) > 1e-9 {
+				t.Fatalf("%d inverse: x[%d] = %v, want %v", n, i, out[i], want)
+			}
+		}
+	}
+}
+
+// windowed frames overlapping by half add back to the input, the aliasing
+// of the MDCT cancels out with a Princen-Bradley window
+func TestMDCTReconstruction(t *testing.T) {
+	const n = 256
+	rnd := rand.New(rand.NewSource(3))
+	for _, rise := range [][]float64{sineWindow(n), kbdWindow(n, 6)} {
+		window := append(append([]float64(nil), rise...), make([]float64, n/2)...)
+		for i := range rise {
+			window[n-1-i] = rise[i]
+		}
+		m := newMDCT(n)
+		signal := make([]float64, 8*n/2)
+		for i := range signal {
+			signal[i] = rnd.Float64()*2 - 1
+		}
+		rec := make([]float64, len(signal)+n/2)
+		in := make([]float64, n)
+		spec := make([]float64, n/2)
+		coefs := make([]float32, n/2)
+		out := make([]float64, n)
+		// the first frame starts half a window before the signal
+		for start := -n / 2; start < len(signal); start += n / 2 {
+			for i := range in {
+				in[i] = 0
+				if j := start + i; j >= 0 && j < len(signal) {
+					in[i] = signal[j] * window[i]
+				}
+			}
+			m.forward(in, spec)
+			for k, v := range spec {
+				coefs[k] = float32(v)
+			}
+			m.inverse(coefs, out)
+			for i, v := range out {
+				if j := start + i; j >= 0 && j < len(rec) {
+					rec[j] += v * window[i]
+				}
+			}
+		}
+		for i, want := range signal {
+			if math.Abs(rec[i]-want) > 1e-5 {
+				t.Fatalf("sample %d: %v, want %v", i, rec[i], want)
+			}
+		}
+	}
+}
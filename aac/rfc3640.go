@@ -0,0 +1,205 @@
+// Package aac depacketizes AAC access units from RTP, MPEG4-GENERIC
+// (RFC 3640) and MP4A-LATM (RFC 3016, RFC 6416) payload formats
+package aac
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrAUConfig = errors.New("aac: AU headers without size, the AUs after the first one take no bits")
+
+// AUConfig are the AU header field sizes in bits, from the SDP fmtp
+type AUConfig struct {
+	SizeLength              int
+	IndexLength             int
+	IndexDeltaLength        int
+	CTSDeltaLength          int
+	DTSDeltaLength          int
+	RandomAccessIndication  bool
+	StreamStateIndication   int
+	AuxiliaryDataSizeLength int
+}
+
+// NewAUConfig reads the AU header configuration from the fmtp parameters,
+// names in lower case. Missing sizes default to the ones of the mode.
+func NewAUConfig(fmtp map[string]string) (AUConfig, error) {
+	c := AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+	if strings.EqualFold(fmtp["mode"], "AAC-lbr") {
+		c = AUConfig{SizeLength: 6, IndexLength: 2, IndexDeltaLength: 2}
+	}
+	get := func(key string, def int) int {
+		if v, ok := fmtp[key]; ok {
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && i >= 0 && i <= 32 {
+				return i
+			}
+		}
+		return def
+	}
+	c.SizeLength = get("sizelength", c.SizeLength)
+	c.IndexLength = get("indexlength", c.IndexLength)
+	c.IndexDeltaLength = get("indexdeltalength", c.IndexDeltaLength)
+	c.CTSDeltaLength = get("ctsdeltalength", 0)
+	c.DTSDeltaLength = get("dtsdeltalength", 0)
+	c.RandomAccessIndication = get("randomaccessindication", 0) == 1
+	c.StreamStateIndication = get("streamstateindication", 0)
+	c.AuxiliaryDataSizeLength = get("auxiliarydatasizelength", 0)
+	if c.hasHeaders() && c.nextHeaderBits() == 0 {
+		return c, ErrAUConfig
+	}
+	return c, nil
+}
+
+// nextHeaderBits is the minimum size of the AU headers after the first one
+func (c AUConfig) nextHeaderBits() int {
+	n := c.SizeLength + c.IndexDeltaLength + c.StreamStateIndication
+	if c.CTSDeltaLength > 0 {
+		n++
+	}
+	if c.DTSDeltaLength > 0 {
+		n++
+	}
+	if c.RandomAccessIndication {
+		n++
+	}
+	return n
+}
+
+func (c AUConfig) hasHeaders() bool {
+	return c.SizeLength > 0 || c.IndexLength > 0 || c.IndexDeltaLength > 0 ||
+		c.CTSDeltaLength > 0 || c.DTSDeltaLength > 0 || c.RandomAccessIndication ||
+		c.StreamStateIndication > 0
+}
+
+// Depacketizer extracts the access units of MPEG4-GENERIC payloads
+type Depacketizer struct {
+	Config AUConfig
+
+	frag     []byte // fragmented AU being reassembled
+	fragSize int
+}
+
+// Push returns the access units of a RTP payload. A fragmented access unit
+// is returned with its last fragment. The returned slices point into the
+// payload or into an internal buffer, they are valid until the next call.
+func (d *Depacketizer) Push(payload []byte, marker bool) ([][]byte, error) {
+	r := &bitReader{b: payload}
+	var sizes []int
+	if d.Config.hasHeaders() {
+		length := int(r.u(16)) // AU-headers-length, in bits
+		end := r.pos + length
+		if r.err != nil || end > len(payload)*8 {
+			d.frag = d.frag[:0]
+			return nil, ErrShortPacket
+		}
+		for i := 0; r.pos < end && r.err == nil; i++ {
+			if i > 0 && d.Config.nextHeaderBits() == 0 {
+				// a bad config, the headers would never end
+				d.frag = d.frag[:0]
+				return nil, ErrAUConfig
+			}
+			size := int(r.u(d.Config.SizeLength))
+			if i == 0 {
+				r.u(d.Config.IndexLength)
+			} else {
+				r.u(d.Config.IndexDeltaLength)
+			}
+			if d.Config.CTSDeltaLength > 0 && r.flag() {
+				r.u(d.Config.CTSDeltaLength)
+			}
+			if d.Config.DTSDeltaLength > 0 && r.flag() {
+				r.u(d.Config.DTSDeltaLength)
+			}
+			if d.Config.RandomAccessIndication {
+				r.u(1)
+			}
+			r.u(d.Config.StreamStateIndication)
+			if d.Config.SizeLength > 0 {
+				sizes = append(sizes, size)
+			}
+		}
+		if r.err != nil || r.pos > end {
+			d.frag = d.frag[:0]
+			return nil, ErrShortPacket
+		}
+		if d.Config.SizeLength > 0 && len(sizes) == 0 {
+			// no AU header
+			d.frag = d.frag[:0]
+			return nil, ErrShortPacket
+		}
+		r.pos = end
+		r.align()
+	}
+	if d.Config.AuxiliaryDataSizeLength > 0 {
+		n := int(r.u(d.Config.AuxiliaryDataSizeLength))
+		r.pos += n
+		r.align()
+		if r.err != nil || r.pos > len(payload)*8 {
+			d.frag = d.frag[:0]
+			return nil, ErrShortPacket
+		}
+	}
+	data := payload[r.pos/8:]
+
+	if len(sizes) == 0 {
+		// no AU-size, one access unit fragmented up to the marker bit
+		d.frag = append(d.frag, data...)
+		if !marker {
+			return nil, nil
+		}
+		au := d.frag
+		d.frag = d.frag[:0]
+		return [][]byte{au}, nil
+	}
+
+	if len(d.frag) > 0 {
+		if len(sizes) == 1 && sizes[0] == d.fragSize {
+			d.frag = append(d.frag, data...)
+			if len(d.frag) < d.fragSize {
+				return nil, nil
+			}
+			au := d.frag[:d.fragSize]
+			d.frag = d.frag[:0]
+			return [][]byte{au}, nil
+		}
+		// lost the end of the fragmented AU
+		d.frag = d.frag[:0]
+	}
+
+	if len(sizes) == 1 && sizes[0] > len(data) {
+		if marker {
+			return nil, ErrShortPacket
+		}
+		d.frag = append(d.frag[:0], data...)
+		d.fragSize = sizes[0]
+		return nil, nil
+	}
+
+	aus := make([][]byte, 0, len(sizes))
+	for _, size := range sizes {
+		if size > len(data) {
+			return aus, ErrShortPacket
+		}
+		if size > 0 {
+			aus = append(aus, data[:size])
+		}
+		data = data[size:]
+	}
+	return aus, nil
+}
+
+// StripADTS removes the ADTS header some cameras leave in front of the raw frame
+func StripADTS(frame []byte) []byte {
+	if len(frame) < 7 || frame[0] != 0xFF || frame[1]&0xF6 != 0xF0 {
+		return frame
+	}
+	hdr := 7
+	if frame[1]&0x01 == 0 { // protection_absent == 0, CRC follows
+		hdr = 9
+	}
+	if len(frame) < hdr {
+		return frame
+	}
+	return frame[hdr:]
+}
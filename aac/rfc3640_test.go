@@ -0,0 +1,110 @@
+package aac
+
+import (
+	"bytes"
+	"testing"
+)
+
+// auPayload builds a MPEG4-GENERIC payload with 13 bits AU-size and 3 bits
+// AU-Index(-delta) headers, the data follows
+func auPayload(sizes []int, data []byte) []byte {
+	w := &bitWriter{}
+	w.put(uint(16*len(sizes)), 16)
+	for _, size := range sizes {
+		w.put(uint(size), 13)
+		w.put(0, 3)
+	}
+	return append(w.b, data...)
+}
+
+func TestDepacketizer(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 300)
+	hbr := AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+	for _, c := range []struct {
+		name    string
+		config  AUConfig
+		payload []byte
+		sizes   []int // of the access units
+		err     error
+	}{
+		{"one AU", hbr, auPayload([]int{100}, data[:100]), []int{100}, nil},
+		{"two AUs", hbr, auPayload([]int{100, 50}, data[:150]), []int{100, 50}, nil},
+		{"zero-size AU", hbr, auPayload([]int{0, 50}, data[:50]), []int{50}, nil},
+		{"empty payload", hbr, nil, nil, ErrShortPacket},
+		{"truncated AU-headers-length", hbr, []byte{0}, nil, ErrShortPacket},
+		{"truncated AU headers", hbr, []byte{0, 32, 0, 0x10}, nil, ErrShortPacket},
+		{"AU-headers-length past the payload", hbr, []byte{0xff, 0xff, 0, 0}, nil, ErrShortPacket},
+		{"partial AU header", hbr, []byte{0, 20, 0x0c, 0x80, 0x00}, nil, ErrShortPacket},
+		{"zero-length AU headers", hbr, append([]byte{0, 0}, data[:10]...), nil, ErrShortPacket},
+		{"oversized AU", hbr, auPayload([]int{100}, data[:10]), nil, ErrShortPacket},
+		{"oversized second AU", hbr, auPayload([]int{10, 100}, data[:50]), []int{10}, ErrShortPacket},
+		{"AUs without size", AUConfig{IndexLength: 3, IndexDeltaLength: 3}, append([]byte{0, 6, 0}, data[:10]...), []int{10}, nil},
+		{"headers without bits", AUConfig{IndexLength: 3}, append([]byte{0, 16, 0, 0}, data[:10]...), nil, ErrAUConfig},
+		{"no headers", AUConfig{}, data[:10], []int{10}, nil},
+	} {
+		d := &Depacketizer{Config: c.config}
+		aus, err := d.Push(c.payload, true)
+		if err != c.err {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+		}
+		if len(aus) != len(c.sizes) {
+			t.Errorf("%s: %d AUs, want %d", c.name, len(aus), len(c.sizes))
+			continue
+		}
+		for i, au := range aus {
+			if len(au) != c.sizes[i] || !bytes.Equal(au, data[:len(au)]) {
+				t.Errorf("%s: AU %d of %d bytes, want %d", c.name, i, len(au), c.sizes[i])
+			}
+		}
+	}
+}
+
+// an AU bigger than a packet comes in fragments with the same AU-size,
+// the last one has the marker bit
+func TestDepacketizerFragments(t *testing.T) {
+	au := make([]byte, 3000)
+	for i := range au {
+		au[i] = byte(i)
+	}
+	d := &Depacketizer{Config: AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}}
+	for i := 0; i < len(au); i += 1000 {
+		aus, err := d.Push(auPayload([]int{len(au)}, au[i:i+1000]), i+1000 == len(au))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i+1000 < len(au) && len(aus) != 0 {
+			t.Fatalf("AU returned after fragment at %d", i)
+		}
+		if i+1000 == len(au) && (len(aus) != 1 || !bytes.Equal(aus[0], au)) {
+			t.Fatalf("reassembled %d AUs", len(aus))
+		}
+	}
+
+	// a lost last fragment, the next AU comes whole
+	d.Push(auPayload([]int{len(au)}, au[:1000]), false)
+	aus, err := d.Push(auPayload([]int{100}, au[:100]), true)
+	if err != nil || len(aus) != 1 || len(aus[0]) != 100 {
+		t.Fatalf("AU after a lost fragment: %d AUs, %v", len(aus), err)
+	}
+}
+
+func TestNewAUConfig(t *testing.T) {
+	for _, c := range []struct {
+		fmtp map[string]string
+		want AUConfig
+		err  error
+	}{
+		{map[string]string{"mode": "AAC-hbr"}, AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}, nil},
+		{map[string]string{"mode": "AAC-lbr"}, AUConfig{SizeLength: 6, IndexLength: 2, IndexDeltaLength: 2}, nil},
+		{map[string]string{"sizelength": "13", "indexlength": "3", "indexdeltalength": "3", "ctsdeltalength": "bad"},
+			AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}, nil},
+		{map[string]string{"sizelength": "0", "indexlength": "3", "indexdeltalength": "0"},
+			AUConfig{IndexLength: 3}, ErrAUConfig},
+		{map[string]string{"sizelength": "0", "indexlength": "0", "indexdeltalength": "0"}, AUConfig{}, nil},
+	} {
+		got, err := NewAUConfig(c.fmtp)
+		if got != c.want || err != c.err {
+			t.Errorf("%v: %+v %v, want %+v %v", c.fmtp, got, err, c.want, c.err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package aac
+
+// sampleRates by sampling frequency index
+var sampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// sampleRateIndex returns the index of a standard rate, -1 for others
+func sampleRateIndex(rate int) int {
+	for i, r := range sampleRates {
+		if r == rate {
+			return i
+		}
+	}
+	return -1
+}
+
+// Scalefactor band offsets of ISO/IEC 14496-3 4.5.4, for the 1024 and
+// 128 lines of long and short windows
+var (
+	swb1024_96 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 64,
+		72, 80, 88, 96, 108, 120, 132, 144, 156, 172, 188, 212, 240, 276, 320, 384,
+		448, 512, 576, 640, 704, 768, 832, 896, 960, 1024}
+	swb1024_64 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 64,
+		72, 80, 88, 100, 112, 124, 140, 156, 172, 192, 216, 240, 268, 304, 344, 384,
+		424, 464, 504, 544, 584, 624, 664, 704, 744, 784, 824, 864, 904, 944, 984, 1024}
+	swb1024_48 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48, 56, 64, 72, 80,
+		88, 96, 108, 120, 132, 144, 160, 176, 196, 216, 240, 264, 292, 320, 352, 384,
+		416, 448, 480, 512, 544, 576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896,
+		928, 1024}
+	swb1024_32 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48, 56, 64, 72, 80,
+		88, 96, 108, 120, 132, 144, 160, 176, 196, 216, 240, 264, 292, 320, 352, 384,
+		416, 448, 480, 512, 544, 576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896,
+		928, 960, 992, 1024}
+	swb1024_24 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 52, 60, 68, 76,
+		84, 92, 100, 108, 116, 124, 136, 148, 160, 172, 188, 204, 220, 240, 260, 284,
+		308, 336, 364, 396, 432, 468, 508, 552, 600, 652, 704, 768, 832, 896, 960, 1024}
+	swb1024_16 = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 72, 80, 88, 100, 112, 124, 136,
+		148, 160, 172, 184, 196, 212, 228, 244, 260, 280, 300, 320, 344, 368, 396, 424,
+		456, 492, 532, 572, 616, 664, 716, 772, 832, 896, 960, 1024}
+	swb1024_8 = []int{0, 12, 24, 36, 48, 60, 72, 84, 96, 108, 120, 132, 144, 156, 172, 188,
+		204, 220, 236, 252, 268, 288, 308, 328, 348, 372, 396, 420, 448, 476, 508, 544,
+		580, 620, 664, 712, 764, 820, 880, 944, 1024}
+
+	swb128_96 = []int{0, 4, 8, 12, 16, 20, 24, 32, 40, 48, 64, 92, 128}
+	swb128_48 = []int{0, 4, 8, 12, 16, 20, 28, 36, 44, 56, 68, 80, 96, 112, 128}
+	swb128_24 = []int{0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 64, 76, 92, 108, 128}
+	swb128_16 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 40, 48, 60, 72, 88, 108, 128}
+	swb128_8  = []int{0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 60, 72, 88, 108, 128}
+)
+
+// band offsets by sampling frequency index
+var (
+	swbLong = [...][]int{swb1024_96, swb1024_96, swb1024_64, swb1024_48, swb1024_48, swb1024_32,
+		swb1024_24, swb1024_24, swb1024_16, swb1024_16, swb1024_16, swb1024_8, swb1024_8}
+	swbShort = [...][]int{swb128_96, swb128_96, swb128_96, swb128_48, swb128_48, swb128_48,
+		swb128_24, swb128_24, swb128_16, swb128_16, swb128_16, swb128_8, swb128_8}
+)
+
+// TNS_MAX_BANDS of AAC LC by sampling frequency index
+var (
+	tnsMaxBandsLong  = [...]int{31, 31, 34, 40, 42, 51, 46, 46, 42, 42, 42, 39, 39}
+	tnsMaxBandsShort = [...]int{9, 9, 10, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14}
+)
@@ -0,0 +1,160 @@
+// Package audio describes the RTP audio payload formats that vdk has no
+// codec data for (RFC 3551): G.722, G.726 and L16.
+package audio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// codecTypeBase keeps clear of the vdk codec types
+const codecTypeBase = 0x7a0000
+
+var (
+	G722 = av.MakeAudioCodecType(codecTypeBase + 1)
+	G726 = av.MakeAudioCodecType(codecTypeBase + 2)
+)
+
+// TypeName returns the name of a codec type, including the ones of this package
+func TypeName(t av.CodecType) string {
+	switch t {
+	case G722:
+		return "G722"
+	case G726:
+		return "G726"
+	}
+	return t.String()
+}
+
+// CodecData of a sample based audio stream. Durations come from the
+// payload size, so every packet carries whole samples.
+type CodecData struct {
+	CodecType_     av.CodecType
+	SampleRate_    int
+	ChannelLayout_ av.ChannelLayout
+	// BitsPerSample of a single channel in the payload
+	BitsPerSample int
+	// ClockRate of RTP timestamps, G.722 keeps 8000 for 16 kHz audio
+	ClockRate int
+	// BigEndian G.726 code words packing (AAL2-G726), RTP uses the
+	// little-endian one with the first sample in the low bits
+	BigEndian bool
+}
+
+func (c CodecData) Type() av.CodecType {
+	return c.CodecType_
+}
+
+func (c CodecData) SampleRate() int {
+	return c.SampleRate_
+}
+
+func (c CodecData) ChannelLayout() av.ChannelLayout {
+	return c.ChannelLayout_
+}
+
+func (c CodecData) SampleFormat() av.SampleFormat {
+	return av.S16
+}
+
+// PacketDuration of a payload
+func (c CodecData) PacketDuration(data []byte) (time.Duration, error) {
+	bits := c.BitsPerSample * c.ChannelLayout_.Count()
+	if bits == 0 || c.SampleRate_ == 0 {
+		return 0, fmt.Errorf("audio: invalid %s codec data", TypeName(c.CodecType_))
+	}
+	samples := len(data) * 8 / bits
+	return time.Duration(samples) * time.Second / time.Duration(c.SampleRate_), nil
+}
+
+// FrameSize is the payload size of one sample of every channel, in bytes,
+// 0 when samples are not byte aligned
+func (c CodecData) FrameSize() int {
+	bits := c.BitsPerSample * c.ChannelLayout_.Count()
+	if bits%8 != 0 {
+		return 0
+	}
+	return bits / 8
+}
+
+// NewG722CodecData of a RFC 3551 G.722 stream, 16 kHz mono at 64 kbit/s
+func NewG722CodecData() CodecData {
+	return CodecData{
+		CodecType_:     G722,
+		SampleRate_:    16000,
+		ChannelLayout_: av.CH_MONO,
+		BitsPerSample:  4,
+		ClockRate:      8000,
+	}
+}
+
+// NewG726CodecData of an encoding name like G726-32 or AAL2-G726-32
+func NewG726CodecData(encoding string) (CodecData, error) {
+	encoding = strings.ToUpper(encoding)
+	bigEndian := strings.HasPrefix(encoding, "AAL2-")
+	rate, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(encoding, "AAL2-"), "G726-"))
+	if err != nil || rate%8 != 0 || rate < 16 || rate > 40 {
+		return CodecData{}, fmt.Errorf("audio: unsupported G.726 encoding %s", encoding)
+	}
+	return CodecData{
+		CodecType_:     G726,
+		SampleRate_:    8000,
+		ChannelLayout_: av.CH_MONO,
+		BitsPerSample:  rate / 8,
+		ClockRate:      8000,
+		BigEndian:      bigEndian,
+	}, nil
+}
+
+// NewL16CodecData of a 16 bit big-endian linear PCM stream
+func NewL16CodecData(sampleRate, channels int) (CodecData, error) {
+	var layout av.ChannelLayout
+	switch channels {
+	case 0, 1:
+		layout = av.CH_MONO
+	case 2:
+		layout = av.CH_STEREO
+	default:
+		return CodecData{}, fmt.Errorf("audio: unsupported L16 channel count %d", channels)
+	}
+	if sampleRate <= 0 {
+		return CodecData{}, fmt.Errorf("audio: invalid L16 sample rate %d", sampleRate)
+	}
+	return CodecData{
+		CodecType_:     av.PCM,
+		SampleRate_:    sampleRate,
+		ChannelLayout_: layout,
+		BitsPerSample:  16,
+		ClockRate:      sampleRate,
+	}, nil
+}
+
+// NewCodecData for a rtpmap encoding name, static payload types are used
+// when the SDP has no rtpmap. It returns false for other formats.
+func NewCodecData(payloadType int, encoding string, clockRate, channels int) (CodecData, bool, error) {
+	if encoding == "" {
+		switch payloadType {
+		case 9:
+			encoding = "G722"
+		case 10:
+			encoding, clockRate, channels = "L16", 44100, 2
+		case 11:
+			encoding, clockRate, channels = "L16", 44100, 1
+		}
+	}
+	switch e := strings.ToUpper(encoding); {
+	case e == "G722":
+		return NewG722CodecData(), true, nil
+	case strings.HasPrefix(e, "G726-") || strings.HasPrefix(e, "AAL2-G726-"):
+		c, err := NewG726CodecData(e)
+		return c, true, err
+	case e == "L16":
+		c, err := NewL16CodecData(clockRate, channels)
+		return c, true, err
+	}
+	return CodecData{}, false, nil
+}
@@ -0,0 +1,87 @@
+package audio
+
+// G.711 companding of 16 bit linear samples, after the Sun reference code
+
+var (
+	aLawSegEnd  = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+	muLawSegEnd = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+)
+
+const muLawBias = 0x84
+
+func segment(v int, ends *[8]int) int {
+	for i, end := range ends {
+		if v <= end {
+			return i
+		}
+	}
+	return 8
+}
+
+// ALawEncode returns the A-law code of a sample
+func ALawEncode(s int16) byte {
+	v := int(s) >> 3
+	mask := byte(0xD5)
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := segment(v, &aLawSegEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+	a := byte(seg << 4)
+	if seg < 2 {
+		a |= byte(v>>1) & 0x0F
+	} else {
+		a |= byte(v>>uint(seg)) & 0x0F
+	}
+	return a ^ mask
+}
+
+// ALawDecode returns the sample of an A-law code
+func ALawDecode(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << uint(seg-1)
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// MuLawEncode returns the μ-law code of a sample
+func MuLawEncode(s int16) byte {
+	v := int(s) >> 2
+	mask := byte(0xFF)
+	if v < 0 {
+		v = -v
+		mask = 0x7F
+	}
+	if v > 8159 {
+		v = 8159
+	}
+	v += muLawBias >> 2
+	seg := segment(v, &muLawSegEnd)
+	if seg >= 8 {
+		return 0x7F ^ mask
+	}
+	return (byte(seg<<4) | byte(v>>uint(seg+1))&0x0F) ^ mask
+}
+
+// MuLawDecode returns the sample of a μ-law code
+func MuLawDecode(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F)<<3 + muLawBias) << (uint(u&0x70) >> 4)
+	if u&0x80 != 0 {
+		return int16(muLawBias - t)
+	}
+	return int16(t - muLawBias)
+}
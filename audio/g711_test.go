@@ -0,0 +1,81 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// the values of the reference implementation of G.711 (Sun Microsystems)
+func TestG711Vectors(t *testing.T) {
+	alaw := []struct {
+		s    int16
+		code byte
+		dec  int16
+	}{
+		{0, 0xd5, 8},
+		{-1, 0x55, -8},
+		{1000, 0xfa, 1008},
+		{-1000, 0x7a, -1008},
+		{32767, 0xaa, 32256},
+		{-32768, 0x2a, -32256},
+	}
+	for _, c := range alaw {
+		if code := ALawEncode(c.s); code != c.code {
+			t.Errorf("A-law encode %d: got %#x, want %#x", c.s, code, c.code)
+		}
+		if dec := ALawDecode(c.code); dec != c.dec {
+			t.Errorf("A-law decode %#x: got %d, want %d", c.code, dec, c.dec)
+		}
+	}
+	mulaw := []struct {
+		s    int16
+		code byte
+		dec  int16
+	}{
+		{0, 0xff, 0},
+		{-1, 0x7e, -8},
+		{1000, 0xce, 988},
+		{-1000, 0x4e, -988},
+		{32767, 0x80, 32124},
+		{-32768, 0x00, -32124},
+	}
+	for _, c := range mulaw {
+		if code := MuLawEncode(c.s); code != c.code {
+			t.Errorf("mu-law encode %d: got %#x, want %#x", c.s, code, c.code)
+		}
+		if dec := MuLawDecode(c.code); dec != c.dec {
+			t.Errorf("mu-law decode %#x: got %d, want %d", c.code, dec, c.dec)
+		}
+	}
+}
+
+// every code decodes to a value that encodes back to it, but the negative
+// zero of mu-law
+func TestG711Codes(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		a := byte(i)
+		if got := ALawEncode(ALawDecode(a)); got != a {
+			t.Errorf("A-law %#x: decodes to %d, encodes to %#x", a, ALawDecode(a), got)
+		}
+		if a == 0x7f {
+			continue
+		}
+		if got := MuLawEncode(MuLawDecode(a)); got != a {
+			t.Errorf("mu-law %#x: decodes to %d, encodes to %#x", a, MuLawDecode(a), got)
+		}
+	}
+}
+
+// the quantization error is within half a step of the segment, 1/32 of
+// the magnitude
+func TestG711Error(t *testing.T) {
+	for s := -32768; s <= 32767; s++ {
+		bound := math.Abs(float64(s))/32 + 16
+		if e := math.Abs(float64(int(ALawDecode(ALawEncode(int16(s)))) - s)); e > bound {
+			t.Fatalf("A-law %d: error %v", s, e)
+		}
+		if e := math.Abs(float64(int(MuLawDecode(MuLawEncode(int16(s)))) - s)); e > bound {
+			t.Fatalf("mu-law %d: error %v", s, e)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package audio
+
+import "fmt"
+
+// G.726 ADPCM decoding at 16, 24, 32 and 40 kbit/s, after the Sun
+// reference code (g72x.c) and spandsp for 16 kbit/s
+
+// g726Rate are the tables of a bit rate, by code word
+type g726Rate struct {
+	quant []int // decision levels of the encoder, in the tests
+	dqln  []int // log of the reconstructed magnitude
+	wi    []int // log of the scale factor multiplier
+	fi    []int // transition detection
+}
+
+var g726Rates = map[int]*g726Rate{
+	2: {
+		quant: []int{261},
+		dqln:  []int{116, 365, 365, 116},
+		wi:    []int{-704, 14048, 14048, -704},
+		fi:    []int{0, 0xE00, 0xE00, 0},
+	},
+	3: {
+		quant: []int{8, 218, 331},
+		dqln:  []int{-2048, 135, 273, 373, 373, 273, 135, -2048},
+		wi:    []int{-128, 960, 4384, 18624, 18624, 4384, 960, -128},
+		fi:    []int{0, 0x200, 0x400, 0xE00, 0xE00, 0x400, 0x200, 0},
+	},
+	4: {
+		quant: []int{-124, 80, 178, 246, 300, 349, 400},
+		dqln:  []int{-2048, 4, 135, 213, 273, 323, 373, 425, 425, 373, 323, 273, 213, 135, 4, -2048},
+		wi: []int{-384, 576, 1312, 2048, 3584, 6336, 11360, 35904,
+			35904, 11360, 6336, 3584, 2048, 1312, 576, -384},
+		fi: []int{0, 0, 0, 0x200, 0x200, 0x200, 0x600, 0xE00, 0xE00, 0x600, 0x200, 0x200, 0x200, 0, 0, 0},
+	},
+	5: {
+		quant: []int{-122, -16, 68, 139, 198, 250, 298, 339, 378, 413, 445, 475, 502, 528, 553},
+		dqln: []int{-2048, -66, 28, 104, 169, 224, 274, 318, 358, 395, 429, 459, 488, 514, 539, 566,
+			566, 539, 514, 488, 459, 429, 395, 358, 318, 274, 224, 169, 104, 28, -66, -2048},
+		wi: []int{448, 448, 768, 1248, 1280, 1312, 1856, 3200, 4512, 5728, 7008, 8960, 11456, 14080, 16928, 22272,
+			22272, 16928, 14080, 11456, 8960, 7008, 5728, 4512, 3200, 1856, 1312, 1280, 1248, 768, 448, 448},
+		fi: []int{0, 0, 0, 0, 0, 0x200, 0x200, 0x200, 0x200, 0x200, 0x400, 0x600, 0x800, 0xA00, 0xC00, 0xC00,
+			0xC00, 0xC00, 0xA00, 0x800, 0x600, 0x400, 0x200, 0x200, 0x200, 0x200, 0x200, 0, 0, 0, 0, 0},
+	},
+}
+
+// g726State is the adaptive predictor and quantizer shared by the
+// encoder and the decoder. The dq and sr history is kept in the 4 bit
+// exponent, 6 bit mantissa floating point of the standard.
+type g726State struct {
+	bits int
+	rate *g726Rate
+
+	yl  int // locked quantizer scale factor
+	yu  int // unlocked quantizer scale factor
+	dms int // short term energy estimate
+	dml int // long term energy estimate
+	ap  int // linear weighting coefficient of yl and yu
+	a   [2]int
+	b   [6]int
+	pk  [2]int // signs of the previous partial reconstructed signals
+	dq  [6]int
+	sr  [2]int
+	td  bool // tone detect
+}
+
+func newG726State(bits int) (*g726State, error) {
+	rate, ok := g726Rates[bits]
+	if !ok {
+		return nil, fmt.Errorf("audio: unsupported G.726 code word size %d", bits)
+	}
+	s := &g726State{bits: bits, rate: rate, yl: 34816, yu: 544}
+	for i := range s.dq {
+		s.dq[i] = 32
+	}
+	s.sr = [2]int{32, 32}
+	return s, nil
+}
+
+// quan returns the index of the first table value bigger than val
+func quan(val int, table []int) int {
+	for i, v := range table {
+		if val < v {
+			return i
+		}
+	}
+	return len(table)
+}
+
+var power2 = []int{1, 2, 4, 8, 0x10, 0x20, 0x40, 0x80, 0x100, 0x200, 0x400, 0x800, 0x1000, 0x2000, 0x4000}
+
+// fmult multiplies a predictor coefficient with a floating point value
+func fmult(an, srn int) int {
+	anmag := an
+	if an <= 0 {
+		anmag = -an & 0x1FFF
+	}
+	anexp := quan(anmag, power2) - 6
+	var anmant int
+	switch {
+	case anmag == 0:
+		anmant = 32
+	case anexp >= 0:
+		anmant = anmag >> uint(anexp)
+	default:
+		anmant = anmag << uint(-anexp)
+	}
+	wanexp := anexp + (srn>>6)&0xF - 13
+	wanmant := (anmant*(srn&0x3F) + 0x30) >> 4
+	var ret int
+	if wanexp >= 0 {
+		ret = (wanmant << uint(wanexp)) & 0x7FFF
+	} else {
+		ret = wanmant >> uint(-wanexp)
+	}
+	if (an ^ srn) < 0 {
+		return -ret
+	}
+	return ret
+}
+
+// toFloat converts a magnitude and its sign to the floating point of the
+// history
+func toFloat(mag int, negative bool) int {
+	if mag == 0 {
+		if negative {
+			return -992 // 0xFC20
+		}
+		return 0x20
+	}
+	exp := quan(mag, power2)
+	f := exp<<6 + (mag<<6)>>uint(exp)
+	if negative {
+		f -= 0x400
+	}
+	return f
+}
+
+// predict returns the signal estimate and the one of the zeros
+func (s *g726State) predict() (se, sez int) {
+	sezi := 0
+	for i := range s.b {
+		sezi += fmult(s.b[i]>>2, s.dq[i])
+	}
+	sei := sezi + fmult(s.a[1]>>2, s.sr[1]) + fmult(s.a[0]>>2, s.sr[0])
+	return sei >> 1, sezi >> 1
+}
+
+// stepSize returns the quantizer scale factor
+func (s *g726State) stepSize() int {
+	if s.ap >= 256 {
+		return s.yu
+	}
+	y := s.yl >> 6
+	dif := s.yu - y
+	al := s.ap >> 2
+	if dif > 0 {
+		y += (dif * al) >> 6
+	} else if dif < 0 {
+		y += (dif*al + 0x3F) >> 6
+	}
+	return y
+}
+
+// reconstruct returns the quantized difference signal of a code word
+func (s *g726State) reconstruct(i, y int) int {
+	negative := i&(1<<uint(s.bits-1)) != 0
+	dql := s.rate.dqln[i] + y>>2
+	if dql < 0 {
+		if negative {
+			return -0x8000
+		}
+		return 0
+	}
+	dex := (dql >> 7) & 15
+	dqt := 128 + dql&127
+	dq := (dqt << 7) >> uint(14-dex)
+	if negative {
+		return dq - 0x8000
+	}
+	return dq
+}
+
+// step reconstructs the signal of a code word and adapts the state to it
+func (s *g726State) step(i, se, sez, y int) int {
+	dq := s.reconstruct(i, y)
+	sr := se + dq
+	if dq < 0 {
+		sr = se - dq&0x3FFF
+	}
+	s.update(y, s.rate.wi[i], s.rate.fi[i], dq, sr, sr-se+sez)
+	return sr
+}
+
+func (s *g726State) update(y, wi, fi, dq, sr, dqsez int) {
+	pk0 := 0
+	if dqsez < 0 {
+		pk0 = 1
+	}
+	mag := dq & 0x7FFF
+
+	// transition detect
+	ylint := s.yl >> 15
+	ylfrac := (s.yl >> 10) & 0x1F
+	thr := (32 + ylfrac) << uint(ylint)
+	if ylint > 9 {
+		thr = 31 << 10
+	}
+	dqthr := (thr + thr>>1) >> 1
+	tr := s.td && mag > dqthr
+
+	// quantizer scale factor adaptation
+	s.yu = y + (wi-y)>>5
+	if s.yu < 544 {
+		s.yu = 544
+	} else if s.yu > 5120 {
+		s.yu = 5120
+	}
+	s.yl += s.yu + (-s.yl)>>6
+
+	// adaptive predictor coefficients
+	a2p := 0
+	if tr {
+		s.a = [2]int{}
+		s.b = [6]int{}
+	} else {
+		pks1 := pk0 ^ s.pk[0]
+		a2p = s.a[1] - s.a[1]>>7
+		if dqsez != 0 {
+			fa1 := -s.a[0]
+			if pks1 != 0 {
+				fa1 = s.a[0]
+			}
+			if fa1 < -8191 {
+				a2p -= 0x100
+			} else if fa1 > 8191 {
+				a2p += 0xFF
+			} else {
+				a2p += fa1 >> 5
+			}
+			if pk0^s.pk[1] != 0 {
+				if a2p <= -12160 {
+					a2p = -12288
+				} else if a2p >= 12416 {
+					a2p = 12288
+				} else {
+					a2p -= 0x80
+				}
+			} else if a2p <= -12416 {
+				a2p = -12288
+			} else if a2p >= 12160 {
+				a2p = 12288
+			} else {
+				a2p += 0x80
+			}
+		}
+		s.a[1] = a2p
+
+		s.a[0] -= s.a[0] >> 8
+		if dqsez != 0 {
+			if pks1 == 0 {
+				s.a[0] += 192
+			} else {
+				s.a[0] -= 192
+			}
+		}
+		a1ul := 15360 - a2p
+		if s.a[0] < -a1ul {
+			s.a[0] = -a1ul
+		} else if s.a[0] > a1ul {
+			s.a[0] = a1ul
+		}
+
+		for i := range s.b {
+			if s.bits == 5 {
+				s.b[i] -= s.b[i] >> 9
+			} else {
+				s.b[i] -= s.b[i] >> 8
+			}
+			if mag != 0 {
+				if (dq ^ s.dq[i]) >= 0 {
+					s.b[i] += 128
+				} else {
+					s.b[i] -= 128
+				}
+			}
+		}
+	}
+
+	copy(s.dq[1:], s.dq[:5])
+	s.dq[0] = toFloat(mag, dq < 0)
+	s.sr[1] = s.sr[0]
+	switch {
+	case sr > -32768:
+		if sr < 0 {
+			s.sr[0] = toFloat(-sr, true)
+		} else {
+			s.sr[0] = toFloat(sr, false)
+		}
+	default:
+		s.sr[0] = -992
+	}
+	s.pk[1], s.pk[0] = s.pk[0], pk0
+
+	// tone detect
+	s.td = !tr && a2p < -11776
+
+	// adaptation speed control
+	s.dms += (fi - s.dms) >> 5
+	s.dml += (fi<<2 - s.dml) >> 7
+	switch {
+	case tr:
+		s.ap = 256
+	case y < 1536, s.td, abs(s.dms<<2-s.dml) >= s.dml>>3:
+		s.ap += (0x200 - s.ap) >> 4
+	default:
+		s.ap += (-s.ap) >> 4
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// G726Decoder decodes the code words of a G.726 stream, packed from the
+// least significant bit as RFC 3551 does or from the most significant
+// one for AAL2-G726
+type G726Decoder struct {
+	state     *g726State
+	bigEndian bool
+}
+
+// NewG726Decoder of the codec data of a G.726 stream
+func NewG726Decoder(c CodecData) (*G726Decoder, error) {
+	if c.CodecType_ != G726 {
+		return nil, fmt.Errorf("audio: %s is not G.726", TypeName(c.CodecType_))
+	}
+	s, err := newG726State(c.BitsPerSample)
+	if err != nil {
+		return nil, err
+	}
+	return &G726Decoder{state: s, bigEndian: c.BigEndian}, nil
+}
+
+func (d *G726Decoder) Decode(data []byte) ([][]float32, error) {
+	bits := d.state.bits
+	mask := 1<<uint(bits) - 1
+	out := make([]float32, 0, len(data)*8/bits)
+	var acc, n int
+	for _, b := range data {
+		if d.bigEndian {
+			acc = acc<<8 | int(b)
+		} else {
+			acc |= int(b) << uint(n)
+		}
+		n += 8
+		for n >= bits {
+			var i int
+			if d.bigEndian {
+				i = acc >> uint(n-bits) & mask
+			} else {
+				i = acc & mask
+				acc >>= uint(bits)
+			}
+			n -= bits
+			se, sez := d.state.predict()
+			sr := d.state.step(i, se, sez, d.state.stepSize())
+			out = append(out, float32(sr<<2)/32768)
+		}
+		if d.bigEndian {
+			acc &= 1<<uint(n) - 1
+		}
+	}
+	return [][]float32{out}, nil
+}
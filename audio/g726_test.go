@@ -0,0 +1,147 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// encode is the encoder of the reference code, a 16 bit sample to a code
+// word
+func (s *g726State) encode(sl int) int {
+	se, sez := s.predict()
+	d := sl>>2 - se
+	y := s.stepSize()
+	i := s.quantize(d, y)
+	s.step(i, se, sez, y)
+	return i
+}
+
+func (s *g726State) quantize(d, y int) int {
+	dqm := abs(d)
+	exp := quan(dqm>>1, power2)
+	mant := ((dqm << 7) >> uint(exp)) & 0x7F
+	dln := exp<<7 + mant - y>>2
+	size := len(s.rate.quant)
+	i := quan(dln, s.rate.quant)
+	switch {
+	case d < 0:
+		return size<<1 + 1 - i
+	case i == 0 && s.bits > 2:
+		// the 1's complement of zero, 16 kbit/s has no zero
+		return size<<1 + 1
+	}
+	return i
+}
+
+// pack packs code words like RFC 3551, or AAL2-G726 when bigEndian
+func pack(codes []int, bits int, bigEndian bool) []byte {
+	var out []byte
+	var acc, n int
+	for _, c := range codes {
+		if bigEndian {
+			acc = acc<<uint(bits) | c
+		} else {
+			acc |= c << uint(n)
+		}
+		n += bits
+		for n >= 8 {
+			if bigEndian {
+				out = append(out, byte(acc>>uint(n-8)))
+			} else {
+				out = append(out, byte(acc))
+				acc >>= 8
+			}
+			n -= 8
+		}
+	}
+	return out
+}
+
+// a tone encoded by the reference encoder decodes within the noise of
+// the bit rate, in both packings
+func TestG726Decoder(t *testing.T) {
+	for _, c := range []struct {
+		encoding string
+		minSNR   float64
+	}{
+		{"G726-16", 15},
+		{"G726-24", 20},
+		{"G726-32", 30},
+		{"G726-40", 35},
+		{"AAL2-G726-32", 30},
+		{"AAL2-G726-40", 35},
+	} {
+		codec, err := NewG726CodecData(c.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, _ := newG726State(codec.BitsPerSample)
+		dec, err := NewG726Decoder(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 20 ms packets, 8 samples are whole bytes at every bit rate
+		const n = 8000
+		pcm := make([]float64, n)
+		var out []float32
+		for i := 0; i < n; i += 160 {
+			codes := make([]int, 160)
+			for j := range codes {
+				pcm[i+j] = 0.3 * math.Sin(2*math.Pi*1000*float64(i+j)/8000)
+				codes[j] = enc.encode(int(pcm[i+j] * 32768))
+			}
+			frame, err := dec.Decode(pack(codes, codec.BitsPerSample, codec.BigEndian))
+			if err != nil {
+				t.Fatalf("%s: %v", c.encoding, err)
+			}
+			out = append(out, frame[0]...)
+		}
+		if len(out) != n {
+			t.Fatalf("%s: %d samples decoded, want %d", c.encoding, len(out), n)
+		}
+		var signal, noise float64
+		// the quantizer adapts to the tone first
+		for i := 800; i < n; i++ {
+			signal += pcm[i] * pcm[i]
+			noise += (float64(out[i]) - pcm[i]) * (float64(out[i]) - pcm[i])
+		}
+		if snr := 10 * math.Log10(signal/noise); snr < c.minSNR {
+			t.Errorf("%s: SNR %.1f dB", c.encoding, snr)
+		}
+	}
+}
+
+func TestG726Packing(t *testing.T) {
+	for _, c := range []struct {
+		encoding string
+		data     []byte
+		codes    []int
+	}{
+		{"G726-32", []byte{0x21, 0x43}, []int{1, 2, 3, 4}},
+		{"AAL2-G726-32", []byte{0x12, 0x34}, []int{1, 2, 3, 4}},
+		// 8 code words of 3 bits, 01 234 567 from the low bits
+		{"G726-24", []byte{0x88, 0xc6, 0xfa}, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"AAL2-G726-24", []byte{0x05, 0x39, 0x77}, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+	} {
+		codec, _ := NewG726CodecData(c.encoding)
+		if got := pack(c.codes, codec.BitsPerSample, codec.BigEndian); string(got) != string(c.data) {
+			t.Errorf("%s: packed % x, want % x", c.encoding, got, c.data)
+		}
+		// the decoder follows the code words of a state fed the same
+		want, _ := newG726State(codec.BitsPerSample)
+		dec, _ := NewG726Decoder(codec)
+		frame, _ := dec.Decode(c.data)
+		if len(frame[0]) != len(c.codes) {
+			t.Fatalf("%s: %d samples, want %d", c.encoding, len(frame[0]), len(c.codes))
+		}
+		for j, i := range c.codes {
+			se, sez := want.predict()
+			if sr := want.step(i, se, sez, want.stepSize()); frame[0][j] != float32(sr<<2)/32768 {
+				t.Errorf("%s: sample %d is %v, want code word %d", c.encoding, j, frame[0][j], i)
+			}
+		}
+	}
+	if _, err := NewG726Decoder(NewG722CodecData()); err == nil {
+		t.Error("G.722 decoder")
+	}
+}
@@ -0,0 +1,125 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// Decoder turns a packet into planar samples in [-1, 1]
+type Decoder interface {
+	Decode(data []byte) ([][]float32, error)
+}
+
+// Encoder turns planar samples in [-1, 1] into packets, samples that
+// don't make a whole packet are kept for the next call
+type Encoder interface {
+	Encode(pcm [][]float32) ([][]byte, error)
+}
+
+// G711Decoder decodes PCMA, or PCMU when ALaw is false
+type G711Decoder struct {
+	ALaw bool
+}
+
+func (d G711Decoder) Decode(data []byte) ([][]float32, error) {
+	out := make([]float32, len(data))
+	for i, c := range data {
+		if d.ALaw {
+			out[i] = float32(ALawDecode(c)) / 32768
+		} else {
+			out[i] = float32(MuLawDecode(c)) / 32768
+		}
+	}
+	return [][]float32{out}, nil
+}
+
+// G711Encoder encodes mono samples to PCMA, or PCMU when ALaw is false,
+// in packets of Size samples
+type G711Encoder struct {
+	ALaw bool
+	Size int
+
+	pending []byte
+}
+
+func (e *G711Encoder) Encode(pcm [][]float32) ([][]byte, error) {
+	if len(pcm) != 1 {
+		return nil, fmt.Errorf("audio: G.711 is mono, got %d channels", len(pcm))
+	}
+	for _, s := range pcm[0] {
+		if e.ALaw {
+			e.pending = append(e.pending, ALawEncode(toS16(s)))
+		} else {
+			e.pending = append(e.pending, MuLawEncode(toS16(s)))
+		}
+	}
+	var pkts [][]byte
+	for e.Size > 0 && len(e.pending) >= e.Size {
+		pkt := make([]byte, e.Size)
+		copy(pkt, e.pending)
+		pkts = append(pkts, pkt)
+		e.pending = e.pending[:copy(e.pending, e.pending[e.Size:])]
+	}
+	return pkts, nil
+}
+
+// L16Decoder decodes big-endian 16 bit interleaved samples
+type L16Decoder struct {
+	Channels int
+}
+
+func (d L16Decoder) Decode(data []byte) ([][]float32, error) {
+	if d.Channels < 1 {
+		return nil, fmt.Errorf("audio: invalid L16 channel count %d", d.Channels)
+	}
+	n := len(data) / 2 / d.Channels
+	out := make([][]float32, d.Channels)
+	for ch := range out {
+		out[ch] = make([]float32, n)
+	}
+	for i := 0; i < n; i++ {
+		for ch := range out {
+			off := (i*d.Channels + ch) * 2
+			out[ch][i] = float32(int16(uint16(data[off])<<8|uint16(data[off+1]))) / 32768
+		}
+	}
+	return out, nil
+}
+
+func toS16(s float32) int16 {
+	v := math.Round(float64(s) * 32768)
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
+
+// Downmix returns the samples with the given number of channels: mono
+// is duplicated, more channels are averaged
+func Downmix(pcm [][]float32, channels int) [][]float32 {
+	if len(pcm) == channels || len(pcm) == 0 {
+		return pcm
+	}
+	mono := pcm[0]
+	if len(pcm) > 1 {
+		mono = make([]float32, len(pcm[0]))
+		for _, ch := range pcm {
+			for i := range mono {
+				if i < len(ch) {
+					mono[i] += ch[i]
+				}
+			}
+		}
+		for i := range mono {
+			mono[i] /= float32(len(pcm))
+		}
+	}
+	out := make([][]float32, channels)
+	for ch := range out {
+		out[ch] = mono
+	}
+	return out
+}
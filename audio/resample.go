@@ -0,0 +1,90 @@
+package audio
+
+import "math"
+
+// resampleTaps is the half width of the filter in output samples
+const resampleTaps = 16
+
+// Resampler converts the sample rate of planar audio with a windowed sinc
+// low-pass filter, it keeps the samples of the filter between calls.
+type Resampler struct {
+	in, out   int
+	step      float64 // input samples per output sample
+	cutoff    float64 // relative to the input Nyquist frequency
+	halfWidth int     // in input samples
+	pos       float64 // next output position in the buffer
+	buf       [][]float32
+}
+
+// NewResampler converts from rate in to rate out
+func NewResampler(in, out, channels int) *Resampler {
+	r := &Resampler{
+		in:     in,
+		out:    out,
+		step:   float64(in) / float64(out),
+		cutoff: 0.95,
+		buf:    make([][]float32, channels),
+	}
+	if out < in {
+		r.cutoff *= float64(out) / float64(in)
+	}
+	r.halfWidth = int(math.Ceil(resampleTaps / r.cutoff))
+	for ch := range r.buf {
+		// the filter starts on silence
+		r.buf[ch] = make([]float32, r.halfWidth)
+	}
+	r.pos = float64(r.halfWidth)
+	return r
+}
+
+// Process returns the resampled samples available so far
+func (r *Resampler) Process(pcm [][]float32) [][]float32 {
+	if r.in == r.out {
+		return pcm
+	}
+	for ch := range r.buf {
+		if ch < len(pcm) {
+			r.buf[ch] = append(r.buf[ch], pcm[ch]...)
+		}
+	}
+	out := make([][]float32, len(r.buf))
+	n := len(r.buf[0])
+	for int(r.pos)+r.halfWidth < n {
+		center := int(r.pos)
+		frac := r.pos - float64(center)
+		for ch, b := range r.buf {
+			var sum, norm float64
+			for i := center - r.halfWidth + 1; i <= center+r.halfWidth; i++ {
+				x := float64(i-center) - frac
+				h := r.kernel(x)
+				sum += float64(b[i]) * h
+				norm += h
+			}
+			out[ch] = append(out[ch], float32(sum/norm))
+		}
+		r.pos += r.step
+	}
+	// drop what the next outputs don't need
+	if drop := int(r.pos) - r.halfWidth; drop > 0 {
+		for ch := range r.buf {
+			r.buf[ch] = r.buf[ch][:copy(r.buf[ch], r.buf[ch][drop:])]
+		}
+		r.pos -= float64(drop)
+	}
+	return out
+}
+
+// kernel is a Blackman windowed sinc at x input samples from the center
+func (r *Resampler) kernel(x float64) float64 {
+	if math.Abs(x) >= float64(r.halfWidth) {
+		return 0
+	}
+	s := 1.0
+	if x != 0 {
+		a := math.Pi * x * r.cutoff
+		s = math.Sin(a) / a
+	}
+	t := math.Pi * (x/float64(r.halfWidth) + 1) // 0..2π over the width
+	w := 0.42 - 0.5*math.Cos(t) + 0.08*math.Cos(2*t)
+	return s * w
+}
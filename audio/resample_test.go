@@ -0,0 +1,36 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// a tone below both Nyquist frequencies comes out at the new rate, in
+// phase, whatever the size of the chunks
+func TestResampler(t *testing.T) {
+	for _, c := range []struct{ in, out int }{{48000, 8000}, {8000, 48000}, {44100, 16000}} {
+		const freq = 440.0
+		r := NewResampler(c.in, c.out, 1)
+		var out []float32
+		for i, chunk := 0, 1; i < c.in; chunk = chunk%700 + 37 {
+			pcm := make([]float32, chunk)
+			for j := range pcm {
+				pcm[j] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i+j)/float64(c.in)))
+			}
+			i += chunk
+			out = append(out, r.Process([][]float32{pcm})[0]...)
+		}
+		if len(out) < c.out*9/10 {
+			t.Fatalf("%d to %d: %d samples out of a second", c.in, c.out, len(out))
+		}
+		var signal, noise float64
+		for j, v := range out {
+			want := 0.5 * math.Sin(2*math.Pi*freq*float64(j)/float64(c.out))
+			signal += want * want
+			noise += (float64(v) - want) * (float64(v) - want)
+		}
+		if snr := 10 * math.Log10(signal/noise); snr < 40 {
+			t.Errorf("%d to %d: SNR %.1f dB", c.in, c.out, snr)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package audio
+
+// Depacketizer returns the audio of a RTP payload, cut to whole samples
+type Depacketizer struct {
+	Codec CodecData
+}
+
+// Push returns the samples of a payload, nil when there are none. G.722
+// and G.726 frames are the payload itself, L16 drops a trailing partial
+// sample frame a broken sender may add.
+func (d *Depacketizer) Push(payload []byte) []byte {
+	if n := d.Codec.FrameSize(); n > 1 {
+		payload = payload[:len(payload)-len(payload)%n]
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return payload
+}
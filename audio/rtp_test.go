@@ -0,0 +1,98 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+func TestDepacketizer(t *testing.T) {
+	g722 := NewG722CodecData()
+	g726r24, _ := NewG726CodecData("G726-24")
+	g726r32, _ := NewG726CodecData("G726-32")
+	g726r40, _ := NewG726CodecData("AAL2-G726-40")
+	l16Mono, _ := NewL16CodecData(8000, 1)
+	l16Stereo, _ := NewL16CodecData(44100, 2)
+	data := make([]byte, 2000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, c := range []struct {
+		name     string
+		codec    CodecData
+		payload  int
+		samples  int // bytes of whole samples
+		duration time.Duration
+	}{
+		{"G.722 20ms", g722, 160, 160, 20 * time.Millisecond},
+		{"G.722 odd size", g722, 161, 161, 20125 * time.Microsecond},
+		{"G.726-24 20ms", g726r24, 60, 60, 20 * time.Millisecond},
+		{"G.726-32 20ms", g726r32, 80, 80, 20 * time.Millisecond},
+		{"G.726-40 20ms", g726r40, 100, 100, 20 * time.Millisecond},
+		{"L16 mono 20ms", l16Mono, 320, 320, 20 * time.Millisecond},
+		{"L16 mono partial sample", l16Mono, 321, 320, 20 * time.Millisecond},
+		{"L16 stereo 10ms", l16Stereo, 1764, 1764, 10 * time.Millisecond},
+		{"L16 stereo partial frame", l16Stereo, 1767, 1764, 10 * time.Millisecond},
+		{"L16 less than a sample", l16Stereo, 3, 0, 0},
+		{"empty", g722, 0, 0, 0},
+	} {
+		d := &Depacketizer{Codec: c.codec}
+		out := d.Push(data[:c.payload])
+		if !bytes.Equal(out, data[:c.samples]) {
+			t.Errorf("%s: %d bytes, want %d", c.name, len(out), c.samples)
+		}
+		if c.samples == 0 {
+			if out != nil {
+				t.Errorf("%s: not nil", c.name)
+			}
+			continue
+		}
+		if d, err := c.codec.PacketDuration(out); err != nil || d != c.duration {
+			t.Errorf("%s: duration %v %v, want %v", c.name, d, err, c.duration)
+		}
+	}
+}
+
+func TestL16Samples(t *testing.T) {
+	c, _ := NewL16CodecData(48000, 2)
+	// left 0x4000, right -0x4000, then a partial frame
+	out := (&Depacketizer{Codec: c}).Push([]byte{0x40, 0x00, 0xc0, 0x00, 0x12, 0x34})
+	pcm, err := L16Decoder{Channels: 2}.Decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcm) != 2 || len(pcm[0]) != 1 || pcm[0][0] != 0.5 || pcm[1][0] != -0.5 {
+		t.Errorf("decoded %v, want [[0.5] [-0.5]]", pcm)
+	}
+}
+
+func TestNewCodecData(t *testing.T) {
+	for _, c := range []struct {
+		pt        int
+		encoding  string
+		clockRate int
+		channels  int
+		want      CodecData
+		ok, err   bool
+	}{
+		{9, "", 0, 0, NewG722CodecData(), true, false},
+		{96, "g722", 8000, 1, NewG722CodecData(), true, false},
+		{10, "", 0, 0, CodecData{av.PCM, 44100, av.CH_STEREO, 16, 44100, false}, true, false},
+		{11, "", 0, 0, CodecData{av.PCM, 44100, av.CH_MONO, 16, 44100, false}, true, false},
+		{97, "L16", 16000, 0, CodecData{av.PCM, 16000, av.CH_MONO, 16, 16000, false}, true, false},
+		{97, "L16", 16000, 6, CodecData{}, true, true},
+		{97, "L16", 0, 1, CodecData{}, true, true},
+		{98, "G726-16", 8000, 1, CodecData{G726, 8000, av.CH_MONO, 2, 8000, false}, true, false},
+		{98, "AAL2-G726-32", 8000, 1, CodecData{G726, 8000, av.CH_MONO, 4, 8000, true}, true, false},
+		{98, "G726-20", 8000, 1, CodecData{}, true, true},
+		{0, "PCMU", 8000, 1, CodecData{}, false, false},
+		{0, "", 0, 0, CodecData{}, false, false},
+	} {
+		got, ok, err := NewCodecData(c.pt, c.encoding, c.clockRate, c.channels)
+		if ok != c.ok || (err != nil) != c.err || got != c.want {
+			t.Errorf("%d %q: %+v %v %v, want %+v %v error %v", c.pt, c.encoding, got, ok, err, c.want, c.ok, c.err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package av1 rebuilds AV1 temporal units from RTP payloads and packetizes
+// them again, as in the RTP Payload Format For AV1 (AOMedia)
+package av1
+
+import (
+	"errors"
+
+	"github.com/deepch/vdk/av"
+)
+
+var (
+	ErrShortOBU     = errors.New("av1: OBU too short")
+	ErrLostFragment = errors.New("av1: OBU fragment lost")
+)
+
+// OBU types
+const (
+	OBUSequenceHeader       = 1
+	OBUTemporalDelimiter    = 2
+	OBUFrameHeader          = 3
+	OBUTileGroup            = 4
+	OBUMetadata             = 5
+	OBUFrame                = 6
+	OBURedundantFrameHeader = 7
+	OBUTileList             = 8
+	OBUPadding              = 15
+)
+
+// CodecData of an AV1 stream, the size comes from the sequence header
+type CodecData struct {
+	Width_  int
+	Height_ int
+}
+
+func (c CodecData) Type() av.CodecType {
+	return av.AV1
+}
+
+func (c CodecData) Width() int {
+	return c.Width_
+}
+
+func (c CodecData) Height() int {
+	return c.Height_
+}
+
+// obu is the header of an OBU
+type obu struct {
+	typ       byte
+	extension bool // one more header byte
+	hasSize   bool
+}
+
+func parseHeader(b []byte) obu {
+	return obu{
+		typ:       b[0] >> 3 & 0x0F,
+		extension: b[0]&0x04 != 0,
+		hasSize:   b[0]&0x02 != 0,
+	}
+}
+
+func (h obu) headerSize() int {
+	if h.extension {
+		return 2
+	}
+	return 1
+}
+
+// readLEB128 returns the value and the size of a leb128() field
+func readLEB128(b []byte) (uint, int, bool) {
+	var v uint
+	for i := 0; i < 8 && i < len(b); i++ {
+		v |= uint(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+func appendLEB128(b []byte, v uint) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// splitOBUs splits a low overhead bitstream, every OBU has its size field
+func splitOBUs(b []byte) ([][]byte, error) {
+	var obus [][]byte
+	for len(b) > 0 {
+		h := parseHeader(b)
+		if len(b) < h.headerSize() {
+			return nil, ErrShortOBU
+		}
+		end := len(b)
+		if h.hasSize {
+			size, n, ok := readLEB128(b[h.headerSize():])
+			if !ok || uint(len(b)-h.headerSize()-n) < size {
+				return nil, ErrShortOBU
+			}
+			end = h.headerSize() + n + int(size)
+		}
+		obus = append(obus, b[:end])
+		b = b[end:]
+	}
+	return obus, nil
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+// u reads n bits, zeros past the end
+func (r *bitReader) u(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if k := r.pos >> 3; k < len(r.b) {
+			v |= uint(r.b[k]>>(7-r.pos&7)) & 1
+		}
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+// uvlc reads a variable length unsigned value (4.10.3)
+func (r *bitReader) uvlc() uint {
+	zeros := 0
+	for !r.flag() {
+		if zeros++; zeros >= 32 || r.eof() {
+			return 0
+		}
+	}
+	return r.u(zeros) + 1<<zeros - 1
+}
+
+func (r *bitReader) eof() bool {
+	return r.pos > len(r.b)*8
+}
+
+// sequenceSize reads the maximum frame size of a sequence header OBU
+// payload (AV1 specification 5.5)
+func sequenceSize(b []byte) (width, height int, ok bool) {
+	r := &bitReader{b: b}
+	r.u(3)        // seq_profile
+	r.u(1)        // still_picture
+	if r.flag() { // reduced_still_picture_header
+		r.u(5) // seq_level_idx[0]
+	} else {
+		var decoderModelInfo bool
+		bufferDelayLength := 0
+		if r.flag() { // timing_info_present_flag
+			r.u(32)       // num_units_in_display_tick
+			r.u(32)       // time_scale
+			if r.flag() { // equal_picture_interval
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			decoderModelInfo = r.flag()
+			if decoderModelInfo {
+				bufferDelayLength = int(r.u(5)) + 1
+				r.u(32) // num_units_in_decoding_tick
+				r.u(5)  // buffer_removal_time_length_minus_1
+				r.u(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.flag()
+		points := int(r.u(5)) + 1
+		for i := 0; i < points; i++ {
+			r.u(12)         // operating_point_idc
+			if r.u(5) > 7 { // seq_level_idx
+				r.u(1) // seq_tier
+			}
+			if decoderModelInfo && r.flag() { // decoder_model_present_for_this_op
+				r.u(bufferDelayLength) // decoder_buffer_delay
+				r.u(bufferDelayLength) // encoder_buffer_delay
+				r.u(1)                 // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.flag() {
+				r.u(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	widthBits := int(r.u(4)) + 1
+	heightBits := int(r.u(4)) + 1
+	width = int(r.u(widthBits)) + 1
+	height = int(r.u(heightBits)) + 1
+	return width, height, !r.eof()
+}
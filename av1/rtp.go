@@ -0,0 +1,194 @@
+package av1
+
+import (
+	"github.com/pion/rtp/codecs"
+)
+
+// aggregation header bits
+const (
+	headerZ = 0x80 // continuation of the last OBU of the previous packet
+	headerY = 0x40 // the last OBU continues in the next packet
+	headerN = 0x08 // first packet of a coded video sequence
+)
+
+// Depacketizer rebuilds the temporal units of a RTP session as a low
+// overhead bitstream: every OBU has its size field, temporal delimiters
+// are left out. Packets are expected in order.
+type Depacketizer struct {
+	tu      []byte
+	obu     []byte // fragment of an OBU
+	frag    bool
+	started bool
+	key     bool
+	width   int
+	height  int
+
+	lost bool // a packet of the temporal unit was lost, skip to its end
+}
+
+// Push adds the payload of a RTP packet, it returns the temporal unit once
+// the packet with the marker bit is received.
+func (d *Depacketizer) Push(payload []byte, marker bool) (tu []byte, key bool, err error) {
+	if d.lost {
+		// a temporal unit has no start flag, the next one follows the marker
+		d.lost = !marker
+		return nil, false, nil
+	}
+	var p codecs.AV1Packet
+	if _, err := p.Unmarshal(payload); err != nil {
+		d.reset()
+		return nil, false, err
+	}
+	if !d.started {
+		d.started = true
+		d.key = p.N
+	}
+	last := len(p.OBUElements) - 1
+	for i, el := range p.OBUElements {
+		if i == 0 && p.Z {
+			if !d.frag {
+				d.reset()
+				return nil, false, ErrLostFragment
+			}
+			d.obu = append(d.obu, el...)
+		} else {
+			d.obu = append(d.obu[:0], el...)
+		}
+		d.frag = i == last && p.Y
+		if !d.frag {
+			if err := d.add(d.obu); err != nil {
+				d.reset()
+				return nil, false, err
+			}
+		}
+	}
+	if !marker {
+		return nil, false, nil
+	}
+	tu, key = d.tu, d.key
+	d.tu = nil
+	d.reset()
+	if len(tu) == 0 {
+		return nil, false, nil
+	}
+	return tu, key, nil
+}
+
+// Lost drops the temporal unit being rebuilt after a lost packet, the
+// packets up to its marker bit are skipped
+func (d *Depacketizer) Lost() {
+	d.reset()
+	d.lost = true
+}
+
+func (d *Depacketizer) reset() {
+	d.tu = d.tu[:0]
+	d.frag = false
+	d.started = false
+	d.key = false
+}
+
+// add appends a complete OBU to the temporal unit, with its size field
+func (d *Depacketizer) add(b []byte) error {
+	if len(b) == 0 {
+		return ErrShortOBU
+	}
+	h := parseHeader(b)
+	if len(b) < h.headerSize() {
+		return ErrShortOBU
+	}
+	payload := b[h.headerSize():]
+	if h.hasSize {
+		size, n, ok := readLEB128(payload)
+		if !ok || uint(len(payload)-n) < size {
+			return ErrShortOBU
+		}
+		payload = payload[n : n+int(size)]
+	}
+	switch h.typ {
+	case OBUTemporalDelimiter, OBUTileList, OBUPadding:
+		return nil
+	case OBUSequenceHeader:
+		d.key = true
+		if width, height, ok := sequenceSize(payload); ok {
+			d.width, d.height = width, height
+		}
+	}
+	d.tu = append(d.tu, b[0]|0x02)
+	if h.extension {
+		d.tu = append(d.tu, b[1])
+	}
+	d.tu = appendLEB128(d.tu, uint(len(payload)))
+	d.tu = append(d.tu, payload...)
+	return nil
+}
+
+// Size of the last sequence header
+func (d *Depacketizer) Size() (int, int) {
+	return d.width, d.height
+}
+
+// Payloader packetizes low overhead bitstream temporal units, it
+// implements rtp.Payloader. The OBUs are sent without size field,
+// each one with a length field in the packet.
+type Payloader struct{}
+
+// Payload splits a temporal unit into RTP payloads
+func (p *Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	obus, err := splitOBUs(payload)
+	if err != nil {
+		return nil
+	}
+	var out [][]byte
+	cur := []byte{0}
+	key := false
+	for _, b := range obus {
+		h := parseHeader(b)
+		data := b[h.headerSize():]
+		if h.hasSize {
+			_, n, _ := readLEB128(data)
+			data = data[n:]
+		}
+		switch h.typ {
+		case OBUTemporalDelimiter, OBUTileList:
+			continue
+		case OBUSequenceHeader:
+			key = true
+		}
+		element := make([]byte, 0, h.headerSize()+len(data))
+		element = append(element, b[0]&^0x02)
+		if h.extension {
+			element = append(element, b[1])
+		}
+		element = append(element, data...)
+
+		for len(element) > 0 {
+			// the length field takes 2 bytes for any MTU below 16 KiB
+			space := int(mtu) - len(cur) - 2
+			if space <= 0 {
+				out = append(out, cur)
+				cur = []byte{0}
+				continue
+			}
+			n := len(element)
+			if n > space {
+				n = space
+			}
+			cur = appendLEB128(cur, uint(n))
+			cur = append(cur, element[:n]...)
+			element = element[n:]
+			if len(element) > 0 {
+				cur[0] |= headerY
+				out = append(out, cur)
+				cur = []byte{headerZ}
+			}
+		}
+	}
+	if len(cur) > 1 {
+		out = append(out, cur)
+	}
+	if key && len(out) > 0 {
+		out[0][0] |= headerN
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package av1
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter writes the fields of a sequence header
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) put(v uint, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+}
+
+// testOBU returns an OBU with its size field
+func testOBU(typ byte, payload []byte) []byte {
+	return append(appendLEB128([]byte{typ<<3 | 0x02}, uint(len(payload))), payload...)
+}
+
+// testSequenceHeader is the sequence header OBU of a 1280x720 main profile
+// stream at level 4.0
+func testSequenceHeader() []byte {
+	w := &bitWriter{}
+	w.put(0, 3)     // seq_profile
+	w.put(0, 1)     // still_picture
+	w.put(0, 1)     // reduced_still_picture_header
+	w.put(0, 1)     // timing_info_present_flag
+	w.put(0, 1)     // initial_display_delay_present_flag
+	w.put(0, 5)     // operating_points_cnt_minus_1
+	w.put(0, 12)    // operating_point_idc[0]
+	w.put(8, 5)     // seq_level_idx[0]
+	w.put(0, 1)     // seq_tier[0]
+	w.put(10, 4)    // frame_width_bits_minus_1
+	w.put(10, 4)    // frame_height_bits_minus_1
+	w.put(1279, 11) // max_frame_width_minus_1
+	w.put(719, 11)  // max_frame_height_minus_1
+	w.put(0x55, 16) // the rest of the header
+	return testOBU(OBUSequenceHeader, w.b)
+}
+
+// testTU returns a temporal unit with a temporal delimiter, a sequence
+// header for a keyframe and a frame OBU, and the temporal unit the
+// depacketizer rebuilds without the temporal delimiter
+func testTU(key bool, size int) (tu, want []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if key {
+		want = testSequenceHeader()
+	}
+	want = append(want, testOBU(OBUFrame, data)...)
+	return append(testOBU(OBUTemporalDelimiter, nil), want...), want
+}
+
+// push sends the payloads of a temporal unit, the last one with the marker
+func push(t *testing.T, d *Depacketizer, payloads [][]byte) ([]byte, bool) {
+	var tu []byte
+	var key bool
+	for i, p := range payloads {
+		u, k, err := d.Push(p, i == len(payloads)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != nil && i != len(payloads)-1 {
+			t.Fatal("temporal unit before the marker")
+		}
+		tu, key = u, k
+	}
+	return tu, key
+}
+
+func TestDepacketizer(t *testing.T) {
+	p := &Payloader{}
+	d := &Depacketizer{}
+
+	keyTU, key := testTU(true, 400)
+	payloads := p.Payload(100, keyTU)
+	if len(payloads) < 5 || payloads[0][0]&headerN == 0 {
+		t.Fatalf("%d payloads, N %v", len(payloads), payloads[0][0]&headerN != 0)
+	}
+	tu, isKey := push(t, d, payloads)
+	if !bytes.Equal(tu, key) || !isKey {
+		t.Errorf("key temporal unit: %d bytes key %v, want %d bytes", len(tu), isKey, len(key))
+	}
+	if w, h := d.Size(); w != 1280 || h != 720 {
+		t.Errorf("size %dx%d, want 1280x720", w, h)
+	}
+
+	interTU, inter := testTU(false, 300)
+	tu, isKey = push(t, d, p.Payload(100, interTU))
+	if !bytes.Equal(tu, inter) || isKey {
+		t.Errorf("inter temporal unit: %d bytes key %v, want %d bytes", len(tu), isKey, len(inter))
+	}
+
+	// one packet per OBU
+	tu, _ = push(t, d, p.Payload(1200, keyTU))
+	if !bytes.Equal(tu, key) {
+		t.Errorf("unfragmented temporal unit: %d bytes, want %d", len(tu), len(key))
+	}
+}
+
+func TestDepacketizerLoss(t *testing.T) {
+	p := &Payloader{}
+	interTU, inter := testTU(false, 300)
+	payloads := p.Payload(100, interTU)
+	n := len(payloads)
+	if n < 3 {
+		t.Fatalf("%d payloads", n)
+	}
+	for _, c := range []struct {
+		name     string
+		received [][][]byte // the packets between the gaps
+		gap      bool       // before the next temporal unit
+	}{
+		{"first packet lost", [][][]byte{nil, payloads[1:]}, false},
+		{"middle packet lost", [][][]byte{payloads[:1], payloads[2:]}, false},
+		{"last packet lost", [][][]byte{payloads[:n-1]}, true},
+	} {
+		d := &Depacketizer{}
+		for i, received := range c.received {
+			if i > 0 {
+				d.Lost()
+			}
+			for _, p := range received {
+				last := &p[0] == &payloads[n-1][0]
+				if tu, _, err := d.Push(p, last); tu != nil || err != nil {
+					t.Errorf("%s: temporal unit %d bytes, error %v", c.name, len(tu), err)
+				}
+			}
+		}
+		if c.gap {
+			// the next temporal unit is taken for the rest of the lost one
+			d.Lost()
+			if tu, _ := push(t, d, payloads); tu != nil {
+				t.Errorf("%s: temporal unit after the loss", c.name)
+			}
+		}
+		if tu, _ := push(t, d, payloads); !bytes.Equal(tu, inter) {
+			t.Errorf("%s: next temporal unit %d bytes, want %d", c.name, len(tu), len(inter))
+		}
+	}
+
+	// a continuation without the start of its OBU
+	if payloads[1][0]&headerZ == 0 {
+		t.Fatal("second packet is not a continuation")
+	}
+	if _, _, err := (&Depacketizer{}).Push(payloads[1], false); err != ErrLostFragment {
+		t.Errorf("continuation: error %v, want %v", err, ErrLostFragment)
+	}
+}
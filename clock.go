@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/rtsp"
+)
+
+// mediaClock puts the RTP timestamps of the video and the audio of a camera
+// on one timeline, the Time of their av.Packets. Once every track had a
+// RTCP sender report, the reports map the timestamps to the wall clock of
+// the camera. Before that the arrival of the first packet of a track is
+// used, which is off by the latency difference of the tracks.
+type mediaClock struct {
+	epoch  time.Time     // wall clock of the timeline start
+	offset time.Duration // wall clock of the camera - local clock
+	synced bool          // mapped by the sender reports
+	tracks [2]trackClock // video, audio
+}
+
+type trackClock struct {
+	rate     int64
+	anchored bool
+	ts       uint32    // RTP timestamp of the last packet
+	wall     time.Time // and its wall clock
+	sr       *rtsp.SenderReport
+}
+
+func (c *mediaClock) track(video bool) *trackClock {
+	if video {
+		return &c.tracks[0]
+	}
+	return &c.tracks[1]
+}
+
+// time returns the time of a RTP timestamp on the timeline. Without a clock
+// rate (audio without SDP) the arrival of the packet is used.
+func (c *mediaClock) time(video bool, ts uint32, rate int64) time.Duration {
+	t := c.track(video)
+	t.rate = rate
+	if rate <= 0 {
+		t.ts, t.wall, t.anchored = ts, time.Now().Add(c.offset), true
+		if c.epoch.IsZero() {
+			c.epoch = t.wall
+		}
+		return t.wall.Sub(c.epoch)
+	}
+	if !t.anchored {
+		t.ts, t.wall, t.anchored = ts, time.Now().Add(c.offset), true
+		if c.synced && t.sr != nil {
+			t.ts, t.wall = t.sr.RTPTime, t.sr.NTPTime
+		}
+	}
+	// the difference to the previous packet, wraps around and B-frames included
+	t.wall = t.wall.Add(time.Duration(int64(int32(ts-t.ts)) * int64(time.Second) / t.rate))
+	t.ts = ts
+	if c.epoch.IsZero() {
+		c.epoch = t.wall
+	}
+	return t.wall.Sub(c.epoch)
+}
+
+// report takes a RTCP sender report of a track
+func (c *mediaClock) report(video bool, sr rtsp.SenderReport) {
+	t := c.track(video)
+	t.sr = &sr
+	if c.synced {
+		if t.anchored {
+			t.ts, t.wall = sr.RTPTime, sr.NTPTime
+		}
+		return
+	}
+	var ref *trackClock
+	for i := range c.tracks {
+		// a track without clock rate can't be mapped, it stays on arrival
+		if u := &c.tracks[i]; u.anchored && u.rate > 0 {
+			if u.sr == nil {
+				// wait for the reports of all the tracks
+				return
+			}
+			if ref == nil {
+				ref = u
+			}
+		}
+	}
+	if ref == nil {
+		return
+	}
+	// the timeline goes on where the first track is, the others move to
+	// their place relative to it
+	wall := ref.sr.NTPTime.Add(time.Duration(int64(int32(ref.ts-ref.sr.RTPTime)) * int64(time.Second) / ref.rate))
+	shift := wall.Sub(ref.wall)
+	c.epoch = c.epoch.Add(shift)
+	c.offset += shift
+	for i := range c.tracks {
+		if u := &c.tracks[i]; u.anchored && u.rate > 0 {
+			u.ts, u.wall = u.sr.RTPTime, u.sr.NTPTime
+		}
+	}
+	c.synced = true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/rtsp"
+)
+
+// before the sender reports the tracks start on their arrival and follow
+// their timestamps, wrapping around and going back for B-frames
+func TestMediaClockArrival(t *testing.T) {
+	var c mediaClock
+	for _, p := range []struct {
+		name string
+		ts   uint32
+		want time.Duration
+	}{
+		{"first", 0xFFFFE000, 0},
+		{"next frame", 0xFFFFEE10, 40 * time.Millisecond},
+		{"wraparound", 0x00000A30, 120 * time.Millisecond},
+		{"B-frame", 0xFFFFFC20, 80 * time.Millisecond},
+		{"after the B-frame", 0x00001840, 160 * time.Millisecond},
+	} {
+		if got := c.time(true, p.ts, 90000); got != p.want {
+			t.Errorf("video %s: %v, want %v", p.name, got, p.want)
+		}
+	}
+	// the audio starts when it arrives
+	first := c.time(false, 1000, 8000)
+	if elapsed := time.Since(c.epoch); first < 0 || first > elapsed {
+		t.Errorf("audio starts at %v, %v after the video", first, elapsed)
+	}
+	if got := c.time(false, 1160, 8000); got != first+20*time.Millisecond {
+		t.Errorf("audio 20 ms later at %v, want %v", got, first+20*time.Millisecond)
+	}
+	if c.synced {
+		t.Error("synced without reports")
+	}
+}
+
+// the reports of every track put the tracks in their place relative to
+// the first one, which goes on where it was
+func TestMediaClockReports(t *testing.T) {
+	var c mediaClock
+	ntp := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.time(true, 90000, 90000)
+	c.time(false, 8000, 8000)
+
+	// the video was 100 ms before the report and the audio 300 ms, they
+	// arrived at the same time
+	c.report(true, rtsp.SenderReport{NTPTime: ntp, RTPTime: 99000})
+	if c.synced {
+		t.Fatal("synced without the report of the audio")
+	}
+	c.report(false, rtsp.SenderReport{NTPTime: ntp, RTPTime: 10400})
+	if !c.synced {
+		t.Fatal("not synced by the reports")
+	}
+	if got := c.time(true, 99000, 90000); got != 100*time.Millisecond {
+		t.Errorf("video at the report: %v, want 100ms", got)
+	}
+	if got := c.time(false, 10400, 8000); got != 100*time.Millisecond {
+		t.Errorf("audio at the report: %v, want 100ms", got)
+	}
+	if got := c.time(false, 8000, 8000); got != -200*time.Millisecond {
+		t.Errorf("first audio packet: %v, want -200ms", got)
+	}
+
+	// a report after the sync moves its track, e.g. the camera set its clock
+	c.report(true, rtsp.SenderReport{NTPTime: ntp.Add(10 * time.Second), RTPTime: 99000})
+	if got := c.time(true, 102600, 90000); got != 10*time.Second+140*time.Millisecond {
+		t.Errorf("video after the jump: %v, want 10.14s", got)
+	}
+	if got := c.time(false, 10720, 8000); got != 140*time.Millisecond {
+		t.Errorf("audio after the video jump: %v, want 140ms", got)
+	}
+}
+
+// a track starting after the sync starts at its report
+func TestMediaClockLateTrack(t *testing.T) {
+	var c mediaClock
+	ntp := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.time(true, 90000, 90000)
+	c.report(true, rtsp.SenderReport{NTPTime: ntp, RTPTime: 90000})
+	if !c.synced {
+		t.Fatal("not synced by the report of the only track")
+	}
+	c.report(false, rtsp.SenderReport{NTPTime: ntp.Add(time.Second), RTPTime: 16000})
+	if got := c.time(false, 16160, 8000); got != time.Second+20*time.Millisecond {
+		t.Errorf("late audio: %v, want 1.02s", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +11,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/deepch/RTSPtoWebRTC/nal"
 	"github.com/deepch/vdk/av"
+	"github.com/pion/rtp"
 )
 
 //Config global
@@ -43,18 +46,85 @@ type StreamST struct {
 	Debug        bool   `json:"debug"`
 	RunLock      bool   `json:"-"`
 	Codecs       []av.CodecData
+	Info         nal.VideoInfo `json:"-"`
 	Cl           map[string]viewer
+	gop          *gopCache
+	tc           map[av.CodecType]*audioTranscoder // by output codec, nil when it can't be done
+
+	// RTPPassthrough forwards the RTP packets of H264/H265 cameras to the
+	// WebRTC viewers as they are
+	RTPPassthrough bool `json:"rtp_passthrough"`
+
+	// Publish is a WHIP endpoint the stream is pushed to
+	Publish string `json:"publish,omitempty"`
+
+	// Sub is the stream of the same camera at a lower quality, the WebRTC
+	// viewers switch to it when their link can't take this one
+	Sub string `json:"sub,omitempty"`
+
+	// FEC is the redundancy of the WebRTC video in percent of its packets
+	FEC int `json:"fec,omitempty"`
+
+	// WHIPToken is the bearer token of the WHIP publishers of the stream,
+	// it has no URL then
+	WHIPToken string `json:"whip_token,omitempty"`
+
+	publisher string        // session of the WHIP publisher
+	pli       chan struct{} // asks the WHIP publisher for a keyframe
+
+	state string // of the source, Status tells it is online
+
+	// closed when the stream is removed, its WHIP publishing ends
+	stop chan struct{}
 }
 
+// the states of the source of a stream
+const (
+	streamOffline      = "offline"
+	streamOnline       = "online"
+	streamReconnecting = "reconnecting"
+)
+
 type viewer struct {
-	c chan av.Packet
+	c     chan av.Packet
+	u     chan []av.CodecData
+	audio audioPolicy
+	rtp   chan rtpPacket // video of the passthrough viewers, nil for the others
+	late  *bool          // a video packet was dropped, waiting for a keyframe
+}
+
+// send delivers a packet, it is dropped when the viewer is too slow. The
+// video after a dropped packet is dropped until the next keyframe, the
+// decoder can't use it anyway.
+func (v viewer) send(pck av.Packet, video bool) {
+	if video && *v.late {
+		if !pck.IsKeyFrame {
+			return
+		}
+		*v.late = false
+	}
+	if len(v.c) < cap(v.c) {
+		v.c <- pck
+	} else if video {
+		*v.late = true
+	}
+}
+
+// update delivers the new codecs to the viewer, a pending update not yet
+// consumed is replaced, only the latest one matters.
+func (v viewer) update(codecs []av.CodecData) {
+	select {
+	case <-v.u:
+	default:
+	}
+	v.u <- codecs
 }
 
 func (element *ConfigST) RunIFNotRun(uuid string) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
 	if tmp, ok := element.Streams[uuid]; ok {
-		if tmp.OnDemand && !tmp.RunLock {
+		if tmp.OnDemand && !tmp.RunLock && tmp.WHIPToken == "" {
 			tmp.RunLock = true
 			element.Streams[uuid] = tmp
 			go RTSPWorkerLoop(uuid, tmp.URL, tmp.OnDemand, tmp.DisableAudio, tmp.Debug)
@@ -128,18 +198,273 @@ func loadConfig() *ConfigST {
 	}
 	for i, v := range tmp.Streams {
 		v.Cl = make(map[string]viewer)
+		v.gop = newGOPCache()
+		v.tc = make(map[av.CodecType]*audioTranscoder)
+		v.stop = make(chan struct{})
 		tmp.Streams[i] = v
 	}
+	for i, v := range tmp.Streams {
+		if _, ok := tmp.Streams[v.Sub]; v.Sub != "" && (!ok || v.Sub == i) {
+			log.Println("Stream", i, "unknown sub-stream", v.Sub)
+			v.Sub = ""
+			tmp.Streams[i] = v
+		}
+	}
 	return &tmp
 }
 
 func (element *ConfigST) cast(uuid string, pck av.Packet) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
-	for _, v := range element.Streams[uuid].Cl {
-		if len(v.c) < cap(v.c) {
-			v.c <- pck
+	t, ok := element.Streams[uuid]
+	if !ok {
+		// removed, its source is stopping
+		return
+	}
+	if t.state != streamOnline {
+		element.online(uuid, t)
+	}
+	if t.gop != nil {
+		t.gop.push(pck)
+	}
+	// every output codec is encoded once for all its viewers
+	var converted map[av.CodecType]bool
+	video := int(pck.Idx) < len(t.Codecs) && t.Codecs[pck.Idx].Type().IsVideo()
+	for _, v := range t.Cl {
+		if video && v.rtp != nil {
+			continue
+		}
+		target, tc := t.audioTarget(pck.Idx, v.audio)
+		switch {
+		case tc == nil:
+			v.send(pck, video)
+		case tc.err != nil || converted[target]:
+			// no audio, or queued for the transcoder already
+		default:
+			if converted == nil {
+				converted = make(map[av.CodecType]bool)
+			}
+			tc.feed(uuid, target, pck)
+			converted[target] = true
+		}
+	}
+}
+
+// castConverted sends the packets of a transcoder to the viewers of the
+// stream needing them, unless it was stopped in the meantime
+func (element *ConfigST) castConverted(suuid string, target av.CodecType, tc *audioTranscoder, pkts []av.Packet) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t, ok := element.Streams[suuid]
+	if !ok || t.tc[target] != tc {
+		return
+	}
+	for _, v := range t.Cl {
+		if _, vtc := t.audioTarget(pkts[0].Idx, v.audio); vtc != tc {
+			continue
+		}
+		for _, p := range pkts {
+			v.send(p, false)
+		}
+	}
+}
+
+// rtpCast sends a video RTP packet to the passthrough viewers with its time
+// at on the stream timeline, it reports whether the other viewers need the
+// packet depacketized
+func (element *ConfigST) rtpCast(uuid string, p *rtp.Packet, at time.Duration) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t, ok := element.Streams[uuid]
+	if !ok {
+		return false
+	}
+	if t.state != streamOnline {
+		element.online(uuid, t)
+	}
+	if !t.RTPPassthrough {
+		return true
+	}
+	// without viewers the stream is still followed for the next ones, the
+	// GOP cache and the codecs stay up to date
+	demux := len(t.Cl) == 0
+	var pck *rtp.Packet
+	for _, v := range t.Cl {
+		if v.rtp == nil {
+			demux = true
+			continue
+		}
+		if pck == nil {
+			// the payload belongs to the RTSP reader, extensions aren't forwarded
+			pck = &rtp.Packet{Header: rtp.Header{
+				Version:        2,
+				Marker:         p.Marker,
+				SequenceNumber: p.SequenceNumber,
+				Timestamp:      p.Timestamp,
+			}, Payload: append([]byte(nil), p.Payload...)}
 		}
+		if len(v.rtp) < cap(v.rtp) {
+			v.rtp <- rtpPacket{Packet: pck, Time: at}
+		}
+	}
+	if !demux && t.gop != nil {
+		// it won't follow the stream until the depacketizer is back
+		t.gop.reset()
+	}
+	return demux
+}
+
+// online marks the source of the stream online with its first packet, the
+// caller holds the lock
+func (element *ConfigST) online(suuid string, t StreamST) {
+	t.state = streamOnline
+	t.Status = true
+	element.Streams[suuid] = t
+}
+
+// stSet sets the state of the source of a stream
+func (element *ConfigST) stSet(suuid, state string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t, ok := element.Streams[suuid]
+	if !ok {
+		return
+	}
+	t.state = state
+	t.Status = state == streamOnline
+	element.Streams[suuid] = t
+}
+
+// stDe removes a stream, its transcoders and WHIP publishing end
+func (element *ConfigST) stDe(suuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t, ok := element.Streams[suuid]
+	if !ok {
+		return
+	}
+	for _, tc := range t.tc {
+		tc.stop()
+	}
+	if t.stop != nil {
+		close(t.stop)
+	}
+	delete(element.Streams, suuid)
+}
+
+// puGe returns the WHIP endpoint a stream is published to, empty once it
+// is removed
+func (element *ConfigST) puGe(suuid string) string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[suuid].Publish
+}
+
+// stGe returns the state of the source of a stream
+func (element *ConfigST) stGe(suuid string) string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if state := element.Streams[suuid].state; state != "" {
+		return state
+	}
+	return streamOffline
+}
+
+// rtpGe reports whether the stream has the RTP passthrough mode
+func (element *ConfigST) rtpGe(suuid string) bool {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[suuid].RTPPassthrough
+}
+
+// audioTarget returns the transcoder of a packet for a viewer, nil when
+// the viewer gets the packet as it is. A transcoder that can't be created
+// is kept with its error, the viewers get no audio. The caller holds the
+// lock.
+func (t StreamST) audioTarget(idx int8, policy audioPolicy) (av.CodecType, *audioTranscoder) {
+	if policy == nil || int(idx) >= len(t.Codecs) || !t.Codecs[idx].Type().IsAudio() {
+		return 0, nil
+	}
+	c := t.Codecs[idx]
+	target := policy(c.Type())
+	if target == 0 || target == c.Type() {
+		return 0, nil
+	}
+	tc, ok := t.tc[target]
+	if !ok && t.tc != nil {
+		var err error
+		tc, err = newAudioTranscoder(c, target)
+		if err != nil {
+			log.Println("Audio transcode", err, "dropping the audio")
+			tc = &audioTranscoder{err: err}
+		}
+		t.tc[target] = tc
+	}
+	return target, tc
+}
+
+// viewerCodecs returns the codecs as a viewer with the audio policy gets
+// them. The caller holds the lock.
+func (t StreamST) viewerCodecs(codecs []av.CodecData, policy audioPolicy) []av.CodecData {
+	if policy == nil || codecs == nil {
+		return codecs
+	}
+	res := make([]av.CodecData, len(codecs))
+	for i, c := range codecs {
+		res[i] = c
+		if _, tc := t.audioTarget(int8(i), policy); tc != nil && tc.err == nil {
+			res[i] = tc.codec
+		}
+	}
+	return res
+}
+
+// whipAu checks the bearer token of a WHIP request for a stream, only the
+// streams of the config with a whip_token can be published
+func (element *ConfigST) whipAu(suuid, token string) error {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[suuid].whipAuth(token)
+}
+
+func (t StreamST) whipAuth(token string) error {
+	if t.WHIPToken == "" {
+		return ErrorWHIPNoStream
+	}
+	if subtle.ConstantTimeCompare([]byte(t.WHIPToken), []byte(token)) != 1 {
+		return ErrorWHIPToken
+	}
+	return nil
+}
+
+// whipAd makes a WHIP publisher with the token the source of a stream, a
+// stream has one publisher at a time. The publisher is asked for a
+// keyframe on pli.
+func (element *ConfigST) whipAd(suuid, id, token string, pli chan struct{}) error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t := element.Streams[suuid]
+	if err := t.whipAuth(token); err != nil {
+		return err
+	}
+	if t.publisher != "" {
+		return ErrorWHIPPublished
+	}
+	t.publisher, t.pli = id, pli
+	element.Streams[suuid] = t
+	return nil
+}
+
+// whipDe ends the WHIP publisher of a stream, its viewers stay for the
+// next one
+func (element *ConfigST) whipDe(suuid, id string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if t, ok := element.Streams[suuid]; ok && t.publisher == id {
+		t.publisher, t.pli = "", nil
+		t.state = streamOffline
+		t.Status = false
+		element.Streams[suuid] = t
 	}
 }
 
@@ -150,23 +475,111 @@ func (element *ConfigST) ext(suuid string) bool {
 	return ok
 }
 
+// grGe returns the main stream and the sub-stream of the group of a
+// stream, empty when it has none
+func (element *ConfigST) grGe(suuid string) (string, string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if t, ok := element.Streams[suuid]; ok && t.Sub != "" {
+		return suuid, t.Sub
+	}
+	for main, t := range element.Streams {
+		if t.Sub == suuid {
+			return main, suuid
+		}
+	}
+	return "", ""
+}
+
+// fecGe returns the FEC redundancy of a stream in percent
+func (element *ConfigST) fecGe(suuid string) int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.Streams[suuid].FEC
+}
+
+// copyCodecs copies the codecs of a source, the source changes its own in
+// place while the viewers read the ones of the stream
+func copyCodecs(codecs []av.CodecData) []av.CodecData {
+	if codecs == nil {
+		return nil
+	}
+	return append([]av.CodecData{}, codecs...)
+}
+
 func (element *ConfigST) coAd(suuid string, codecs []av.CodecData) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
-	t := element.Streams[suuid]
-	t.Codecs = codecs
+	t, ok := element.Streams[suuid]
+	if !ok {
+		return
+	}
+	changed := t.Codecs != nil
+	t.Codecs = copyCodecs(codecs)
 	element.Streams[suuid] = t
+	if changed {
+		element.coNotify(t, t.Codecs)
+	}
 }
 
+// coNilAd sets the codecs only when there are none, or when the source
+// came back with different codec types (e.g. H264 -> H265 after a camera
+// settings change).
 func (element *ConfigST) coNilAd(suuid string, codecs []av.CodecData) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
-	t := element.Streams[suuid]
-	if t.Codecs != nil {
+	t, ok := element.Streams[suuid]
+	if !ok || t.Codecs != nil && sameCodecTypes(t.Codecs, codecs) {
 		return
 	}
-	t.Codecs = codecs
+	changed := t.Codecs != nil
+	t.Codecs = copyCodecs(codecs)
 	element.Streams[suuid] = t
+	if changed {
+		element.coNotify(t, t.Codecs)
+	}
+}
+
+// coNotify sends the codec change event to every viewer, the caller holds the lock
+func (element *ConfigST) coNotify(t StreamST, codecs []av.CodecData) {
+	if t.gop != nil {
+		// cached packets belong to the old codecs
+		t.gop.reset()
+	}
+	for target, tc := range t.tc {
+		tc.stop()
+		delete(t.tc, target)
+	}
+	for _, v := range t.Cl {
+		v.update(t.viewerCodecs(codecs, v.audio))
+	}
+}
+
+func sameCodecTypes(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+	}
+	return true
+}
+
+func (element *ConfigST) inAd(suuid string, info nal.VideoInfo) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if t, ok := element.Streams[suuid]; ok {
+		t.Info = info
+		element.Streams[suuid] = t
+	}
+}
+
+func (element *ConfigST) inGe(suuid string) nal.VideoInfo {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[suuid].Info
 }
 
 func (element *ConfigST) coGe(suuid string) []av.CodecData {
@@ -200,13 +613,119 @@ func (element *ConfigST) coGe(suuid string) []av.CodecData {
 	return nil
 }
 
-func (element *ConfigST) clAd(suuid string) (string, chan av.Packet) {
+// coGeAudio returns the codecs of a stream as a viewer with the audio policy gets them
+func (element *ConfigST) coGeAudio(suuid string, policy audioPolicy) []av.CodecData {
+	if element.coGe(suuid) == nil {
+		return nil
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t := element.Streams[suuid]
+	return t.viewerCodecs(t.Codecs, policy)
+}
+
+// clAd adds a viewer, its channel is pre-filled with the packets since the
+// last keyframe. The number of packets served from the GOP cache is returned.
+func (element *ConfigST) clAd(suuid string) (string, chan av.Packet, int) {
+	return element.clAdAudio(suuid, nil)
+}
+
+// clAdAudio adds a viewer that gets the audio converted by the policy,
+// converted audio doesn't come from the GOP cache.
+func (element *ConfigST) clAdAudio(suuid string, policy audioPolicy) (string, chan av.Packet, int) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	t := element.Streams[suuid]
+	cuuid := pseudoUUID()
+	var cached []av.Packet
+	if g := t.gop; g != nil {
+		for _, pck := range g.snapshot() {
+			if target, _ := t.audioTarget(pck.Idx, policy); target == 0 {
+				cached = append(cached, pck)
+			}
+		}
+		if len(cached) > 0 {
+			g.viewers++
+			g.served += int64(len(cached))
+			log.Printf("Stream %s viewer %s: %d packets (%v) from GOP cache", suuid, cuuid, len(cached), g.last.Sub(g.start))
+		}
+	}
+	if len(cached) == 0 {
+		t.keyframe()
+	}
+	ch := make(chan av.Packet, 100+len(cached))
+	for _, pck := range cached {
+		ch <- pck
+	}
+	if t.Cl != nil {
+		// a removed stream has none, the viewer ends without video
+		t.Cl[cuuid] = viewer{c: ch, u: make(chan []av.CodecData, 1), audio: policy, late: new(bool)}
+	}
+	return cuuid, ch, len(cached)
+}
+
+// clAdLive adds a viewer that starts with the live packets, nothing comes
+// from the GOP cache. With passthrough its video comes as the RTP packets of the
+// camera for the passthrough mode.
+func (element *ConfigST) clAdLive(suuid string, policy audioPolicy, passthrough bool) (string, chan av.Packet, chan rtpPacket) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
 	cuuid := pseudoUUID()
 	ch := make(chan av.Packet, 100)
-	element.Streams[suuid].Cl[cuuid] = viewer{c: ch}
-	return cuuid, ch
+	var r chan rtpPacket
+	if passthrough {
+		// a keyframe takes hundreds of packets
+		r = make(chan rtpPacket, 1024)
+	}
+	t := element.Streams[suuid]
+	if t.Cl != nil {
+		t.Cl[cuuid] = viewer{c: ch, u: make(chan []av.CodecData, 1), audio: policy, rtp: r, late: new(bool)}
+	}
+	t.keyframe()
+	return cuuid, ch, r
+}
+
+// keyframe asks the WHIP publisher of the stream for a keyframe, the
+// request is dropped when one is pending
+func (t StreamST) keyframe() {
+	select {
+	case t.pli <- struct{}{}:
+	default:
+	}
+}
+
+// gopEmpty tells whether a new viewer of the stream would have to wait for
+// the next keyframe
+func (element *ConfigST) gopEmpty(suuid string) bool {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	g := element.Streams[suuid].gop
+	return g == nil || len(g.pkts) == 0
+}
+
+// gopGe returns the GOP cache stats of a stream
+func (element *ConfigST) gopGe(suuid string) (stats JGOP) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	g := element.Streams[suuid].gop
+	if g == nil {
+		return
+	}
+	stats.Packets = len(g.pkts)
+	stats.Bytes = g.bytes
+	if len(g.pkts) > 0 {
+		stats.Duration = g.last.Sub(g.start).Milliseconds()
+	}
+	stats.Viewers = g.viewers
+	stats.Served = g.served
+	return
+}
+
+// clUp returns the codec change events of a viewer added by clAd
+func (element *ConfigST) clUp(suuid, cuuid string) <-chan []av.CodecData {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[suuid].Cl[cuuid].u
 }
 
 func (element *ConfigST) list() (string, []string) {
@@ -225,7 +744,24 @@ func (element *ConfigST) list() (string, []string) {
 func (element *ConfigST) clDe(suuid, cuuid string) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
-	delete(element.Streams[suuid].Cl, cuuid)
+	t := element.Streams[suuid]
+	delete(t.Cl, cuuid)
+	// stop the transcoders no viewer needs anymore
+	for target, tc := range t.tc {
+		needed := false
+		for _, v := range t.Cl {
+			for _, c := range t.Codecs {
+				if v.audio != nil && c.Type().IsAudio() && v.audio(c.Type()) == target {
+					needed = true
+				}
+			}
+		}
+		// a failed one stays until the codecs change, it is logged once
+		if !needed && tc.err == nil {
+			tc.stop()
+			delete(t.tc, target)
+		}
+	}
 }
 
 func pseudoUUID() (uuid string) {
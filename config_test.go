@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/vdk/av"
+	"golang.org/x/net/websocket"
+)
+
+// the codecs of the stream and of its viewers don't change with the ones
+// of the source
+func TestCoAdCopy(t *testing.T) {
+	const suuid = "codec-copy-test"
+	testStream(t, suuid, nil)
+	main, high := testH264(t), testH264High(t)
+
+	codecs := []av.CodecData{main}
+	Config.coAd(suuid, codecs)
+	cid, _, _ := Config.clAdLive(suuid, nil, false)
+	up := Config.clUp(suuid, cid)
+	codecs[0] = high
+	if got := Config.coGe(suuid); !reflect.DeepEqual(got[0], main) {
+		t.Error("the codecs of the stream changed with the ones of the source")
+	}
+
+	Config.coAd(suuid, codecs)
+	var notified []av.CodecData
+	select {
+	case notified = <-up:
+	default:
+		t.Fatal("the viewer didn't get the codec change")
+	}
+	codecs[0] = main
+	if !reflect.DeepEqual(notified[0], high) || !reflect.DeepEqual(Config.coGe(suuid)[0], high) {
+		t.Error("the codecs of the viewer changed with the ones of the source")
+	}
+}
+
+func TestMSECodecChange(t *testing.T) {
+	const suuid = "mse-codec-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		startMSE(ws, suuid)
+	}))
+	defer srv.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// the codecs string and the init segment
+	init := func() (string, []byte) {
+		if err := ws.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		var r Response
+		if err := websocket.JSON.Receive(ws, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Type != "mse" {
+			t.Fatalf("message %q %q, want mse", r.Type, r.Error)
+		}
+		var segment []byte
+		if err := websocket.Message.Receive(ws, &segment); err != nil {
+			t.Fatal(err)
+		}
+		return r.Codecs, segment
+	}
+	codecs, segment := init()
+	if !strings.HasPrefix(strings.ToLower(codecs), "avc1.4d") {
+		t.Errorf("codecs %q of a Main profile camera", codecs)
+	}
+
+	Config.coAd(suuid, []av.CodecData{testH264High(t)})
+	high, highSegment := init()
+	if !strings.HasPrefix(strings.ToLower(high), "avc1.64") {
+		t.Errorf("codecs %q after the change to High", high)
+	}
+	if bytes.Equal(segment, highSegment) {
+		t.Error("same init segment after the codec change")
+	}
+}
+
+func TestWebRTCCodecChange(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "webrtc-codec-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	s, _, _ := testViewer(t, suuid)
+	before := attachedSenders(s)
+	if len(before) != 1 {
+		t.Fatalf("%d senders, want 1", len(before))
+	}
+
+	Config.coAd(suuid, []av.CodecData{testH264High(t)})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after := attachedSenders(s)
+		switched := false
+		for sender := range before {
+			now, ok := after[sender]
+			if !ok {
+				t.Fatal("the sender changed with the codec")
+			}
+			track, _ := now.(*fanout.Track)
+			switched = now != before[sender] && track != nil && strings.Contains(track.Codec().SDPFmtpLine, "profile-level-id=64")
+		}
+		if switched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sender didn't switch to a High profile track")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-s.done:
+		t.Error("the session ended with the codec change")
+	default:
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The video of a WebRTC viewer is degraded on purpose when its link can't
+// take the bitrate of the camera, instead of losing random packets: the
+// non-reference frames are dropped first, then all but the keyframes. The
+// bandwidth is the estimate of the TWCC feedback of the browser (GCC), or
+// of its REMB messages.
+const (
+	// bweInitialBitrate is where the TWCC estimates start, above the
+	// cameras so they only go down with the congestion
+	bweInitialBitrate = 20_000_000
+
+	// congestionHold is how long the estimate has to stay below the
+	// bitrate of the level before it is degraded, recoveryHold how long it
+	// has to be above the one of the level below with the headroom
+	congestionHold   = 2 * time.Second
+	recoveryHold     = 10 * time.Second
+	recoveryHeadroom = 1.25
+
+	// rateSmoothing is the weight of the last second in the bitrates of
+	// the levels, keyframes make them bursty
+	rateSmoothing = 0.2
+)
+
+// estimators passes the bandwidth estimator pion creates in
+// NewPeerConnection to newViewerPeerConnection
+var estimators = struct {
+	sync.Mutex
+	c chan cc.BandwidthEstimator
+}{c: make(chan cc.BandwidthEstimator, 1)}
+
+// onNewEstimator is called by pion in NewPeerConnection
+func onNewEstimator(id string, estimator cc.BandwidthEstimator) {
+	select {
+	case estimators.c <- estimator:
+	default:
+	}
+}
+
+// newViewerPeerConnection creates a PeerConnection of the viewers with its
+// TWCC bandwidth estimator
+func newViewerPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	estimators.Lock()
+	defer estimators.Unlock()
+	pc, err := webRTCAPI.NewPeerConnection(peerConnectionConfig())
+	var estimator cc.BandwidthEstimator
+	select {
+	case estimator = <-estimators.c:
+	default:
+	}
+	return pc, estimator, err
+}
+
+// congestion follows the bandwidth estimate of a viewer
+type congestion struct {
+	remb      uint64 // atomic, the last REMB of the browser in bit/s
+	estimator cc.BandwidthEstimator
+
+	level     fanout.Level
+	rates     [fanout.KeyOnly + 1]float64 // bit/s of the tracks at every level
+	octets    map[int8][fanout.KeyOnly + 1]uint64
+	measured  time.Time
+	congested time.Time
+	recovered time.Time
+}
+
+func newCongestion(estimator cc.BandwidthEstimator) *congestion {
+	return &congestion{
+		estimator: estimator,
+		octets:    make(map[int8][fanout.KeyOnly + 1]uint64),
+	}
+}
+
+// reset starts again with other tracks, at the full level
+func (c *congestion) reset() {
+	c.level = fanout.Full
+	c.rates = [fanout.KeyOnly + 1]float64{}
+	c.octets = make(map[int8][fanout.KeyOnly + 1]uint64)
+	c.measured, c.congested, c.recovered = time.Time{}, time.Time{}, time.Time{}
+}
+
+// onRTCP takes the REMB messages of the RTCP of a sender
+func (c *congestion) onRTCP(pkts []rtcp.Packet) {
+	for _, pkt := range pkts {
+		if remb, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+			atomic.StoreUint64(&c.remb, uint64(remb.Bitrate))
+		}
+	}
+}
+
+// estimate returns the bandwidth of the viewer in bit/s, 0 when unknown
+func (c *congestion) estimate() int {
+	estimate := int(atomic.LoadUint64(&c.remb))
+	if c.estimator != nil {
+		if twcc := c.estimator.GetTargetBitrate(); estimate == 0 || twcc < estimate {
+			estimate = twcc
+		}
+	}
+	return estimate
+}
+
+// measure updates the bitrates of the levels from the octets of the tracks
+func (c *congestion) measure(tracks map[int8]*fanout.Track, now time.Time) bool {
+	elapsed := now.Sub(c.measured).Seconds()
+	first := c.measured.IsZero()
+	c.measured = now
+	var rates [fanout.KeyOnly + 1]float64
+	for idx, track := range tracks {
+		if track == nil {
+			continue
+		}
+		octets := track.Octets()
+		last, ok := c.octets[idx]
+		c.octets[idx] = octets
+		if !ok || first {
+			continue
+		}
+		for l := range octets {
+			// a level gets the packets of the levels above too
+			for below := 0; below <= l; below++ {
+				rates[below] += float64(octets[l]-last[l]) * 8 / elapsed
+			}
+		}
+	}
+	if first {
+		return false
+	}
+	for l := range rates {
+		c.rates[l] = (1-rateSmoothing)*c.rates[l] + rateSmoothing*rates[l]
+	}
+	return true
+}
+
+// adapt returns the level of the video for the estimate, one level at a
+// time once the estimate held long enough
+func (c *congestion) adapt(estimate int, now time.Time) fanout.Level {
+	switch {
+	case c.level < fanout.KeyOnly && c.rates[c.level] > float64(estimate):
+		c.recovered = time.Time{}
+		if c.congested.IsZero() {
+			c.congested = now
+		} else if now.Sub(c.congested) >= congestionHold {
+			c.level++
+			c.congested = time.Time{}
+		}
+	case c.level > fanout.Full && c.rates[c.level-1]*recoveryHeadroom <= float64(estimate):
+		c.congested = time.Time{}
+		if c.recovered.IsZero() {
+			c.recovered = now
+		} else if now.Sub(c.recovered) >= recoveryHold {
+			c.level--
+			c.recovered = time.Time{}
+		}
+	default:
+		c.congested, c.recovered = time.Time{}, time.Time{}
+	}
+	return c.level
+}
+
+// adapt sets the level of the video of the viewer from its bandwidth
+// estimate, the viewer gets the stats when it changes
+func (s *WebRTCStreamer) adapt(now time.Time) {
+	if !s.bwe.measure(s.tracks, now) {
+		return
+	}
+	before := s.bwe.level
+	level := before
+	if estimate := s.bwe.estimate(); estimate > 0 {
+		level = s.bwe.adapt(estimate, now)
+	}
+	if level != before {
+		log.Println("WebRTC viewer video level", level, "estimate", s.bwe.estimate(), "bit/s")
+		defer s.sendStats()
+	}
+	// new bindings of switched or resumed tracks start at Full
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		params := sender.GetParameters()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo || len(params.Encodings) == 0 {
+			continue
+		}
+		track.SetLevel(params.Encodings[0].SSRC, level)
+	}
+}
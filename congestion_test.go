@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/rtp"
+)
+
+func TestCongestionAdapt(t *testing.T) {
+	// bit/s of the tracks at the full, reference and keyframes levels
+	rates := [fanout.KeyOnly + 1]float64{1e6, 6e5, 2e5}
+	type step struct {
+		at       time.Duration
+		estimate int
+		level    fanout.Level
+	}
+	for _, c := range []struct {
+		name  string
+		level fanout.Level
+		steps []step
+	}{
+		{"degraded after the hold", fanout.Full, []step{
+			{0, 9e5, fanout.Full},
+			{congestionHold - time.Millisecond, 9e5, fanout.Full},
+			{congestionHold, 9e5, fanout.Reference},
+			// the next level has a hold of its own
+			{congestionHold + time.Second, 1e5, fanout.Reference},
+			{2*congestionHold + time.Second - time.Millisecond, 1e5, fanout.Reference},
+			{2*congestionHold + time.Second, 1e5, fanout.KeyOnly},
+			{10 * congestionHold, 1e5, fanout.KeyOnly},
+		}},
+		{"congestion hold reset by a flip", fanout.Full, []step{
+			{0, 9e5, fanout.Full},
+			{congestionHold / 2, 11e5, fanout.Full},
+			{congestionHold - time.Millisecond, 9e5, fanout.Full},
+			{congestionHold, 9e5, fanout.Full},
+			{2*congestionHold - 2*time.Millisecond, 9e5, fanout.Full},
+			{2*congestionHold - time.Millisecond, 9e5, fanout.Reference},
+		}},
+		{"recovered one level at a time", fanout.KeyOnly, []step{
+			// the rate of the reference level with the headroom
+			{0, 75e4, fanout.KeyOnly},
+			{recoveryHold - time.Millisecond, 75e4, fanout.KeyOnly},
+			{recoveryHold, 75e4, fanout.Reference},
+			// not enough for the full level
+			{2 * recoveryHold, 75e4, fanout.Reference},
+			{2*recoveryHold + time.Second, 125e4, fanout.Reference},
+			{3*recoveryHold + time.Second - time.Millisecond, 125e4, fanout.Reference},
+			{3*recoveryHold + time.Second, 125e4, fanout.Full},
+		}},
+		{"recovery without headroom", fanout.KeyOnly, []step{
+			{0, 74e4, fanout.KeyOnly},
+			{2 * recoveryHold, 74e4, fanout.KeyOnly},
+		}},
+		{"recovery hold reset by a flip", fanout.KeyOnly, []step{
+			{0, 75e4, fanout.KeyOnly},
+			{recoveryHold - time.Second, 1e5, fanout.KeyOnly},
+			{recoveryHold, 75e4, fanout.KeyOnly},
+			{2*recoveryHold - time.Millisecond, 75e4, fanout.KeyOnly},
+			{2 * recoveryHold, 75e4, fanout.Reference},
+		}},
+	} {
+		bwe := newCongestion(nil)
+		bwe.level, bwe.rates = c.level, rates
+		start := time.Now()
+		for _, s := range c.steps {
+			if level := bwe.adapt(s.estimate, start.Add(s.at)); level != s.level {
+				t.Errorf("%s: %v at %d bit/s after %v, want %v", c.name, level, s.estimate, s.at, s.level)
+			}
+		}
+	}
+}
+
+// sameRates compares bitrates, their sums are rounded
+func sameRates(a, b [fanout.KeyOnly + 1]float64) bool {
+	for l := range a {
+		if math.Abs(a[l]-b[l]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCongestionMeasure(t *testing.T) {
+	video, audio := testVideoTrack("video"), testAudioTrack("audio")
+	bwe := newCongestion(nil)
+	start := time.Now()
+	if bwe.measure(map[int8]*fanout.Track{0: video}, start) {
+		t.Error("measured without a previous measure")
+	}
+	var ts uint32
+	write := func(track *fanout.Track, key bool, payload ...byte) {
+		ts += 3000
+		if err := track.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: ts}, Payload: payload}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1 byte keyframe, reference and non-reference frames of 2 and 4
+	// bytes, 8 bytes of audio over a second
+	write(video, true, 0x65)
+	write(video, false, 0x41, 0)
+	write(video, false, 0x01, 0, 0, 0)
+	write(audio, false, 0, 0, 0, 0, 0, 0, 0, 0)
+	tracks := map[int8]*fanout.Track{0: video, 1: audio}
+	if !bwe.measure(tracks, start.Add(time.Second)) {
+		t.Fatal("not measured")
+	}
+	// the audio track is measured from its first measure on
+	want := [fanout.KeyOnly + 1]float64{rateSmoothing * 7 * 8, rateSmoothing * 3 * 8, rateSmoothing * 1 * 8}
+	if !sameRates(bwe.rates, want) {
+		t.Errorf("rates %v, want %v", bwe.rates, want)
+	}
+
+	write(audio, false, 0, 0, 0, 0, 0, 0, 0, 0)
+	if !bwe.measure(tracks, start.Add(3*time.Second)) {
+		t.Fatal("not measured")
+	}
+	// every level has the audio, over 2 seconds
+	for l := range want {
+		want[l] = (1-rateSmoothing)*want[l] + rateSmoothing*8*8/2
+	}
+	if !sameRates(bwe.rates, want) {
+		t.Errorf("rates %v, want %v", bwe.rates, want)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/webrtc/v3"
+)
+
+// controlLabel is the label of the control data channel of a viewer. The
+// client opens it with its offer, the server opens it with its own.
+const controlLabel = "control"
+
+// controlStatsInterval is how often the stats of a viewer are sent
+const controlStatsInterval = 5 * time.Second
+
+// controlMessage is a JSON message of the control data channel. The server
+// sends the "state" of the stream source with the codecs of the tracks and
+// the "stats" of the viewer, the client sends "mute", "unmute", "pause",
+// "resume", "quality" and "fec" requests. A failed request is answered with its
+// type and the error, the others with the stats.
+type controlMessage struct {
+	Type      string       `json:"type"`
+	State     string       `json:"state,omitempty"` // offline, online or reconnecting
+	Codecs    []string     `json:"codecs,omitempty"`
+	Qualities []string     `json:"qualities,omitempty"` // of the stream group, see quality.go
+	Quality   string       `json:"quality,omitempty"`
+	FEC       int          `json:"fec,omitempty"` // redundancy in percent, see fec.go
+	Stats     *viewerStats `json:"stats,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// viewerStats are the delivery of a viewer, the counters of a track start
+// again when it is paused or muted
+type viewerStats struct {
+	ICE      string       `json:"ice"`
+	Paused   bool         `json:"paused"`
+	Muted    bool         `json:"muted"`
+	Level    string       `json:"level"`              // of the video, see congestion.go
+	Estimate int          `json:"estimate,omitempty"` // bandwidth in bit/s
+	Quality  string       `json:"quality,omitempty"`  // main or sub
+	Auto     bool         `json:"auto,omitempty"`     // the quality follows the estimate
+	FEC      int          `json:"fec"`                // redundancy of the video in percent
+	Tracks   []trackStats `json:"tracks"`
+}
+
+type trackStats struct {
+	Codec   string `json:"codec"`
+	Packets uint32 `json:"packets"`
+	Bytes   uint32 `json:"bytes"`
+	Errors  uint32 `json:"errors,omitempty"` // packets that couldn't be sent
+
+	// the overhead of the FEC since the viewer started
+	FECPackets uint32 `json:"fec_packets,omitempty"`
+	FECBytes   uint32 `json:"fec_bytes,omitempty"`
+}
+
+// onDataChannel takes the control channel opened by the client
+func (s *WebRTCStreamer) onDataChannel(d *webrtc.DataChannel) {
+	if d.Label() != controlLabel {
+		log.Println("WebRTC ignore data channel", d.Label())
+		return
+	}
+	s.openControl(d)
+}
+
+// openControl passes the channel to the session once it is open, and the
+// messages of the client. They are dropped once the session is over.
+func (s *WebRTCStreamer) openControl(d *webrtc.DataChannel) {
+	d.OnOpen(func() {
+		select {
+		case s.channels <- d:
+		default:
+			log.Println("WebRTC control channel already open")
+		}
+	})
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m controlMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			log.Println("WebRTC control", err)
+			return
+		}
+		select {
+		case s.commands <- m:
+		case <-s.done:
+		}
+	})
+}
+
+// sendControl sends a message on the control channel, if any
+func (s *WebRTCStreamer) sendControl(m controlMessage) {
+	if s.control == nil {
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Println("WebRTC control", err)
+		return
+	}
+	if err := s.control.SendText(string(b)); err != nil {
+		log.Println("WebRTC control", err)
+	}
+}
+
+// sendState sends the state of the source when it changed, or anyway
+func (s *WebRTCStreamer) sendState(force bool) {
+	if s.hub == nil {
+		return
+	}
+	state := Config.stGe(s.hub.suuid)
+	if state == s.source && !force {
+		return
+	}
+	s.source = state
+	var codecs []string
+	for _, idx := range s.trackIdx() {
+		codecs = append(codecs, s.tracks[idx].Codec().MimeType)
+	}
+	s.sendControl(controlMessage{Type: "state", State: state, Codecs: codecs, Qualities: s.qualities()})
+}
+
+func (s *WebRTCStreamer) sendStats() {
+	if s.control == nil {
+		return
+	}
+	stats := &viewerStats{
+		ICE:      s.state.String(),
+		Paused:   s.paused,
+		Muted:    s.muted,
+		Level:    s.bwe.level.String(),
+		Estimate: s.bwe.estimate(),
+		Quality:  s.current(),
+		Auto:     s.quality == qualityAuto,
+		FEC:      s.fec,
+	}
+	now := time.Now()
+	for _, idx := range s.trackIdx() {
+		t := trackStats{Codec: s.tracks[idx].Codec().MimeType}
+		if sender := s.senders[idx]; sender != nil {
+			if params := sender.GetParameters(); len(params.Encodings) > 0 {
+				if sr, ok := s.tracks[idx].SenderReport(uint32(params.Encodings[0].SSRC), now); ok {
+					t.Packets, t.Bytes = sr.PacketCount, sr.OctetCount
+				}
+				t.Errors = s.tracks[idx].Errors(params.Encodings[0].SSRC)
+				t.FECPackets, t.FECBytes = fanout.FECStats(params.Encodings[0].SSRC)
+			}
+		}
+		stats.Tracks = append(stats.Tracks, t)
+	}
+	s.sendControl(controlMessage{Type: "stats", Stats: stats})
+}
+
+// trackIdx returns the indexes of the tracks in order
+func (s *WebRTCStreamer) trackIdx() []int8 {
+	var idx []int8
+	for i, track := range s.tracks {
+		if track != nil {
+			idx = append(idx, i)
+		}
+	}
+	return sortIdx(idx)
+}
+
+// command applies a request of the client
+func (s *WebRTCStreamer) command(m controlMessage) {
+	var err error
+	switch m.Type {
+	case "mute", "unmute":
+		s.muted = m.Type == "mute"
+		err = s.deliver()
+	case "pause", "resume":
+		s.paused = m.Type == "pause"
+		err = s.deliver()
+	case "quality":
+		err = s.setQuality(m.Quality)
+	case "fec":
+		err = s.setFEC(m.FEC)
+	default:
+		err = fmt.Errorf("WebRTC unknown control message %q", m.Type)
+	}
+	if err != nil {
+		log.Println(err)
+		s.sendControl(controlMessage{Type: m.Type, Error: err.Error()})
+		return
+	}
+	s.sendStats()
+}
+
+// deliver detaches the senders of the silenced tracks and attaches the
+// others, a track attached again starts from the last keyframe
+func (s *WebRTCStreamer) deliver() error {
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		if track == nil {
+			continue
+		}
+		var want webrtc.TrackLocal
+		if !s.silenced(track) {
+			want = track
+		}
+		if sender.Track() == want {
+			continue
+		}
+		if err := sender.ReplaceTrack(want); err != nil {
+			return err
+		}
+	}
+	s.prefill()
+	return nil
+}
+
+// silenced tells whether the client paused the delivery of the track or
+// muted it
+func (s *WebRTCStreamer) silenced(track *fanout.Track) bool {
+	return s.paused || s.muted && track.Kind() == webrtc.RTPCodecTypeAudio
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// testControlViewer is a viewer of the video and the audio of a stream with
+// a control channel, the video codecs are added to the default ones. It
+// returns the session once ICE is connected, the messages of the channel
+// and the video packets the viewer receives.
+func testControlViewer(t *testing.T, suuid string, video ...webrtc.RTPCodecParameters) (*WebRTCStreamer, *webrtc.DataChannel, chan controlMessage, chan *rtp.Packet) {
+	// without the transport-cc feedback of the default interceptors: the
+	// estimator of pion/interceptor closes its channels unsynchronized
+	// with the feedback, the race detector sees it
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range video {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		_, err = pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	packets := make(chan *rtp.Packet, 1024)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				select {
+				case packets <- pkt:
+				default:
+				}
+			}
+		}
+	})
+	d, err := pc.CreateDataChannel(controlLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan controlMessage, 64)
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m controlMessage
+		if err := json.Unmarshal(msg.Data, &m); err == nil {
+			messages <- m
+		}
+	})
+
+	replies := make(chan Response, 16)
+	s := newWebRTCStreamer(func(r Response) error {
+		replies <- r
+		return nil
+	}, false)
+	t.Cleanup(func() {
+		s.end()
+		<-s.done
+	})
+	go s.run(suuid, testLocalOffer(t, pc, nil))
+	testSetAnswer(t, pc, replies)
+	return s, d, messages, packets
+}
+
+// testControl sends a request on the control channel
+func testControl(t *testing.T, d *webrtc.DataChannel, m controlMessage) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SendText(string(b)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testControlWait returns the next message of the type, the others are
+// skipped
+func testControlWait(t *testing.T, messages chan controlMessage, typ string) controlMessage {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-messages:
+			if m.Type == typ {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no %q message", typ)
+		}
+	}
+}
+
+// testAttached returns whether the senders of the session are attached to
+// their track, by kind
+func testAttached(s *WebRTCStreamer) map[webrtc.RTPCodecType]bool {
+	attached := make(map[webrtc.RTPCodecType]bool)
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		attached[track.Kind()] = sender.Track() == track
+	}
+	return attached
+}
+
+func TestControl(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "control-test"
+	testStream(t, suuid, []av.CodecData{testH264(t), codec.NewPCMAlawCodecData()})
+
+	s, d, messages, video := testControlViewer(t, suuid)
+	if m := testControlWait(t, messages, "state"); m.State != streamOffline || len(m.Codecs) != 2 {
+		t.Errorf("state %q of codecs %v when the channel opens", m.State, m.Codecs)
+	}
+	// a keyframe brings the stream online, the viewer gets it
+	Config.cast(suuid, av.Packet{Idx: 0, IsKeyFrame: true, Data: avcc([]byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff})})
+	if m := testControlWait(t, messages, "state"); m.State != streamOnline {
+		t.Errorf("state %q after a keyframe", m.State)
+	}
+	select {
+	case <-video:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video")
+	}
+
+	// the state isn't sent again while it doesn't change
+	timeout := time.After(2500 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case m := <-messages:
+			if m.Type == "state" {
+				t.Errorf("state %q sent again", m.State)
+			}
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	// the audio only is muted
+	testControl(t, d, controlMessage{Type: "mute"})
+	if m := testControlWait(t, messages, "stats"); m.Stats == nil || !m.Stats.Muted || m.Stats.Paused {
+		t.Errorf("stats %+v after mute", m.Stats)
+	}
+	if attached := testAttached(s); attached[webrtc.RTPCodecTypeAudio] || !attached[webrtc.RTPCodecTypeVideo] {
+		t.Errorf("attached %v after mute, want the video only", attached)
+	}
+	testControl(t, d, controlMessage{Type: "unmute"})
+	testControlWait(t, messages, "stats")
+	if attached := testAttached(s); !attached[webrtc.RTPCodecTypeAudio] || !attached[webrtc.RTPCodecTypeVideo] {
+		t.Errorf("attached %v after unmute, want all", attached)
+	}
+
+	// paused, then resumed from the last keyframe of the track
+	testControl(t, d, controlMessage{Type: "pause"})
+	if m := testControlWait(t, messages, "stats"); m.Stats == nil || !m.Stats.Paused {
+		t.Errorf("stats %+v after pause", m.Stats)
+	}
+	if attached := testAttached(s); attached[webrtc.RTPCodecTypeAudio] || attached[webrtc.RTPCodecTypeVideo] {
+		t.Errorf("attached %v after pause, want none", attached)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for drained := false; !drained; {
+		select {
+		case <-video:
+		default:
+			drained = true
+		}
+	}
+	// the keyframe isn't sent to the paused viewer
+	Config.cast(suuid, av.Packet{Idx: 0, IsKeyFrame: true, Time: time.Second, Data: avcc([]byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff})})
+	select {
+	case <-video:
+		t.Error("video while paused")
+	case <-time.After(200 * time.Millisecond):
+	}
+	testControl(t, d, controlMessage{Type: "resume"})
+	if m := testControlWait(t, messages, "stats"); m.Stats == nil || m.Stats.Paused {
+		t.Errorf("stats %+v after resume", m.Stats)
+	}
+	if attached := testAttached(s); !attached[webrtc.RTPCodecTypeAudio] || !attached[webrtc.RTPCodecTypeVideo] {
+		t.Errorf("attached %v after resume, want all", attached)
+	}
+	select {
+	case <-video:
+	case <-time.After(5 * time.Second):
+		t.Error("no keyframe after resume")
+	}
+
+	testControl(t, d, controlMessage{Type: "rewind"})
+	if m := testControlWait(t, messages, "rewind"); m.Error == "" {
+		t.Error("unknown request without an error")
+	}
+
+	// a track switch sends the state anyway
+	Config.coAd(suuid, Config.coGe(suuid))
+	if m := testControlWait(t, messages, "state"); m.State != streamOnline {
+		t.Errorf("state %q after a track switch", m.State)
+	}
+}
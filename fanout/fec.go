@@ -0,0 +1,306 @@
+package fanout
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The video of a sender can be protected with ULPFEC (RFC 5109) in RED
+// (RFC 2198), the way browsers receive it: the media packets are sent in
+// RED and a FEC packet follows every group of them, the receiver recovers
+// one lost packet of a group without waiting for a retransmission.
+//
+// A track only knows the groups, it writes an empty FEC packet with the
+// next sequence number after the last packet of a group. The FEC is
+// computed by the FEC interceptor from the packets as they leave the
+// PeerConnection, with the header extensions added by the interceptors
+// before it, the receiver recovers them as it got them. It has to be the
+// first one of the registry.
+
+// The RED and ULPFEC formats of the SDP
+const (
+	MimeTypeRED    = "video/red"
+	MimeTypeULPFEC = "video/ulpfec"
+)
+
+// fecMaxGroup is the number of packets of the 16 bits mask of a FEC packet
+const fecMaxGroup = 16
+
+// fecHistory is the number of FEC packets kept for retransmissions
+const fecHistory = 16
+
+// fecStream is the FEC of a sender, shared by the tracks it binds and the
+// FEC interceptor
+type fecStream struct {
+	mu      sync.Mutex
+	red     webrtc.PayloadType // 0 when the viewer didn't negotiate RED and ULPFEC
+	ulpfec  webrtc.PayloadType
+	k       int // media packets per FEC packet, 0 without FEC
+	pending int // media packets written by the track since the last group
+
+	// the group of the interceptor, the protection bitstrings of its
+	// packets are XORed as they come
+	n       int
+	base    uint16
+	b0, b1  byte
+	ts      uint32
+	length  uint16
+	mask    uint16
+	payload []byte
+	buf     []byte
+
+	started bool
+	seen    uint16 // last sequence number, older ones are retransmissions
+	sent    [fecHistory]fecPacket
+	packets uint32
+	octets  uint32
+}
+
+type fecPacket struct {
+	seq     uint16
+	payload []byte
+}
+
+// fecStreams are the FEC of the senders by SSRC, from their first track
+// to the end of the sender
+var fecStreams = struct {
+	sync.Mutex
+	m map[webrtc.SSRC]*fecStream
+}{m: make(map[webrtc.SSRC]*fecStream)}
+
+// bindFEC returns the FEC of a sender binding a track, the formats are
+// only negotiated in the context of its first track
+func bindFEC(ssrc webrtc.SSRC, codecs []webrtc.RTPCodecParameters) *fecStream {
+	var red, ulpfec webrtc.PayloadType
+	for _, c := range codecs {
+		switch {
+		case strings.EqualFold(c.MimeType, MimeTypeRED):
+			red = c.PayloadType
+		case strings.EqualFold(c.MimeType, MimeTypeULPFEC):
+			ulpfec = c.PayloadType
+		}
+	}
+	fecStreams.Lock()
+	defer fecStreams.Unlock()
+	s := fecStreams.m[ssrc]
+	if red == 0 || ulpfec == 0 {
+		return s
+	}
+	if s == nil {
+		s = &fecStream{}
+		fecStreams.m[ssrc] = s
+	}
+	s.mu.Lock()
+	s.red, s.ulpfec = red, ulpfec
+	s.mu.Unlock()
+	return s
+}
+
+func lookupFEC(ssrc webrtc.SSRC) *fecStream {
+	fecStreams.Lock()
+	defer fecStreams.Unlock()
+	return fecStreams.m[ssrc]
+}
+
+// SetFEC sets the redundancy of the video of the sender with the SSRC in
+// percent of its packets, 0 for none. It returns false when the viewer
+// didn't negotiate RED and ULPFEC.
+func SetFEC(ssrc webrtc.SSRC, percent int) bool {
+	s := lookupFEC(ssrc)
+	if s == nil {
+		return false
+	}
+	k := 0
+	if percent > 0 {
+		k = (100 + percent/2) / percent
+	}
+	switch {
+	case percent > 0 && k < 1:
+		k = 1
+	case k > fecMaxGroup:
+		k = fecMaxGroup
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.k != k {
+		s.k, s.pending = k, 0
+	}
+	return s.red != 0
+}
+
+// FECStats returns the FEC packets and their RED payload octets sent by
+// the sender with the SSRC
+func FECStats(ssrc webrtc.SSRC) (packets, octets uint32) {
+	s := lookupFEC(ssrc)
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.packets, s.octets
+}
+
+// params returns the RED and ULPFEC payload types while the sender is
+// protected
+func (s *fecStream) params() (webrtc.PayloadType, webrtc.PayloadType, bool) {
+	if s == nil {
+		return 0, 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.red, s.ulpfec, s.red != 0 && s.k > 0
+}
+
+// protect counts a media packet written by a track, it tells whether the
+// FEC packet of the group follows. A frame ending after half a group ends
+// it too, the receiver doesn't wait for the next frame to recover it.
+func (s *fecStream) protect(marker bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending++
+	if s.k == 0 || s.pending < s.k && !(marker && 2*s.pending >= s.k) {
+		return false
+	}
+	s.pending = 0
+	return true
+}
+
+// FECInterceptorFactory creates the FEC interceptor of a PeerConnection
+type FECInterceptorFactory struct{}
+
+// NewInterceptor is called by pion for every PeerConnection
+func (FECInterceptorFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &fecInterceptor{}, nil
+}
+
+type fecInterceptor struct {
+	interceptor.NoOp
+}
+
+// BindLocalStream protects the video of a sender
+func (i *fecInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	ssrc := webrtc.SSRC(info.SSRC)
+	fecStreams.Lock()
+	s := fecStreams.m[ssrc]
+	if s == nil {
+		s = &fecStream{}
+		fecStreams.m[ssrc] = s
+	}
+	fecStreams.Unlock()
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		payload, ok := s.write(header, payload)
+		if !ok {
+			return 0, nil
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// UnbindLocalStream ends the FEC of a sender
+func (i *fecInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	fecStreams.Lock()
+	defer fecStreams.Unlock()
+	delete(fecStreams.m, webrtc.SSRC(info.SSRC))
+}
+
+// write adds a RED media packet to the group, and fills the FEC packet of
+// a group. It returns the payload to send, false to drop the packet.
+func (s *fecStream) write(h *rtp.Header, payload []byte) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.red == 0 || h.PayloadType != uint8(s.red) || len(payload) == 0 {
+		return payload, true
+	}
+	seq := h.SequenceNumber
+	if s.started && int16(seq-s.seen) <= 0 {
+		// a retransmission, the FEC packets were empty in the history
+		if webrtc.PayloadType(payload[0]&0x7f) != s.ulpfec {
+			return payload, true
+		}
+		p := s.sent[seq%fecHistory]
+		return p.payload, p.payload != nil && p.seq == seq
+	}
+	s.started, s.seen = true, seq
+	if webrtc.PayloadType(payload[0]&0x7f) == s.ulpfec {
+		if s.n == 0 || seq != s.last()+1 {
+			return nil, false
+		}
+		fec := s.packet()
+		s.sent[seq%fecHistory] = fecPacket{seq: seq, payload: fec}
+		s.packets++
+		s.octets += uint32(len(fec))
+		return fec, true
+	}
+	s.add(h, payload)
+	return payload, true
+}
+
+// last is the sequence number of the last packet of the group
+func (s *fecStream) last() uint16 {
+	return s.base + uint16(s.n) - 1
+}
+
+// add XORs a media packet into the group, as the receiver gets it out of
+// its RED payload
+func (s *fecStream) add(h *rtp.Header, payload []byte) {
+	if s.n > 0 && (h.SequenceNumber != s.last()+1 || s.n == fecMaxGroup) {
+		// a gap the track made starting or stopping FEC
+		s.n = 0
+	}
+	media := *h
+	media.PayloadType = payload[0] & 0x7f
+	size := media.MarshalSize()
+	if cap(s.buf) < size {
+		s.buf = make([]byte, size)
+	}
+	s.buf = s.buf[:size]
+	if _, err := media.MarshalTo(s.buf); err != nil {
+		s.n = 0
+		return
+	}
+	s.buf = append(s.buf, payload[1:]...)
+
+	if s.n == 0 {
+		s.base = h.SequenceNumber
+		s.b0, s.b1, s.ts, s.length, s.mask = 0, 0, 0, 0, 0
+		s.payload = s.payload[:0]
+	}
+	s.b0 ^= s.buf[0]
+	s.b1 ^= s.buf[1]
+	s.ts ^= h.Timestamp
+	s.length ^= uint16(len(s.buf) - 12)
+	for len(s.payload) < len(s.buf)-12 {
+		s.payload = append(s.payload, 0)
+	}
+	for i, b := range s.buf[12:] {
+		s.payload[i] ^= b
+	}
+	s.mask |= 0x8000 >> uint(s.n)
+	s.n++
+}
+
+// packet returns the RED payload of the FEC packet of the group, with a
+// FEC header and a level 0 header with the short mask
+func (s *fecStream) packet() []byte {
+	fec := make([]byte, 1+10+4+len(s.payload))
+	fec[0] = uint8(s.ulpfec)
+	f := fec[1:]
+	f[0] = s.b0 & 0x3f // E and L are 0
+	f[1] = s.b1
+	binary.BigEndian.PutUint16(f[2:], s.base)
+	binary.BigEndian.PutUint32(f[4:], s.ts)
+	binary.BigEndian.PutUint16(f[8:], s.length)
+	binary.BigEndian.PutUint16(f[10:], uint16(len(s.payload)))
+	binary.BigEndian.PutUint16(f[12:], s.mask)
+	copy(f[14:], s.payload)
+	s.n = 0
+	return fec
+}
@@ -0,0 +1,192 @@
+package fanout
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	testRED    = 115
+	testULPFEC = 116
+	testH264PT = 102
+)
+
+var testFECCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: testH264PT},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeRED}, PayloadType: testRED},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeULPFEC}, PayloadType: testULPFEC},
+}
+
+// redPacket is a media packet of the group in RED, as the interceptor gets it
+func redPacket(seq uint16, ts uint32, marker bool, payload []byte) (*rtp.Header, []byte) {
+	h := &rtp.Header{Version: 2, Marker: marker, PayloadType: testRED, SequenceNumber: seq, Timestamp: ts, SSRC: 1234}
+	return h, append([]byte{testH264PT}, payload...)
+}
+
+// mediaPacket is a media packet as the receiver gets it out of its RED
+func mediaPacket(h *rtp.Header, red []byte) []byte {
+	media := *h
+	media.PayloadType = red[0] & 0x7f
+	b, err := media.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return append(b, red[1:]...)
+}
+
+// recoverFEC rebuilds the lost packet of a group from the received ones
+// and the RED payload of the FEC packet, like a receiver (RFC 5109 8.2)
+func recoverFEC(t *testing.T, fec []byte, received map[uint16][]byte) (uint16, []byte) {
+	if webrtc.PayloadType(fec[0]&0x7f) != testULPFEC {
+		t.Fatalf("FEC in RED of payload type %d", fec[0]&0x7f)
+	}
+	f := fec[1:]
+	if f[0]&0xc0 != 0 {
+		t.Fatalf("E or L bit set: %#x", f[0])
+	}
+	base := binary.BigEndian.Uint16(f[2:])
+	mask := binary.BigEndian.Uint16(f[12:])
+	b0, b1 := f[0], f[1]
+	ts := binary.BigEndian.Uint32(f[4:])
+	length := binary.BigEndian.Uint16(f[8:])
+	payload := append([]byte(nil), f[14:14+binary.BigEndian.Uint16(f[10:])]...)
+	var lost []uint16
+	for i := uint16(0); i < 16; i++ {
+		if mask&(0x8000>>i) == 0 {
+			continue
+		}
+		p, ok := received[base+i]
+		if !ok {
+			lost = append(lost, base+i)
+			continue
+		}
+		b0 ^= p[0]
+		b1 ^= p[1]
+		ts ^= binary.BigEndian.Uint32(p[4:])
+		length ^= uint16(len(p) - 12)
+		for j, b := range p[12:] {
+			payload[j] ^= b
+		}
+	}
+	if len(lost) != 1 {
+		t.Fatalf("lost %v of the mask %016b", lost, mask)
+	}
+	p := make([]byte, 12, 12+int(length))
+	p[0] = 0x80 | b0&0x3f
+	p[1] = b1
+	binary.BigEndian.PutUint16(p[2:], lost[0])
+	binary.BigEndian.PutUint32(p[4:], ts)
+	binary.BigEndian.PutUint32(p[8:], 1234)
+	return lost[0], append(p, payload[:length]...)
+}
+
+// unbindFEC ends the FEC of a sender like its interceptor
+func unbindFEC(ssrc uint32) {
+	(&fecInterceptor{}).UnbindLocalStream(&interceptor.StreamInfo{SSRC: ssrc})
+}
+
+func TestFECRecovery(t *testing.T) {
+	const ssrc = 4321
+	s := bindFEC(ssrc, testFECCodecs)
+	defer unbindFEC(ssrc)
+	if !SetFEC(ssrc, 34) {
+		t.Fatal("FEC not negotiated")
+	}
+	// a group of 3 packets of different sizes, the last one ends a frame
+	payloads := [][]byte{
+		bytes.Repeat([]byte{0x41}, 100),
+		bytes.Repeat([]byte{0x01, 0xaa}, 300),
+		{0x41, 0x9a},
+	}
+	received := make(map[uint16][]byte)
+	var all [][]byte
+	for i, payload := range payloads {
+		h, red := redPacket(1000+uint16(i), 90000, i == len(payloads)-1, payload)
+		if end := s.protect(h.Marker); end != (i == len(payloads)-1) {
+			t.Errorf("packet %d ends the group: %v", i, end)
+		}
+		out, ok := s.write(h, red)
+		if !ok || !bytes.Equal(out, red) {
+			t.Fatalf("packet %d not sent as it is", i)
+		}
+		received[h.SequenceNumber] = mediaPacket(h, red)
+		all = append(all, received[h.SequenceNumber])
+	}
+	// the empty FEC packet of the track is filled
+	h, _ := redPacket(1003, 90000, false, nil)
+	fec, ok := s.write(h, []byte{testULPFEC})
+	if !ok || len(fec) == 1 {
+		t.Fatal("FEC packet not filled")
+	}
+	if packets, octets := FECStats(ssrc); packets != 1 || octets != uint32(len(fec)) {
+		t.Errorf("FEC stats %d packets, %d octets, want 1 and %d", packets, octets, len(fec))
+	}
+
+	for lost := range payloads {
+		got := make(map[uint16][]byte)
+		for seq, p := range received {
+			if seq != 1000+uint16(lost) {
+				got[seq] = p
+			}
+		}
+		seq, p := recoverFEC(t, fec, got)
+		if seq != 1000+uint16(lost) || !bytes.Equal(p, all[lost]) {
+			t.Errorf("packet %d lost: recovered %d\n% x\nwant\n% x", lost, seq, p, all[lost])
+		}
+	}
+
+	// a retransmission of the FEC packet is the one sent
+	if again, ok := s.write(h, []byte{testULPFEC}); !ok || !bytes.Equal(again, fec) {
+		t.Error("FEC packet retransmitted another way")
+	}
+	// a FEC packet without a group before it isn't sent
+	h, _ = redPacket(1004, 93000, false, nil)
+	if _, ok := s.write(h, []byte{testULPFEC}); ok {
+		t.Error("FEC packet without a group sent")
+	}
+	if packets, _ := FECStats(ssrc); packets != 1 {
+		t.Errorf("%d FEC packets counted, want 1", packets)
+	}
+}
+
+func TestSetFEC(t *testing.T) {
+	const ssrc, plain = 5678, 5679
+	s := bindFEC(ssrc, testFECCodecs)
+	defer unbindFEC(ssrc)
+	for _, c := range []struct {
+		percent, k int
+	}{
+		{0, 0},
+		{100, 1},
+		{50, 2},
+		{34, 3},
+		{25, 4},
+		{10, 10},
+		{5, fecMaxGroup},
+		{1, fecMaxGroup},
+	} {
+		if !SetFEC(ssrc, c.percent) {
+			t.Errorf("%d%%: not negotiated", c.percent)
+		}
+		if s.k != c.k {
+			t.Errorf("%d%%: a FEC packet every %d packets, want %d", c.percent, s.k, c.k)
+		}
+	}
+
+	// a viewer without RED and ULPFEC, its video goes through the
+	// interceptor anyway
+	(&fecInterceptor{}).BindLocalStream(&interceptor.StreamInfo{SSRC: plain, MimeType: webrtc.MimeTypeH264}, nil)
+	defer unbindFEC(plain)
+	bindFEC(plain, testFECCodecs[:1])
+	if SetFEC(plain, 50) {
+		t.Error("FEC set without RED and ULPFEC")
+	}
+	if SetFEC(9999, 50) {
+		t.Error("FEC set for an unknown sender")
+	}
+}
@@ -0,0 +1,566 @@
+// Package fanout implements a local WebRTC track shared by many
+// PeerConnections, the media is packetized once for all of them.
+package fanout
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/nal"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// MTU is the payload size of the packets built from samples
+const MTU = 1200
+
+// The video packets since the last keyframe are kept for the bindings
+// starting in the middle of a GOP, like the GOP cache of the streams
+const (
+	gopMaxBytes = 16 << 20
+	gopMaxAge   = 15 * time.Second
+	gopStale    = 2 * time.Second // without packets, the source went quiet
+)
+
+// Level is how much of the video a binding gets. A congested viewer drops
+// the frames no other frame depends on first, then all but the keyframes.
+type Level int
+
+const (
+	Full      Level = iota // every frame
+	Reference              // no H264 non-reference frames (NRI 0)
+	KeyOnly                // the keyframes
+)
+
+func (l Level) String() string {
+	switch l {
+	case Full:
+		return "full"
+	case Reference:
+		return "reference"
+	case KeyOnly:
+		return "keyframes"
+	}
+	return "unknown"
+}
+
+// Track is a webrtc.TrackLocal that can be added to any number of
+// PeerConnections. A PeerConnection gets the packets from the first
+// keyframe after it bound the track on, the decoder of a viewer joining
+// in the middle of a GOP would only show garbage until then. Prefill
+// starts it right away with the packets since the last keyframe.
+//
+// The RTP timestamps follow the wall clock, the RTCP sender reports of
+// tracks sharing a clock let browsers play them in sync.
+type Track struct {
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecCapability
+	kind     webrtc.RTPCodecType
+	base     uint32 // RTP timestamp of the Unix epoch
+
+	mu         sync.Mutex
+	packetizer rtp.Packetizer // nil for tracks written with WriteRTP
+	clockRate  float64
+	bindings   []*binding
+	header     rtp.Header // of the packet being written, reused for every binding
+
+	// the packets with the timestamp of the last keyframe belong to it
+	h264   bool
+	keyTS  uint32
+	inKey  bool
+	octets [KeyOnly + 1]uint64 // written by the lowest level getting them
+	red    []byte              // RED payload of the packet being written
+
+	// the video packets since the last keyframe
+	gop      []kept
+	gopBytes int
+	gopStart time.Time // arrival of the keyframe
+	gopLast  time.Time // arrival of the last packet
+}
+
+// kept is a packet of the GOP with the lowest level getting it
+type kept struct {
+	p     *rtp.Packet
+	key   bool
+	level Level
+}
+
+type binding struct {
+	id      string
+	ssrc    webrtc.SSRC
+	pt      webrtc.PayloadType
+	w       webrtc.TrackLocalWriter
+	started bool
+	packets uint32
+	octets  uint32
+	errors  uint32 // packets the writer refused
+
+	// the packets of a sender switching tracks go on from its last ones,
+	// the offsets are added to the sequence numbers and timestamps
+	from *handoff
+	seq  uint16
+	ts   uint32
+	last handoff
+
+	// the dropped packets are left out of the numbering, a binding going
+	// back from KeyOnly waits for a keyframe
+	level   Level
+	next    Level
+	upgrade bool
+
+	fec *fecStream // of the sender, see fec.go
+}
+
+// handoff is where a sender left a track
+type handoff struct {
+	seq uint16 // last sequence number sent
+	ts  uint32 // last timestamp sent
+	at  time.Time
+}
+
+// handoffTTL is how long the position of a sender is kept after it
+// unbound a track, a track switch binds the new one right away
+const handoffTTL = time.Minute
+
+// handoffs are the positions of the senders that unbound a track by
+// binding id. A RTPSender.ReplaceTrack keeps the id, the new track goes on
+// with its sequence numbers so the SRTP replay protection of the receiver
+// doesn't drop the packets, and with its timestamps for the jitter buffer.
+var handoffs = struct {
+	sync.Mutex
+	m map[string]handoff
+}{m: make(map[string]handoff)}
+
+// New creates a track, samples are split by the payloader. With a nil
+// payloader only WriteRTP can be used.
+func New(c webrtc.RTPCodecCapability, payloader rtp.Payloader, id, streamID string) *Track {
+	t := &Track{
+		id:        id,
+		streamID:  streamID,
+		codec:     c,
+		kind:      webrtc.RTPCodecTypeAudio,
+		base:      rand.Uint32(),
+		clockRate: float64(c.ClockRate),
+	}
+	if strings.HasPrefix(strings.ToLower(c.MimeType), "video/") {
+		t.kind = webrtc.RTPCodecTypeVideo
+	}
+	t.h264 = strings.EqualFold(c.MimeType, webrtc.MimeTypeH264)
+	if payloader != nil {
+		// payload type and SSRC are set for every binding
+		t.packetizer = rtp.NewPacketizer(MTU, 0, 0, payloader, rtp.NewRandomSequencer(), c.ClockRate)
+	}
+	return t
+}
+
+// Bind is called by a PeerConnection when the track is negotiated
+func (t *Track) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := t.match(ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		bindFEC(ctx.SSRC(), ctx.CodecParameters())
+	}
+	t.bind(ctx.ID(), ctx.SSRC(), codec.PayloadType, ctx.WriteStream())
+	return codec, nil
+}
+
+func (t *Track) bind(id string, ssrc webrtc.SSRC, pt webrtc.PayloadType, w webrtc.TrackLocalWriter) {
+	b := &binding{
+		id:   id,
+		ssrc: ssrc,
+		pt:   pt,
+		w:    w,
+	}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		b.fec = lookupFEC(ssrc)
+	}
+	handoffs.Lock()
+	if h, ok := handoffs.m[id]; ok {
+		b.from = &h
+		delete(handoffs.m, id)
+	}
+	handoffs.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bindings = append(t.bindings, b)
+}
+
+// match picks the negotiated codec of the track. H.264 needs the
+// non-interleaved packetization mode of the payloader, and a profile able
+// to decode the one of the track when it has a profile-level-id.
+func (t *Track) match(codecs []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	h264 := strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeH264)
+	profile := nal.H264ProfileUnknown
+	if plid, ok := FmtpParameter(t.codec.SDPFmtpLine, "profile-level-id"); h264 && ok {
+		profile, _, _ = nal.ParseProfileLevelID(plid)
+	}
+	var res webrtc.RTPCodecParameters
+	rank := 0 // 1 other packetization mode, 2 compatible profile, 3 same profile
+	for _, c := range codecs {
+		if !strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			continue
+		}
+		if !h264 {
+			return c, true
+		}
+		r := 1
+		if mode, _ := FmtpParameter(c.SDPFmtpLine, "packetization-mode"); mode == "1" {
+			r = 3
+			if profile != nal.H264ProfileUnknown {
+				plid, _ := FmtpParameter(c.SDPFmtpLine, "profile-level-id")
+				p, _, err := nal.ParseProfileLevelID(plid)
+				switch {
+				case err != nil || !p.Decodes(profile):
+					continue
+				case p != profile:
+					r = 2
+				}
+			}
+		} else if profile != nal.H264ProfileUnknown {
+			continue
+		}
+		if r > rank {
+			res, rank = c, r
+		}
+	}
+	return res, rank > 0
+}
+
+// FmtpParameter returns a parameter of a SDP fmtp line
+func FmtpParameter(line, key string) (string, bool) {
+	for _, p := range strings.Split(line, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Unbind is called by a PeerConnection when the track is removed or the
+// connection is closed
+func (t *Track) Unbind(ctx webrtc.TrackLocalContext) error {
+	return t.unbind(ctx.ID())
+}
+
+func (t *Track) unbind(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, b := range t.bindings {
+		if b.id == id {
+			t.bindings = append(t.bindings[:i], t.bindings[i+1:]...)
+			if b.packets > 0 {
+				b.handoff()
+			}
+			return nil
+		}
+	}
+	return webrtc.ErrUnbindFailed
+}
+
+// handoff keeps the position of the binding for the next track of its
+// sender
+func (b *binding) handoff() {
+	now := time.Now()
+	handoffs.Lock()
+	defer handoffs.Unlock()
+	for id, h := range handoffs.m {
+		if now.Sub(h.at) > handoffTTL {
+			delete(handoffs.m, id)
+		}
+	}
+	h := b.last
+	h.at = now
+	handoffs.m[b.id] = h
+}
+
+// resume sets the offsets of a binding starting with the packet, the
+// timestamps go on with the time elapsed since the last packet
+func (b *binding) resume(p *rtp.Header, clockRate float64) {
+	if b.from == nil {
+		return
+	}
+	b.seq = b.from.seq + 1 - p.SequenceNumber
+	b.ts = b.from.ts + uint32(time.Since(b.from.at).Seconds()*clockRate) - p.Timestamp
+	b.from = nil
+}
+
+// ID is the track id in the SDP
+func (t *Track) ID() string { return t.id }
+
+// RID is empty, there is no simulcast
+func (t *Track) RID() string { return "" }
+
+// StreamID is the MediaStream id in the SDP
+func (t *Track) StreamID() string { return t.streamID }
+
+// Kind is audio or video by the mime type
+func (t *Track) Kind() webrtc.RTPCodecType { return t.kind }
+
+// Codec returns the codec capability the track was created with
+func (t *Track) Codec() webrtc.RTPCodecCapability { return t.codec }
+
+// Bindings returns the number of PeerConnections of the track
+func (t *Track) Bindings() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.bindings)
+}
+
+// WriteSample packetizes a sample once and sends it to every binding,
+// key tells whether a binding can start with it. The RTP timestamp is the
+// one of the sample Timestamp, without one the durations add up.
+func (t *Track) WriteSample(s media.Sample, key bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.packetizer == nil {
+		return nil
+	}
+	samples := uint32(s.Duration.Seconds() * t.clockRate)
+	if len(t.bindings) == 0 && t.kind == webrtc.RTPCodecTypeAudio {
+		// nobody to send to, only the clock goes on. The video is kept
+		// for the next bindings.
+		t.packetizer.SkipSamples(samples)
+		return nil
+	}
+	for i, p := range t.packetizer.Packetize(s.Data, samples) {
+		if !s.Timestamp.IsZero() {
+			p.Timestamp = t.RTPTime(s.Timestamp)
+		}
+		t.write(p, key && i == 0)
+	}
+	return nil
+}
+
+// RTPTime returns the RTP timestamp of a wall clock time
+func (t *Track) RTPTime(w time.Time) uint32 {
+	rate := uint64(t.codec.ClockRate)
+	return t.base + uint32(uint64(w.Unix())*rate+uint64(w.Nanosecond())*rate/uint64(time.Second))
+}
+
+// SenderReport returns the RTCP sender report of the binding with the
+// SSRC, false before it sent packets
+func (t *Track) SenderReport(ssrc uint32, now time.Time) (*rtcp.SenderReport, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if uint32(b.ssrc) != ssrc || b.packets == 0 {
+			continue
+		}
+		return &rtcp.SenderReport{
+			SSRC:        ssrc,
+			NTPTime:     ntpTime(now),
+			RTPTime:     t.RTPTime(now) + b.ts,
+			PacketCount: b.packets,
+			OctetCount:  b.octets,
+		}, true
+	}
+	return nil, false
+}
+
+// ntpEpoch is the NTP time 0
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func ntpTime(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// SetLevel sets the level of the binding with the SSRC, false without it
+func (t *Track) SetLevel(ssrc webrtc.SSRC, l Level) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if b.ssrc != ssrc {
+			continue
+		}
+		if b.level == KeyOnly && l < KeyOnly {
+			// the frames since the last keyframe are missing
+			b.next, b.upgrade = l, true
+		} else {
+			b.level, b.upgrade = l, false
+		}
+		return true
+	}
+	return false
+}
+
+// Errors returns the packets the writer of the binding with the SSRC
+// refused, e.g. bigger than the buffers of the interceptors
+func (t *Track) Errors(ssrc webrtc.SSRC) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if b.ssrc == ssrc {
+			return b.errors
+		}
+	}
+	return 0
+}
+
+// Octets returns the payload octets written to the track by the lowest
+// level getting them, a binding at a level gets the sum of the levels from
+// it up
+func (t *Track) Octets() [KeyOnly + 1]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.octets
+}
+
+// classify returns the lowest level getting the packet
+func (t *Track) classify(p *rtp.Packet, key bool) Level {
+	switch {
+	case key:
+		t.keyTS, t.inKey = p.Timestamp, true
+		return KeyOnly
+	case t.inKey && p.Timestamp == t.keyTS:
+		return KeyOnly
+	}
+	t.inKey = false
+	switch {
+	case t.kind == webrtc.RTPCodecTypeAudio:
+		return KeyOnly
+	case t.h264 && len(p.Payload) > 0 && p.Payload[0]&0x60 == 0:
+		// NRI of the NAL unit, or of the FU-A and STAP-A carrying it
+		return Full
+	}
+	return Reference
+}
+
+// WriteRTP sends a packet to every binding, key tells whether a binding
+// can start with it. Sequence numbers and timestamps are kept.
+func (t *Track) WriteRTP(p *rtp.Packet, key bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.write(p, key)
+	return nil
+}
+
+// write is called with the lock held. A failed binding is closed by its
+// PeerConnection, the others go on.
+func (t *Track) write(p *rtp.Packet, key bool) {
+	// a keyframe can take several samples with the same timestamp
+	first := key && !(t.inKey && p.Timestamp == t.keyTS)
+	l := t.classify(p, key)
+	t.octets[l] += uint64(len(p.Payload))
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		t.keep(p, key, first, l)
+	}
+	for _, b := range t.bindings {
+		if !b.started {
+			// audio has no keyframes
+			if !key && t.kind != webrtc.RTPCodecTypeAudio {
+				continue
+			}
+			b.started = true
+			b.resume(&p.Header, t.clockRate)
+		}
+		t.send(b, p, key, l)
+	}
+}
+
+// send writes a packet to a binding, with the lock held
+func (t *Track) send(b *binding, p *rtp.Packet, key bool, l Level) {
+	if key && b.upgrade {
+		b.level, b.upgrade = b.next, false
+	}
+	if l < b.level {
+		// the next packets are numbered on
+		b.seq--
+		return
+	}
+	t.header = p.Header
+	t.header.SSRC = uint32(b.ssrc)
+	t.header.PayloadType = uint8(b.pt)
+	t.header.SequenceNumber += b.seq
+	t.header.Timestamp += b.ts
+	payload := p.Payload
+	red, ulpfec, protected := b.fec.params()
+	if protected {
+		t.header.PayloadType = uint8(red)
+		t.red = append(append(t.red[:0], uint8(b.pt)), p.Payload...)
+		payload = t.red
+	}
+	if _, err := b.w.WriteRTP(&t.header, payload); err == nil {
+		b.packets++
+		b.octets += uint32(len(p.Payload))
+		b.last.seq = t.header.SequenceNumber
+		b.last.ts = t.header.Timestamp
+	} else {
+		b.errors++
+	}
+	if protected && b.fec.protect(p.Marker) {
+		// the FEC packet is numbered with the media
+		b.seq++
+		t.header.SequenceNumber++
+		t.header.Marker = false
+		t.red = append(t.red[:0], uint8(ulpfec))
+		if _, err := b.w.WriteRTP(&t.header, t.red); err == nil {
+			b.last.seq = t.header.SequenceNumber
+		}
+	}
+}
+
+// keep adds a video packet to the packets since the last keyframe, first
+// tells whether it starts a new one
+func (t *Track) keep(p *rtp.Packet, key, first bool, l Level) {
+	now := time.Now()
+	if first {
+		t.resetGOP()
+		t.gopStart = now
+	} else if len(t.gop) == 0 {
+		// nothing useful until the next keyframe
+		return
+	}
+	if t.gopBytes+len(p.Payload) > gopMaxBytes || now.Sub(t.gopStart) > gopMaxAge {
+		// too long GOP, a partial one can't be decoded
+		t.resetGOP()
+		return
+	}
+	t.gop = append(t.gop, kept{p: p, key: key, level: l})
+	t.gopBytes += len(p.Payload)
+	t.gopLast = now
+}
+
+func (t *Track) resetGOP() {
+	for i := range t.gop {
+		t.gop[i] = kept{}
+	}
+	t.gop = t.gop[:0]
+	t.gopBytes = 0
+}
+
+// Prefill starts the binding with the SSRC with the packets since the last
+// keyframe, the viewer doesn't wait for the next one. It returns the number
+// of packets sent, none when the binding already started or there is no
+// recent keyframe. The packets are sent at once, the SRTP session of the
+// binding has to be up.
+func (t *Track) Prefill(ssrc webrtc.SSRC) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.gop) == 0 || time.Since(t.gopLast) > gopStale {
+		return 0
+	}
+	for _, b := range t.bindings {
+		if b.ssrc != ssrc || b.started {
+			continue
+		}
+		b.started = true
+		b.resume(&t.gop[0].p.Header, t.clockRate)
+		for _, k := range t.gop {
+			t.send(b, k.p, k.key, k.level)
+		}
+		return len(t.gop)
+	}
+	return 0
+}
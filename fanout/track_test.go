@@ -0,0 +1,392 @@
+package fanout
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// discard stands in for the SRTP stream of a PeerConnection
+type discard struct {
+	packets     int
+	first, last uint16 // sequence numbers
+	buf         []byte
+}
+
+func (d *discard) WriteRTP(h *rtp.Header, payload []byte) (int, error) {
+	// a PeerConnection marshals every packet before encrypting it
+	b, err := h.MarshalTo(d.buf[:cap(d.buf)])
+	if err != nil {
+		return 0, err
+	}
+	if d.packets == 0 {
+		d.first = h.SequenceNumber
+	}
+	d.last = h.SequenceNumber
+	d.packets++
+	return b + len(payload), nil
+}
+
+func (d *discard) Write(b []byte) (int, error) { return len(b), nil }
+
+func newDiscard() *discard {
+	return &discard{buf: make([]byte, 0, 1500)}
+}
+
+var h264 = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+
+// frame is an Annex B access unit of a 4 Mbit/s 25 fps camera
+func frame(key bool) []byte {
+	b := make([]byte, 20000)
+	rand.Read(b)
+	copy(b, []byte{0, 0, 0, 1, 0x41})
+	if key {
+		b[4] = 0x65
+	}
+	// no start code in the slice data
+	for i := 5; i < len(b); i++ {
+		if b[i] < 4 {
+			b[i] = 4
+		}
+	}
+	return b
+}
+
+func TestGating(t *testing.T) {
+	tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+	early, late := newDiscard(), newDiscard()
+	tr.bind("early", 1, 102, early)
+	if err := tr.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true); err != nil {
+		t.Fatal(err)
+	}
+	tr.bind("late", 2, 102, late)
+	tr.WriteSample(media.Sample{Data: frame(false), Duration: 40 * time.Millisecond}, false)
+	if early.packets == 0 || late.packets != 0 {
+		t.Fatalf("before the keyframe early %d late %d packets", early.packets, late.packets)
+	}
+	tr.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+	if late.packets == 0 {
+		t.Fatal("late binding didn't start with the keyframe")
+	}
+}
+
+// a binding in the middle of a GOP starts with the packets since the
+// keyframe and goes on with the next ones
+func TestPrefill(t *testing.T) {
+	tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+	sample := func(key bool) {
+		tr.WriteSample(media.Sample{Data: frame(key), Duration: 40 * time.Millisecond}, key)
+	}
+	sample(false)
+	late := newDiscard()
+	tr.bind("late", 1, 102, late)
+	if n := tr.Prefill(1); n != 0 {
+		t.Fatalf("%d packets prefilled without a keyframe", n)
+	}
+	sample(true)
+	sample(false)
+	early := newDiscard()
+	tr.bind("early", 2, 102, early)
+	sample(false)
+	if early.packets != 0 {
+		t.Fatal("binding started before the keyframe or the prefill")
+	}
+	n := tr.Prefill(2)
+	if n == 0 || early.packets != n || early.packets != late.packets {
+		t.Fatalf("%d packets prefilled, %d sent, %d since the keyframe", n, early.packets, late.packets)
+	}
+	if tr.Prefill(2) != 0 || tr.Prefill(1) != 0 {
+		t.Fatal("started binding prefilled")
+	}
+	sample(false)
+	if early.packets != late.packets || int(early.last-early.first)+1 != early.packets {
+		t.Fatalf("%d packets numbered from %d to %d after the prefill", early.packets, early.first, early.last)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	a := New(h264, &codecs.H264Payloader{}, "video", "a")
+	b := New(h264, &codecs.H264Payloader{}, "video", "b")
+	before, after := newDiscard(), newDiscard()
+	a.bind("sender", 1, 102, before)
+	a.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+	b.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+
+	// RTPSender.ReplaceTrack
+	if err := a.unbind("sender"); err != nil {
+		t.Fatal(err)
+	}
+	b.bind("sender", 1, 102, after)
+	b.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+	if after.packets == 0 || after.first != before.last+1 {
+		t.Fatalf("switched track starts with sequence number %d after %d", after.first, before.last)
+	}
+}
+
+// refuse is a writer failing like the NACK interceptor of pion with
+// packets bigger than its buffers
+type refuse struct{}
+
+func (refuse) WriteRTP(h *rtp.Header, payload []byte) (int, error) { return 0, io.ErrShortBuffer }
+func (refuse) Write(b []byte) (int, error)                         { return 0, io.ErrShortBuffer }
+
+// the packets a writer refuses are counted by binding
+func TestErrors(t *testing.T) {
+	tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+	ok := newDiscard()
+	tr.bind("ok", 1, 102, ok)
+	tr.bind("refuse", 2, 102, refuse{})
+	tr.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+	if n := tr.Errors(2); n == 0 || int(n) != ok.packets {
+		t.Errorf("%d errors, want %d", n, ok.packets)
+	}
+	if n := tr.Errors(1); n != 0 {
+		t.Errorf("%d errors of the binding taking the packets", n)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+	full, reference, keys := newDiscard(), newDiscard(), newDiscard()
+	tr.bind("full", 1, 102, full)
+	tr.bind("reference", 2, 102, reference)
+	tr.bind("keys", 3, 102, keys)
+	tr.SetLevel(2, Reference)
+	tr.SetLevel(3, KeyOnly)
+
+	nonReference := frame(false)
+	nonReference[4] = 0x01 // NRI 0
+	sample := func(b []byte) media.Sample {
+		return media.Sample{Data: b, Duration: 40 * time.Millisecond}
+	}
+	tr.WriteSample(sample(frame(true)), true)
+	key := keys.packets
+	tr.WriteSample(sample(nonReference), false)
+	tr.WriteSample(sample(frame(false)), false)
+	if full.packets != 3*key || reference.packets != 2*key || keys.packets != key {
+		t.Fatalf("full %d reference %d keys %d packets, %d per frame", full.packets, reference.packets, keys.packets, key)
+	}
+
+	// back to full from the next keyframe, without gaps in the numbering
+	tr.SetLevel(3, Full)
+	tr.WriteSample(sample(nonReference), false)
+	if keys.packets != key {
+		t.Fatal("KeyOnly binding went back to full before a keyframe")
+	}
+	tr.WriteSample(sample(frame(true)), true)
+	tr.WriteSample(sample(nonReference), false)
+	for _, d := range []*discard{full, reference, keys} {
+		if int(d.last-d.first)+1 != d.packets {
+			t.Fatalf("%d packets numbered from %d to %d", d.packets, d.first, d.last)
+		}
+	}
+	if keys.packets != 3*key {
+		t.Fatalf("keys %d packets after the keyframe, %d per frame", keys.packets, key)
+	}
+}
+
+// extender adds a header extension to the packets of a track, like the
+// interceptors adding the transport-wide sequence numbers before the FEC
+type extender struct {
+	w interceptor.RTPWriter
+}
+
+func (e extender) WriteRTP(h *rtp.Header, payload []byte) (int, error) {
+	if err := h.SetExtension(1, []byte{byte(h.SequenceNumber)}); err != nil {
+		return 0, err
+	}
+	return e.w.Write(h, payload, nil)
+}
+
+func (e extender) Write(b []byte) (int, error) { return len(b), nil }
+
+// unRED returns a packet sent in RED as the receiver gets it out of it
+func unRED(t *testing.T, b []byte) []byte {
+	var p rtp.Packet
+	if err := p.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	p.PayloadType = p.Payload[0] & 0x7f
+	p.Payload = p.Payload[1:]
+	media, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return media
+}
+
+func TestFEC(t *testing.T) {
+	const ssrc = 7
+	bindFEC(ssrc, []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeRED}, PayloadType: 115},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeULPFEC}, PayloadType: 116},
+	})
+	i, _ := FECInterceptorFactory{}.NewInterceptor("")
+	info := &interceptor.StreamInfo{SSRC: ssrc, MimeType: webrtc.MimeTypeH264}
+	defer i.UnbindLocalStream(info)
+	var sent [][]byte
+	w := i.BindLocalStream(info, interceptor.RTPWriterFunc(func(h *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		b, err := h.Marshal()
+		sent = append(sent, append(b, payload...))
+		return len(b) + len(payload), err
+	}))
+	if !SetFEC(ssrc, 34) {
+		t.Fatal("RED and ULPFEC not negotiated")
+	}
+
+	tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+	tr.bind("fec", ssrc, 102, extender{w})
+	tr.WriteSample(media.Sample{Data: frame(true), Duration: 40 * time.Millisecond}, true)
+
+	// recover the first packet of every group from the others and the FEC
+	media := make(map[uint16][]byte)
+	groups := 0
+	for n, b := range sent {
+		seq := binary.BigEndian.Uint16(b[2:])
+		if n > 0 && seq != binary.BigEndian.Uint16(sent[n-1][2:])+1 {
+			t.Fatalf("packet %d numbered %d", n, seq)
+		}
+		m := unRED(t, b)
+		if m[1]&0x7f == 102 {
+			media[seq] = m
+			continue
+		}
+		groups++
+		var p rtp.Packet
+		if err := p.Unmarshal(m); err != nil {
+			t.Fatal(err)
+		}
+		f := p.Payload
+		base, mask := binary.BigEndian.Uint16(f[2:]), binary.BigEndian.Uint16(f[12:])
+		b0, b1 := f[0], f[1]
+		ts, length := binary.BigEndian.Uint32(f[4:]), binary.BigEndian.Uint16(f[8:])
+		payload := append([]byte(nil), f[14:]...)
+		for k := 1; k < 16; k++ {
+			if mask&(0x8000>>uint(k)) == 0 {
+				continue
+			}
+			m := media[base+uint16(k)]
+			b0, b1 = b0^m[0], b1^m[1]
+			ts ^= binary.BigEndian.Uint32(m[4:])
+			length ^= uint16(len(m) - 12)
+			for j, c := range m[12:] {
+				payload[j] ^= c
+			}
+		}
+		recovered := make([]byte, 12+int(length))
+		recovered[0], recovered[1] = 0x80|b0&0x3f, b1
+		binary.BigEndian.PutUint16(recovered[2:], base)
+		binary.BigEndian.PutUint32(recovered[4:], ts)
+		binary.BigEndian.PutUint32(recovered[8:], ssrc)
+		copy(recovered[12:], payload)
+		if !bytes.Equal(recovered, media[base]) {
+			t.Fatalf("packet %d not recovered from the FEC packet %d", base, seq)
+		}
+	}
+	if groups == 0 || groups < len(media)/3 {
+		t.Fatalf("%d FEC packets for %d packets", groups, len(media))
+	}
+	if packets, octets := FECStats(ssrc); int(packets) != groups || octets == 0 {
+		t.Fatalf("FEC stats %d packets %d octets, %d sent", packets, octets, groups)
+	}
+}
+
+// BenchmarkViewers compares one track per viewer, every viewer packetizing
+// every frame, with one track shared by all the viewers. The ns/op is the
+// cost of sending one frame to all the viewers.
+func BenchmarkViewers(b *testing.B) {
+	key, delta := frame(true), frame(false)
+	sample := func(i int) (media.Sample, bool) {
+		if i%50 == 0 {
+			return media.Sample{Data: key, Duration: 40 * time.Millisecond}, true
+		}
+		return media.Sample{Data: delta, Duration: 40 * time.Millisecond}, false
+	}
+	for _, viewers := range []int{1, 5, 20, 50} {
+		b.Run(fmt.Sprintf("PerViewer/%d", viewers), func(b *testing.B) {
+			tracks := make([]*Track, viewers)
+			for i := range tracks {
+				tracks[i] = New(h264, &codecs.H264Payloader{}, "video", "stream")
+				tracks[i].bind("pc", webrtc.SSRC(i), 102, newDiscard())
+			}
+			b.SetBytes(int64(len(delta)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s, k := sample(i)
+				for _, tr := range tracks {
+					tr.WriteSample(s, k)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Shared/%d", viewers), func(b *testing.B) {
+			tr := New(h264, &codecs.H264Payloader{}, "video", "stream")
+			for i := 0; i < viewers; i++ {
+				tr.bind(fmt.Sprint("pc", i), webrtc.SSRC(i), 102, newDiscard())
+			}
+			b.SetBytes(int64(len(delta)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s, k := sample(i)
+				tr.WriteSample(s, k)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	format := func(pt webrtc.PayloadType, mime, fmtp string) webrtc.RTPCodecParameters {
+		return webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mime, ClockRate: 90000, SDPFmtpLine: fmtp},
+			PayloadType:        pt,
+		}
+	}
+	var (
+		cb       = format(102, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f")
+		cbMode0  = format(103, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f")
+		main     = format(104, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f")
+		high     = format(106, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f")
+		high444  = format(112, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=f4001f")
+		noLevel  = format(108, webrtc.MimeTypeH264, "packetization-mode=1")
+		vp8      = format(96, webrtc.MimeTypeVP8, "")
+		vp8Other = format(97, webrtc.MimeTypeVP8, "")
+	)
+	for _, c := range []struct {
+		name   string
+		track  webrtc.RTPCodecCapability
+		codecs []webrtc.RTPCodecParameters
+		want   webrtc.PayloadType // 0 without a match
+	}{
+		{"same profile before a superset", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: "packetization-mode=1;profile-level-id=4d001f"},
+			[]webrtc.RTPCodecParameters{cb, high444, high, main}, 104},
+		{"superset of the profile", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: "packetization-mode=1;profile-level-id=4d001f"},
+			[]webrtc.RTPCodecParameters{cb, high444, high}, 112},
+		{"no decoder of the profile", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: "packetization-mode=1;profile-level-id=640028"},
+			[]webrtc.RTPCodecParameters{cb, main}, 0},
+		{"packetization-mode 0", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: "packetization-mode=1;profile-level-id=42e01f"},
+			[]webrtc.RTPCodecParameters{cbMode0}, 0},
+		{"mode 1 before mode 0", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+			[]webrtc.RTPCodecParameters{cbMode0, noLevel}, 108},
+		{"no profile on the track", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+			[]webrtc.RTPCodecParameters{cbMode0}, 103},
+		{"other codecs take the first one", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+			[]webrtc.RTPCodecParameters{cb, vp8, vp8Other}, 96},
+		{"codec not negotiated", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9},
+			[]webrtc.RTPCodecParameters{cb, vp8}, 0},
+	} {
+		tr := New(c.track, &codecs.H264Payloader{}, "video", "stream")
+		got, ok := tr.match(c.codecs)
+		if ok != (c.want != 0) || got.PayloadType != c.want {
+			t.Errorf("%s: payload type %d (%v), want %d", c.name, got.PayloadType, ok, c.want)
+		}
+	}
+}
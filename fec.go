@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/webrtc/v3"
+)
+
+// The video of a WebRTC viewer can be protected with ULPFEC in RED when
+// the browser negotiated them, see fanout/fec.go. The redundancy is the
+// "fec" of the stream in the config, the client changes it on the control
+// channel. A FEC packet follows every 100/fec video packets.
+
+// maxFEC is the redundancy of a FEC packet for every video packet
+const maxFEC = 100
+
+// protect sets the redundancy of the video senders, new ones after a track
+// switch too. It tells whether the viewer negotiated the FEC.
+func (s *WebRTCStreamer) protect() bool {
+	negotiated := false
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		params := sender.GetParameters()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo || len(params.Encodings) == 0 {
+			continue
+		}
+		if fanout.SetFEC(params.Encodings[0].SSRC, s.fec) {
+			negotiated = true
+		}
+	}
+	return negotiated
+}
+
+// setFEC applies a redundancy request of the client
+func (s *WebRTCStreamer) setFEC(percent int) error {
+	if percent < 0 || percent > maxFEC {
+		return fmt.Errorf("WebRTC FEC %d%% out of 0..%d", percent, maxFEC)
+	}
+	previous := s.fec
+	s.fec = percent
+	if !s.protect() && percent > 0 {
+		s.fec = previous
+		return errors.New("WebRTC FEC not negotiated by the browser")
+	}
+	return nil
+}
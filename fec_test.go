@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// testFECRequest sends a redundancy request on the control channel, it
+// returns the error of the reply or the redundancy of the stats
+func testFECRequest(t *testing.T, d *webrtc.DataChannel, messages chan controlMessage, percent int) (string, int) {
+	testControl(t, d, controlMessage{Type: "fec", FEC: percent})
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-messages:
+			switch {
+			case m.Type == "fec":
+				return m.Error, -1
+			case m.Type == "stats" && m.Stats != nil:
+				return "", m.Stats.FEC
+			}
+		case <-timeout:
+			t.Fatal("no reply to the FEC request")
+		}
+	}
+}
+
+func TestSetFEC(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "fec-test"
+	s := testStream(t, suuid, []av.CodecData{testH264(t)})
+	s.FEC = 20
+	Config.mutex.Lock()
+	Config.Streams[suuid] = s
+	Config.mutex.Unlock()
+
+	red := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: fanout.MimeTypeRED, ClockRate: 90000},
+		PayloadType:        115,
+	}
+	for _, c := range []struct {
+		name       string
+		negotiated bool
+		codecs     []webrtc.RTPCodecParameters
+	}{
+		{"without RED", false, nil},
+		{"with RED and ULPFEC", true, []webrtc.RTPCodecParameters{red}},
+	} {
+		_, d, messages, _ := testControlViewer(t, suuid, c.codecs...)
+		testControlWait(t, messages, "state")
+		for _, r := range []struct {
+			percent int
+			failed  bool
+			fec     int // of the stats after the request
+		}{
+			{-1, true, 20},
+			{101, true, 20},
+			{50, !c.negotiated, 50},
+			{100, !c.negotiated, 100},
+			{0, false, 0},
+		} {
+			failed, fec := testFECRequest(t, d, messages, r.percent)
+			if (failed != "") != r.failed {
+				t.Errorf("%s: %d%%: error %q", c.name, r.percent, failed)
+			}
+			if failed != "" {
+				// rolled back
+				testControl(t, d, controlMessage{Type: "unmute"})
+				fec = testControlWait(t, messages, "stats").Stats.FEC
+				if fec != 20 {
+					t.Errorf("%s: %d%% refused, the redundancy is %d%%, want 20%%", c.name, r.percent, fec)
+				}
+				continue
+			}
+			if fec != r.fec {
+				t.Errorf("%s: %d%%: redundancy %d%%, want %d%%", c.name, r.percent, fec, r.fec)
+			}
+		}
+	}
+}
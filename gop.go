@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+const (
+	gopCacheMaxPackets = 1024
+	gopCacheMaxBytes   = 16 << 20
+	gopCacheMaxAge     = 15 * time.Second
+)
+
+// gopCache keeps the packets of a stream since its last keyframe, so a new
+// viewer can start decoding right away instead of waiting for the next one.
+// It is only accessed with the ConfigST lock held.
+type gopCache struct {
+	pkts  []av.Packet
+	bytes int
+	start time.Time // arrival of the keyframe
+	last  time.Time // arrival of the last packet
+
+	// stats
+	viewers int64 // viewers started from the cache
+	served  int64 // packets served from the cache
+}
+
+func newGOPCache() *gopCache {
+	return &gopCache{}
+}
+
+func (g *gopCache) push(pck av.Packet) {
+	now := time.Now()
+	if pck.IsKeyFrame {
+		g.reset()
+		g.start = now
+	} else if len(g.pkts) == 0 {
+		// nothing useful until the next keyframe
+		return
+	}
+	if len(g.pkts) >= gopCacheMaxPackets || g.bytes+len(pck.Data) > gopCacheMaxBytes || now.Sub(g.start) > gopCacheMaxAge {
+		// too long GOP, a partial one can't be decoded
+		g.reset()
+		return
+	}
+	g.pkts = append(g.pkts, pck)
+	g.bytes += len(pck.Data)
+	g.last = now
+}
+
+func (g *gopCache) reset() {
+	for i := range g.pkts {
+		g.pkts[i] = av.Packet{}
+	}
+	g.pkts = g.pkts[:0]
+	g.bytes = 0
+}
+
+// snapshot returns the cached packets, none when the source went quiet
+func (g *gopCache) snapshot() []av.Packet {
+	if len(g.pkts) == 0 || time.Since(g.last) > 2*time.Second {
+		return nil
+	}
+	res := make([]av.Packet, len(g.pkts))
+	copy(res, g.pkts)
+	return res
+}
+
+// catchUp rewrites a packet served from the cache for outputs that pace
+// by packet duration: video is sent as fast as possible, so the viewer
+// reaches live quickly, and audio is dropped as it can't be played faster.
+func catchUp(pck *av.Packet, codecs []av.CodecData) bool {
+	if int(pck.Idx) < len(codecs) && codecs[pck.Idx].Type().IsAudio() {
+		return false
+	}
+	pck.Duration = time.Millisecond
+	return true
+}
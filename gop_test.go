@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+)
+
+// testPackets are the packets of a pattern, K a keyframe, P another video
+// frame and A audio. Their Time is their index.
+func testPackets(pattern string, size int) []av.Packet {
+	pkts := make([]av.Packet, len(pattern))
+	for i, c := range pattern {
+		pkts[i] = av.Packet{IsKeyFrame: c == 'K', Data: make([]byte, size), Time: time.Duration(i)}
+		if c == 'A' {
+			pkts[i].Idx = 1
+		}
+	}
+	return pkts
+}
+
+func TestGOPCache(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		pattern string
+		size    int
+		age     time.Duration // of the GOP before the last packet
+		cached  []time.Duration
+	}{
+		{"empty", "", 10, 0, nil},
+		{"no keyframe yet", "PPAP", 10, 0, nil},
+		{"from the keyframe", "PPKPAP", 10, 0, []time.Duration{2, 3, 4, 5}},
+		{"reset on keyframe", "KPPAKP", 10, 0, []time.Duration{4, 5}},
+		{"keyframe only", "PK", 10, 0, []time.Duration{1}},
+		{"byte limit", "KPP", gopCacheMaxBytes / 3, 0, []time.Duration{0, 1, 2}},
+		{"over the byte limit", "KPPP", gopCacheMaxBytes / 3, 0, nil},
+		{"over the byte limit, next GOP", "KPPPKP", gopCacheMaxBytes / 3, 0, []time.Duration{4, 5}},
+		{"age limit", "KP", 10, gopCacheMaxAge - time.Second, []time.Duration{0, 1}},
+		{"over the age limit", "KPP", 10, gopCacheMaxAge + time.Second, nil},
+	} {
+		g := newGOPCache()
+		pkts := testPackets(c.pattern, c.size)
+		for i, p := range pkts {
+			if i == len(pkts)-1 && c.age != 0 {
+				g.start = time.Now().Add(-c.age)
+			}
+			g.push(p)
+		}
+		snapshot := g.snapshot()
+		if len(snapshot) != len(c.cached) {
+			t.Errorf("%s: %d packets cached, want %d", c.name, len(snapshot), len(c.cached))
+			continue
+		}
+		for i, p := range snapshot {
+			if p.Time != c.cached[i] {
+				t.Errorf("%s: packet %d is %v, want %v", c.name, i, p.Time, c.cached[i])
+			}
+		}
+		if len(snapshot) > 0 && !snapshot[0].IsKeyFrame {
+			t.Errorf("%s: starts without a keyframe", c.name)
+		}
+		if bytes := len(c.cached) * c.size; g.bytes != bytes {
+			t.Errorf("%s: %d bytes, want %d", c.name, g.bytes, bytes)
+		}
+	}
+
+	g := newGOPCache()
+	for _, p := range testPackets("K"+strings.Repeat("P", gopCacheMaxPackets), 1) {
+		g.push(p)
+	}
+	if len(g.pkts) != 0 {
+		t.Errorf("%d packets cached over the packet limit", len(g.pkts))
+	}
+
+	// a copy, the viewers don't see the next GOP
+	g = newGOPCache()
+	for _, p := range testPackets("KP", 1) {
+		g.push(p)
+	}
+	snapshot := g.snapshot()
+	g.push(av.Packet{IsKeyFrame: true, Time: 10})
+	if snapshot[0].Time != 0 || snapshot[1].Time != 1 {
+		t.Errorf("snapshot changed by the next GOP: %v %v", snapshot[0].Time, snapshot[1].Time)
+	}
+	// nothing once the source went quiet
+	g.last = time.Now().Add(-3 * time.Second)
+	if s := g.snapshot(); s != nil {
+		t.Errorf("%d packets of a quiet source", len(s))
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	codecs := []av.CodecData{testH264(t), codec.NewPCMAlawCodecData()}
+	video := av.Packet{Idx: 0, Duration: 40 * time.Millisecond}
+	if !catchUp(&video, codecs) || video.Duration != time.Millisecond {
+		t.Errorf("video: %v", video.Duration)
+	}
+	if audio := (av.Packet{Idx: 1}); catchUp(&audio, codecs) {
+		t.Error("audio served from the cache")
+	}
+}
+
+// a viewer added mid-GOP gets the packets since the keyframe before the
+// live ones
+func TestClAdPrefill(t *testing.T) {
+	const suuid = "gop-test"
+	testStream(t, suuid, []av.CodecData{testH264(t), codec.NewPCMAlawCodecData()})
+	for _, p := range testPackets("PPKPAP", 10) {
+		Config.cast(suuid, p)
+	}
+	cuuid, ch, cached := Config.clAd(suuid)
+	defer Config.clDe(suuid, cuuid)
+	if cached != 4 {
+		t.Fatalf("%d packets from the cache, want 4", cached)
+	}
+	Config.cast(suuid, av.Packet{Time: 6})
+	for _, want := range []time.Duration{2, 3, 4, 5, 6} {
+		select {
+		case p := <-ch:
+			if p.Time != want {
+				t.Errorf("packet %v, want %v", p.Time, want)
+			}
+		default:
+			t.Fatalf("packet %v missing", want)
+		}
+	}
+	if stats := Config.gopGe(suuid); stats.Viewers != 1 || stats.Served != 4 || stats.Packets != 5 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// the next GOP, nothing from the previous one
+	Config.cast(suuid, av.Packet{IsKeyFrame: true, Time: 7})
+	cuuid, ch, cached = Config.clAd(suuid)
+	defer Config.clDe(suuid, cuuid)
+	if p := <-ch; cached != 1 || p.Time != 7 {
+		t.Errorf("%d packets from the cache starting at %v, want the keyframe", cached, p.Time)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,8 +13,11 @@ import (
 
 	"golang.org/x/net/websocket"
 
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/RTSPtoWebRTC/nal"
 	"github.com/deepch/vdk/av"
 	"github.com/gin-gonic/gin"
+	pion "github.com/pion/webrtc/v3"
 
 	mse "github.com/deepch/vdk/format/mp4f"
 	webrtc "github.com/deepch/vdk/format/webrtcv3"
@@ -23,6 +27,20 @@ type JCodec struct {
 	Type string
 }
 
+type JInfo struct {
+	Codecs []string       `json:"codecs"`
+	Video  *nal.VideoInfo `json:"video,omitempty"`
+	GOP    JGOP           `json:"gop"`
+}
+
+type JGOP struct {
+	Packets  int   `json:"packets"`
+	Bytes    int   `json:"bytes"`
+	Duration int64 `json:"duration_ms"`
+	Viewers  int64 `json:"viewers"` // viewers started from the cache
+	Served   int64 `json:"served"`  // packets served from the cache
+}
+
 func serveHTTP() {
 	gin.SetMode(gin.ReleaseMode)
 
@@ -36,6 +54,13 @@ func serveHTTP() {
 	}
 	router.POST("/stream/receiver/:uuid", HTTPAPIServerStreamWebRTC)
 	router.GET("/stream/codec/:uuid", HTTPAPIServerStreamCodec)
+	router.GET("/stream/info/:uuid", HTTPAPIServerStreamInfo)
+	router.GET("/stream/mjpeg/:uuid", HTTPAPIServerStreamMJPEG)
+	router.POST("/stream/whep/:uuid", HTTPAPIServerWHEP)
+	router.PATCH("/stream/whep/:uuid/:session", HTTPAPIServerWHEPPatch)
+	router.DELETE("/stream/whep/:uuid/:session", HTTPAPIServerWHEPDelete)
+	router.POST("/stream/whip/:uuid", HTTPAPIServerWHIP)
+	router.DELETE("/stream/whip/:uuid/:session", HTTPAPIServerWHIPDelete)
 
 	router.GET("/ws", func(c *gin.Context) {
 		handler := websocket.Handler(ws)
@@ -43,6 +68,12 @@ func serveHTTP() {
 		s.ServeHTTP(c.Writer, c.Request)
 	})
 
+	router.GET("/ws/session", func(c *gin.Context) {
+		handler := websocket.Handler(wsSession)
+		s := websocket.Server{Handler: handler}
+		s.ServeHTTP(c.Writer, c.Request)
+	})
+
 	router.StaticFS("/static", http.Dir("web/static"))
 	err := router.Run(Config.Server.HTTPPort)
 	if err != nil {
@@ -88,7 +119,7 @@ func HTTPAPIServerStreamCodec(c *gin.Context) {
 		var tmpCodec []JCodec
 		for _, codec := range codecs {
 			if codec.Type() != av.H264 && codec.Type() != av.PCM_ALAW && codec.Type() != av.PCM_MULAW && codec.Type() != av.OPUS {
-				log.Println("Codec Not Supported WebRTC ignore this track", codec.Type())
+				log.Println("Codec Not Supported WebRTC ignore this track", audio.TypeName(codec.Type()))
 				continue
 			}
 			if codec.Type().IsVideo() {
@@ -108,6 +139,36 @@ func HTTPAPIServerStreamCodec(c *gin.Context) {
 	}
 }
 
+//HTTPAPIServerStreamInfo stream codecs and video parameters
+func HTTPAPIServerStreamInfo(c *gin.Context) {
+	if !Config.ext(c.Param("uuid")) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	Config.RunIFNotRun(c.Param("uuid"))
+	codecs := Config.coGe(c.Param("uuid"))
+	if codecs == nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	info := JInfo{}
+	for _, codec := range codecs {
+		info.Codecs = append(info.Codecs, audio.TypeName(codec.Type()))
+	}
+	if video := Config.inGe(c.Param("uuid")); video.Codec != "" {
+		info.Video = &video
+	}
+	info.GOP = Config.gopGe(c.Param("uuid"))
+	b, err := json.Marshal(info)
+	if err == nil {
+		_, err = c.Writer.Write(b)
+		if err != nil {
+			log.Println("Write Info error", err)
+			return
+		}
+	}
+}
+
 //HTTPAPIServerStreamWebRTC stream video over WebRTC
 func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 	if !Config.ext(c.PostForm("suuid")) {
@@ -136,8 +197,9 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 		return
 	}
 	go func() {
-		cid, ch := Config.clAd(c.PostForm("suuid"))
+		cid, ch, cached := Config.clAd(c.PostForm("suuid"))
 		defer Config.clDe(c.PostForm("suuid"), cid)
+		up := Config.clUp(c.PostForm("suuid"), cid)
 		defer muxerWebRTC.Close()
 		var videoStart bool
 		noVideo := time.NewTimer(10 * time.Second)
@@ -146,7 +208,17 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 			case <-noVideo.C:
 				log.Println("noVideo")
 				return
+			case <-up:
+				// the muxer keeps the codecs of WriteHeader, the client has to reconnect
+				log.Println("Codec changed, closing WebRTC session")
+				return
 			case pck := <-ch:
+				if cached > 0 {
+					cached--
+					if !catchUp(&pck, codecs) {
+						continue
+					}
+				}
 				if pck.IsKeyFrame || AudioOnly {
 					noVideo.Reset(10 * time.Second)
 					videoStart = true
@@ -164,13 +236,79 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 	}()
 }
 
+//HTTPAPIServerStreamMJPEG stream JPEG video as multipart/x-mixed-replace
+func HTTPAPIServerStreamMJPEG(c *gin.Context) {
+	suuid := c.Param("uuid")
+	if !Config.ext(suuid) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	Config.RunIFNotRun(suuid)
+	idx := jpegIdx(Config.coGe(suuid))
+	if idx < 0 {
+		c.String(http.StatusUnsupportedMediaType, "Stream is not MJPEG")
+		return
+	}
+
+	cid, ch, _ := Config.clAd(suuid)
+	defer Config.clDe(suuid, cid)
+	up := Config.clUp(suuid, cid)
+
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.Status(http.StatusOK)
+
+	noVideo := time.NewTimer(10 * time.Second)
+	defer noVideo.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-noVideo.C:
+			log.Println("noVideo")
+			return
+		case codecs := <-up:
+			if idx = jpegIdx(codecs); idx < 0 {
+				log.Println("Codec changed, stream is not MJPEG anymore")
+				return
+			}
+		case pck := <-ch:
+			if pck.Idx != idx {
+				continue
+			}
+			noVideo.Reset(10 * time.Second)
+			_, err := fmt.Fprintf(c.Writer, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(pck.Data))
+			if err == nil {
+				_, err = c.Writer.Write(pck.Data)
+			}
+			if err == nil {
+				_, err = c.Writer.Write([]byte("\r\n"))
+			}
+			if err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// jpegIdx returns the index of the JPEG video codec, -1 when there is none
+func jpegIdx(codecs []av.CodecData) int8 {
+	for i, codec := range codecs {
+		if codec.Type() == av.JPEG {
+			return int8(i)
+		}
+	}
+	return -1
+}
+
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, x-access-token")
-		c.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Cache-Control, Content-Language, Content-Type")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, x-access-token, If-Match")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Cache-Control, Content-Language, Content-Type, Location, ETag")
+		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -182,15 +320,22 @@ func CORSMiddleware() gin.HandlerFunc {
 }
 
 type Request struct {
-	Type string `json:"type"`
-	Sdp  string `json:"sdp,omitempty"`
+	Type      string                 `json:"type"`
+	Sdp       string                 `json:"sdp,omitempty"`
+	Candidate *pion.ICECandidateInit `json:"candidate,omitempty"`
+	Stream    string                 `json:"stream,omitempty"`  // of a /ws/session request
+	Replace   string                 `json:"replace,omitempty"` // stream replaced by Stream
+	Trickle   bool                   `json:"trickle,omitempty"` // the client takes candidate messages
 }
 
 type Response struct {
-	Type   string `json:"type,omitempty"`
-	Codecs string `json:"codecs,omitempty"`
-	Error  string `json:"error,omitempty"`
-	Sdp    string `json:"sdp,omitempty"`
+	Type      string                 `json:"type,omitempty"`
+	Codecs    string                 `json:"codecs,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Sdp       string                 `json:"sdp,omitempty"`
+	Candidate *pion.ICECandidateInit `json:"candidate,omitempty"`
+	Stream    string                 `json:"stream,omitempty"`
+	Streams   map[string]string      `json:"streams,omitempty"` // stream uuids by mid
 }
 
 func ws(ws *websocket.Conn) {
@@ -202,6 +347,9 @@ func ws(ws *websocket.Conn) {
 			URL:      url,
 			OnDemand: true,
 			Cl:       make(map[string]viewer),
+			gop:      newGOPCache(),
+			tc:       make(map[av.CodecType]*audioTranscoder),
+			stop:     make(chan struct{}),
 		}
 	}
 
@@ -227,6 +375,7 @@ func ws(ws *websocket.Conn) {
 		return
 	}
 
+	var streamer *WebRTCStreamer
 	for {
 		var request Request
 		err := websocket.JSON.Receive(ws, &request)
@@ -239,54 +388,72 @@ func ws(ws *websocket.Conn) {
 		switch request.Type {
 		case "mse":
 			go startMSE(ws, url)
+		case "mjpeg":
+			go startMJPEG(ws, url)
 		case "webrtc":
 			// go startWebRTC(ws, url, request.Sdp)
-			go (&WebRTCStreamer{WS: ws}).run(url, request.Sdp)
+			if streamer != nil {
+				err := streamer.restart(request.Sdp)
+				if err == nil {
+					// ICE restart of the running session
+					continue
+				}
+				if err != ErrorWebRTCSessionOver && err != ErrorWebRTCOtherPeer {
+					log.Println("WebRTC restart", err)
+					if err := websocket.JSON.Send(ws, Response{Type: "webrtc", Error: err.Error()}); err != nil {
+						log.Println("websocket.JSON.Send", err)
+					}
+					continue
+				}
+				// a new PeerConnection of the client replaces the session
+				streamer.end()
+			}
+			streamer = newWebRTCStreamer(wsSender(ws), request.Trickle)
+			go streamer.run(url, request.Sdp)
+		case "offer":
+			// the client waits for our offer, it replaces the running session
+			if streamer != nil {
+				streamer.end()
+			}
+			streamer = newWebRTCStreamer(wsSender(ws), request.Trickle)
+			streamer.offering = true
+			go streamer.run(url, "")
+		case "answer":
+			if streamer == nil || !streamer.takeAnswer(request.Sdp) {
+				log.Println("WebRTC answer without an offer")
+			}
+		case "candidate":
+			if streamer != nil && request.Candidate != nil {
+				streamer.candidate(*request.Candidate)
+			}
 		}
 	}
 }
 
-func startMSE(ws *websocket.Conn, url string) {
-	codecs := Config.coGe(url)
-
-	mseCodecs := make([]av.CodecData, 0)
-	mseIdx := make(map[int8]bool)
-	for i, codec := range codecs {
-		switch codec.Type() {
-		case av.H264, av.H265, av.AAC:
-			mseCodecs = append(mseCodecs, codec)
-			mseIdx[int8(i)] = true
-		}
-	}
-
-	mseMuxer := mse.NewMuxer(nil)
-	// only supported codecs
-	err := mseMuxer.WriteHeader(mseCodecs)
-	if err != nil {
-		log.Println("mseMuxer.WriteHeader", err)
-		err = websocket.JSON.Send(ws, Response{Error: err.Error()})
+// wsSender sends the signaling messages of a WebRTC session on the
+// WebSocket. A broken one is closed instead of letting it retry.
+func wsSender(ws *websocket.Conn) func(Response) error {
+	return func(r Response) error {
+		err := websocket.JSON.Send(ws, r)
 		if err != nil {
-			log.Println("websocket.JSON.Send", err)
+			ws.Close()
 		}
-		return
+		return err
 	}
+}
 
-	meta, init := mseMuxer.GetInit(mseCodecs)
-	err = websocket.JSON.Send(ws, Response{Type: "mse", Codecs: meta})
-	if err != nil {
-		log.Println("websocket.JSON.Send", err)
-		return
-	}
+func startMSE(ws *websocket.Conn, url string) {
+	// MSE gets the cached packets as they are, seeking to the end of the
+	// buffered range is up to the player
+	cid, ch, _ := Config.clAdAudio(url, mseAudio)
+	defer Config.clDe(url, cid)
+	up := Config.clUp(url, cid)
 
-	err = websocket.Message.Send(ws, init)
+	mseMuxer, mseIdx, err := sendMSEInit(ws, Config.coGeAudio(url, mseAudio))
 	if err != nil {
-		log.Println("websocket.Message.Send", err)
 		return
 	}
 
-	cid, ch := Config.clAd(url)
-	defer Config.clDe(url, cid)
-
 	noVideo := time.NewTimer(10 * time.Second)
 	var start bool
 	for {
@@ -298,6 +465,14 @@ func startMSE(ws *websocket.Conn, url string) {
 				log.Println("websocket.JSON.Send", err)
 			}
 			return
+		case codecs := <-up:
+			// the client replaces its SourceBuffer on every "mse" message
+			log.Println("MSE codec change, sending new init segment", url)
+			mseMuxer, mseIdx, err = sendMSEInit(ws, codecs)
+			if err != nil {
+				return
+			}
+			start = false
 		case pck := <-ch:
 			if pck.IsKeyFrame {
 				noVideo.Reset(10 * time.Second)
@@ -324,6 +499,110 @@ func startMSE(ws *websocket.Conn, url string) {
 	}
 }
 
+// startMJPEG sends the JPEG frames as binary messages
+func startMJPEG(ws *websocket.Conn, url string) {
+	cid, ch, _ := Config.clAd(url)
+	defer Config.clDe(url, cid)
+	up := Config.clUp(url, cid)
+
+	idx := jpegIdx(Config.coGe(url))
+	if idx < 0 {
+		err := websocket.JSON.Send(ws, Response{Error: "Stream is not MJPEG"})
+		if err != nil {
+			log.Println("websocket.JSON.Send", err)
+		}
+		return
+	}
+	err := websocket.JSON.Send(ws, Response{Type: "mjpeg"})
+	if err != nil {
+		log.Println("websocket.JSON.Send", err)
+		return
+	}
+
+	noVideo := time.NewTimer(10 * time.Second)
+	defer noVideo.Stop()
+	for {
+		select {
+		case <-noVideo.C:
+			log.Println("noVideo")
+			err = websocket.JSON.Send(ws, Response{Error: "No video"})
+			if err != nil {
+				log.Println("websocket.JSON.Send", err)
+			}
+			return
+		case codecs := <-up:
+			if idx = jpegIdx(codecs); idx < 0 {
+				err = websocket.JSON.Send(ws, Response{Error: "Stream is not MJPEG"})
+				if err != nil {
+					log.Println("websocket.JSON.Send", err)
+				}
+				return
+			}
+		case pck := <-ch:
+			if pck.Idx != idx {
+				continue
+			}
+			noVideo.Reset(10 * time.Second)
+			err = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err != nil {
+				return
+			}
+			err = websocket.Message.Send(ws, pck.Data)
+			if err != nil {
+				log.Println("websocket.Message.Send", err)
+				return
+			}
+		}
+	}
+}
+
+// sendMSEInit creates a muxer for the codecs supported by MSE, then sends
+// the codecs string and the init segment to the client
+func sendMSEInit(ws *websocket.Conn, codecs []av.CodecData) (*mse.Muxer, map[int8]bool, error) {
+	mseCodecs := make([]av.CodecData, 0)
+	mseIdx := make(map[int8]bool)
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.H265, av.AAC:
+			mseCodecs = append(mseCodecs, codec)
+			mseIdx[int8(i)] = true
+		}
+	}
+
+	if len(mseCodecs) == 0 {
+		err := fmt.Errorf("MSE Codec Not Supported")
+		if err := websocket.JSON.Send(ws, Response{Error: err.Error()}); err != nil {
+			log.Println("websocket.JSON.Send", err)
+		}
+		return nil, nil, err
+	}
+
+	mseMuxer := mse.NewMuxer(nil)
+	// only supported codecs
+	err := mseMuxer.WriteHeader(mseCodecs)
+	if err != nil {
+		log.Println("mseMuxer.WriteHeader", err)
+		if err := websocket.JSON.Send(ws, Response{Error: err.Error()}); err != nil {
+			log.Println("websocket.JSON.Send", err)
+		}
+		return nil, nil, err
+	}
+
+	meta, init := mseMuxer.GetInit(mseCodecs)
+	err = websocket.JSON.Send(ws, Response{Type: "mse", Codecs: meta})
+	if err != nil {
+		log.Println("websocket.JSON.Send", err)
+		return nil, nil, err
+	}
+
+	err = websocket.Message.Send(ws, init)
+	if err != nil {
+		log.Println("websocket.Message.Send", err)
+		return nil, nil, err
+	}
+	return mseMuxer, mseIdx, nil
+}
+
 func startWebRTC(ws *websocket.Conn, url string, sdp string) {
 	muxerWebRTC := webrtc.NewMuxer(
 		webrtc.Options{
@@ -351,8 +630,9 @@ func startWebRTC(ws *websocket.Conn, url string, sdp string) {
 	}
 
 	// TODO: try to use single cid/ch
-	cid, ch := Config.clAd(url)
+	cid, ch, _ := Config.clAd(url)
 	defer Config.clDe(url, cid)
+	up := Config.clUp(url, cid)
 
 	defer muxerWebRTC.Close()
 
@@ -363,6 +643,9 @@ func startWebRTC(ws *websocket.Conn, url string, sdp string) {
 		case <-noVideo.C:
 			log.Println("noVideo")
 			return
+		case <-up:
+			log.Println("Codec changed, closing WebRTC session")
+			return
 		case pck := <-ch:
 			if pck.IsKeyFrame {
 				noVideo.Reset(10 * time.Second)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/RTSPtoWebRTC/nal"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// webrtcHub owns the local tracks of a stream, every WebRTC viewer of the
+// stream adds them to its PeerConnection. A frame is packetized once
+// whatever the number of viewers, each of them starts with a keyframe.
+// The hub reads the stream as a single viewer while it has WebRTC viewers,
+// from the GOP cache: the video tracks keep the packets since the last
+// keyframe to prefill the senders of the viewers.
+type webrtcHub struct {
+	suuid       string
+	passthrough bool
+
+	mutex  sync.Mutex
+	codecs []av.CodecData
+	tracks map[int8]*fanout.Track
+	subs   map[chan struct{}]bool // track switch events of the viewers
+
+	// only used by run
+	fwd   *rtpForwarder // video of the RTP passthrough mode
+	cid   string
+	ch    chan av.Packet
+	rtpC  chan rtpPacket
+	gop   []av.Packet // from the GOP cache, written first
+	up    <-chan []av.CodecData
+	epoch time.Time // wall clock of the stream timeline start
+	stop  chan struct{}
+}
+
+// webrtcHubs are the hubs of the streams with WebRTC viewers
+var webrtcHubs = struct {
+	sync.Mutex
+	m map[string]*webrtcHub
+}{m: make(map[string]*webrtcHub)}
+
+// joinHub returns the hub of a stream, it is started for the first viewer.
+// The channel tells the viewer the hub switched tracks.
+func joinHub(suuid string) (*webrtcHub, chan struct{}, error) {
+	codecs := Config.coGeAudio(suuid, webrtcAudio)
+	webrtcHubs.Lock()
+	defer webrtcHubs.Unlock()
+	h := webrtcHubs.m[suuid]
+	if h == nil {
+		var err error
+		if h, err = startHub(suuid, codecs); err != nil {
+			return nil, nil, err
+		}
+		webrtcHubs.m[suuid] = h
+	}
+	sub := make(chan struct{}, 1)
+	h.mutex.Lock()
+	h.subs[sub] = true
+	h.mutex.Unlock()
+	return h, sub, nil
+}
+
+// startHub creates the tracks of the codecs and runs the hub as a viewer
+// of the stream. The codecs are read again once it is one: a change
+// before isn't sent to it, after it comes with its update channel.
+func startHub(suuid string, codecs []av.CodecData) (*webrtcHub, error) {
+	h := &webrtcHub{
+		suuid:       suuid,
+		passthrough: Config.rtpGe(suuid),
+		subs:        make(map[chan struct{}]bool),
+		stop:        make(chan struct{}),
+	}
+	h.setTracks(codecs)
+	if len(h.tracks) == 0 {
+		return nil, fmt.Errorf("WebRTC Not Track Available")
+	}
+	h.subscribe(true)
+	if codecs := Config.coGeAudio(suuid, webrtcAudio); codecs != nil {
+		h.update(codecs)
+	}
+	go h.run()
+	return h, nil
+}
+
+// leave removes a viewer, the hub stops with its last viewer
+func (h *webrtcHub) leave(sub chan struct{}) {
+	webrtcHubs.Lock()
+	defer webrtcHubs.Unlock()
+	h.mutex.Lock()
+	delete(h.subs, sub)
+	last := len(h.subs) == 0
+	h.mutex.Unlock()
+	if last {
+		delete(webrtcHubs.m, h.suuid)
+		close(h.stop)
+	}
+}
+
+// snapshot returns the codecs and the tracks for a viewer
+func (h *webrtcHub) snapshot() ([]av.CodecData, map[int8]*fanout.Track) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	tracks := make(map[int8]*fanout.Track, len(h.tracks))
+	for idx, track := range h.tracks {
+		tracks[idx] = track
+	}
+	return h.codecs, tracks
+}
+
+// subscribe adds the hub as a viewer of the stream, the video comes as RTP
+// when it is forwarded. Otherwise the packets of the GOP cache are taken
+// with seed, before anybody is bound to the tracks.
+func (h *webrtcHub) subscribe(seed bool) {
+	if seed && h.fwd == nil {
+		var n int
+		h.cid, h.ch, n = Config.clAdAudio(h.suuid, webrtcAudio)
+		h.rtpC = nil
+		h.gop = make([]av.Packet, 0, n)
+		for ; n > 0; n-- {
+			h.gop = append(h.gop, <-h.ch)
+		}
+	} else {
+		h.cid, h.ch, h.rtpC = Config.clAdLive(h.suuid, webrtcAudio, h.fwd != nil)
+	}
+	h.up = Config.clUp(h.suuid, h.cid)
+}
+
+func (h *webrtcHub) run() {
+	defer func() {
+		Config.clDe(h.suuid, h.cid)
+	}()
+	h.seed()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case codecs := <-h.up:
+			h.update(codecs)
+		case p := <-h.rtpC:
+			if err := h.fwd.write(p, h.wall(p.Time)); err != nil {
+				log.Println("RTP passthrough", err)
+			}
+		case pck := <-h.ch:
+			if err := h.writePacket(&pck, h.wall(pck.Time)); err != nil {
+				log.Println("muxerWebRTC.WritePacket", err)
+			}
+		}
+	}
+}
+
+// seed writes the video of the GOP cache to the tracks, its last packet is
+// now on the wall clock. The audio is dropped, it can't be played faster.
+func (h *webrtcHub) seed() {
+	if len(h.gop) == 0 {
+		return
+	}
+	h.epoch = time.Now().Add(-h.gop[len(h.gop)-1].Time)
+	for i := range h.gop {
+		pck := &h.gop[i]
+		if int(pck.Idx) < len(h.codecs) && h.codecs[pck.Idx].Type().IsAudio() {
+			continue
+		}
+		if err := h.writePacket(pck, h.epoch.Add(pck.Time)); err != nil {
+			log.Println("muxerWebRTC.WritePacket", err)
+		}
+	}
+	h.gop = nil
+}
+
+// setTracks creates the tracks of the codecs. A track is kept when its
+// codec type and H264 profile didn't change, new parameter sets don't need
+// a new one.
+func (h *webrtcHub) setTracks(codecs []av.CodecData) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	tracks := make(map[int8]*fanout.Track)
+	var fwd *rtpForwarder
+	for i, c := range codecs {
+		idx := int8(i)
+		if track := h.tracks[idx]; track != nil && h.codecs[i].Type() == c.Type() && track.Codec().SDPFmtpLine == trackFmtp(c) {
+			tracks[idx] = track
+			if h.fwd != nil && h.fwd.idx == idx {
+				// new parameter sets for the next keyframes
+				fwd = h.fwd
+				fwd.codec = c
+			}
+			continue
+		}
+		if h.passthrough && fwd == nil && rtpForwardable(c.Type()) {
+			fwd = newRTPForwarder(idx, c, h.suuid)
+			tracks[idx] = fwd.track
+			continue
+		}
+		if track := newTrack(c, h.suuid); track != nil {
+			tracks[idx] = track
+		}
+	}
+	h.codecs = codecs
+	h.tracks = tracks
+	h.fwd = fwd
+}
+
+// update applies a codec change of the stream, the viewers switch their
+// senders to the new tracks
+func (h *webrtcHub) update(codecs []av.CodecData) {
+	forwarded := h.fwd != nil
+	h.setTracks(codecs)
+	if forwarded != (h.fwd != nil) {
+		// the video comes the other way now
+		Config.clDe(h.suuid, h.cid)
+		h.subscribe(false)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for sub := range h.subs {
+		select {
+		case sub <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wall maps a time of the stream timeline to the wall clock of the RTP
+// timestamps, all the tracks use it so browsers can play them in sync
+func (h *webrtcHub) wall(t time.Duration) time.Time {
+	now := time.Now()
+	w := h.epoch.Add(t)
+	if h.epoch.IsZero() || w.Sub(now) > time.Second || now.Sub(w) > time.Second {
+		// first packet, or the timeline restarted with the source
+		h.epoch = now.Add(-t)
+		w = now
+	}
+	return w
+}
+
+// writePacket writes a packet to its track, wall is the wall clock of its
+// time
+func (h *webrtcHub) writePacket(pkt *av.Packet, wall time.Time) error {
+	var err error
+
+	track := h.tracks[pkt.Idx]
+	if track == nil {
+		return nil
+	}
+
+	// element.StreamACK.Reset(10 * time.Second)
+	if len(pkt.Data) < 5 {
+		log.Println("len(pkt.Data) < 5")
+		return nil
+	}
+	c := h.codecs[pkt.Idx]
+	switch c.Type() {
+	case av.H264:
+		nalus, _ := h264parser.SplitNALUs(pkt.Data)
+		for _, nalu := range nalus {
+			naltype := nalu[0] & 0x1f
+			if naltype == 5 {
+				codec := c.(h264parser.CodecData)
+				err = track.WriteSample(media.Sample{Data: bytes.Join([][]byte{{}, codec.SPS(), codec.PPS(), nalu}, []byte{0, 0, 0, 1}), Timestamp: wall, Duration: pkt.Duration}, true)
+				// } else if naltype == 1 {
+			} else {
+				err = track.WriteSample(media.Sample{Data: append([]byte{0, 0, 0, 1}, nalu...), Timestamp: wall, Duration: pkt.Duration}, false)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// WritePacketSuccess = true
+		return nil
+	case av.H265:
+		// a whole access unit per sample, RTP timestamps advance once
+		au, key := hevcAccessUnit(c.(h265parser.CodecData), pkt.Data)
+		return track.WriteSample(media.Sample{Data: au, Timestamp: wall, Duration: pkt.Duration}, key)
+	case av.VP8, av.VP9, av.AV1:
+		// a whole frame per sample
+	case av.PCM_ALAW:
+	case av.OPUS:
+	case av.PCM_MULAW:
+	case audio.G722:
+	default:
+		return fmt.Errorf("WebRTC Codec Not Supported")
+	}
+
+	return track.WriteSample(media.Sample{Data: pkt.Data, Timestamp: wall, Duration: pkt.Duration}, pkt.IsKeyFrame || c.Type().IsAudio())
+}
+
+// hevcAccessUnit is the Annex B access unit of the NAL units of a H265
+// packet, it tells whether it is a keyframe. The parameter sets of the
+// codec go once before an IRAP picture unless they are in-band.
+func hevcAccessUnit(codec h265parser.CodecData, data []byte) ([]byte, bool) {
+	au := [][]byte{{}}
+	key, inband := false, false
+	for _, u := range nal.CompatibleSplit(data, false) {
+		if len(u) < 2 {
+			continue
+		}
+		switch u.HEVCType() {
+		case nal.HEVCTypeVPS, nal.HEVCTypeSPS, nal.HEVCTypePPS:
+			inband = true
+		}
+		if start, _ := nal.HEVCRTPKeyFrame(u); start {
+			if !inband && !key {
+				au = append(au, codec.VPS(), codec.SPS(), codec.PPS())
+			}
+			key = true
+		}
+		au = append(au, u)
+	}
+	return bytes.Join(au, []byte{0, 0, 0, 1}), key
+}
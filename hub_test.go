@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+var (
+	testHEVCVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	testHEVCSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03,
+		0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00,
+		0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+	testHEVCPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+// avcc is the packet data of the NAL units, each after its 4-byte size
+func avcc(units ...[]byte) []byte {
+	var b []byte
+	for _, u := range units {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(u)))
+		b = append(append(b, size...), u...)
+	}
+	return b
+}
+
+func TestHEVCAccessUnit(t *testing.T) {
+	codec, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(testHEVCVPS, testHEVCSPS, testHEVCPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := []byte{0, 0, 0, 1}
+	idr := []byte{19 << 1, 0x01, 0xaf, 0x01}   // IDR_W_RADL
+	trail := []byte{1 << 1, 0x01, 0xd0, 0x02}  // TRAIL_R
+	sei := []byte{39 << 1, 0x01, 0x05, 0x80}   // prefix SEI
+	otherPPS := []byte{0x44, 0x01, 0xc0, 0xf0} // in-band, not the one of the codec
+	for _, c := range []struct {
+		name  string
+		units [][]byte
+		au    [][]byte
+		key   bool
+	}{
+		{"IDR", [][]byte{idr}, [][]byte{testHEVCVPS, testHEVCSPS, testHEVCPPS, idr}, true},
+		{"IDR after SEI", [][]byte{sei, idr}, [][]byte{sei, testHEVCVPS, testHEVCSPS, testHEVCPPS, idr}, true},
+		{"in-band parameter sets", [][]byte{testHEVCVPS, testHEVCSPS, otherPPS, idr},
+			[][]byte{testHEVCVPS, testHEVCSPS, otherPPS, idr}, true},
+		{"not IRAP", [][]byte{trail}, [][]byte{trail}, false},
+	} {
+		au, key := hevcAccessUnit(codec, avcc(c.units...))
+		if want := append(sc, bytes.Join(c.au, sc)...); !bytes.Equal(au, want) {
+			t.Errorf("%s: access unit % x, want % x", c.name, au, want)
+		}
+		if key != c.key {
+			t.Errorf("%s: key %v, want %v", c.name, key, c.key)
+		}
+	}
+}
+
+// a codec change between the codecs read for the tracks and the hub
+// joining the stream isn't sent to the hub, it reads them again
+func TestStartHubCodecChange(t *testing.T) {
+	const suuid = "hub-codec-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	old := Config.coGeAudio(suuid, webrtcAudio)
+	pps := []byte{0x68, 0xee, 0x3c, 0x81}
+	c, err := h264parser.NewCodecDataFromSPSAndPPS(old[0].(h264parser.CodecData).SPS(), pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.coAd(suuid, []av.CodecData{c})
+	h, err := startHub(suuid, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(h.stop)
+	codecs, tracks := h.snapshot()
+	if got := codecs[0].(h264parser.CodecData).PPS(); !bytes.Equal(got, pps) {
+		t.Errorf("hub PPS % x, want % x", got, pps)
+	}
+	if len(tracks) != 1 || tracks[0] == nil {
+		t.Errorf("tracks %v", tracks)
+	}
+}
@@ -0,0 +1,239 @@
+// Package mjpeg rebuilds JPEG frames from RTP payloads (RFC 2435)
+package mjpeg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/deepch/vdk/av"
+)
+
+var (
+	ErrShortPacket  = errors.New("mjpeg: packet too short")
+	ErrNoQuantTable = errors.New("mjpeg: quantization table not received")
+)
+
+// CodecData of a JPEG video stream, the size comes from the RTP JPEG header
+type CodecData struct {
+	Width_  int
+	Height_ int
+}
+
+func (c CodecData) Type() av.CodecType {
+	return av.JPEG
+}
+
+func (c CodecData) Width() int {
+	return c.Width_
+}
+
+func (c CodecData) Height() int {
+	return c.Height_
+}
+
+// Depacketizer rebuilds the JPEG frames of a RTP session.
+// Fragments are expected in order, a gap drops the frame.
+type Depacketizer struct {
+	data    []byte // entropy coded segment
+	next    uint32 // expected fragment offset
+	typ     byte
+	q       byte
+	width   int
+	height  int
+	dri     uint16
+	qt      []byte
+	precise byte // precision bit per table, 1 for 16 bit tables
+
+	tables map[byte]quantTables // dynamic tables by Q value, they may be sent only once
+}
+
+type quantTables struct {
+	data      []byte
+	precision byte
+}
+
+// Push adds the payload of a RTP packet, it returns the complete frame
+// once the packet with the marker bit is received.
+func (d *Depacketizer) Push(payload []byte, marker bool) ([]byte, error) {
+	if len(payload) < 8 {
+		return nil, ErrShortPacket
+	}
+	// Main JPEG header
+	// type-specific(8) fragment offset(24) type(8) q(8) width(8) height(8)
+	offset := uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3])
+	typ := payload[4]
+	q := payload[5]
+	width := int(payload[6]) * 8
+	height := int(payload[7]) * 8
+	b := payload[8:]
+
+	var dri uint16
+	if typ >= 64 && typ <= 127 {
+		// Restart Marker header
+		if len(b) < 4 {
+			return nil, ErrShortPacket
+		}
+		dri = binary.BigEndian.Uint16(b)
+		b = b[4:]
+		typ -= 64
+	}
+	if typ > 1 {
+		d.reset()
+		return nil, fmt.Errorf("mjpeg: unsupported type %d", typ)
+	}
+
+	if offset == 0 {
+		d.reset()
+		if q >= 128 {
+			// Quantization Table header
+			// mbz(8) precision(8) length(16)
+			if len(b) < 4 {
+				return nil, ErrShortPacket
+			}
+			precision := b[1]
+			length := int(binary.BigEndian.Uint16(b[2:]))
+			b = b[4:]
+			if len(b) < length {
+				return nil, ErrShortPacket
+			}
+			if length > 0 {
+				if d.tables == nil {
+					d.tables = make(map[byte]quantTables)
+				}
+				qt := make([]byte, length)
+				copy(qt, b[:length])
+				d.tables[q] = quantTables{data: qt, precision: precision}
+			}
+			b = b[length:]
+			qt, ok := d.tables[q]
+			if !ok {
+				return nil, ErrNoQuantTable
+			}
+			d.qt = qt.data
+			d.precise = qt.precision
+		} else {
+			d.qt = makeTables(int(q))
+			d.precise = 0
+		}
+		d.typ, d.q, d.width, d.height, d.dri = typ, q, width, height, dri
+	} else if offset != d.next || d.qt == nil {
+		// lost fragment, wait for the next frame
+		d.reset()
+		return nil, nil
+	}
+
+	d.data = append(d.data, b...)
+	d.next = offset + uint32(len(b))
+	if !marker {
+		return nil, nil
+	}
+
+	frame := d.frame()
+	d.reset()
+	return frame, nil
+}
+
+// Size of the last frame
+func (d *Depacketizer) Size() (width, height int) {
+	return d.width, d.height
+}
+
+func (d *Depacketizer) reset() {
+	d.data = d.data[:0]
+	d.next = 0
+	d.qt = nil
+}
+
+// frame adds the JPEG headers in front of the entropy coded data (RFC 2435 Appendix B)
+func (d *Depacketizer) frame() []byte {
+	res := make([]byte, 0, len(d.data)+1024)
+	res = append(res, 0xFF, 0xD8) // SOI
+
+	// DQT, 64 values per 8 bit table, 128 for 16 bit ones
+	qt := d.qt
+	for id := byte(0); len(qt) > 0 && id < 4; id++ {
+		size := 64
+		if d.precise&(1<<id) != 0 {
+			size = 128
+		}
+		if len(qt) < size {
+			break
+		}
+		res = append(res, 0xFF, 0xDB, 0, byte(3+size), byte(size/128)<<4|id)
+		res = append(res, qt[:size]...)
+		qt = qt[size:]
+	}
+
+	// SOF0, baseline
+	res = append(res, 0xFF, 0xC0, 0, 17, 8,
+		byte(d.height>>8), byte(d.height), byte(d.width>>8), byte(d.width), 3)
+	if d.typ == 0 {
+		res = append(res, 1, 0x21, 0) // 4:2:2
+	} else {
+		res = append(res, 1, 0x22, 0) // 4:2:0
+	}
+	chromaQT := byte(1)
+	if len(d.qt) <= 64 {
+		// a single table is shared by all components
+		chromaQT = 0
+	}
+	res = append(res, 2, 0x11, chromaQT, 3, 0x11, chromaQT)
+
+	if d.dri != 0 {
+		res = append(res, 0xFF, 0xDD, 0, 4, byte(d.dri>>8), byte(d.dri))
+	}
+
+	res = appendHuffmanTable(res, 0x00, lumDCCodeLens[:], lumDCSymbols[:])
+	res = appendHuffmanTable(res, 0x10, lumACCodeLens[:], lumACSymbols[:])
+	res = appendHuffmanTable(res, 0x01, chmDCCodeLens[:], chmDCSymbols[:])
+	res = appendHuffmanTable(res, 0x11, chmACCodeLens[:], chmACSymbols[:])
+
+	// SOS
+	res = append(res, 0xFF, 0xDA, 0, 12, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0)
+
+	res = append(res, d.data...)
+	if n := len(d.data); n < 2 || d.data[n-2] != 0xFF || d.data[n-1] != 0xD9 {
+		res = append(res, 0xFF, 0xD9) // EOI
+	}
+	return res
+}
+
+func appendHuffmanTable(b []byte, class byte, codeLens, symbols []byte) []byte {
+	length := 3 + len(codeLens) + len(symbols)
+	b = append(b, 0xFF, 0xC4, byte(length>>8), byte(length), class)
+	b = append(b, codeLens...)
+	return append(b, symbols...)
+}
+
+// makeTables scales the example tables of the JPEG spec by the Q factor
+// (RFC 2435 Appendix A)
+func makeTables(q int) []byte {
+	if q < 1 {
+		q = 1
+	} else if q > 99 {
+		q = 99
+	}
+	if q < 50 {
+		q = 5000 / q
+	} else {
+		q = 200 - q*2
+	}
+	res := make([]byte, 128)
+	for i := 0; i < 64; i++ {
+		res[i] = scale(lumQuantizer[i], q)
+		res[64+i] = scale(chmQuantizer[i], q)
+	}
+	return res
+}
+
+func scale(v byte, q int) byte {
+	r := (int(v)*q + 50) / 100
+	if r < 1 {
+		return 1
+	}
+	if r > 255 {
+		return 255
+	}
+	return byte(r)
+}
@@ -0,0 +1,239 @@
+package mjpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes a colour gradient with the Go encoder, a baseline 4:2:0
+// JPEG with the typical Huffman tables, as a camera sends it
+func testJPEG(t *testing.T, quality int) []byte {
+	img := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			r, g, b := uint8(x*4), uint8(y*5), uint8((x+y)*2)
+			yy, cb, cr := color.RGBToYCbCr(r, g, b)
+			img.Y[img.YOffset(x, y)] = yy
+			img.Cb[img.COffset(x, y)] = cb
+			img.Cr[img.COffset(x, y)] = cr
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// packetize splits a JPEG into RFC 2435 payloads of at most size bytes of
+// scan data, type 1 (4:2:0). The quantization tables are sent in the first
+// packet when q is 128 or more.
+func packetize(t *testing.T, jpg []byte, q byte, size int) [][]byte {
+	var tables, scan []byte
+	var width, height int
+	b := jpg[2:]
+	for len(b) >= 4 && scan == nil {
+		marker := b[1]
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		segment := b[4 : 2+length]
+		switch marker {
+		case 0xdb: // DQT
+			for len(segment) >= 65 {
+				tables = append(tables, segment[1:65]...)
+				segment = segment[65:]
+			}
+		case 0xc0: // SOF0
+			height = int(binary.BigEndian.Uint16(segment[1:]))
+			width = int(binary.BigEndian.Uint16(segment[3:]))
+		case 0xda: // SOS
+			scan = b[2+length:]
+		}
+		b = b[2+length:]
+	}
+	if scan == nil || !bytes.HasSuffix(scan, []byte{0xff, 0xd9}) {
+		t.Fatal("no scan in the JPEG")
+	}
+	scan = scan[:len(scan)-2]
+
+	var payloads [][]byte
+	for offset := 0; offset < len(scan); offset += size {
+		end := offset + size
+		if end > len(scan) {
+			end = len(scan)
+		}
+		p := []byte{0, byte(offset >> 16), byte(offset >> 8), byte(offset), 1, q, byte(width / 8), byte(height / 8)}
+		if offset == 0 && q >= 128 {
+			p = append(p, 0, 0, byte(len(tables)>>8), byte(len(tables)))
+			p = append(p, tables...)
+		}
+		payloads = append(payloads, append(p, scan[offset:end]...))
+	}
+	return payloads
+}
+
+// push sends the payloads to the depacketizer, the last one with the marker
+func push(t *testing.T, d *Depacketizer, payloads [][]byte) []byte {
+	var frame []byte
+	for i, p := range payloads {
+		f, err := d.Push(p, i == len(payloads)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != nil {
+			if frame != nil {
+				t.Fatal("two frames")
+			}
+			frame = f
+		}
+	}
+	return frame
+}
+
+// samePicture decodes both JPEGs, the same coefficients with the same
+// tables give the same pixels
+func samePicture(t *testing.T, name string, got, want []byte) {
+	g, err := jpeg.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	w, err := jpeg.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gy, wy := g.(*image.YCbCr), w.(*image.YCbCr)
+	if g.Bounds() != w.Bounds() || gy.SubsampleRatio != wy.SubsampleRatio {
+		t.Fatalf("%s: %v %v, want %v %v", name, g.Bounds(), gy.SubsampleRatio, w.Bounds(), wy.SubsampleRatio)
+	}
+	if !bytes.Equal(gy.Y, wy.Y) || !bytes.Equal(gy.Cb, wy.Cb) || !bytes.Equal(gy.Cr, wy.Cr) {
+		t.Errorf("%s: the pictures differ", name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		quality int
+		q       byte
+	}{
+		{"in-band tables", 90, 255},
+		{"Q 75", 75, 75},
+		{"Q 50", 50, 50},
+		{"Q 25", 25, 25},
+	} {
+		jpg := testJPEG(t, c.quality)
+		d := &Depacketizer{}
+		frame := push(t, d, packetize(t, jpg, c.q, 100))
+		if frame == nil {
+			t.Fatalf("%s: no frame", c.name)
+		}
+		samePicture(t, c.name, frame, jpg)
+		if w, h := d.Size(); w != 64 || h != 48 {
+			t.Errorf("%s: size %dx%d, want 64x48", c.name, w, h)
+		}
+	}
+}
+
+func TestMakeTables(t *testing.T) {
+	// the tables of the Go encoder are scaled the same way
+	jpg := testJPEG(t, 75)
+	i := bytes.Index(jpg, []byte{0xff, 0xdb})
+	want := append(append([]byte{}, jpg[i+5:i+69]...), jpg[i+70:i+134]...)
+	if got := makeTables(75); !bytes.Equal(got, want) {
+		t.Errorf("makeTables(75) = %v, want %v", got, want)
+	}
+	for _, q := range []int{0, 1} {
+		for i, v := range makeTables(q) {
+			if v == 0 {
+				t.Errorf("makeTables(%d)[%d] is 0", q, i)
+			}
+		}
+	}
+}
+
+func TestInBandTablesOnce(t *testing.T) {
+	jpg := testJPEG(t, 90)
+	payloads := packetize(t, jpg, 200, 100)
+	d := &Depacketizer{}
+	if push(t, d, payloads) == nil {
+		t.Fatal("no first frame")
+	}
+
+	// the next frames may have a table header of length 0
+	first := append([]byte{}, payloads[0][:8]...)
+	first = append(first, 0, 0, 0, 0)
+	first = append(first, payloads[0][8+4+128:]...)
+	frame := push(t, d, append([][]byte{first}, payloads[1:]...))
+	if frame == nil {
+		t.Fatal("no frame with the cached tables")
+	}
+	samePicture(t, "cached tables", frame, jpg)
+
+	// unknown until they are received
+	d = &Depacketizer{}
+	if _, err := d.Push(first, false); err != ErrNoQuantTable {
+		t.Errorf("tables not received: error %v, want %v", err, ErrNoQuantTable)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	jpg := testJPEG(t, 75)
+	payloads := packetize(t, jpg, 75, 100)
+	if len(payloads) < 3 {
+		t.Fatalf("%d payloads", len(payloads))
+	}
+	d := &Depacketizer{}
+
+	// a lost fragment drops the frame, the next one is complete
+	lost := append(append([][]byte{}, payloads[:1]...), payloads[2:]...)
+	if frame := push(t, d, lost); frame != nil {
+		t.Error("frame with a lost fragment")
+	}
+	// a lost first fragment too
+	if frame := push(t, d, payloads[1:]); frame != nil {
+		t.Error("frame without its first fragment")
+	}
+	frame := push(t, d, payloads)
+	if frame == nil {
+		t.Fatal("no frame after the loss")
+	}
+	samePicture(t, "after the loss", frame, jpg)
+}
+
+func TestHeaders(t *testing.T) {
+	d := &Depacketizer{}
+	scan := []byte{1, 2, 3}
+	// type 65: 4:2:0 with a restart interval of 4 MCUs
+	p := append([]byte{0, 0, 0, 0, 65, 50, 8, 6, 0, 4, 0xff, 0xff}, scan...)
+	frame, err := d.Push(p, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(frame, []byte{0xff, 0xdd, 0, 4, 0, 4}) {
+		t.Error("no DRI for the restart interval")
+	}
+	if !bytes.Contains(frame, []byte{0xff, 0xc0, 0, 17, 8, 0, 48, 0, 64, 3, 1, 0x22, 0}) {
+		t.Error("no 64x48 4:2:0 SOF0")
+	}
+	if !bytes.HasSuffix(frame, append(scan, 0xff, 0xd9)) {
+		t.Error("no EOI after the scan")
+	}
+
+	for _, c := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"short", []byte{0, 0, 0, 0, 1, 50, 8}},
+		{"short restart header", []byte{0, 0, 0, 0, 65, 50, 8, 6, 0, 4}},
+		{"short table header", []byte{0, 0, 0, 0, 1, 255, 8, 6, 0, 0}},
+		{"table past the payload", []byte{0, 0, 0, 0, 1, 255, 8, 6, 0, 0, 0, 128, 1, 2}},
+		{"unsupported type", []byte{0, 0, 0, 0, 3, 50, 8, 6, 1}},
+	} {
+		if _, err := (&Depacketizer{}).Push(c.payload, true); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package nal
+
+import (
+	"errors"
+)
+
+var ErrShortRBSP = errors.New("nal: unexpected end of RBSP")
+
+// RBSP removes the emulation prevention bytes (0x000003) from an
+// encapsulated byte sequence payload. The input is returned as is
+// when there is nothing to remove.
+func RBSP(b []byte) []byte {
+	var res []byte
+	zeros, last := 0, 0
+	for i := 0; i < len(b); i++ {
+		if zeros >= 2 && b[i] == 0x03 {
+			if res == nil {
+				res = make([]byte, 0, len(b))
+			}
+			res = append(res, b[last:i]...)
+			last = i + 1
+			zeros = 0
+			continue
+		}
+		if b[i] == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if res == nil {
+		return b
+	}
+	return append(res, b[last:]...)
+}
+
+// bitReader reads a RBSP most significant bit first. Errors are sticky,
+// the first read past the end sets err and every next read returns zero.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func newBitReader(b []byte) *bitReader {
+	return &bitReader{b: b}
+}
+
+func (r *bitReader) u(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) bit() uint {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.b)*8 {
+		r.err = ErrShortRBSP
+		return 0
+	}
+	v := uint(r.b[r.pos>>3]>>(7-uint(r.pos&7))) & 1
+	r.pos++
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bit() == 1
+}
+
+func (r *bitReader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+	if r.pos+n > len(r.b)*8 {
+		r.err = ErrShortRBSP
+		return
+	}
+	r.pos += n
+}
+
+// Exp-Golomb unsigned
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err != nil || zeros > 31 {
+			if r.err == nil {
+				r.err = errors.New("nal: invalid Exp-Golomb code")
+			}
+			return 0
+		}
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + r.u(zeros)
+}
+
+// Exp-Golomb signed
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int((v + 1) / 2)
+	}
+	return -int(v / 2)
+}
@@ -0,0 +1,134 @@
+package nal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter writes the syntax elements of the parameter sets built by the
+// tests, most significant bit first
+type bitWriter struct {
+	b []byte
+	n int // bits
+}
+
+func (w *bitWriter) put(v uint, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) flag(v bool) {
+	if v {
+		w.put(1, 1)
+	} else {
+		w.put(0, 1)
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	bits := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		bits++
+	}
+	w.put(0, bits)
+	w.put(v+1, bits+1)
+}
+
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint(2*v - 1))
+	} else {
+		w.ue(uint(-2 * v))
+	}
+}
+
+// unit ends the RBSP with its stop bit and adds the emulation prevention
+// bytes after the header
+func (w *bitWriter) unit(header ...byte) Unit {
+	w.put(1, 1)
+	u := append(Unit{}, header...)
+	zeros := 0
+	for _, b := range w.b {
+		if zeros >= 2 && b <= 3 {
+			u = append(u, 3)
+			zeros = 0
+		}
+		u = append(u, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return u
+}
+
+func TestRBSP(t *testing.T) {
+	for _, c := range []struct {
+		in, out []byte
+	}{
+		{[]byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+		{[]byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03}, []byte{0x00, 0x00, 0x00, 0x00}},
+		{[]byte{0x00, 0x00, 0x03, 0x03}, []byte{0x00, 0x00, 0x03}},
+		{[]byte{0x00, 0x03, 0x00, 0x03}, []byte{0x00, 0x03, 0x00, 0x03}},
+		{[]byte{0x12, 0x00, 0x00, 0x03}, []byte{0x12, 0x00, 0x00}},
+		{nil, nil},
+	} {
+		if out := RBSP(c.in); !bytes.Equal(out, c.out) {
+			t.Errorf("RBSP(% x) = % x, want % x", c.in, out, c.out)
+		}
+	}
+	// nothing to remove, the input itself comes back
+	in := []byte{0x67, 0x00, 0x01, 0x00, 0x00, 0x01}
+	if out := RBSP(in); &out[0] != &in[0] {
+		t.Error("RBSP copied a payload without emulation prevention bytes")
+	}
+}
+
+func TestBitReader(t *testing.T) {
+	w := &bitWriter{}
+	values := []uint{0, 1, 2, 3, 7, 254, 255, 65535, 1<<32 - 2}
+	for _, v := range values {
+		w.ue(v)
+	}
+	signed := []int{0, 1, -1, 2, -2, 1000, -1000}
+	for _, v := range signed {
+		w.se(v)
+	}
+	w.put(0x5a, 8)
+	r := newBitReader(w.b)
+	for _, v := range values {
+		if got := r.ue(); got != v {
+			t.Errorf("ue %d, want %d", got, v)
+		}
+	}
+	for _, v := range signed {
+		if got := r.se(); got != v {
+			t.Errorf("se %d, want %d", got, v)
+		}
+	}
+	if got := r.u(8); got != 0x5a {
+		t.Errorf("u(8) %#x, want 0x5a", got)
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.skip(8)
+	if r.err != ErrShortRBSP {
+		t.Errorf("read past the end: error %v, want %v", r.err, ErrShortRBSP)
+	}
+	if r.u(8) != 0 || r.ue() != 0 || r.flag() {
+		t.Error("reads after an error are not zero")
+	}
+
+	// 33 leading zeros are not a valid Exp-Golomb code
+	r = newBitReader([]byte{0, 0, 0, 0, 0, 0xff})
+	if r.ue(); r.err == nil || r.err == ErrShortRBSP {
+		t.Errorf("long Exp-Golomb prefix: error %v", r.err)
+	}
+}
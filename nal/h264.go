@@ -0,0 +1,268 @@
+package nal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.264 nal_unit_type values used by the parsers
+const (
+	TypeNonIDR = 1
+	TypeIDR    = 5
+	TypeSEI    = 6
+	TypeSPS    = 7
+	TypePPS    = 8
+	TypeAUD    = 9
+	TypeSTAPA  = 24
+	TypeFUA    = 28
+)
+
+var (
+	ErrNotSPS = errors.New("nal: not a sequence parameter set")
+	ErrNotPPS = errors.New("nal: not a picture parameter set")
+	ErrCrop   = errors.New("nal: cropping bigger than the picture")
+)
+
+// SPS is a H.264 sequence parameter set (7.3.2.1.1)
+type SPS struct {
+	ProfileIDC      byte
+	ConstraintFlags byte // constraint_set0_flag..constraint_set5_flag, reserved_zero_2bits
+	LevelIDC        byte
+	ID              uint
+
+	ChromaFormatIDC       uint
+	SeparateColourPlane   bool
+	BitDepthLuma          uint
+	BitDepthChroma        uint
+	Log2MaxFrameNum       uint
+	PicOrderCntType       uint
+	Log2MaxPicOrderCntLsb uint
+	MaxNumRefFrames       uint
+	FrameMbsOnly          bool
+	PicWidthInMbs         uint
+	PicHeightInMapUnits   uint
+	CropLeft, CropRight   uint
+	CropTop, CropBottom   uint
+	VUIParametersPresent  bool
+	VUI                   VUI
+}
+
+// ParseSPS parses a H.264 SPS NAL unit, header included
+func ParseSPS(u Unit) (*SPS, error) {
+	if len(u) < 4 || u.Type() != TypeSPS {
+		return nil, ErrNotSPS
+	}
+	r := newBitReader(RBSP(u.Payload()))
+	s := &SPS{
+		ChromaFormatIDC: 1,
+		BitDepthLuma:    8,
+		BitDepthChroma:  8,
+	}
+	s.ProfileIDC = byte(r.u(8))
+	s.ConstraintFlags = byte(r.u(8))
+	s.LevelIDC = byte(r.u(8))
+	s.ID = r.ue()
+	switch s.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.ChromaFormatIDC = r.ue()
+		if s.ChromaFormatIDC == 3 {
+			s.SeparateColourPlane = r.flag()
+		}
+		s.BitDepthLuma = r.ue() + 8
+		s.BitDepthChroma = r.ue() + 8
+		r.skip(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			n := 8
+			if s.ChromaFormatIDC == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if !r.flag() { // seq_scaling_list_present_flag
+					continue
+				}
+				if i < 6 {
+					skipScalingList(r, 16)
+				} else {
+					skipScalingList(r, 64)
+				}
+			}
+		}
+	}
+	s.Log2MaxFrameNum = r.ue() + 4
+	s.PicOrderCntType = r.ue()
+	switch s.PicOrderCntType {
+	case 0:
+		s.Log2MaxPicOrderCntLsb = r.ue() + 4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	s.MaxNumRefFrames = r.ue()
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	s.PicWidthInMbs = r.ue() + 1
+	s.PicHeightInMapUnits = r.ue() + 1
+	s.FrameMbsOnly = r.flag()
+	if !s.FrameMbsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1)     // direct_8x8_inference_flag
+	if r.flag() { // frame_cropping_flag
+		s.CropLeft = r.ue()
+		s.CropRight = r.ue()
+		s.CropTop = r.ue()
+		s.CropBottom = r.ue()
+	}
+	s.VUIParametersPresent = r.flag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	cropUnitX, cropUnitY := s.cropUnits()
+	if s.CropLeft+s.CropRight >= s.PicWidthInMbs*16/cropUnitX ||
+		s.CropTop+s.CropBottom >= s.frameHeightInMbs()*16/cropUnitY {
+		return nil, ErrCrop
+	}
+	if s.VUIParametersPresent {
+		readVUIHead(r, &s.VUI)
+		if r.flag() { // timing_info_present_flag
+			readTimingInfo(r, &s.VUI)
+			s.VUI.FixedFrameRate = r.flag()
+		}
+		if r.err != nil {
+			// A truncated VUI is common on cheap cameras, the picture
+			// format is still valid.
+			s.VUIParametersPresent = false
+			s.VUI = VUI{}
+		}
+	}
+	return s, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// cropUnits are the luma samples of one unit of the frame cropping offsets
+func (s *SPS) cropUnits() (uint, uint) {
+	cropUnitX, cropUnitY := uint(1), uint(1)
+	if !s.FrameMbsOnly {
+		cropUnitY = 2
+	}
+	if !s.SeparateColourPlane && (s.ChromaFormatIDC == 1 || s.ChromaFormatIDC == 2) {
+		cropUnitX = 2
+	}
+	if !s.SeparateColourPlane && s.ChromaFormatIDC == 1 {
+		cropUnitY *= 2
+	}
+	return cropUnitX, cropUnitY
+}
+
+func (s *SPS) frameHeightInMbs() uint {
+	if !s.FrameMbsOnly {
+		return s.PicHeightInMapUnits * 2
+	}
+	return s.PicHeightInMapUnits
+}
+
+// Width after cropping
+func (s *SPS) Width() int {
+	cropUnitX, _ := s.cropUnits()
+	return int(s.PicWidthInMbs*16 - cropUnitX*(s.CropLeft+s.CropRight))
+}
+
+// Height after cropping
+func (s *SPS) Height() int {
+	_, cropUnitY := s.cropUnits()
+	return int(s.frameHeightInMbs()*16 - cropUnitY*(s.CropTop+s.CropBottom))
+}
+
+// FPS from the VUI timing info, 0 when not present.
+// A frame takes two ticks (field based clock).
+func (s *SPS) FPS() float64 {
+	if !s.VUI.TimingInfoPresent || s.VUI.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(s.VUI.TimeScale) / float64(2*s.VUI.NumUnitsInTick)
+}
+
+func (s *SPS) ProfileName() string {
+	switch s.ProfileIDC {
+	case 66:
+		if s.ConstraintFlags&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	case 44:
+		return "CAVLC 4:4:4 Intra"
+	}
+	return fmt.Sprintf("Profile %d", s.ProfileIDC)
+}
+
+func (s *SPS) LevelName() string {
+	if s.LevelIDC == 9 || (s.LevelIDC == 11 && s.ConstraintFlags&0x10 != 0 && (s.ProfileIDC == 66 || s.ProfileIDC == 77)) {
+		return "1b"
+	}
+	return formatLevel(int(s.LevelIDC)/10, int(s.LevelIDC)%10)
+}
+
+func (s *SPS) Info() VideoInfo {
+	return VideoInfo{
+		Codec:        "H264",
+		Profile:      s.ProfileName(),
+		Level:        s.LevelName(),
+		Width:        s.Width(),
+		Height:       s.Height(),
+		FPS:          s.FPS(),
+		BitDepth:     int(s.BitDepthLuma),
+		ChromaFormat: int(s.ChromaFormatIDC),
+		SARWidth:     s.VUI.SARWidth,
+		SARHeight:    s.VUI.SARHeight,
+		Colour:       s.VUI.Colour,
+	}
+}
+
+// PPS is the head of a H.264 picture parameter set (7.3.2.2)
+type PPS struct {
+	ID                    uint
+	SPSID                 uint
+	EntropyCodingModeFlag bool // CABAC
+}
+
+func ParsePPS(u Unit) (*PPS, error) {
+	if len(u) < 2 || u.Type() != TypePPS {
+		return nil, ErrNotPPS
+	}
+	r := newBitReader(RBSP(u.Payload()))
+	p := &PPS{}
+	p.ID = r.ue()
+	p.SPSID = r.ue()
+	p.EntropyCodingModeFlag = r.flag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
@@ -0,0 +1,134 @@
+package nal
+
+import (
+	"testing"
+)
+
+// h264SPS builds a Main profile SPS with the picture size in macroblocks
+// (map units when fields are coded) and the frame cropping offsets, left,
+// right, top and bottom
+func h264SPS(widthMbs, heightMapUnits uint, frameMbsOnly bool, crop [4]uint) Unit {
+	w := &bitWriter{}
+	w.put(77, 8) // profile_idc
+	w.put(0, 8)  // constraint flags
+	w.put(31, 8) // level_idc
+	w.ue(0)      // seq_parameter_set_id
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(2)      // pic_order_cnt_type
+	w.ue(1)      // max_num_ref_frames
+	w.flag(false)
+	w.ue(widthMbs - 1)
+	w.ue(heightMapUnits - 1)
+	w.flag(frameMbsOnly)
+	if !frameMbsOnly {
+		w.flag(true) // mb_adaptive_frame_field_flag
+	}
+	w.flag(true) // direct_8x8_inference_flag
+	w.flag(crop != [4]uint{})
+	if crop != [4]uint{} {
+		for _, c := range crop {
+			w.ue(c)
+		}
+	}
+	w.flag(false) // vui_parameters_present_flag
+	return w.unit(0x67)
+}
+
+func TestParseSPS(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		sps  Unit
+		info VideoInfo
+	}{
+		{
+			// camera, no cropping and no VUI
+			"Main 640x480",
+			Unit{0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64},
+			VideoInfo{Codec: "H264", Profile: "Main", Level: "3", Width: 640, Height: 480, BitDepth: 8, ChromaFormat: 1},
+		},
+		{
+			// x264, 1088 lines cropped to 1080, emulation prevention in
+			// the VUI timing info
+			"High 1080p",
+			Unit{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+				0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58},
+			VideoInfo{Codec: "H264", Profile: "High", Level: "4", Width: 1920, Height: 1080, FPS: 30, BitDepth: 8, ChromaFormat: 1,
+				SARWidth: 1, SARHeight: 1, Colour: Colour{ColourPrimaries: 2, TransferCharacteristics: 2, MatrixCoefficients: 2}},
+		},
+		{
+			// the crop unit of fields is 4 lines in 4:2:0
+			"interlaced 1080i",
+			h264SPS(120, 34, false, [4]uint{0, 0, 0, 2}),
+			VideoInfo{Codec: "H264", Profile: "Main", Level: "3.1", Width: 1920, Height: 1080, BitDepth: 8, ChromaFormat: 1},
+		},
+		{
+			"cropped on every side",
+			h264SPS(40, 30, true, [4]uint{4, 4, 2, 2}),
+			VideoInfo{Codec: "H264", Profile: "Main", Level: "3.1", Width: 624, Height: 472, BitDepth: 8, ChromaFormat: 1},
+		},
+	} {
+		sps, err := ParseSPS(c.sps)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if info := sps.Info(); info != c.info {
+			t.Errorf("%s: %+v, want %+v", c.name, info, c.info)
+		}
+	}
+}
+
+func TestParseSPSFields(t *testing.T) {
+	sps, err := ParseSPS(Unit{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SPS{
+		ProfileIDC:            100,
+		LevelIDC:              40,
+		ChromaFormatIDC:       1,
+		BitDepthLuma:          8,
+		BitDepthChroma:        8,
+		Log2MaxFrameNum:       4,
+		Log2MaxPicOrderCntLsb: 6,
+		MaxNumRefFrames:       4,
+		FrameMbsOnly:          true,
+		PicWidthInMbs:         120,
+		PicHeightInMapUnits:   68,
+		CropBottom:            4,
+		VUIParametersPresent:  true,
+		VUI: VUI{
+			SARWidth:          1,
+			SARHeight:         1,
+			VideoFormat:       5,
+			Colour:            Colour{ColourPrimaries: 2, TransferCharacteristics: 2, MatrixCoefficients: 2},
+			TimingInfoPresent: true,
+			NumUnitsInTick:    1,
+			TimeScale:         60,
+		},
+	}
+	if *sps != want {
+		t.Errorf("%+v, want %+v", *sps, want)
+	}
+}
+
+func TestParseSPSErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		sps  Unit
+		err  error
+	}{
+		{"PPS", Unit{0x68, 0xee, 0x3c, 0x80}, ErrNotSPS},
+		{"too short", Unit{0x67, 0x4d, 0x00}, ErrNotSPS},
+		{"truncated", Unit{0x67, 0x4d, 0x00, 0x1e, 0x95}, ErrShortRBSP},
+		{"crop as wide as the picture", h264SPS(40, 30, true, [4]uint{160, 160, 0, 0}), ErrCrop},
+		{"crop as high as the picture", h264SPS(40, 30, true, [4]uint{0, 0, 120, 120}), ErrCrop},
+		{"crop past the fields", h264SPS(120, 34, false, [4]uint{0, 0, 0, 272}), ErrCrop},
+		{"huge crop", h264SPS(40, 30, true, [4]uint{0, 1 << 31, 0, 0}), ErrCrop},
+	} {
+		if _, err := ParseSPS(c.sps); err != c.err {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+		}
+	}
+}
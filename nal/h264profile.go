@@ -0,0 +1,115 @@
+package nal
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// H264Profile is a H.264 profile as negotiated in SDP (RFC 6184 table 5),
+// the constrained profiles are told apart by the constraint flags
+type H264Profile int
+
+const (
+	H264ProfileUnknown H264Profile = iota
+	H264ProfileConstrainedBaseline
+	H264ProfileBaseline
+	H264ProfileMain
+	H264ProfileExtended
+	H264ProfileConstrainedHigh
+	H264ProfileHigh
+	H264ProfileHigh10
+	H264ProfileHigh422
+	H264ProfileHigh444
+)
+
+func (p H264Profile) String() string {
+	switch p {
+	case H264ProfileConstrainedBaseline:
+		return "Constrained Baseline"
+	case H264ProfileBaseline:
+		return "Baseline"
+	case H264ProfileMain:
+		return "Main"
+	case H264ProfileExtended:
+		return "Extended"
+	case H264ProfileConstrainedHigh:
+		return "Constrained High"
+	case H264ProfileHigh:
+		return "High"
+	case H264ProfileHigh10:
+		return "High 10"
+	case H264ProfileHigh422:
+		return "High 4:2:2"
+	case H264ProfileHigh444:
+		return "High 4:4:4 Predictive"
+	}
+	return "unknown profile"
+}
+
+// ProfileLevelID is the profile-level-id of the SPS for SDP
+func (s *SPS) ProfileLevelID() string {
+	return fmt.Sprintf("%02x%02x%02x", s.ProfileIDC, s.ConstraintFlags, s.LevelIDC)
+}
+
+// ParseProfileLevelID returns the profile and the level_idc of a
+// profile-level-id
+func ParseProfileLevelID(plid string) (H264Profile, byte, error) {
+	b, err := hex.DecodeString(plid)
+	if err != nil || len(b) != 3 {
+		return H264ProfileUnknown, 0, fmt.Errorf("nal: bad profile-level-id %q", plid)
+	}
+	idc, iop := b[0], b[1]
+	p := H264ProfileUnknown
+	switch idc {
+	case 66:
+		p = H264ProfileBaseline
+		if iop&0x40 != 0 {
+			p = H264ProfileConstrainedBaseline
+		}
+	case 77:
+		p = H264ProfileMain
+		if iop&0x80 != 0 {
+			p = H264ProfileConstrainedBaseline
+		}
+	case 88:
+		p = H264ProfileExtended
+		if iop&0xC0 == 0xC0 {
+			p = H264ProfileConstrainedBaseline
+		} else if iop&0x80 != 0 {
+			p = H264ProfileBaseline
+		}
+	case 100:
+		p = H264ProfileHigh
+		if iop&0x0C == 0x0C {
+			p = H264ProfileConstrainedHigh
+		}
+	case 110:
+		p = H264ProfileHigh10
+	case 122:
+		p = H264ProfileHigh422
+	case 244:
+		p = H264ProfileHigh444
+	}
+	return p, b[2], nil
+}
+
+// Decodes reports whether a decoder of the profile plays streams of the
+// profile s. Every profile but Baseline is a subset of the bigger High
+// profiles, Constrained Baseline plays everywhere.
+func (p H264Profile) Decodes(s H264Profile) bool {
+	if p == H264ProfileUnknown || s == H264ProfileUnknown {
+		return false
+	}
+	if p == s || s == H264ProfileConstrainedBaseline {
+		return true
+	}
+	switch s {
+	case H264ProfileBaseline:
+		return p == H264ProfileExtended
+	case H264ProfileMain, H264ProfileConstrainedHigh:
+		return p >= H264ProfileHigh
+	case H264ProfileHigh, H264ProfileHigh10, H264ProfileHigh422:
+		return p > s
+	}
+	return false
+}
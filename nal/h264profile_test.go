@@ -0,0 +1,77 @@
+package nal
+
+import (
+	"testing"
+)
+
+func TestParseProfileLevelID(t *testing.T) {
+	for _, c := range []struct {
+		plid    string
+		profile H264Profile
+		level   byte
+		err     bool
+	}{
+		// constraint_set1 tells Constrained Baseline from Baseline
+		{"42e01f", H264ProfileConstrainedBaseline, 0x1f, false},
+		{"42401f", H264ProfileConstrainedBaseline, 0x1f, false},
+		{"42001f", H264ProfileBaseline, 0x1f, false},
+		{"42801f", H264ProfileBaseline, 0x1f, false},
+		{"4d001f", H264ProfileMain, 0x1f, false},
+		{"4d801f", H264ProfileConstrainedBaseline, 0x1f, false},
+		{"58c01e", H264ProfileConstrainedBaseline, 0x1e, false},
+		{"58801e", H264ProfileBaseline, 0x1e, false},
+		{"58001e", H264ProfileExtended, 0x1e, false},
+		{"640c1f", H264ProfileConstrainedHigh, 0x1f, false},
+		{"64081f", H264ProfileHigh, 0x1f, false},
+		{"640028", H264ProfileHigh, 0x28, false},
+		{"6e001f", H264ProfileHigh10, 0x1f, false},
+		{"7a001f", H264ProfileHigh422, 0x1f, false},
+		{"F4001F", H264ProfileHigh444, 0x1f, false},
+		{"2c001f", H264ProfileUnknown, 0x1f, false}, // CAVLC 4:4:4 Intra
+		{"42e0", H264ProfileUnknown, 0, true},
+		{"42e01f00", H264ProfileUnknown, 0, true},
+		{"zze01f", H264ProfileUnknown, 0, true},
+		{"", H264ProfileUnknown, 0, true},
+	} {
+		p, level, err := ParseProfileLevelID(c.plid)
+		if (err != nil) != c.err {
+			t.Errorf("%q: error %v", c.plid, err)
+			continue
+		}
+		if p != c.profile || level != c.level {
+			t.Errorf("%q: %s level %#x, want %s level %#x", c.plid, p, level, c.profile, c.level)
+		}
+	}
+}
+
+func TestH264ProfileDecodes(t *testing.T) {
+	for _, c := range []struct {
+		decoder, stream H264Profile
+		decodes         bool
+	}{
+		{H264ProfileConstrainedBaseline, H264ProfileConstrainedBaseline, true},
+		{H264ProfileConstrainedBaseline, H264ProfileBaseline, false},
+		{H264ProfileConstrainedBaseline, H264ProfileMain, false},
+		{H264ProfileBaseline, H264ProfileConstrainedBaseline, true},
+		{H264ProfileBaseline, H264ProfileMain, false},
+		{H264ProfileMain, H264ProfileConstrainedBaseline, true},
+		{H264ProfileMain, H264ProfileBaseline, false},
+		{H264ProfileMain, H264ProfileHigh, false},
+		{H264ProfileExtended, H264ProfileBaseline, true},
+		{H264ProfileConstrainedHigh, H264ProfileMain, false},
+		{H264ProfileConstrainedHigh, H264ProfileConstrainedBaseline, true},
+		{H264ProfileHigh, H264ProfileMain, true},
+		{H264ProfileHigh, H264ProfileConstrainedHigh, true},
+		{H264ProfileHigh, H264ProfileBaseline, false},
+		{H264ProfileHigh, H264ProfileHigh10, false},
+		{H264ProfileHigh10, H264ProfileHigh, true},
+		{H264ProfileHigh444, H264ProfileHigh422, true},
+		{H264ProfileHigh422, H264ProfileHigh444, false},
+		{H264ProfileUnknown, H264ProfileConstrainedBaseline, false},
+		{H264ProfileHigh, H264ProfileUnknown, false},
+	} {
+		if d := c.decoder.Decodes(c.stream); d != c.decodes {
+			t.Errorf("%s decodes %s: %v, want %v", c.decoder, c.stream, d, c.decodes)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package nal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.265 nal_unit_type values used by the parsers
+const (
+	HEVCTypeIDRWRADL = 19
+	HEVCTypeIDRNLP   = 20
+	HEVCTypeCRA      = 21
+	HEVCTypeVPS      = 32
+	HEVCTypeSPS      = 33
+	HEVCTypePPS      = 34
+	HEVCTypeAUD      = 35
+	HEVCTypeAP       = 48
+	HEVCTypeFU       = 49
+)
+
+var ErrNotVPS = errors.New("nal: not a video parameter set")
+
+// HEVC nal_unit_type, the header is two bytes long
+func (u Unit) HEVCType() byte {
+	return u[0] >> 1 & 0x3F
+}
+
+// ProfileTierLevel holds the general part of profile_tier_level() (7.3.3)
+type ProfileTierLevel struct {
+	ProfileSpace byte
+	TierFlag     bool
+	ProfileIDC   byte
+	Compat       uint32
+	LevelIDC     byte
+}
+
+func readProfileTierLevel(r *bitReader, maxSubLayersMinus1 uint) ProfileTierLevel {
+	var p ProfileTierLevel
+	p.ProfileSpace = byte(r.u(2))
+	p.TierFlag = r.flag()
+	p.ProfileIDC = byte(r.u(5))
+	p.Compat = uint32(r.u(32))
+	r.skip(4)  // progressive, interlaced, non_packed, frame_only
+	r.skip(44) // reserved / constraint flags
+	p.LevelIDC = byte(r.u(8))
+
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := range profilePresent {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.skip(2) // reserved_zero_2bits
+		}
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+	return p
+}
+
+func (p ProfileTierLevel) ProfileName() string {
+	idc := p.ProfileIDC
+	if idc == 0 {
+		// Some encoders only signal the compatibility flags
+		for i := byte(1); i < 32; i++ {
+			if p.Compat&(1<<(31-i)) != 0 {
+				idc = i
+				break
+			}
+		}
+	}
+	switch idc {
+	case 1:
+		return "Main"
+	case 2:
+		return "Main 10"
+	case 3:
+		return "Main Still Picture"
+	case 4:
+		return "Range Extensions"
+	case 5:
+		return "High Throughput"
+	case 9:
+		return "Screen Content"
+	}
+	return fmt.Sprintf("Profile %d", idc)
+}
+
+func (p ProfileTierLevel) LevelName() string {
+	// general_level_idc is 30 times the level number
+	l := formatLevel(int(p.LevelIDC)/30, int(p.LevelIDC)%30/3)
+	if p.TierFlag {
+		return l + " High"
+	}
+	return l
+}
+
+// HEVCVPS is the head of a H.265 video parameter set (7.3.2.1)
+type HEVCVPS struct {
+	ID                 uint
+	MaxSubLayersMinus1 uint
+	PTL                ProfileTierLevel
+	TimingInfoPresent  bool
+	NumUnitsInTick     uint32
+	TimeScale          uint32
+}
+
+func ParseHEVCVPS(u Unit) (*HEVCVPS, error) {
+	if len(u) < 3 || u.HEVCType() != HEVCTypeVPS {
+		return nil, ErrNotVPS
+	}
+	r := newBitReader(RBSP(u[2:]))
+	v := &HEVCVPS{}
+	v.ID = r.u(4)
+	r.skip(2) // vps_base_layer_internal_flag, vps_base_layer_available_flag
+	r.skip(6) // vps_max_layers_minus1
+	v.MaxSubLayersMinus1 = r.u(3)
+	r.skip(1)  // vps_temporal_id_nesting_flag
+	r.skip(16) // vps_reserved_0xffff_16bits
+	v.PTL = readProfileTierLevel(r, v.MaxSubLayersMinus1)
+	ordering := r.flag()
+	i := v.MaxSubLayersMinus1
+	if ordering {
+		i = 0
+	}
+	for ; i <= v.MaxSubLayersMinus1 && r.err == nil; i++ {
+		r.ue() // vps_max_dec_pic_buffering_minus1
+		r.ue() // vps_max_num_reorder_pics
+		r.ue() // vps_max_latency_increase_plus1
+	}
+	maxLayerID := int(r.u(6))
+	numLayerSets := r.ue() + 1
+	for i := uint(1); i < numLayerSets && r.err == nil; i++ {
+		r.skip(maxLayerID + 1) // layer_id_included_flag
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.flag() { // vps_timing_info_present_flag
+		num := uint32(r.u(32))
+		scale := uint32(r.u(32))
+		if r.err == nil {
+			v.TimingInfoPresent = true
+			v.NumUnitsInTick, v.TimeScale = num, scale
+		}
+	}
+	return v, nil
+}
+
+func (v *HEVCVPS) FPS() float64 {
+	if !v.TimingInfoPresent || v.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(v.TimeScale) / float64(v.NumUnitsInTick)
+}
+
+// HEVCSPS is a H.265 sequence parameter set (7.3.2.2.1)
+type HEVCSPS struct {
+	VPSID              uint
+	MaxSubLayersMinus1 uint
+	PTL                ProfileTierLevel
+	ID                 uint
+
+	ChromaFormatIDC       uint
+	SeparateColourPlane   bool
+	PicWidth              uint
+	PicHeight             uint
+	ConfWinLeft           uint
+	ConfWinRight          uint
+	ConfWinTop            uint
+	ConfWinBottom         uint
+	BitDepthLuma          uint
+	BitDepthChroma        uint
+	Log2MaxPicOrderCntLsb uint
+
+	VUIParametersPresent bool
+	VUI                  VUI
+}
+
+func ParseHEVCSPS(u Unit) (*HEVCSPS, error) {
+	if len(u) < 3 || u.HEVCType() != HEVCTypeSPS {
+		return nil, ErrNotSPS
+	}
+	r := newBitReader(RBSP(u[2:]))
+	s := &HEVCSPS{}
+	s.VPSID = r.u(4)
+	s.MaxSubLayersMinus1 = r.u(3)
+	r.skip(1) // sps_temporal_id_nesting_flag
+	s.PTL = readProfileTierLevel(r, s.MaxSubLayersMinus1)
+	s.ID = r.ue()
+	s.ChromaFormatIDC = r.ue()
+	if s.ChromaFormatIDC == 3 {
+		s.SeparateColourPlane = r.flag()
+	}
+	s.PicWidth = r.ue()
+	s.PicHeight = r.ue()
+	if r.flag() { // conformance_window_flag
+		s.ConfWinLeft = r.ue()
+		s.ConfWinRight = r.ue()
+		s.ConfWinTop = r.ue()
+		s.ConfWinBottom = r.ue()
+	}
+	s.BitDepthLuma = r.ue() + 8
+	s.BitDepthChroma = r.ue() + 8
+	s.Log2MaxPicOrderCntLsb = r.ue() + 4
+	if r.err != nil {
+		return nil, r.err
+	}
+	subWidth, subHeight := s.subWidthHeight()
+	if s.ConfWinLeft+s.ConfWinRight >= s.PicWidth/subWidth ||
+		s.ConfWinTop+s.ConfWinBottom >= s.PicHeight/subHeight {
+		return nil, ErrCrop
+	}
+
+	// Everything below is only walked through to reach the VUI
+	ordering := r.flag()
+	i := s.MaxSubLayersMinus1
+	if ordering {
+		i = 0
+	}
+	for ; i <= s.MaxSubLayersMinus1 && r.err == nil; i++ {
+		r.ue() // sps_max_dec_pic_buffering_minus1
+		r.ue() // sps_max_num_reorder_pics
+		r.ue() // sps_max_latency_increase_plus1
+	}
+	r.ue()        // log2_min_luma_coding_block_size_minus3
+	r.ue()        // log2_diff_max_min_luma_coding_block_size
+	r.ue()        // log2_min_luma_transform_block_size_minus2
+	r.ue()        // log2_diff_max_min_luma_transform_block_size
+	r.ue()        // max_transform_hierarchy_depth_inter
+	r.ue()        // max_transform_hierarchy_depth_intra
+	if r.flag() { // scaling_list_enabled_flag
+		if r.flag() { // sps_scaling_list_data_present_flag
+			skipHEVCScalingListData(r)
+		}
+	}
+	r.skip(1)     // amp_enabled_flag
+	r.skip(1)     // sample_adaptive_offset_enabled_flag
+	if r.flag() { // pcm_enabled_flag
+		r.skip(4) // pcm_sample_bit_depth_luma_minus1
+		r.skip(4) // pcm_sample_bit_depth_chroma_minus1
+		r.ue()    // log2_min_pcm_luma_coding_block_size_minus3
+		r.ue()    // log2_diff_max_min_pcm_luma_coding_block_size
+		r.skip(1) // pcm_loop_filter_disabled_flag
+	}
+	numSets := r.ue()
+	if numSets > 64 {
+		return s, nil
+	}
+	numDeltaPocs := make([]uint, numSets)
+	for i := uint(0); i < numSets && r.err == nil; i++ {
+		numDeltaPocs[i] = skipShortTermRefPicSet(r, i, numDeltaPocs)
+	}
+	if r.flag() { // long_term_ref_pics_present_flag
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.skip(int(s.Log2MaxPicOrderCntLsb)) // lt_ref_pic_poc_lsb_sps
+			r.skip(1)                            // used_by_curr_pic_lt_sps_flag
+		}
+	}
+	r.skip(1)                      // sps_temporal_mvp_enabled_flag
+	r.skip(1)                      // strong_intra_smoothing_enabled_flag
+	if !r.flag() || r.err != nil { // vui_parameters_present_flag
+		return s, nil
+	}
+
+	var v VUI
+	readVUIHead(r, &v)
+	r.skip(1)     // neutral_chroma_indication_flag
+	r.skip(1)     // field_seq_flag
+	r.skip(1)     // frame_field_info_present_flag
+	if r.flag() { // default_display_window_flag
+		r.ue()
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+	if r.flag() { // vui_timing_info_present_flag
+		readTimingInfo(r, &v)
+	}
+	if r.err == nil {
+		s.VUIParametersPresent = true
+		s.VUI = v
+	}
+	return s, nil
+}
+
+func skipHEVCScalingListData(r *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !r.flag() { // scaling_list_pred_mode_flag
+				r.ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			coefNum := 1 << (4 + uint(sizeID)<<1)
+			if coefNum > 64 {
+				coefNum = 64
+			}
+			if sizeID > 1 {
+				r.se() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefNum && r.err == nil; i++ {
+				r.se() // scaling_list_delta_coef
+			}
+		}
+	}
+}
+
+// skipShortTermRefPicSet walks st_ref_pic_set(idx) (7.3.7) and returns NumDeltaPocs[idx]
+func skipShortTermRefPicSet(r *bitReader, idx uint, numDeltaPocs []uint) uint {
+	if idx != 0 && r.flag() { // inter_ref_pic_set_prediction_flag
+		r.skip(1) // delta_rps_sign
+		r.ue()    // abs_delta_rps_minus1
+		var n uint
+		for j := uint(0); j <= numDeltaPocs[idx-1] && r.err == nil; j++ {
+			used := r.flag()      // used_by_curr_pic_flag
+			if used || r.flag() { // use_delta_flag
+				n++
+			}
+		}
+		return n
+	}
+	neg := r.ue()
+	pos := r.ue()
+	if neg > 16 || pos > 16 {
+		r.err = errors.New("nal: invalid st_ref_pic_set")
+		return 0
+	}
+	for j := uint(0); j < neg+pos && r.err == nil; j++ {
+		r.ue()    // delta_poc_sX_minus1
+		r.skip(1) // used_by_curr_pic_sX_flag
+	}
+	return neg + pos
+}
+
+func (s *HEVCSPS) subWidthHeight() (uint, uint) {
+	if s.SeparateColourPlane {
+		return 1, 1
+	}
+	switch s.ChromaFormatIDC {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+// Width after the conformance window
+func (s *HEVCSPS) Width() int {
+	w, _ := s.subWidthHeight()
+	return int(s.PicWidth - w*(s.ConfWinLeft+s.ConfWinRight))
+}
+
+// Height after the conformance window
+func (s *HEVCSPS) Height() int {
+	_, h := s.subWidthHeight()
+	return int(s.PicHeight - h*(s.ConfWinTop+s.ConfWinBottom))
+}
+
+// FPS from the VUI timing info, 0 when not present.
+func (s *HEVCSPS) FPS() float64 {
+	if !s.VUI.TimingInfoPresent || s.VUI.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(s.VUI.TimeScale) / float64(s.VUI.NumUnitsInTick)
+}
+
+func (s *HEVCSPS) Info() VideoInfo {
+	return VideoInfo{
+		Codec:        "H265",
+		Profile:      s.PTL.ProfileName(),
+		Level:        s.PTL.LevelName(),
+		Width:        s.Width(),
+		Height:       s.Height(),
+		FPS:          s.FPS(),
+		BitDepth:     int(s.BitDepthLuma),
+		ChromaFormat: int(s.ChromaFormatIDC),
+		SARWidth:     s.VUI.SARWidth,
+		SARHeight:    s.VUI.SARHeight,
+		Colour:       s.VUI.Colour,
+	}
+}
+
+// HEVCPPS is the head of a H.265 picture parameter set (7.3.2.3.1)
+type HEVCPPS struct {
+	ID    uint
+	SPSID uint
+}
+
+func ParseHEVCPPS(u Unit) (*HEVCPPS, error) {
+	if len(u) < 3 || u.HEVCType() != HEVCTypePPS {
+		return nil, ErrNotPPS
+	}
+	r := newBitReader(RBSP(u[2:]))
+	p := &HEVCPPS{}
+	p.ID = r.ue()
+	p.SPSID = r.ue()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
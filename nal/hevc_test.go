@@ -0,0 +1,176 @@
+package nal
+
+import (
+	"testing"
+)
+
+// ffmpeg/x265 720p Main@3.1
+var (
+	hevcVPS = Unit{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	hevcSPS = Unit{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03,
+		0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00,
+		0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+)
+
+// subLayer is the profile and level of a sub-layer in profile_tier_level,
+// they are skipped by the parser
+type subLayer struct {
+	profile, level bool
+}
+
+// hevcTestSPS builds the head of a SPS up to log2_max_pic_order_cnt_lsb,
+// with the general profile, tier and level, the sub-layers and the
+// conformance window, left, right, top and bottom
+func hevcTestSPS(profile byte, tier bool, level byte, subLayers []subLayer, width, height uint, win [4]uint) Unit {
+	w := &bitWriter{}
+	w.put(0, 4) // sps_video_parameter_set_id
+	w.put(uint(len(subLayers)), 3)
+	w.flag(true) // sps_temporal_id_nesting_flag
+	w.put(0, 2)  // general_profile_space
+	w.flag(tier)
+	w.put(uint(profile), 5)
+	w.put(1<<(31-uint(profile)), 32)
+	w.put(0xb, 4) // progressive, interlaced, non_packed, frame_only
+	w.put(0, 44)  // constraint flags
+	w.put(uint(level), 8)
+	for _, l := range subLayers {
+		w.flag(l.profile)
+		w.flag(l.level)
+	}
+	if len(subLayers) > 0 {
+		for i := len(subLayers); i < 8; i++ {
+			w.put(0, 2)
+		}
+	}
+	for _, l := range subLayers {
+		if l.profile {
+			// ones to catch a parser reading them as the next fields
+			w.put(1<<44-1, 44)
+			w.put(1<<44-1, 44)
+		}
+		if l.level {
+			w.put(0xff, 8)
+		}
+	}
+	w.ue(0) // sps_seq_parameter_set_id
+	w.ue(1) // chroma_format_idc
+	w.ue(width)
+	w.ue(height)
+	w.flag(win != [4]uint{})
+	if win != [4]uint{} {
+		for _, c := range win {
+			w.ue(c)
+		}
+	}
+	w.ue(2) // bit_depth_luma_minus8
+	w.ue(2) // bit_depth_chroma_minus8
+	w.ue(4) // log2_max_pic_order_cnt_lsb_minus4
+	return w.unit(0x42, 0x01)
+}
+
+func TestParseHEVCVPS(t *testing.T) {
+	vps, err := ParseHEVCVPS(hevcVPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HEVCVPS{PTL: ProfileTierLevel{ProfileIDC: 1, Compat: 0x60000000, LevelIDC: 93}}
+	if *vps != want {
+		t.Errorf("%+v, want %+v", *vps, want)
+	}
+	if fps := vps.FPS(); fps != 0 {
+		t.Errorf("FPS %v without timing info", fps)
+	}
+	if _, err := ParseHEVCVPS(hevcSPS); err != ErrNotVPS {
+		t.Errorf("SPS: error %v, want %v", err, ErrNotVPS)
+	}
+	if _, err := ParseHEVCVPS(hevcVPS[:8]); err != ErrShortRBSP {
+		t.Errorf("truncated: error %v, want %v", err, ErrShortRBSP)
+	}
+}
+
+func TestParseHEVCSPS(t *testing.T) {
+	sps, err := ParseHEVCSPS(hevcSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := VideoInfo{Codec: "H265", Profile: "Main", Level: "3.1", Width: 1280, Height: 720, FPS: 30000.0 / 1001,
+		BitDepth: 8, ChromaFormat: 1, SARWidth: 1, SARHeight: 1,
+		Colour: Colour{ColourPrimaries: 2, TransferCharacteristics: 2, MatrixCoefficients: 2}}
+	if info := sps.Info(); info != want {
+		t.Errorf("%+v, want %+v", info, want)
+	}
+	if sps.Log2MaxPicOrderCntLsb != 8 {
+		t.Errorf("Log2MaxPicOrderCntLsb %d, want 8", sps.Log2MaxPicOrderCntLsb)
+	}
+}
+
+func TestProfileTierLevel(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		sps      Unit
+		ptl      ProfileTierLevel
+		profile  string
+		level    string
+		maxSub   uint
+		bitDepth uint
+		width    int
+		height   int
+	}{
+		{
+			"no sub-layers",
+			hevcTestSPS(2, false, 120, nil, 1920, 1088, [4]uint{0, 0, 0, 4}),
+			ProfileTierLevel{ProfileIDC: 2, Compat: 1 << 29, LevelIDC: 120}, "Main 10", "4", 0, 10, 1920, 1080,
+		},
+		{
+			"sub-layer profiles and levels",
+			hevcTestSPS(1, true, 153, []subLayer{{true, true}, {false, true}, {true, false}}, 3840, 2160, [4]uint{}),
+			ProfileTierLevel{TierFlag: true, ProfileIDC: 1, Compat: 1 << 30, LevelIDC: 153}, "Main", "5.1 High", 3, 10, 3840, 2160,
+		},
+		{
+			"sub-layers without profiles and levels",
+			hevcTestSPS(1, false, 63, []subLayer{{false, false}}, 640, 360, [4]uint{2, 2, 0, 0}),
+			ProfileTierLevel{ProfileIDC: 1, Compat: 1 << 30, LevelIDC: 63}, "Main", "2.1", 1, 10, 632, 360,
+		},
+	} {
+		sps, err := ParseHEVCSPS(c.sps)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if sps.PTL != c.ptl || sps.MaxSubLayersMinus1 != c.maxSub {
+			t.Errorf("%s: %+v with %d sub-layers, want %+v with %d", c.name, sps.PTL, sps.MaxSubLayersMinus1, c.ptl, c.maxSub)
+		}
+		if p, l := sps.PTL.ProfileName(), sps.PTL.LevelName(); p != c.profile || l != c.level {
+			t.Errorf("%s: %s@%s, want %s@%s", c.name, p, l, c.profile, c.level)
+		}
+		if sps.BitDepthLuma != c.bitDepth || sps.Width() != c.width || sps.Height() != c.height {
+			t.Errorf("%s: %d bits %dx%d, want %d bits %dx%d", c.name, sps.BitDepthLuma, sps.Width(), sps.Height(),
+				c.bitDepth, c.width, c.height)
+		}
+	}
+
+	// the profile of the compatibility flags when general_profile_idc is 0
+	if p := (ProfileTierLevel{Compat: 1 << 29}).ProfileName(); p != "Main 10" {
+		t.Errorf("compatibility flags: %s, want Main 10", p)
+	}
+}
+
+func TestParseHEVCSPSErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		sps  Unit
+		err  error
+	}{
+		{"VPS", hevcVPS, ErrNotSPS},
+		{"too short", hevcSPS[:2], ErrNotSPS},
+		{"truncated", hevcSPS[:12], ErrShortRBSP},
+		{"window as wide as the picture", hevcTestSPS(1, false, 93, nil, 1280, 720, [4]uint{320, 320, 0, 0}), ErrCrop},
+		{"window as high as the picture", hevcTestSPS(1, false, 93, nil, 1280, 720, [4]uint{0, 0, 0, 360}), ErrCrop},
+		{"empty picture", hevcTestSPS(1, false, 93, nil, 0, 720, [4]uint{}), ErrCrop},
+	} {
+		if _, err := ParseHEVCSPS(c.sps); err != c.err {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package nal
+
+// HEVCPayloader packetizes H.265 access units as RFC 7798 payloads,
+// it implements rtp.Payloader. Small NAL units in a row share an
+// aggregation packet, NAL units bigger than the MTU are fragmented.
+type HEVCPayloader struct{}
+
+// Payload splits an Annex B access unit into RTP payloads
+func (p *HEVCPayloader) Payload(mtu uint16, payload []byte) [][]byte {
+	units, _ := AnnexBSplit(payload)
+	var out [][]byte
+	var ap []Unit // pending aggregation
+	apSize := 2
+	flush := func() {
+		switch len(ap) {
+		case 0:
+		case 1:
+			out = append(out, append([]byte{}, ap[0]...))
+		default:
+			// the header takes the lowest layer and temporal ids
+			// and the F bit of any unit
+			f, layer, tid := byte(0), byte(0x3F), byte(0x07)
+			for _, u := range ap {
+				f |= u[0] & 0x80
+				if l := (u[0]&0x01)<<5 | u[1]>>3; l < layer {
+					layer = l
+				}
+				if t := u[1] & 0x07; t < tid {
+					tid = t
+				}
+			}
+			b := make([]byte, 2, apSize)
+			b[0] = f | HEVCTypeAP<<1 | layer>>5
+			b[1] = layer<<3 | tid
+			for _, u := range ap {
+				b = append(b, byte(len(u)>>8), byte(len(u)))
+				b = append(b, u...)
+			}
+			out = append(out, b)
+		}
+		ap = ap[:0]
+		apSize = 2
+	}
+
+	for _, u := range units {
+		if len(u) < 3 {
+			continue
+		}
+		if len(u) > int(mtu) {
+			flush()
+			out = append(out, fragmentHEVC(mtu, u)...)
+			continue
+		}
+		if apSize+2+len(u) > int(mtu) {
+			flush()
+		}
+		ap = append(ap, u)
+		apSize += 2 + len(u)
+	}
+	flush()
+	return out
+}
+
+// fragmentHEVC splits a NAL unit into fragmentation units
+func fragmentHEVC(mtu uint16, u Unit) [][]byte {
+	return fragment([]byte{u[0]&0x81 | HEVCTypeFU<<1, u[1]}, u.HEVCType(), u[2:], true, true, int(mtu))
+}
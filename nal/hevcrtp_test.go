@@ -0,0 +1,122 @@
+package nal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// hevcUnit is a NAL unit of the type, layer and TID with n bytes after its
+// header
+func hevcUnit(typ, layer, tid byte, n int) Unit {
+	return testUnit([]byte{typ<<1 | layer>>5, layer<<3 | tid}, n)
+}
+
+// annexB is the access unit of the units
+func annexB(units ...Unit) []byte {
+	var b []byte
+	for _, u := range units {
+		b = append(append(b, 0, 0, 0, 1), u...)
+	}
+	return b
+}
+
+// hevcHeader returns the type, layer and TID of a payload header
+func hevcHeader(p []byte) (typ, layer, tid byte) {
+	return Unit(p).HEVCType(), (p[0]&0x01)<<5 | p[1]>>3, p[1] & 0x07
+}
+
+func TestHEVCPayloaderAggregation(t *testing.T) {
+	vps, sps, pps := hevcUnit(HEVCTypeVPS, 0, 1, 20), hevcUnit(HEVCTypeSPS, 0, 1, 40), hevcUnit(HEVCTypePPS, 0, 1, 5)
+	payloads := (&HEVCPayloader{}).Payload(1200, annexB(vps, sps, pps))
+	if len(payloads) != 1 {
+		t.Fatalf("%d payloads, want an aggregation packet", len(payloads))
+	}
+	p := payloads[0]
+	if typ, layer, tid := hevcHeader(p); typ != HEVCTypeAP || layer != 0 || tid != 1 {
+		t.Errorf("AP header type %d layer %d TID %d", typ, layer, tid)
+	}
+	if want := aggregate(p[:2], vps, sps, pps); !bytes.Equal(p, want) {
+		t.Errorf("AP % x, want % x", p, want)
+	}
+
+	// the header has the lowest layer and TID of the units, and the F bit
+	// of any of them
+	a, b := hevcUnit(1, 3, 4, 10), hevcUnit(1, 2, 6, 10)
+	b[0] |= 0x80
+	p = (&HEVCPayloader{}).Payload(1200, annexB(a, b))[0]
+	if typ, layer, tid := hevcHeader(p); typ != HEVCTypeAP || layer != 2 || tid != 4 || p[0]&0x80 == 0 {
+		t.Errorf("AP header type %d layer %d TID %d F %v", typ, layer, tid, p[0]&0x80 != 0)
+	}
+
+	// a single unit isn't aggregated
+	p = (&HEVCPayloader{}).Payload(1200, annexB(a))[0]
+	if !bytes.Equal(p, a) {
+		t.Errorf("single unit sent as % x", p)
+	}
+}
+
+func TestHEVCPayloaderFragmentation(t *testing.T) {
+	const mtu = 1200
+	// IDR_W_RADL on layer 33, TID 5, with the F bit
+	idr := hevcUnit(HEVCTypeIDRWRADL, 33, 5, 3000)
+	idr[0] |= 0x80
+	payloads := (&HEVCPayloader{}).Payload(mtu, annexB(idr))
+	if len(payloads) != 3 {
+		t.Fatalf("%d fragments, want 3", len(payloads))
+	}
+	rebuilt := append([]byte(nil), idr[:2]...)
+	for i, p := range payloads {
+		if len(p) > mtu {
+			t.Errorf("fragment %d: %d bytes", i, len(p))
+		}
+		if typ, layer, tid := hevcHeader(p); typ != HEVCTypeFU || layer != 33 || tid != 5 || p[0]&0x80 == 0 {
+			t.Errorf("fragment %d: header type %d layer %d TID %d F %v", i, typ, layer, tid, p[0]&0x80 != 0)
+		}
+		fu := p[2]
+		if s := fu&0x80 != 0; s != (i == 0) {
+			t.Errorf("fragment %d: start bit %v", i, s)
+		}
+		if e := fu&0x40 != 0; e != (i == len(payloads)-1) {
+			t.Errorf("fragment %d: end bit %v", i, e)
+		}
+		if typ := fu & 0x3F; typ != HEVCTypeIDRWRADL {
+			t.Errorf("fragment %d: FU type %d", i, typ)
+		}
+		rebuilt = append(rebuilt, p[3:]...)
+	}
+	if !bytes.Equal(rebuilt, idr) {
+		t.Error("the fragments don't rebuild the unit")
+	}
+}
+
+func TestHEVCPayloaderMTU(t *testing.T) {
+	const mtu = 100
+	small := hevcUnit(1, 0, 1, 8) // 10 bytes
+	for _, c := range []struct {
+		name  string
+		units []Unit
+		sizes []int // of the payloads
+	}{
+		{"unit of the MTU", []Unit{hevcUnit(1, 0, 1, mtu-2)}, []int{mtu}},
+		{"unit over the MTU", []Unit{hevcUnit(1, 0, 1, mtu-1)}, []int{mtu, 3 + 2}}, // 3 bytes of FU headers
+		// 2 bytes of header, 2 bytes of size before each unit
+		{"AP of the MTU", []Unit{small, hevcUnit(1, 0, 1, mtu-2-2-len(small)-2-2)}, []int{mtu}},
+		{"AP over the MTU", []Unit{small, hevcUnit(1, 0, 1, mtu-2-2-len(small)-2-1)}, []int{len(small), mtu - 2 - 2 - len(small) - 2 + 1}},
+	} {
+		payloads := (&HEVCPayloader{}).Payload(mtu, annexB(c.units...))
+		var sizes []int
+		for _, p := range payloads {
+			sizes = append(sizes, len(p))
+		}
+		if len(sizes) != len(c.sizes) {
+			t.Errorf("%s: payloads of %v bytes, want %v", c.name, sizes, c.sizes)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != c.sizes[i] {
+				t.Errorf("%s: payloads of %v bytes, want %v", c.name, sizes, c.sizes)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package nal
+
+// H264RTPKeyFrame reports whether a RFC 6184 payload starts a keyframe, and
+// whether it carries the parameter sets the keyframe needs. A keyframe
+// starts with its first IDR fragment or with the parameter sets before it.
+func H264RTPKeyFrame(payload []byte) (start, params bool) {
+	if len(payload) < 2 {
+		return false, false
+	}
+	switch t := payload[0] & 0x1F; t {
+	case 5:
+		return true, false
+	case 7:
+		return true, true
+	case 24: // STAP-A
+		b := payload[1:]
+		for len(b) > 2 {
+			size := int(b[0])<<8 | int(b[1])
+			if size == 0 || len(b) < 2+size {
+				break
+			}
+			switch b[2] & 0x1F {
+			case 5:
+				start = true
+			case 7:
+				start, params = true, true
+			}
+			b = b[2+size:]
+		}
+		return start, params
+	case 28: // FU-A
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == 5, false
+	}
+	return false, false
+}
+
+// HEVCRTPKeyFrame is H264RTPKeyFrame for RFC 7798 payloads, IRAP pictures
+// are keyframes
+func HEVCRTPKeyFrame(payload []byte) (start, params bool) {
+	if len(payload) < 3 {
+		return false, false
+	}
+	irap := func(t byte) bool { return t >= 16 && t <= 21 }
+	switch t := Unit(payload).HEVCType(); {
+	case irap(t):
+		return true, false
+	case t == HEVCTypeVPS:
+		return true, true
+	case t == HEVCTypeAP:
+		b := payload[2:]
+		for len(b) > 2 {
+			size := int(b[0])<<8 | int(b[1])
+			if size < 2 || len(b) < 2+size {
+				break
+			}
+			switch u := Unit(b[2:]).HEVCType(); {
+			case irap(u):
+				start = true
+			case u == HEVCTypeVPS:
+				start, params = true, true
+			}
+			b = b[2+size:]
+		}
+		return start, params
+	case t == HEVCTypeFU:
+		return payload[2]&0x80 != 0 && irap(payload[2]&0x3F), false
+	}
+	return false, false
+}
+
+// H264ParamsPayload is a STAP-A payload of the SPS and PPS
+func H264ParamsPayload(sps, pps []byte) []byte {
+	if len(sps) == 0 || len(pps) == 0 {
+		return nil
+	}
+	b := []byte{sps[0]&0x60 | 24}
+	for _, u := range [][]byte{sps, pps} {
+		b = append(b, byte(len(u)>>8), byte(len(u)))
+		b = append(b, u...)
+	}
+	return b
+}
+
+// HEVCParamsPayload is an aggregation packet payload of the VPS, SPS and PPS
+func HEVCParamsPayload(vps, sps, pps []byte) []byte {
+	if len(vps) < 2 || len(sps) < 2 || len(pps) < 2 {
+		return nil
+	}
+	var au []byte
+	for _, u := range [][]byte{vps, sps, pps} {
+		au = append(au, 0, 0, 0, 1)
+		au = append(au, u...)
+	}
+	payloads := (&HEVCPayloader{}).Payload(1200, au)
+	if len(payloads) != 1 {
+		return nil
+	}
+	return payloads[0]
+}
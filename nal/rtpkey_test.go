@@ -0,0 +1,72 @@
+package nal
+
+import (
+	"testing"
+)
+
+// aggregate is the payload of a STAP-A, or of an AP with a 2 byte header
+func aggregate(header []byte, units ...[]byte) []byte {
+	b := append([]byte(nil), header...)
+	for _, u := range units {
+		b = append(b, byte(len(u)>>8), byte(len(u)))
+		b = append(b, u...)
+	}
+	return b
+}
+
+func TestH264RTPKeyFrame(t *testing.T) {
+	sps, pps := []byte{0x67, 0x4d, 0x00, 0x1e}, []byte{0x68, 0xee, 0x3c, 0x80}
+	for _, c := range []struct {
+		name          string
+		payload       []byte
+		start, params bool
+	}{
+		{"empty", nil, false, false},
+		{"IDR", []byte{0x65, 0x88}, true, false},
+		{"non-IDR slice", []byte{0x41, 0x9a}, false, false},
+		{"SPS", sps, true, true},
+		{"PPS", pps, false, false},
+		{"STAP-A of the parameter sets", aggregate([]byte{0x78}, sps, pps), true, true},
+		{"STAP-A of SEI and IDR", aggregate([]byte{0x78}, []byte{0x06, 0x05}, []byte{0x65, 0x88}), true, false},
+		{"STAP-A of a slice", aggregate([]byte{0x78}, []byte{0x41, 0x9a}), false, false},
+		{"STAP-A truncated", aggregate([]byte{0x78}, sps)[:4], false, false},
+		{"FU-A IDR start", []byte{0x7c, 0x85, 0x88}, true, false},
+		{"FU-A IDR middle", []byte{0x7c, 0x05, 0x88}, false, false},
+		{"FU-A IDR end", []byte{0x7c, 0x45, 0x88}, false, false},
+		{"FU-A slice start", []byte{0x7c, 0x81, 0x9a}, false, false},
+		{"parameter sets payload", H264ParamsPayload(sps, pps), true, true},
+	} {
+		if start, params := H264RTPKeyFrame(c.payload); start != c.start || params != c.params {
+			t.Errorf("%s: start %v params %v, want %v %v", c.name, start, params, c.start, c.params)
+		}
+	}
+}
+
+func TestHEVCRTPKeyFrame(t *testing.T) {
+	pps := []byte{0x44, 0x01, 0xc1, 0x73}
+	for _, c := range []struct {
+		name          string
+		payload       []byte
+		start, params bool
+	}{
+		{"empty", nil, false, false},
+		{"IDR_W_RADL", []byte{0x26, 0x01, 0xaf}, true, false},
+		{"CRA", []byte{0x2a, 0x01, 0xaf}, true, false},
+		{"TRAIL_R", []byte{0x02, 0x01, 0xd0}, false, false},
+		{"VPS", hevcVPS, true, true},
+		{"SPS", hevcSPS, false, false},
+		{"AP of the parameter sets", aggregate([]byte{0x60, 0x01}, hevcVPS, hevcSPS, pps), true, true},
+		{"AP of SEI and IDR", aggregate([]byte{0x60, 0x01}, []byte{0x4e, 0x01, 0x05}, []byte{0x26, 0x01, 0xaf}), true, false},
+		{"AP of a slice", aggregate([]byte{0x60, 0x01}, []byte{0x02, 0x01, 0xd0}), false, false},
+		{"AP truncated", aggregate([]byte{0x60, 0x01}, hevcVPS)[:8], false, false},
+		{"FU IDR start", []byte{0x62, 0x01, 0x93, 0xaf}, true, false},
+		{"FU IDR middle", []byte{0x62, 0x01, 0x13, 0xaf}, false, false},
+		{"FU IDR end", []byte{0x62, 0x01, 0x53, 0xaf}, false, false},
+		{"FU TRAIL_R start", []byte{0x62, 0x01, 0x81, 0xd0}, false, false},
+		{"parameter sets payload", HEVCParamsPayload(hevcVPS, hevcSPS, pps), true, true},
+	} {
+		if start, params := HEVCRTPKeyFrame(c.payload); start != c.start || params != c.params {
+			t.Errorf("%s: start %v params %v, want %v %v", c.name, start, params, c.start, c.params)
+		}
+	}
+}
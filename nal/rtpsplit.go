@@ -0,0 +1,89 @@
+package nal
+
+// H264RTPSplit splits a RFC 6184 payload bigger than mtu into payloads that
+// fit, for RTP packets sent on as they are: a NAL unit becomes FU-A
+// fragments, a FU-A fragment smaller ones and a STAP-A its NAL units. The
+// payloads that fit or can't be split are returned as they are.
+func H264RTPSplit(payload []byte, mtu int) [][]byte {
+	if len(payload) <= mtu || len(payload) < 2 {
+		return [][]byte{payload}
+	}
+	switch t := payload[0] & 0x1F; {
+	case t >= 1 && t <= 23:
+		return fragment([]byte{payload[0]&0xE0 | 28}, t, payload[1:], true, true, mtu)
+	case t == 24: // STAP-A
+		var out [][]byte
+		b := payload[1:]
+		for len(b) > 2 {
+			size := int(b[0])<<8 | int(b[1])
+			if size == 0 || len(b) < 2+size {
+				break
+			}
+			out = append(out, H264RTPSplit(b[2:2+size], mtu)...)
+			b = b[2+size:]
+		}
+		return out
+	case t == 28: // FU-A
+		h := payload[1]
+		return fragment(payload[:1], h&0x1F, payload[2:], h&0x80 != 0, h&0x40 != 0, mtu)
+	}
+	return [][]byte{payload}
+}
+
+// HEVCRTPSplit is H264RTPSplit for RFC 7798 payloads without DONL, with
+// fragmentation units and aggregation packets
+func HEVCRTPSplit(payload []byte, mtu int) [][]byte {
+	if len(payload) <= mtu || len(payload) < 3 {
+		return [][]byte{payload}
+	}
+	switch t := Unit(payload).HEVCType(); {
+	case t < HEVCTypeAP:
+		return fragmentHEVC(uint16(mtu), payload)
+	case t == HEVCTypeAP:
+		var out [][]byte
+		b := payload[2:]
+		for len(b) > 2 {
+			size := int(b[0])<<8 | int(b[1])
+			if size < 2 || len(b) < 2+size {
+				break
+			}
+			out = append(out, HEVCRTPSplit(b[2:2+size], mtu)...)
+			b = b[2+size:]
+		}
+		return out
+	case t == HEVCTypeFU:
+		h := payload[2]
+		return fragment(payload[:2], h&0x3F, payload[3:], h&0x80 != 0, h&0x40 != 0, mtu)
+	}
+	return [][]byte{payload}
+}
+
+// fragment splits the data of a NAL unit into fragmentation units with
+// the header, the FU header has the type and the start and end bits of
+// the first and last fragments
+func fragment(header []byte, typ byte, data []byte, start, end bool, mtu int) [][]byte {
+	overhead := len(header) + 1
+	max := mtu - overhead
+	if max <= 0 {
+		return nil
+	}
+	var out [][]byte
+	for first := true; len(data) > 0; first = false {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		b := make([]byte, overhead, overhead+n)
+		copy(b, header)
+		b[len(header)] = typ
+		if first && start {
+			b[len(header)] |= 0x80
+		}
+		if n == len(data) && end {
+			b[len(header)] |= 0x40
+		}
+		out = append(out, append(b, data[:n]...))
+		data = data[n:]
+	}
+	return out
+}
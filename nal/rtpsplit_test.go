@@ -0,0 +1,132 @@
+package nal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testUnit is a NAL unit of n bytes after the header
+func testUnit(header []byte, n int) []byte {
+	u := append([]byte(nil), header...)
+	for i := 0; i < n; i++ {
+		u = append(u, byte(i))
+	}
+	return u
+}
+
+// joinFU rebuilds the NAL unit of fragmentation units with a header of
+// size bytes, checking their start and end bits
+func joinFU(t *testing.T, payloads [][]byte, size int, typ func([]byte) byte, unit func(header []byte, typ byte) []byte, start, end bool) []byte {
+	t.Helper()
+	var u []byte
+	for i, p := range payloads {
+		h := p[size]
+		if s := h&0x80 != 0; s != (start && i == 0) {
+			t.Errorf("fragment %d: start bit %v", i, s)
+		}
+		if e := h&0x40 != 0; e != (end && i == len(payloads)-1) {
+			t.Errorf("fragment %d: end bit %v", i, e)
+		}
+		if typ(p) != 28 && typ(p) != HEVCTypeFU {
+			t.Errorf("fragment %d: type %d", i, typ(p))
+		}
+		if i == 0 {
+			u = unit(p[:size], h)
+		}
+		u = append(u, p[size+1:]...)
+	}
+	return u
+}
+
+func TestH264RTPSplit(t *testing.T) {
+	const mtu = 100
+	h264Type := func(p []byte) byte { return p[0] & 0x1F }
+	h264Unit := func(header []byte, fu byte) []byte { return []byte{header[0]&0xE0 | fu&0x1F} }
+	idr := testUnit([]byte{0x65}, 250)
+	slice := testUnit([]byte{0x41}, 60)
+
+	// a NAL unit becomes FU-A fragments with its NRI and type
+	payloads := H264RTPSplit(idr, mtu)
+	if len(payloads) != 3 {
+		t.Fatalf("%d fragments, want 3", len(payloads))
+	}
+	for i, p := range payloads {
+		if len(p) > mtu {
+			t.Errorf("fragment %d: %d bytes", i, len(p))
+		}
+	}
+	if u := joinFU(t, payloads, 1, h264Type, h264Unit, true, true); !bytes.Equal(u, idr) {
+		t.Errorf("rebuilt % x, want % x", u, idr)
+	}
+
+	// a FU-A fragment keeps its start or end bit on its first or last part
+	for _, c := range []struct {
+		name       string
+		start, end bool
+	}{{"start", true, false}, {"middle", false, false}, {"end", false, true}} {
+		fu := []byte{0x7c, 0x05}
+		if c.start {
+			fu[1] |= 0x80
+		}
+		if c.end {
+			fu[1] |= 0x40
+		}
+		fu = append(fu, idr[1:]...)
+		payloads := H264RTPSplit(fu, mtu)
+		if u := joinFU(t, payloads, 1, h264Type, h264Unit, c.start, c.end); !bytes.Equal(u, idr) {
+			t.Errorf("%s FU-A: rebuilt % x, want % x", c.name, u, idr)
+		}
+	}
+
+	// a STAP-A gives its NAL units, the big ones fragmented
+	payloads = H264RTPSplit(aggregate([]byte{0x78}, slice, idr), mtu)
+	if len(payloads) != 4 || !bytes.Equal(payloads[0], slice) {
+		t.Fatalf("STAP-A split in %d payloads, want the slice and 3 fragments", len(payloads))
+	}
+	if u := joinFU(t, payloads[1:], 1, h264Type, h264Unit, true, true); !bytes.Equal(u, idr) {
+		t.Errorf("STAP-A unit rebuilt % x, want % x", u, idr)
+	}
+
+	// the ones that fit are kept
+	if payloads := H264RTPSplit(slice, mtu); len(payloads) != 1 || !bytes.Equal(payloads[0], slice) {
+		t.Errorf("payload that fits split in %d", len(payloads))
+	}
+}
+
+func TestHEVCRTPSplit(t *testing.T) {
+	const mtu = 100
+	hevcType := func(p []byte) byte { return Unit(p).HEVCType() }
+	hevcUnit := func(header []byte, fu byte) []byte {
+		return []byte{header[0]&0x81 | (fu&0x3F)<<1, header[1]}
+	}
+	// IDR_W_RADL, layer 0, TID 1
+	idr := testUnit([]byte{0x26, 0x01}, 250)
+	trail := testUnit([]byte{0x02, 0x01}, 60)
+
+	payloads := HEVCRTPSplit(idr, mtu)
+	for i, p := range payloads {
+		if len(p) > mtu {
+			t.Errorf("fragment %d: %d bytes", i, len(p))
+		}
+	}
+	if u := joinFU(t, payloads, 2, hevcType, hevcUnit, true, true); !bytes.Equal(u, idr) {
+		t.Errorf("rebuilt % x, want % x", u, idr)
+	}
+
+	fu := append([]byte{0x62, 0x01, 0x13}, idr[2:]...) // end fragment
+	if u := joinFU(t, HEVCRTPSplit(fu, mtu), 2, hevcType, hevcUnit, false, false); !bytes.Equal(u, idr) {
+		t.Errorf("middle FU rebuilt % x, want % x", u, idr)
+	}
+	fu[2] |= 0x40
+	if u := joinFU(t, HEVCRTPSplit(fu, mtu), 2, hevcType, hevcUnit, false, true); !bytes.Equal(u, idr) {
+		t.Errorf("end FU rebuilt % x, want % x", u, idr)
+	}
+
+	payloads = HEVCRTPSplit(aggregate([]byte{0x60, 0x01}, trail, idr), mtu)
+	if len(payloads) < 2 || !bytes.Equal(payloads[0], trail) {
+		t.Fatalf("AP split in %d payloads, want the trailing picture and the fragments", len(payloads))
+	}
+	if u := joinFU(t, payloads[1:], 2, hevcType, hevcUnit, true, true); !bytes.Equal(u, idr) {
+		t.Errorf("AP unit rebuilt % x, want % x", u, idr)
+	}
+}
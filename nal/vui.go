@@ -0,0 +1,101 @@
+package nal
+
+import (
+	"fmt"
+)
+
+// VideoInfo is the codec independent summary of the active parameter sets.
+// It is comparable, so a change of the picture format can be detected with !=
+type VideoInfo struct {
+	Codec        string  `json:"codec"`
+	Profile      string  `json:"profile"`
+	Level        string  `json:"level"`
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	FPS          float64 `json:"fps,omitempty"`
+	BitDepth     int     `json:"bit_depth"`
+	ChromaFormat int     `json:"chroma_format"`
+	SARWidth     int     `json:"sar_width,omitempty"`
+	SARHeight    int     `json:"sar_height,omitempty"`
+	Colour       Colour  `json:"colour"`
+}
+
+func (i VideoInfo) String() string {
+	return fmt.Sprintf("%s %s@%s %dx%d %.2ffps", i.Codec, i.Profile, i.Level, i.Width, i.Height, i.FPS)
+}
+
+// Colour description, values as in ITU-T H.273
+type Colour struct {
+	FullRange               bool `json:"full_range"`
+	ColourPrimaries         byte `json:"colour_primaries"`
+	TransferCharacteristics byte `json:"transfer_characteristics"`
+	MatrixCoefficients      byte `json:"matrix_coefficients"`
+}
+
+// Video Usability Information, only the fields preceding the HRD
+// parameters are parsed, they are the ones useful for presentation.
+type VUI struct {
+	SARWidth  int
+	SARHeight int
+
+	VideoFormat byte
+	Colour      Colour
+
+	TimingInfoPresent bool
+	NumUnitsInTick    uint32
+	TimeScale         uint32
+	FixedFrameRate    bool // H.264 only
+}
+
+// Table E-1 sample aspect ratio indicator
+var sarTable = [...][2]int{
+	{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11},
+	{32, 11}, {80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// readVUIHead reads the part shared by H.264 and H.265 up to the chroma
+// location info. Unspecified colour description keeps the value 2.
+func readVUIHead(r *bitReader, v *VUI) {
+	if r.flag() { // aspect_ratio_info_present_flag
+		idc := int(r.u(8))
+		if idc == 255 { // Extended_SAR
+			v.SARWidth = int(r.u(16))
+			v.SARHeight = int(r.u(16))
+		} else if idc < len(sarTable) {
+			v.SARWidth, v.SARHeight = sarTable[idc][0], sarTable[idc][1]
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.skip(1) // overscan_appropriate_flag
+	}
+	v.VideoFormat = 5
+	v.Colour.ColourPrimaries = 2
+	v.Colour.TransferCharacteristics = 2
+	v.Colour.MatrixCoefficients = 2
+	if r.flag() { // video_signal_type_present_flag
+		v.VideoFormat = byte(r.u(3))
+		v.Colour.FullRange = r.flag()
+		if r.flag() { // colour_description_present_flag
+			v.Colour.ColourPrimaries = byte(r.u(8))
+			v.Colour.TransferCharacteristics = byte(r.u(8))
+			v.Colour.MatrixCoefficients = byte(r.u(8))
+		}
+	}
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue() // chroma_sample_loc_type_top_field
+		r.ue() // chroma_sample_loc_type_bottom_field
+	}
+}
+
+func readTimingInfo(r *bitReader, v *VUI) {
+	v.TimingInfoPresent = true
+	v.NumUnitsInTick = uint32(r.u(32))
+	v.TimeScale = uint32(r.u(32))
+}
+
+func formatLevel(major, minor int) string {
+	if minor == 0 {
+		return fmt.Sprintf("%d", major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
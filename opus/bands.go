@@ -0,0 +1,584 @@
+package opus
+
+import (
+	"math"
+	"math/bits"
+)
+
+// bitRes is the resolution of the allocation, in 1/8 bits
+const bitRes = 3
+
+const (
+	allocSteps  = 6
+	maxFineBits = 8
+	fineOffset  = 21
+	thetaOffset = 4
+	spreadNorm  = 2
+)
+
+// allocation of the bits of a frame to the bands, 4.3.3
+type allocation struct {
+	codedBands   int
+	balance      int
+	pulses       [nbBands]int // shape bits in 1/8 bits
+	fineQuant    [nbBands]int
+	finePriority [nbBands]int
+}
+
+// caps of the bands of a mono 20 ms frame in 1/8 bits
+func allocCaps() (caps [nbBands]int) {
+	for i := range caps {
+		n := (bandEdges[i+1] - bandEdges[i]) << frameLM
+		caps[i] = (bandCaps[i] + 64) * n >> 2
+	}
+	return caps
+}
+
+// allocate follows clt_compute_allocation of the reference implementation
+// for a mono frame without dynamic allocation, total is in 1/8 bits. The
+// encoder decides which bands are coded, it keeps all of them and codes
+// the skip flag of the first band where the decoder reads one.
+func allocate(rc *rangeEncoder, trim, total int) *allocation {
+	a := &allocation{}
+	caps := allocCaps()
+	if total < 0 {
+		total = 0
+	}
+	skipRsv := 0
+	if total >= 1<<bitRes {
+		skipRsv = 1 << bitRes
+	}
+	total -= skipRsv
+
+	var bits1, bits2, thresh, trimOffset [nbBands]int
+	for j := 0; j < nbBands; j++ {
+		w := bandEdges[j+1] - bandEdges[j]
+		thresh[j] = 3 * (w << frameLM << bitRes) >> 4
+		if thresh[j] < 1<<bitRes {
+			thresh[j] = 1 << bitRes
+		}
+		trimOffset[j] = w * (trim - 5 - frameLM) * (nbBands - j - 1) * (1 << (frameLM + bitRes)) >> 6
+		if w<<frameLM == 1 {
+			trimOffset[j] -= 1 << bitRes
+		}
+	}
+
+	// the highest static allocation vector that fits
+	lo, hi := 1, len(bandAllocation)-1
+	for lo <= hi {
+		mid := (lo + hi) >> 1
+		psum := 0
+		done := false
+		for j := nbBands - 1; j >= 0; j-- {
+			w := bandEdges[j+1] - bandEdges[j]
+			b := w * bandAllocation[mid][j] << frameLM >> 2
+			if b > 0 {
+				b = maxInt(0, b+trimOffset[j])
+			}
+			if b >= thresh[j] || done {
+				done = true
+				psum += minInt(b, caps[j])
+			} else if b >= 1<<bitRes {
+				psum += 1 << bitRes
+			}
+		}
+		if psum > total {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	hi = lo
+	lo--
+	for j := 0; j < nbBands; j++ {
+		w := bandEdges[j+1] - bandEdges[j]
+		b1 := w * bandAllocation[lo][j] << frameLM >> 2
+		b2 := caps[j]
+		if hi < len(bandAllocation) {
+			b2 = w * bandAllocation[hi][j] << frameLM >> 2
+		}
+		if b1 > 0 {
+			b1 = maxInt(0, b1+trimOffset[j])
+		}
+		if b2 > 0 {
+			b2 = maxInt(0, b2+trimOffset[j])
+		}
+		bits1[j] = b1
+		bits2[j] = maxInt(0, b2-b1)
+	}
+
+	// interpolate between the two vectors in 1/64 steps
+	lo, hi = 0, 1<<allocSteps
+	for i := 0; i < allocSteps; i++ {
+		mid := (lo + hi) >> 1
+		psum := 0
+		done := false
+		for j := nbBands - 1; j >= 0; j-- {
+			tmp := bits1[j] + (mid * bits2[j] >> allocSteps)
+			if tmp >= thresh[j] || done {
+				done = true
+				psum += minInt(tmp, caps[j])
+			} else if tmp >= 1<<bitRes {
+				psum += 1 << bitRes
+			}
+		}
+		if psum > total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	psum := 0
+	done := false
+	b := &a.pulses
+	for j := nbBands - 1; j >= 0; j-- {
+		tmp := bits1[j] + (lo * bits2[j] >> allocSteps)
+		if tmp < thresh[j] && !done {
+			if tmp >= 1<<bitRes {
+				tmp = 1 << bitRes
+			} else {
+				tmp = 0
+			}
+		} else {
+			done = true
+		}
+		tmp = minInt(tmp, caps[j])
+		b[j] = tmp
+		psum += tmp
+	}
+
+	// bands the decoder can skip, we keep the first one that can be
+	codedBands := nbBands
+	for {
+		codedBands--
+		j := codedBands
+		if j <= 0 {
+			total += skipRsv
+			codedBands++
+			break
+		}
+		left := total - psum
+		percoeff := left / bandEdges[codedBands+1]
+		left -= bandEdges[codedBands+1] * percoeff
+		rem := maxInt(left-bandEdges[j], 0)
+		bandWidth := bandEdges[codedBands+1] - bandEdges[j]
+		bandBits := b[j] + percoeff*bandWidth + rem
+		if bandBits >= maxInt(thresh[j], 2<<bitRes) {
+			rc.bitLogp(true, 1)
+			codedBands++
+			break
+		}
+		psum -= b[j]
+		if bandBits >= 1<<bitRes {
+			psum += 1 << bitRes
+			b[j] = 1 << bitRes
+		} else {
+			b[j] = 0
+		}
+	}
+
+	// spread what is left over the coded bins
+	left := total - psum
+	percoeff := left / bandEdges[codedBands]
+	left -= bandEdges[codedBands] * percoeff
+	for j := 0; j < codedBands; j++ {
+		b[j] += percoeff * (bandEdges[j+1] - bandEdges[j])
+	}
+	for j := 0; j < codedBands; j++ {
+		tmp := minInt(left, bandEdges[j+1]-bandEdges[j])
+		b[j] += tmp
+		left -= tmp
+	}
+
+	// split the bits of every band between the fine energy and the shape
+	balance := 0
+	j := 0
+	for ; j < codedBands; j++ {
+		n := (bandEdges[j+1] - bandEdges[j]) << frameLM
+		b[j] += balance
+		excess := maxInt(b[j]-caps[j], 0)
+		b[j] -= excess
+		ncLogN := n * (logN400[j] + frameLM<<bitRes)
+		offset := ncLogN>>1 - n*fineOffset
+		if b[j]+offset < n*2<<bitRes {
+			offset += ncLogN >> 2
+		} else if b[j]+offset < n*3<<bitRes {
+			offset += ncLogN >> 3
+		}
+		fine := maxInt(0, (b[j]+offset+n<<(bitRes-1))/(n<<bitRes))
+		if fine > b[j]>>bitRes {
+			fine = b[j] >> bitRes
+		}
+		fine = minInt(fine, maxFineBits)
+		a.finePriority[j] = boolInt(fine*(n<<bitRes) >= b[j]+offset)
+		b[j] -= fine << bitRes
+		if excess > 0 {
+			extra := minInt(excess>>bitRes, maxFineBits-fine)
+			fine += extra
+			a.finePriority[j] = boolInt(extra<<bitRes >= excess-balance)
+			excess -= extra << bitRes
+		}
+		a.fineQuant[j] = fine
+		balance = excess
+	}
+	a.balance = balance
+	for ; j < nbBands; j++ {
+		a.fineQuant[j] = b[j] >> bitRes
+		b[j] = 0
+		a.finePriority[j] = boolInt(a.fineQuant[j] < 1)
+	}
+	a.codedBands = codedBands
+	return a
+}
+
+// bitsToPulses is the pulse count of a band whose cost is the closest to
+// bits, in the pulse cache of lm
+func bitsToPulses(band, lm, bits int) int {
+	start := pulseCacheIndex[(lm+1)*nbBands+band]
+	if bits <= 0 || start < 0 {
+		return 0
+	}
+	cache := pulseCacheBits[start:]
+	lo, hi := 0, cache[0]
+	bits--
+	for i := 0; i < 6; i++ {
+		mid := (lo + hi + 1) >> 1
+		if cache[mid] >= bits {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	loBits := -1
+	if lo != 0 {
+		loBits = cache[lo]
+	}
+	if bits-loBits <= cache[hi]-bits {
+		return lo
+	}
+	return hi
+}
+
+func pulsesToBits(band, lm, q int) int {
+	if q == 0 {
+		return 0
+	}
+	return pulseCacheBits[pulseCacheIndex[(lm+1)*nbBands+band]+q] + 1
+}
+
+// getPulses expands the pulse counts of the cache, exact up to 8
+func getPulses(q int) int {
+	if q < 8 {
+		return q
+	}
+	return (8 + q&7) << uint(q>>3-1)
+}
+
+// bandCoder codes the normalized bands of a frame, 4.3.4
+type bandCoder struct {
+	rc        *rangeEncoder
+	spread    int
+	remaining int // bits left in the frame, in 1/8 bits
+	iy        []int
+}
+
+// quantAllBands codes the shape of the coded bands of the normalized
+// spectrum x, total is the size of the frame in 1/8 bits
+func (c *bandCoder) quantAllBands(x []float64, a *allocation, total int) {
+	balance := a.balance
+	for i := 0; i < a.codedBands; i++ {
+		tell := c.rc.tellFrac()
+		if i != 0 {
+			balance -= tell
+		}
+		c.remaining = total - tell - 1
+		currBalance := balance / minInt(3, a.codedBands-i)
+		b := maxInt(0, minInt(16383, minInt(c.remaining+1, a.pulses[i]+currBalance)))
+		start, end := bandEdges[i]<<frameLM, bandEdges[i+1]<<frameLM
+		c.quantBand(i, x[start:end], frameLM, b)
+		balance += a.pulses[i] + tell
+	}
+}
+
+// quantBand codes a band, or splits it in two halves when a single PVQ
+// codebook of its bits would be too large
+func (c *bandCoder) quantBand(band int, x []float64, lm, b int) {
+	n := len(x)
+	start := pulseCacheIndex[(lm+1)*nbBands+band]
+	if lm != -1 && start >= 0 && b > pulseCacheBits[start+pulseCacheBits[start]]+12 && n > 2 {
+		n >>= 1
+		x, y := x[:n], x[n:]
+		lm--
+		pulseCap := logN400[band] + lm<<bitRes
+		qn := computeQN(n, b, pulseCap>>1-thetaOffset, pulseCap)
+		// the angle between the energies of the halves
+		var ex, ey float64
+		for i := range x {
+			ex += x[i] * x[i]
+			ey += y[i] * y[i]
+		}
+		itheta := int(math.Floor(0.5 + 16384*2/math.Pi*math.Atan2(math.Sqrt(ey+1e-15), math.Sqrt(ex+1e-15))))
+		tell := c.rc.tellFrac()
+		if qn != 1 {
+			itheta = (itheta*qn + 8192) >> 14
+			// triangular pdf
+			ft := ((qn >> 1) + 1) * ((qn >> 1) + 1)
+			fs, fl := itheta+1, itheta*(itheta+1)>>1
+			if itheta > qn>>1 {
+				fs = qn + 1 - itheta
+				fl = ft - ((qn + 1 - itheta) * (qn + 2 - itheta) >> 1)
+			}
+			c.rc.encode(uint32(fl), uint32(fl+fs), uint32(ft))
+			itheta = itheta * 16384 / qn
+		} else {
+			itheta = 0
+		}
+		qalloc := c.rc.tellFrac() - tell
+		b -= qalloc
+		var delta int
+		switch itheta {
+		case 0:
+			delta = -16384
+		case 16384:
+			delta = 16384
+		default:
+			imid := bitexactCos(itheta)
+			iside := bitexactCos(16384 - itheta)
+			delta = fracMul16((n-1)<<7, bitexactLog2Tan(iside, imid))
+		}
+		mbits := maxInt(0, minInt(b, (b-delta)/2))
+		sbits := b - mbits
+		c.remaining -= qalloc
+		rebalance := c.remaining
+		if mbits >= sbits {
+			c.quantBand(band, x, lm, mbits)
+			rebalance = mbits - (rebalance - c.remaining)
+			if rebalance > 3<<bitRes && itheta != 0 {
+				sbits += rebalance - 3<<bitRes
+			}
+			c.quantBand(band, y, lm, sbits)
+		} else {
+			c.quantBand(band, y, lm, sbits)
+			rebalance = sbits - (rebalance - c.remaining)
+			if rebalance > 3<<bitRes && itheta != 16384 {
+				mbits += rebalance - 3<<bitRes
+			}
+			c.quantBand(band, x, lm, mbits)
+		}
+		return
+	}
+
+	q := bitsToPulses(band, lm, b)
+	curr := pulsesToBits(band, lm, q)
+	c.remaining -= curr
+	// never bust the budget
+	for c.remaining < 0 && q > 0 {
+		c.remaining += curr
+		q--
+		curr = pulsesToBits(band, lm, q)
+		c.remaining -= curr
+	}
+	if q != 0 {
+		c.algQuant(x, getPulses(q))
+	}
+}
+
+// computeQN is the number of steps of the split angle
+func computeQN(n, b, offset, pulseCap int) int {
+	exp2Table8 := [8]int{16384, 17866, 19483, 21247, 23170, 25267, 27554, 30048}
+	n2 := 2*n - 1
+	qb := minInt(b-pulseCap-(4<<bitRes), (b+n2*offset)/n2)
+	qb = minInt(8<<bitRes, qb)
+	if qb < 1<<bitRes>>1 {
+		return 1
+	}
+	return ((exp2Table8[qb&7] >> uint(14-qb>>bitRes)) + 1) >> 1 << 1
+}
+
+// algQuant codes the direction of x with k pulses, 4.3.4.2
+func (c *bandCoder) algQuant(x []float64, k int) {
+	expRotation(x, k, c.spread)
+	n := len(x)
+	if cap(c.iy) < n {
+		c.iy = make([]int, n)
+	}
+	iy := c.iy[:n]
+	pvqSearch(x, iy, k)
+	encodePulses(c.rc, iy, k)
+}
+
+// expRotation spreads the pulses of sparse vectors, the decoder undoes it
+func expRotation(x []float64, k, spread int) {
+	n := len(x)
+	if 2*k >= n {
+		return
+	}
+	factor := [3]int{15, 10, 5}[spread-1]
+	gain := float64(n) / float64(n+factor*k)
+	theta := 0.5 * gain * gain
+	cs := math.Cos(0.5 * math.Pi * theta)
+	sn := math.Sin(0.5 * math.Pi * theta)
+	stride2 := 0
+	if n >= 8 {
+		stride2 = 1
+		// sqrt(n) rounded
+		for stride2*stride2+stride2 < n {
+			stride2++
+		}
+	}
+	expRotation1(x, 1, cs, -sn)
+	if stride2 != 0 {
+		expRotation1(x, stride2, sn, -cs)
+	}
+}
+
+func expRotation1(x []float64, stride int, c, s float64) {
+	n := len(x)
+	for i := 0; i < n-stride; i++ {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+	for i := n - 2*stride - 1; i >= 0; i-- {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+}
+
+// pvqSearch finds the vector of k pulses closest in direction to x
+func pvqSearch(x []float64, iy []int, k int) {
+	n := len(x)
+	ax := make([]float64, n)
+	var sum float64
+	for j, v := range x {
+		ax[j] = math.Abs(v)
+		sum += ax[j]
+		iy[j] = 0
+	}
+	if sum < 1e-15 {
+		ax[0] = 1
+		sum = 1
+	}
+	var xy, yy float64
+	left := k
+	// project on the pyramid first, then add the pulses one by one
+	if k > n>>1 {
+		rcp := float64(k) / sum
+		for j := range ax {
+			iy[j] = int(math.Floor(rcp * ax[j]))
+			yy += float64(iy[j] * iy[j])
+			xy += ax[j] * float64(iy[j])
+			left -= iy[j]
+		}
+	}
+	for ; left > 0; left-- {
+		best, bestNum, bestDen := 0, -1.0, 1.0
+		for j := range ax {
+			rxy := xy + ax[j]
+			ryy := yy + float64(2*iy[j]+1)
+			if rxy*rxy*bestDen > bestNum*ryy {
+				best, bestNum, bestDen = j, rxy*rxy, ryy
+			}
+		}
+		xy += ax[best]
+		yy += float64(2*iy[best] + 1)
+		iy[best]++
+	}
+	for j, v := range x {
+		if v < 0 {
+			iy[j] = -iy[j]
+		}
+	}
+}
+
+// encodePulses codes the index of the pulse vector y of k pulses among
+// all of them, CWRS of 4.3.4.2
+func encodePulses(rc *rangeEncoder, y []int, k int) {
+	n := len(y)
+	u := make([]uint32, k+2)
+	// the row of U(2, 0..k+1)
+	for i := 1; i < len(u); i++ {
+		u[i] = uint32(2*i - 1)
+	}
+	kk := absInt(y[n-1])
+	var i uint32
+	if y[n-1] < 0 {
+		i = 1
+	}
+	j := n - 2
+	i += u[kk]
+	kk += absInt(y[j])
+	if y[j] < 0 {
+		i += u[kk+1]
+	}
+	for j--; j >= 0; j-- {
+		nextRow(u)
+		i += u[kk]
+		kk += absInt(y[j])
+		if y[j] < 0 {
+			i += u[kk+1]
+		}
+	}
+	rc.uint(i, u[kk]+u[kk+1])
+}
+
+// nextRow turns the row U(n, .) into U(n+1, .)
+func nextRow(u []uint32) {
+	var u0 uint32
+	for j := 1; j < len(u); j++ {
+		u1 := u[j] + u[j-1] + u0
+		u[j-1] = u0
+		u0 = u1
+	}
+	u[len(u)-1] = u0
+}
+
+func bitexactCos(x int) int {
+	tmp := (4096 + x*x) >> 13
+	x2 := tmp
+	x2 = (32767 - x2) + fracMul16(x2, -7651+fracMul16(x2, 8277+fracMul16(-626, x2)))
+	return 1 + x2
+}
+
+func bitexactLog2Tan(isin, icos int) int {
+	lc := bits.Len(uint(icos))
+	ls := bits.Len(uint(isin))
+	icos <<= uint(15 - lc)
+	isin <<= uint(15 - ls)
+	return (ls-lc)*(1<<11) +
+		fracMul16(isin, fracMul16(isin, -2597)+7932) -
+		fracMul16(icos, fracMul16(icos, -2597)+7932)
+}
+
+func fracMul16(a, b int) int {
+	return (16384 + int(int16(a))*int(int16(b))) >> 15
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package opus
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// pulseVectors lists the vectors of n values whose magnitudes sum to k
+func pulseVectors(n, k int) [][]int {
+	if n == 1 {
+		if k == 0 {
+			return [][]int{{0}}
+		}
+		return [][]int{{k}, {-k}}
+	}
+	var all [][]int
+	for v := -k; v <= k; v++ {
+		for _, rest := range pulseVectors(n-1, k-absInt(v)) {
+			all = append(all, append([]int{v}, rest...))
+		}
+	}
+	return all
+}
+
+// the CWRS index of every vector is unique and below their count V(n, k)
+func TestEncodePulses(t *testing.T) {
+	for _, c := range []struct{ n, k int }{
+		{2, 1}, {2, 5}, {3, 2}, {4, 3}, {5, 4}, {8, 2},
+	} {
+		vectors := pulseVectors(c.n, c.k)
+		count := uint32(len(vectors))
+		seen := make(map[uint32]bool)
+		for _, y := range vectors {
+			buf := make([]byte, 16)
+			e := newRangeEncoder(buf)
+			encodePulses(e, y, c.k)
+			if !e.done() {
+				t.Fatalf("V(%d, %d): overflow", c.n, c.k)
+			}
+			i := newRangeDecoder(buf).uint(count)
+			if i >= count || seen[i] {
+				t.Fatalf("V(%d, %d) = %d: index %d of %v", c.n, c.k, count, i, y)
+			}
+			seen[i] = true
+		}
+	}
+}
+
+func TestPVQSearch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 100; n++ {
+		x := make([]float64, 2+rnd.Intn(30))
+		for i := range x {
+			x[i] = rnd.NormFloat64()
+		}
+		k := 1 + rnd.Intn(40)
+		iy := make([]int, len(x))
+		pvqSearch(x, iy, k)
+		sum := 0
+		for i, v := range iy {
+			sum += absInt(v)
+			if v != 0 && (v < 0) != (x[i] < 0) {
+				t.Fatalf("y[%d] = %d for x[%d] = %v", i, v, i, x[i])
+			}
+		}
+		if sum != k {
+			t.Fatalf("%d pulses, want %d", sum, k)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package opus
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// testDecoder decodes the packets of the Encoder back to samples after
+// RFC 6716 4.3, written from the decoder side: the encoder functions it
+// shares are the tables, the bit-exact cosines and the pulse cache. It
+// only takes what the encoder codes, long blocks of intra energy without
+// post-filter, time-frequency change or dynamic allocation. The bands
+// without pulses are left silent, the real decoder folds them.
+type testDecoder struct {
+	window []float64
+	energy [][nbBands]float64 // band energies of the frames, less the means
+	out    []float64          // samples since the start, the last overlap not complete
+	last   float64            // de-emphasis state
+	frames int
+}
+
+func newTestDecoder() *testDecoder {
+	return &testDecoder{window: newMDCT(FrameSize, overlap).window}
+}
+
+// decode appends the samples of a packet to out, one frame late: the last
+// overlap waits for the next packet
+func (d *testDecoder) decode(pkt []byte) error {
+	if len(pkt) < 2 || pkt[0] != toc {
+		return fmt.Errorf("toc % x", pkt[:1])
+	}
+	rd := newRangeDecoder(pkt[1:])
+	total := 8 * (len(pkt) - 1)
+	spec := make([]float64, FrameSize)
+	var energy [nbBands]float64
+	if rd.bitLogp(15) {
+		for i := range energy {
+			energy[i] = -28
+		}
+	} else {
+		var a testAllocation
+		var err error
+		if energy, a, err = d.header(rd, total); err != nil {
+			return err
+		}
+		shape := make([]float64, FrameSize)
+		bd := &bandDecoder{rd: rd, spread: a.spread}
+		balance := a.balance
+		for i := 0; i < a.codedBands; i++ {
+			tell := rd.tellFrac()
+			if i != 0 {
+				balance -= tell
+			}
+			bd.remaining = total<<bitRes - tell - 1
+			b := a.pulses[i] + balance/minInt(3, a.codedBands-i)
+			b = maxInt(0, minInt(16383, minInt(bd.remaining+1, b)))
+			bd.band(i, shape[bandEdges[i]<<frameLM:bandEdges[i+1]<<frameLM], frameLM, b, 1)
+			balance += a.pulses[i] + tell
+		}
+		left := total - rd.tell()
+		for prio := 0; prio < 2; prio++ {
+			for i := 0; i < nbBands && left >= 1; i++ {
+				if a.fine[i] >= maxFineBits || a.priority[i] != prio {
+					continue
+				}
+				q2 := float64(rd.bits(1))
+				energy[i] += (q2 - 0.5) * float64(int(1)<<uint(14-a.fine[i]-1)) / 16384
+				left--
+			}
+		}
+		if rd.tell() > total {
+			return fmt.Errorf("%d bits read out of %d", rd.tell(), total)
+		}
+		for i := 0; i < nbBands; i++ {
+			g := math.Exp2(energy[i] + energyMeans[i])
+			for j := bandEdges[i] << frameLM; j < bandEdges[i+1]<<frameLM; j++ {
+				spec[j] = shape[j] * g
+			}
+		}
+	}
+	d.energy = append(d.energy, energy)
+	d.synthesize(spec)
+	return nil
+}
+
+// testAllocation is what the decoder takes from the allocation
+type testAllocation struct {
+	spread, codedBands, balance int
+	pulses, fine, priority      [nbBands]int
+}
+
+// header decodes the symbols up to the fine energy, it returns the band
+// energies and the allocation
+func (d *testDecoder) header(rd *rangeDecoder, total int) (energy [nbBands]float64, a testAllocation, err error) {
+	if rd.tell()+16 <= total && rd.bitLogp(1) {
+		return energy, a, fmt.Errorf("post-filter")
+	}
+	if rd.tell()+3 <= total && rd.bitLogp(3) {
+		return energy, a, fmt.Errorf("transient")
+	}
+	if rd.tell()+3 > total || !rd.bitLogp(3) {
+		return energy, a, fmt.Errorf("inter energy")
+	}
+	// coarse energy, 4.3.2.1
+	var prev float64
+	for i := 0; i < nbBands; i++ {
+		var qi int
+		switch left := total - rd.tell(); {
+		case left >= 15:
+			qi = rd.laplace(intraProbModel[2*i]<<7, intraProbModel[2*i+1]<<6)
+		case left >= 2:
+			qi = rd.icdf(smallEnergyICDF, 2)
+			qi = qi>>1 ^ -(qi & 1)
+		case left >= 1:
+			qi = -boolInt(rd.bitLogp(1))
+		default:
+			qi = -1
+		}
+		energy[i] = prev + float64(qi)
+		prev += float64(qi) - intraBeta*float64(qi)
+	}
+	// tf_change, 4.3.1
+	budget, tell, logp := total, rd.tell(), 4
+	if tell+logp+1 <= budget {
+		budget--
+	}
+	for i := 0; i < nbBands; i++ {
+		if tell+logp <= budget {
+			if rd.bitLogp(uint(logp)) {
+				return energy, a, fmt.Errorf("tf change in band %d", i)
+			}
+			tell = rd.tell()
+		}
+		logp = 5
+	}
+	a.spread = spreadNorm
+	if rd.tell()+4 <= total {
+		a.spread = rd.icdf(spreadICDF, 5)
+	}
+	// band boosts, 4.3.3
+	var caps [nbBands]int
+	for i := range caps {
+		n := (bandEdges[i+1] - bandEdges[i]) << frameLM
+		caps[i] = (bandCaps[i] + 64) * n >> 2
+		if rd.tellFrac()+6<<bitRes < total<<bitRes && caps[i] > 0 && rd.bitLogp(6) {
+			return energy, a, fmt.Errorf("boost of band %d", i)
+		}
+	}
+	trim := 5
+	if rd.tellFrac()+6<<bitRes <= total<<bitRes {
+		trim = rd.icdf(trimICDF, 7)
+	}
+	d.allocate(rd, &a, caps, trim, total<<bitRes-rd.tellFrac()-1)
+	// fine energy, 4.3.2.2
+	for i := 0; i < nbBands; i++ {
+		if a.fine[i] > 0 {
+			q2 := float64(rd.bits(a.fine[i]))
+			energy[i] += (q2+0.5)*float64(int(1)<<uint(14-a.fine[i]))/16384 - 0.5
+		}
+	}
+	return energy, a, nil
+}
+
+// allocate is the mono clt_compute_allocation of the decoder, the skipped
+// bands are read
+func (d *testDecoder) allocate(rd *rangeDecoder, a *testAllocation, caps [nbBands]int, trim, total int) {
+	total = maxInt(total, 0)
+	skipRsv := 0
+	if total >= 1<<bitRes {
+		skipRsv = 1 << bitRes
+	}
+	total -= skipRsv
+	var thresh, trimOffset, bits1, bits2 [nbBands]int
+	width := func(j int) int { return bandEdges[j+1] - bandEdges[j] }
+	for j := 0; j < nbBands; j++ {
+		thresh[j] = maxInt(1<<bitRes, 3*width(j)<<frameLM<<bitRes>>4)
+		trimOffset[j] = width(j) * (trim - 5 - frameLM) * (nbBands - j - 1) * (1 << (frameLM + bitRes)) >> 6
+	}
+	vector := func(v, j int) int {
+		if v >= len(bandAllocation) {
+			return caps[j]
+		}
+		b := width(j) * bandAllocation[v][j] << frameLM >> 2
+		if b > 0 {
+			b = maxInt(0, b+trimOffset[j])
+		}
+		return b
+	}
+	sum := func(bits func(j int) int) int {
+		psum, done := 0, false
+		for j := nbBands - 1; j >= 0; j-- {
+			b := bits(j)
+			if b >= thresh[j] || done {
+				done = true
+				psum += minInt(b, caps[j])
+			} else if b >= 1<<bitRes {
+				psum += 1 << bitRes
+			}
+		}
+		return psum
+	}
+	lo, hi := 1, len(bandAllocation)-1
+	for lo <= hi {
+		mid := (lo + hi) >> 1
+		if sum(func(j int) int { return vector(mid, j) }) > total {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	for j := 0; j < nbBands; j++ {
+		bits1[j] = vector(lo-1, j)
+		bits2[j] = maxInt(0, vector(lo, j)-bits1[j])
+	}
+	lo, hi = 0, 1<<allocSteps
+	for i := 0; i < allocSteps; i++ {
+		mid := (lo + hi) >> 1
+		if sum(func(j int) int { return bits1[j] + mid*bits2[j]>>allocSteps }) > total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	bits := &a.pulses
+	psum, done := 0, false
+	for j := nbBands - 1; j >= 0; j-- {
+		b := bits1[j] + lo*bits2[j]>>allocSteps
+		if b >= thresh[j] || done {
+			done = true
+		} else if b >= 1<<bitRes {
+			b = 1 << bitRes
+		} else {
+			b = 0
+		}
+		bits[j] = minInt(b, caps[j])
+		psum += bits[j]
+	}
+	coded := nbBands
+	for ; ; coded-- {
+		j := coded - 1
+		if j <= 0 {
+			total += skipRsv
+			break
+		}
+		left := total - psum
+		percoeff := left / bandEdges[coded]
+		left -= bandEdges[coded] * percoeff
+		bandBits := bits[j] + percoeff*width(j) + maxInt(left-bandEdges[j], 0)
+		if bandBits >= maxInt(thresh[j], 2<<bitRes) {
+			if rd.bitLogp(1) {
+				break
+			}
+			psum += 1 << bitRes
+			bandBits -= 1 << bitRes
+		}
+		psum -= bits[j]
+		if bandBits >= 1<<bitRes {
+			psum += 1 << bitRes
+			bits[j] = 1 << bitRes
+		} else {
+			bits[j] = 0
+		}
+	}
+	left := total - psum
+	percoeff := left / bandEdges[coded]
+	left -= bandEdges[coded] * percoeff
+	for j := 0; j < coded; j++ {
+		bits[j] += percoeff * width(j)
+	}
+	for j := 0; j < coded; j++ {
+		tmp := minInt(left, width(j))
+		bits[j] += tmp
+		left -= tmp
+	}
+	balance := 0
+	j := 0
+	for ; j < coded; j++ {
+		n := width(j) << frameLM
+		bit := bits[j] + balance
+		excess := maxInt(bit-caps[j], 0)
+		bits[j] = bit - excess
+		ncLogN := n * (logN400[j] + frameLM<<bitRes)
+		offset := ncLogN>>1 - n*fineOffset
+		if bits[j]+offset < n*2<<bitRes {
+			offset += ncLogN >> 2
+		} else if bits[j]+offset < n*3<<bitRes {
+			offset += ncLogN >> 3
+		}
+		fine := maxInt(0, bits[j]+offset+n<<(bitRes-1)) / n >> bitRes
+		if fine > bits[j]>>bitRes {
+			fine = bits[j] >> bitRes
+		}
+		fine = minInt(fine, maxFineBits)
+		a.priority[j] = boolInt(fine*(n<<bitRes) >= bits[j]+offset)
+		bits[j] -= fine << bitRes
+		if excess > 0 {
+			extra := minInt(excess>>bitRes, maxFineBits-fine)
+			fine += extra
+			a.priority[j] = boolInt(extra<<bitRes >= excess-balance)
+			excess -= extra << bitRes
+		}
+		a.fine[j] = fine
+		balance = excess
+	}
+	for ; j < nbBands; j++ {
+		a.fine[j] = bits[j] >> bitRes
+		bits[j] = 0
+		a.priority[j] = boolInt(a.fine[j] < 1)
+	}
+	a.codedBands, a.balance = coded, balance
+}
+
+// bandDecoder decodes the normalized bands, 4.3.4
+type bandDecoder struct {
+	rd        *rangeDecoder
+	spread    int
+	remaining int
+}
+
+// band decodes the shape of a band of the gain, split in two halves like
+// the encoder did
+func (c *bandDecoder) band(band int, x []float64, lm, b int, gain float64) {
+	n := len(x)
+	start := pulseCacheIndex[(lm+1)*nbBands+band]
+	if lm != -1 && start >= 0 && b > pulseCacheBits[start+pulseCacheBits[start]]+12 && n > 2 {
+		n >>= 1
+		lm--
+		pulseCap := logN400[band] + lm<<bitRes
+		qn := computeQN(n, b, pulseCap>>1-thetaOffset, pulseCap)
+		tell := c.rd.tellFrac()
+		itheta := 0
+		if qn != 1 {
+			ft := uint32((qn>>1 + 1) * (qn>>1 + 1))
+			fm := int(c.rd.decode(ft))
+			var fl, fs int
+			if fm < (qn>>1)*(qn>>1+1)>>1 {
+				itheta = (int(math.Sqrt(float64(8*fm+1))) - 1) >> 1
+				fs, fl = itheta+1, itheta*(itheta+1)>>1
+			} else {
+				itheta = (2*(qn+1) - int(math.Sqrt(float64(8*(int(ft)-fm-1)+1)))) >> 1
+				fs, fl = qn+1-itheta, int(ft)-(qn+1-itheta)*(qn+2-itheta)>>1
+			}
+			c.rd.update(uint32(fl), uint32(fl+fs), ft)
+			itheta = itheta * 16384 / qn
+		}
+		qalloc := c.rd.tellFrac() - tell
+		b -= qalloc
+		imid, iside, delta := 32767, 0, -16384
+		switch itheta {
+		case 0:
+		case 16384:
+			imid, iside, delta = 0, 32767, 16384
+		default:
+			imid, iside = bitexactCos(itheta), bitexactCos(16384-itheta)
+			delta = fracMul16((n-1)<<7, bitexactLog2Tan(iside, imid))
+		}
+		mid, side := float64(imid)/32768, float64(iside)/32768
+		mbits := maxInt(0, minInt(b, (b-delta)/2))
+		sbits := b - mbits
+		c.remaining -= qalloc
+		rebalance := c.remaining
+		if mbits >= sbits {
+			c.band(band, x[:n], lm, mbits, gain*mid)
+			if rebalance = mbits - (rebalance - c.remaining); rebalance > 3<<bitRes && itheta != 0 {
+				sbits += rebalance - 3<<bitRes
+			}
+			c.band(band, x[n:], lm, sbits, gain*side)
+		} else {
+			c.band(band, x[n:], lm, sbits, gain*side)
+			if rebalance = sbits - (rebalance - c.remaining); rebalance > 3<<bitRes && itheta != 16384 {
+				mbits += rebalance - 3<<bitRes
+			}
+			c.band(band, x[:n], lm, mbits, gain*mid)
+		}
+		return
+	}
+	q := bitsToPulses(band, lm, b)
+	curr := pulsesToBits(band, lm, q)
+	c.remaining -= curr
+	for c.remaining < 0 && q > 0 {
+		c.remaining += curr
+		q--
+		curr = pulsesToBits(band, lm, q)
+		c.remaining -= curr
+	}
+	if q == 0 {
+		return
+	}
+	k := getPulses(q)
+	y := decodePulses(c.rd, n, k)
+	var yy float64
+	for _, v := range y {
+		yy += float64(v * v)
+	}
+	for i, v := range y {
+		x[i] = gain * float64(v) / math.Sqrt(yy)
+	}
+	// the inverse of the spreading rotation
+	if 2*k < n {
+		factor := [3]int{15, 10, 5}[c.spread-1]
+		g := float64(n) / float64(n+factor*k)
+		theta := 0.5 * g * g
+		cs, sn := math.Cos(0.5*math.Pi*theta), math.Sin(0.5*math.Pi*theta)
+		stride2 := 0
+		if n >= 8 {
+			for stride2 = 1; stride2*stride2+stride2 < n; stride2++ {
+			}
+			expRotation1(x, stride2, sn, cs)
+		}
+		expRotation1(x, 1, cs, sn)
+	}
+}
+
+// pvqCount is V(n, k), the number of vectors of n values whose magnitudes
+// sum to k
+func pvqCount(n, k int) uint64 {
+	v := make([]uint64, k+1)
+	v[0] = 1
+	for i := 0; i < n; i++ {
+		prev := uint64(0) // V(i, j-1)
+		for j := 0; j <= k; j++ {
+			cur := v[j]
+			if j > 0 {
+				v[j] = cur + v[j-1] + prev
+			}
+			prev = cur
+		}
+	}
+	return v[k]
+}
+
+// decodePulses reads the index of a vector of k pulses and enumerates the
+// vectors up to it, 4.3.4.2
+func decodePulses(rd *rangeDecoder, n, k int) []int {
+	i := uint64(rd.uint(uint32(pvqCount(n, k))))
+	y := make([]int, n)
+	for j := 0; j < n; j++ {
+		p := (pvqCount(n-j-1, k) + pvqCount(n-j, k)) / 2
+		sign := 1
+		if i >= p {
+			sign = -1
+			i -= p
+		}
+		k0 := k
+		p -= pvqCount(n-j-1, k)
+		for p > i {
+			k--
+			p -= pvqCount(n-j-1, k)
+		}
+		y[j] = sign * (k0 - k)
+		i -= p
+	}
+	return y
+}
+
+// synthesize adds the inverse MDCT of a frame to the output, windowed in
+// the middle of its 2m samples, and takes the pre-emphasis out of the
+// samples it completes
+func (d *testDecoder) synthesize(spec []float64) {
+	const m = FrameSize
+	if d.out == nil {
+		// the first frame overlaps the one before the start
+		d.out = make([]float64, overlap)
+	}
+	base := len(d.out) - overlap
+	d.out = append(d.out, make([]float64, m)...)
+	start := m/2 - overlap/2
+	for i := 0; i < m+overlap; i++ {
+		var v float64
+		for k, x := range spec[:bandEdges[nbBands]<<frameLM] {
+			v += x * math.Cos(math.Pi/m*(float64(start+i)+0.5+m/2)*(float64(k)+0.5))
+		}
+		switch {
+		case i < overlap:
+			v *= d.window[i]
+		case i >= m:
+			v *= d.window[m+overlap-1-i]
+		}
+		d.out[base+i] += v
+	}
+	for i := base; i < base+m; i++ {
+		d.out[i] += preemphasis * d.last
+		d.last = d.out[i]
+	}
+	d.frames++
+}
+
+// samples returns the decoded samples, the input delayed by the overlap
+func (d *testDecoder) samples() []float64 {
+	out := make([]float64, d.frames*FrameSize)
+	for i := range out {
+		out[i] = d.out[i] / 32768
+	}
+	return out
+}
+
+// bandEnergies are the band energies of the frames of in less the means,
+// from the same analysis as the encoder's
+func bandEnergies(in []float32) [][nbBands]float64 {
+	t := newMDCT(FrameSize, overlap)
+	x := make([]float64, FrameSize+overlap)
+	spec := make([]float64, FrameSize)
+	var last float64
+	var energy [][nbBands]float64
+	for f := 0; f+FrameSize <= len(in); f += FrameSize {
+		copy(x, x[FrameSize:])
+		for i, v := range in[f : f+FrameSize] {
+			x[overlap+i] = float64(v)*32768 - preemphasis*last
+			last = float64(v) * 32768
+		}
+		t.forward(x, spec)
+		var e [nbBands]float64
+		for i := range e {
+			sum := 1e-27
+			for _, v := range spec[bandEdges[i]<<frameLM : bandEdges[i+1]<<frameLM] {
+				sum += v * v
+			}
+			e[i] = math.Log2(math.Sqrt(sum)) - energyMeans[i]
+		}
+		energy = append(energy, e)
+	}
+	return energy
+}
+
+// tones encoded and decoded back: the energies of the bands within 30 dB
+// of the loudest one are those of the input, the samples those of the
+// input delayed by the overlap, in the noise of the quantization. 6 kbit/s
+// are too few to keep the waveform.
+func TestEncodeDecode(t *testing.T) {
+	for _, c := range []struct {
+		bitrate int
+		maxErr  float64 // of the band energies, in 6 dB steps
+		minSNR  float64 // in dB, a wrong spreading rotation costs 1 at 16 kbit/s
+	}{
+		{6000, 0.5, math.Inf(-1)},
+		{16000, 0.5, 10.5},
+		{64000, 0.1, 23},
+		{128000, 0.1, 29},
+		{510000, 0.01, 46},
+	} {
+		enc, err := NewEncoder(c.bitrate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := make([]float32, 25*FrameSize)
+		for i := range in {
+			// the 11th frame silent
+			if i/FrameSize == 10 {
+				continue
+			}
+			x := float64(i) / SampleRate
+			in[i] = float32(0.5*math.Sin(2*math.Pi*440*x) + 0.2*math.Sin(2*math.Pi*2500*x))
+		}
+		pkts, err := enc.Encode([][]float32{in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := newTestDecoder()
+		for i, pkt := range pkts {
+			if err := dec.decode(pkt); err != nil {
+				t.Fatalf("%d bit/s: packet %d: %v", c.bitrate, i, err)
+			}
+		}
+		for f, e := range bandEnergies(in) {
+			loudest := math.Inf(-1)
+			for i := range e {
+				loudest = math.Max(loudest, e[i]+energyMeans[i])
+			}
+			for i := range e {
+				if f == 10 || e[i]+energyMeans[i] < loudest-5 {
+					continue
+				}
+				if got := dec.energy[f][i]; math.Abs(got-e[i]) > c.maxErr {
+					t.Fatalf("%d bit/s: frame %d band %d energy %.3f, want %.3f", c.bitrate, f, i, got, e[i])
+				}
+			}
+		}
+		out := dec.samples()
+		var signal, noise float64
+		for i := FrameSize; i < len(out); i++ {
+			// the silent frame doesn't take the aliasing out of the end of
+			// the previous one
+			if i >= 10*FrameSize && i < 10*FrameSize+overlap {
+				continue
+			}
+			want := float64(in[i-overlap])
+			signal += want * want
+			noise += (out[i] - want) * (out[i] - want)
+		}
+		if snr := 10 * math.Log10(signal/noise); snr < c.minSNR {
+			t.Errorf("%d bit/s: SNR %.1f dB", c.bitrate, snr)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package opus encodes Opus (RFC 6716) in its CELT mode, the audio codec
+// every browser plays over WebRTC.
+package opus
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// SampleRate of the encoder input and of its RTP clock
+	SampleRate = 48000
+	// FrameSize is the number of samples of a 20 ms frame
+	FrameSize = 960
+
+	nbBands     = 21
+	frameLM     = 3 // log2 of the frame size in 2.5 ms blocks
+	overlap     = 120
+	preemphasis = 0.85000610
+	// toc of a single CELT only fullband 20 ms mono frame, RFC 6716 3.1
+	toc = 31 << 3
+)
+
+// Encoder is a simple CELT only Opus encoder: 20 ms mono frames at a
+// constant bitrate, long MDCT blocks only, intra coded band energies and no
+// pitch pre-filter. It is good enough for camera audio, it is not meant
+// for music.
+type Encoder struct {
+	size int // packet size in bytes, the TOC included
+
+	mdct    *mdct
+	pending []float32 // input samples not encoded yet
+	in      []float64 // pre-emphasized samples, the overlap of the previous frame first
+	last    float64   // previous input sample of the pre-emphasis
+	spec    []float64
+	oldE    [nbBands]float64 // band energies of the previous frame
+	bands   bandCoder
+}
+
+// NewEncoder returns a mono encoder of 48 kHz samples, the bitrate from 6
+// to 510 kbit/s
+func NewEncoder(bitrate int) (*Encoder, error) {
+	if bitrate < 6000 || bitrate > 510000 {
+		return nil, fmt.Errorf("opus: unsupported encoder bitrate %d", bitrate)
+	}
+	return &Encoder{
+		size: bitrate * FrameSize / SampleRate / 8,
+		mdct: newMDCT(FrameSize, overlap),
+		in:   make([]float64, FrameSize+overlap),
+		spec: make([]float64, FrameSize),
+	}, nil
+}
+
+// Encode adds planar samples in [-1, 1] and returns the Opus packets of
+// every complete frame of 20 ms
+func (e *Encoder) Encode(pcm [][]float32) ([][]byte, error) {
+	if len(pcm) != 1 {
+		return nil, fmt.Errorf("opus: encoder expects 1 channel, got %d", len(pcm))
+	}
+	e.pending = append(e.pending, pcm[0]...)
+	var pkts [][]byte
+	for len(e.pending) >= FrameSize {
+		pkt, err := e.frame()
+		if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+		e.pending = e.pending[:copy(e.pending, e.pending[FrameSize:])]
+	}
+	return pkts, nil
+}
+
+// frame codes the first FrameSize pending samples, the symbols follow the
+// order of RFC 6716 Table 56
+func (e *Encoder) frame() ([]byte, error) {
+	pkt := make([]byte, e.size)
+	pkt[0] = toc
+	rc := newRangeEncoder(pkt[1:])
+	total := 8 * (e.size - 1)
+
+	silence := true
+	for i, v := range e.pending[:FrameSize] {
+		x := float64(v) * 32768
+		if x != 0 {
+			silence = false
+		}
+		e.in[overlap+i] = x - preemphasis*e.last
+		e.last = x
+	}
+	defer copy(e.in, e.in[FrameSize:])
+	rc.bitLogp(silence, 15)
+	if silence {
+		// the decoder reads nothing else
+		for i := range e.oldE {
+			e.oldE[i] = -28
+		}
+		if !rc.done() {
+			return nil, fmt.Errorf("opus: frame of %d bytes overflow", e.size)
+		}
+		return pkt, nil
+	}
+	// no pitch post-filter
+	if rc.tell()+16 <= total {
+		rc.bitLogp(false, 1)
+	}
+	// no transient, long blocks
+	if rc.tell()+3 <= total {
+		rc.bitLogp(false, 3)
+	}
+
+	e.mdct.forward(e.in, e.spec)
+	var logE [nbBands]float64
+	for i := 0; i < nbBands; i++ {
+		band := e.spec[bandEdges[i]<<frameLM : bandEdges[i+1]<<frameLM]
+		sum := 1e-27
+		for _, v := range band {
+			sum += v * v
+		}
+		amp := math.Sqrt(sum)
+		for j := range band {
+			band[j] /= amp
+		}
+		logE[i] = math.Log2(amp) - energyMeans[i]
+	}
+
+	errs := e.coarseEnergy(rc, &logE, total)
+
+	// time-frequency resolution unchanged in every band, no tf_select
+	budget, tell, logp := total, rc.tell(), 4
+	if tell+logp+1 <= budget {
+		budget--
+	}
+	for i := 0; i < nbBands; i++ {
+		if tell+logp <= budget {
+			rc.bitLogp(false, uint(logp))
+			tell = rc.tell()
+		}
+		logp = 5
+	}
+	if rc.tell()+4 <= total {
+		rc.icdf(spreadNorm, spreadICDF, 5)
+	}
+	// no dynamic allocation boost
+	caps := allocCaps()
+	for i := 0; i < nbBands; i++ {
+		if rc.tellFrac()+6<<bitRes < total<<bitRes && caps[i] > 0 {
+			rc.bitLogp(false, 6)
+		}
+	}
+	trim := 5
+	if rc.tellFrac()+6<<bitRes <= total<<bitRes {
+		rc.icdf(trim, trimICDF, 7)
+	}
+
+	a := allocate(rc, trim, total<<bitRes-rc.tellFrac()-1)
+	e.fineEnergy(rc, a, &errs)
+	e.bands.rc, e.bands.spread = rc, spreadNorm
+	e.bands.quantAllBands(e.spec, a, total<<bitRes)
+	e.finalEnergy(rc, a, &errs, total-rc.tell())
+	if !rc.done() {
+		return nil, fmt.Errorf("opus: frame of %d bytes overflow", e.size)
+	}
+	return pkt, nil
+}
+
+// coarseEnergy codes the energies in 6 dB steps, predicted from the lower
+// band only so that a lost packet doesn't affect the next ones. It returns
+// what is left for the fine energy.
+func (e *Encoder) coarseEnergy(rc *rangeEncoder, logE *[nbBands]float64, total int) (errs [nbBands]float64) {
+	if rc.tell()+3 <= total {
+		rc.bitLogp(true, 3) // intra
+	}
+	maxDecay := math.Min(16, 0.125*float64(e.size-1))
+	var prev float64
+	for i := 0; i < nbBands; i++ {
+		x := logE[i]
+		f := x - prev
+		qi := int(math.Floor(0.5 + f))
+		// don't let the energy drop faster than the decoder can follow
+		if bound := math.Max(-28, e.oldE[i]) - maxDecay; qi < 0 && x < bound {
+			qi += int(bound - x)
+			if qi > 0 {
+				qi = 0
+			}
+		}
+		tell := rc.tell()
+		if left := total - tell - 3*(nbBands-i); i != 0 && left < 30 {
+			if left < 24 {
+				qi = minInt(1, qi)
+			}
+			if left < 16 {
+				qi = maxInt(-1, qi)
+			}
+		}
+		switch {
+		case total-tell >= 15:
+			qi = rc.laplace(qi, intraProbModel[2*i]<<7, intraProbModel[2*i+1]<<6)
+		case total-tell >= 2:
+			qi = maxInt(-1, minInt(1, qi))
+			s := 2 * qi
+			if qi < 0 {
+				s = 1
+			}
+			rc.icdf(s, smallEnergyICDF, 2)
+		case total-tell >= 1:
+			qi = minInt(0, qi)
+			rc.bitLogp(qi != 0, 1)
+		default:
+			qi = -1
+		}
+		q := float64(qi)
+		errs[i] = f - q
+		e.oldE[i] = prev + q
+		prev += q - intraBeta*q
+	}
+	return errs
+}
+
+// fineEnergy refines the energies with the raw bits of the allocation
+func (e *Encoder) fineEnergy(rc *rangeEncoder, a *allocation, errs *[nbBands]float64) {
+	for i := 0; i < nbBands; i++ {
+		fq := a.fineQuant[i]
+		if fq <= 0 {
+			continue
+		}
+		frac := 1 << uint(fq)
+		q2 := int(math.Floor((errs[i] + 0.5) * float64(frac)))
+		q2 = maxInt(0, minInt(frac-1, q2))
+		rc.bits(uint32(q2), fq)
+		offset := (float64(q2)+0.5)*float64(int(1)<<uint(14-fq))/16384 - 0.5
+		e.oldE[i] += offset
+		errs[i] -= offset
+	}
+}
+
+// finalEnergy spends the bits left at the end of the frame on one more
+// bit of energy per band, in the order of their priority
+func (e *Encoder) finalEnergy(rc *rangeEncoder, a *allocation, errs *[nbBands]float64, left int) {
+	for prio := 0; prio < 2; prio++ {
+		for i := 0; i < nbBands && left >= 1; i++ {
+			fq := a.fineQuant[i]
+			if fq >= maxFineBits || a.finePriority[i] != prio {
+				continue
+			}
+			q2 := 0
+			if errs[i] >= 0 {
+				q2 = 1
+			}
+			rc.bits(uint32(q2), 1)
+			offset := (float64(q2) - 0.5) * float64(int(1)<<uint(14-fq-1)) / 16384
+			e.oldE[i] += offset
+			errs[i] -= offset
+			left--
+		}
+	}
+}
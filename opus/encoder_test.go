@@ -0,0 +1,90 @@
+package opus
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewEncoder(t *testing.T) {
+	for _, bitrate := range []int{0, 5999, 510001} {
+		if _, err := NewEncoder(bitrate); err == nil {
+			t.Errorf("bitrate %d accepted", bitrate)
+		}
+	}
+	if _, err := NewEncoder(64000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// every 20 ms of samples, whatever the chunks they come in, make a packet
+// of the bitrate whose first symbols read back
+func TestEncode(t *testing.T) {
+	for _, bitrate := range []int{6000, 32000, 64000, 510000} {
+		enc, err := NewEncoder(bitrate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkts [][]byte
+		n := 5*FrameSize + 100
+		for i := 0; i < n; i += 441 {
+			chunk := make([]float32, 441)
+			for j := range chunk {
+				x := float64(i+j) / SampleRate
+				chunk[j] = float32(0.5*math.Sin(2*math.Pi*440*x) + 0.1*math.Sin(2*math.Pi*5000*x))
+			}
+			out, err := enc.Encode([][]float32{chunk})
+			if err != nil {
+				t.Fatalf("%d bit/s: %v", bitrate, err)
+			}
+			pkts = append(pkts, out...)
+		}
+		if len(pkts) != n/FrameSize {
+			t.Fatalf("%d bit/s: %d packets, want %d", bitrate, len(pkts), n/FrameSize)
+		}
+		for i, pkt := range pkts {
+			if len(pkt) != bitrate/400 {
+				t.Fatalf("%d bit/s: packet %d of %d bytes", bitrate, i, len(pkt))
+			}
+			if pkt[0] != 0xf8 {
+				t.Fatalf("%d bit/s: packet %d toc %#x", bitrate, i, pkt[0])
+			}
+			d := newRangeDecoder(pkt[1:])
+			if d.bitLogp(15) {
+				t.Fatalf("%d bit/s: packet %d silent", bitrate, i)
+			}
+			if d.bitLogp(1) || d.bitLogp(3) {
+				t.Fatalf("%d bit/s: packet %d post-filter or transient", bitrate, i)
+			}
+			if !d.bitLogp(3) {
+				t.Fatalf("%d bit/s: packet %d inter coded", bitrate, i)
+			}
+		}
+	}
+}
+
+func TestEncodeSilence(t *testing.T) {
+	enc, err := NewEncoder(32000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts, err := enc.Encode([][]float32{make([]float32, FrameSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || len(pkts[0]) != 80 {
+		t.Fatalf("packets %v", pkts)
+	}
+	if !newRangeDecoder(pkts[0][1:]).bitLogp(15) {
+		t.Fatal("silence not flagged")
+	}
+}
+
+func TestEncodeChannels(t *testing.T) {
+	enc, err := NewEncoder(32000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Encode([][]float32{make([]float32, FrameSize), make([]float32, FrameSize)}); err == nil {
+		t.Fatal("stereo accepted")
+	}
+}
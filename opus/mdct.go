@@ -0,0 +1,141 @@
+package opus
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// mdct computes the MDCT of a frame of m new samples, through a DCT-IV of
+// m points done with a m/2 point FFT. The CELT frames overlap by a short
+// window only, the samples out of it are zero.
+type mdct struct {
+	m       int
+	window  []float64 // rising edge of the overlap
+	pre     []complex128
+	post    []complex128
+	roots   []complex128
+	factors []int
+	buf     []complex128
+	tmp     []complex128
+	in      []float64
+	fold    []float64
+}
+
+func newMDCT(m, overlap int) *mdct {
+	t := &mdct{
+		m:      m,
+		window: make([]float64, overlap),
+		pre:    make([]complex128, m/2),
+		post:   make([]complex128, m/2),
+		roots:  make([]complex128, m/2),
+		buf:    make([]complex128, m/2),
+		tmp:    make([]complex128, m/2),
+		in:     make([]float64, 2*m),
+		fold:   make([]float64, m),
+	}
+	// the power complementary window of 4.3.7
+	for i := range t.window {
+		s := math.Sin(math.Pi / 2 * (float64(i) + 0.5) / float64(overlap))
+		t.window[i] = math.Sin(math.Pi / 2 * s * s)
+	}
+	for k := range t.pre {
+		t.pre[k] = cmplx.Exp(complex(0, -math.Pi*(4*float64(k)+1)/(4*float64(m))))
+		t.post[k] = cmplx.Exp(complex(0, -math.Pi*float64(k)/float64(m)))
+		t.roots[k] = cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(m/2)))
+	}
+	for n := m / 2; n > 1; {
+		p := 2
+		for n%p != 0 {
+			p++
+		}
+		t.factors = append(t.factors, p)
+		n /= p
+	}
+	return t
+}
+
+// dct4 computes y[n] = sum x[k] cos(pi/M (n+1/2)(k+1/2)) of M = len(x) points in place
+func (t *mdct) dct4(x []float64) {
+	m := len(x)
+	z := t.tmp
+	for k := 0; k < m/2; k++ {
+		z[k] = complex(x[2*k], x[m-1-2*k]) * t.pre[k]
+	}
+	t.fft(t.buf, z, m/2, 1, t.factors)
+	for k := 0; k < m/2; k++ {
+		w := t.buf[k] * t.post[k]
+		x[2*k] = real(w)
+		x[m-1-2*k] = -imag(w)
+	}
+}
+
+// fft writes to out the DFT of the n values of in spaced by stride,
+// a mixed radix decimation in time over the factors of n
+func (t *mdct) fft(out, in []complex128, n, stride int, factors []int) {
+	if n == 1 {
+		out[0] = in[0]
+		return
+	}
+	p := factors[0]
+	m := n / p
+	for q := 0; q < p; q++ {
+		t.fft(out[q*m:], in[q*stride:], m, stride*p, factors[1:])
+	}
+	// the roots are the ones of len(t.roots) points
+	step := len(t.roots) / n
+	sums := make([]complex128, p)
+	for k := 0; k < m; k++ {
+		for r := 0; r < p; r++ {
+			var s complex128
+			for q := 0; q < p; q++ {
+				s += out[q*m+k] * t.roots[(q*(k+r*m)*step)%len(t.roots)]
+			}
+			sums[r] = s
+		}
+		for r := 0; r < p; r++ {
+			out[k+r*m] = sums[r]
+		}
+	}
+}
+
+// forward writes the m spectral coefficients of the m+overlap samples of
+// in, the overlap with the previous frame first
+func (t *mdct) forward(in []float64, spec []float64) {
+	m, overlap := t.m, len(t.window)
+	x := t.in
+	for i := range x {
+		x[i] = 0
+	}
+	// the window puts the samples in the middle of 2m, the flat part
+	// between the overlaps
+	start := m/2 - overlap/2
+	for i, v := range in[:m+overlap] {
+		switch {
+		case i < overlap:
+			v *= t.window[i]
+		case i >= m:
+			v *= t.window[m+overlap-1-i]
+		}
+		x[start+i] = v
+	}
+	u := t.fold
+	for i := range u {
+		u[i] = 0
+	}
+	for n := 0; n < 2*m; n++ {
+		i := n + m/2
+		switch {
+		case i < m:
+			u[i] += x[n]
+		case i < 2*m:
+			u[2*m-1-i] -= x[n]
+		default:
+			u[i-2*m] -= x[n]
+		}
+	}
+	t.dct4(u)
+	// the inverse of the decoder isn't scaled
+	for k := range u {
+		spec[k] = 2 * u[k] / float64(m)
+	}
+}
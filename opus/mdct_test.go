@@ -0,0 +1,74 @@
+package opus
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDCT4(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{240, 960} {
+		m := newMDCT(n, overlap)
+		x := make([]float64, n)
+		for i := range x {
+			x[i] = rnd.Float64()*2 - 1
+		}
+		want := make([]float64, len(x))
+		for i := range want {
+			for k, v := range x {
+				want[i] += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*(float64(k)+0.5))
+			}
+		}
+		m.dct4(x)
+		for i := range x {
+			if math.Abs(x[i]-want[i]) > 1e-9 {
+				t.Fatalf("%d points: y[%d] = %v, want %v", n, i, x[i], want[i])
+			}
+		}
+	}
+}
+
+// the MDCT of 2m windowed samples straight from its definition, the
+// samples in the middle between the overlaps
+func TestMDCT(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	const m = FrameSize
+	tr := newMDCT(m, overlap)
+	in := make([]float64, m+overlap)
+	for i := range in {
+		in[i] = rnd.Float64()*2 - 1
+	}
+	x := make([]float64, 2*m)
+	for i, v := range in {
+		switch {
+		case i < overlap:
+			v *= tr.window[i]
+		case i >= m:
+			v *= tr.window[m+overlap-1-i]
+		}
+		x[m/2-overlap/2+i] = v
+	}
+	spec := make([]float64, m)
+	tr.forward(in, spec)
+	for k := range spec {
+		var want float64
+		for n, v := range x {
+			want += v * math.Cos(math.Pi/m*(float64(n)+0.5+m/2)*(float64(k)+0.5))
+		}
+		want *= 2.0 / m
+		if math.Abs(spec[k]-want) > 1e-9 {
+			t.Fatalf("X[%d] = %v, want %v", k, spec[k], want)
+		}
+	}
+}
+
+// the window is power complementary, the overlaps of two frames add up
+func TestWindow(t *testing.T) {
+	w := newMDCT(FrameSize, overlap).window
+	for i := range w {
+		if p := w[i]*w[i] + w[overlap-1-i]*w[overlap-1-i]; math.Abs(p-1) > 1e-12 {
+			t.Fatalf("w[%d]² + w[%d]² = %v", i, overlap-1-i, p)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package opus
+
+import "math/bits"
+
+// rangeEncoder is the encoder side of the range coder of RFC 6716 4.1,
+// entenc.c of the reference implementation. The range coded symbols grow
+// from the start of the frame, the raw bits from its end.
+type rangeEncoder struct {
+	buf        []byte
+	offs       int // range coder bytes written from the start
+	endOffs    int // raw bytes written from the end
+	endWindow  uint32
+	endBits    int
+	nbitsTotal int
+	rng, val   uint32
+	rem        int // buffered byte waiting for a carry, -1 for none
+	ext        int // run of 0xff bytes waiting for a carry
+	err        bool
+}
+
+const (
+	codeBits  = 32
+	codeShift = codeBits - 9
+	codeTop   = 1 << (codeBits - 1)
+	codeBot   = codeTop >> 8
+	uintBits  = 8
+)
+
+func newRangeEncoder(buf []byte) *rangeEncoder {
+	return &rangeEncoder{buf: buf, nbitsTotal: codeBits + 1, rng: codeTop, rem: -1}
+}
+
+func (e *rangeEncoder) writeByte(v int) {
+	if e.offs+e.endOffs >= len(e.buf) {
+		e.err = true
+		return
+	}
+	e.buf[e.offs] = byte(v)
+	e.offs++
+}
+
+func (e *rangeEncoder) writeByteAtEnd(v uint32) {
+	if e.offs+e.endOffs >= len(e.buf) {
+		e.err = true
+		return
+	}
+	e.endOffs++
+	e.buf[len(e.buf)-e.endOffs] = byte(v)
+}
+
+// carryOut outputs a byte, holding it back while a carry can still
+// propagate into it
+func (e *rangeEncoder) carryOut(c int) {
+	if c == 0xff {
+		e.ext++
+		return
+	}
+	carry := c >> 8
+	if e.rem >= 0 {
+		e.writeByte(e.rem + carry)
+	}
+	for ; e.ext > 0; e.ext-- {
+		e.writeByte((0xff + carry) & 0xff)
+	}
+	e.rem = c & 0xff
+}
+
+func (e *rangeEncoder) normalize() {
+	for e.rng <= codeBot {
+		e.carryOut(int(e.val >> codeShift))
+		e.val = (e.val << 8) & (codeTop - 1)
+		e.rng <<= 8
+		e.nbitsTotal += 8
+	}
+}
+
+// encode codes the symbol [fl, fh) of a total frequency ft
+func (e *rangeEncoder) encode(fl, fh, ft uint32) {
+	r := e.rng / ft
+	if fl > 0 {
+		e.val += e.rng - r*(ft-fl)
+		e.rng = r * (fh - fl)
+	} else {
+		e.rng -= r * (ft - fh)
+	}
+	e.normalize()
+}
+
+// encodeBin is encode with a total frequency of 1<<bits
+func (e *rangeEncoder) encodeBin(fl, fh uint32, bits uint) {
+	r := e.rng >> bits
+	if fl > 0 {
+		e.val += e.rng - r*((1<<bits)-fl)
+		e.rng = r * (fh - fl)
+	} else {
+		e.rng -= r * ((1 << bits) - fh)
+	}
+	e.normalize()
+}
+
+// bitLogp codes a bit whose probability of being 1 is 1/2^logp
+func (e *rangeEncoder) bitLogp(v bool, logp uint) {
+	s := e.rng >> logp
+	r := e.rng - s
+	if v {
+		e.val += r
+		e.rng = s
+	} else {
+		e.rng = r
+	}
+	e.normalize()
+}
+
+// icdf codes the symbol s of an inverse cumulative distribution table with
+// a total of 1<<ftb
+func (e *rangeEncoder) icdf(s int, icdf []uint8, ftb uint) {
+	r := e.rng >> ftb
+	if s > 0 {
+		e.val += e.rng - r*uint32(icdf[s-1])
+		e.rng = r * uint32(icdf[s-1]-icdf[s])
+	} else {
+		e.rng -= r * uint32(icdf[s])
+	}
+	e.normalize()
+}
+
+// uint codes fl in [0, ft) uniformly, the low bits of large values go raw
+func (e *rangeEncoder) uint(fl, ft uint32) {
+	ft--
+	ftb := bits.Len32(ft)
+	if ftb > uintBits {
+		ftb -= uintBits
+		t := (ft >> uint(ftb)) + 1
+		f := fl >> uint(ftb)
+		e.encode(f, f+1, t)
+		e.bits(fl&(1<<uint(ftb)-1), ftb)
+	} else {
+		e.encode(fl, fl+1, ft+1)
+	}
+}
+
+// bits writes n raw bits at the end of the frame
+func (e *rangeEncoder) bits(fl uint32, n int) {
+	window, used := e.endWindow, e.endBits
+	if used+n > 32 {
+		for used >= 8 {
+			e.writeByteAtEnd(window & 0xff)
+			window >>= 8
+			used -= 8
+		}
+	}
+	window |= fl << uint(used)
+	e.endWindow, e.endBits = window, used+n
+	e.nbitsTotal += n
+}
+
+// laplace codes the coarse energy value of ec_laplace_encode, fs is the
+// probability of 0 and decay the one of the next values, both in Q15. It
+// returns the value coded, the tail of the distribution is clamped.
+func (e *rangeEncoder) laplace(val int, fs, decay uint32) int {
+	var fl uint32
+	if val != 0 {
+		s := 0
+		if val < 0 {
+			s = -1
+		}
+		v := (val + s) ^ s
+		fl = fs
+		fs = (32768 - 2*16 - fs) * (16384 - decay) >> 15
+		i := 1
+		for ; fs > 0 && i < v; i++ {
+			fs *= 2
+			fl += fs + 2
+			fs = fs * decay >> 15
+		}
+		if fs == 0 {
+			ndiMax := int(32768 - fl)
+			ndiMax = (ndiMax - s) >> 1
+			di := v - i
+			if di > ndiMax-1 {
+				di = ndiMax - 1
+			}
+			fl += uint32(2*di + 1 + s)
+			fs = 1
+			if 32768-fl < fs {
+				fs = 32768 - fl
+			}
+			val = (i + di + s) ^ s
+		} else {
+			fs++
+			if s == 0 {
+				fl += fs
+			}
+		}
+	}
+	e.encodeBin(fl, fl+fs, 15)
+	return val
+}
+
+// tell is the number of bits written, rounded up
+func (e *rangeEncoder) tell() int {
+	return e.nbitsTotal - bits.Len32(e.rng)
+}
+
+// tellFrac is tell in 1/8 bits, the exact ec_tell_frac the decoder computes
+func (e *rangeEncoder) tellFrac() int {
+	l := bits.Len32(e.rng)
+	r := e.rng >> uint(l-16)
+	for i := 0; i < 3; i++ {
+		r = r * r >> 15
+		b := int(r >> 16)
+		l = l<<1 | b
+		r >>= uint(b)
+	}
+	return e.nbitsTotal<<3 - l
+}
+
+// done flushes the range coder and the raw bits, the bytes between them
+// are zero. It returns false when the symbols didn't fit the frame.
+func (e *rangeEncoder) done() bool {
+	l := codeBits - bits.Len32(e.rng)
+	msk := uint32(codeTop-1) >> uint(l)
+	end := (e.val + msk) &^ msk
+	if (end | msk) >= e.val+e.rng {
+		l++
+		msk >>= 1
+		end = (e.val + msk) &^ msk
+	}
+	for l > 0 {
+		e.carryOut(int(end >> codeShift))
+		end = (end << 8) & (codeTop - 1)
+		l -= 8
+	}
+	if e.rem >= 0 || e.ext > 0 {
+		e.carryOut(0)
+	}
+	window, used := e.endWindow, e.endBits
+	for used >= 8 {
+		e.writeByteAtEnd(window & 0xff)
+		window >>= 8
+		used -= 8
+	}
+	if e.err {
+		return false
+	}
+	for i := e.offs; i < len(e.buf)-e.endOffs; i++ {
+		e.buf[i] = 0
+	}
+	if used > 0 {
+		if e.endOffs >= len(e.buf) {
+			return false
+		}
+		l = -l
+		if e.offs+e.endOffs >= len(e.buf) && l < used {
+			window &= 1<<uint(l) - 1
+			e.err = true
+		}
+		e.buf[len(e.buf)-e.endOffs-1] |= byte(window)
+	}
+	return !e.err
+}
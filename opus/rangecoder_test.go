@@ -0,0 +1,267 @@
+package opus
+
+import (
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// rangeDecoder is the decoder of RFC 6716 4.1, to read back what the
+// encoder wrote
+type rangeDecoder struct {
+	buf        []byte
+	offs       int
+	endOffs    int
+	endWindow  uint32
+	endBits    int
+	nbitsTotal int
+	rng, val   uint32
+	rem        int
+	ext        uint32
+}
+
+func newRangeDecoder(buf []byte) *rangeDecoder {
+	d := &rangeDecoder{buf: buf, nbitsTotal: codeBits + 1 - 24, rng: 1 << 7}
+	d.rem = d.readByte()
+	d.val = d.rng - 1 - uint32(d.rem>>1)
+	d.normalize()
+	return d
+}
+
+func (d *rangeDecoder) readByte() int {
+	if d.offs >= len(d.buf) {
+		return 0
+	}
+	d.offs++
+	return int(d.buf[d.offs-1])
+}
+
+func (d *rangeDecoder) readByteFromEnd() uint32 {
+	if d.endOffs >= len(d.buf) {
+		return 0
+	}
+	d.endOffs++
+	return uint32(d.buf[len(d.buf)-d.endOffs])
+}
+
+func (d *rangeDecoder) normalize() {
+	for d.rng <= codeBot {
+		d.nbitsTotal += 8
+		d.rng <<= 8
+		sym := d.rem
+		d.rem = d.readByte()
+		sym = (sym<<8 | d.rem) >> 1
+		d.val = ((d.val << 8) + uint32(0xff&^sym)) & (codeTop - 1)
+	}
+}
+
+func (d *rangeDecoder) decode(ft uint32) uint32 {
+	d.ext = d.rng / ft
+	s := d.val / d.ext
+	if s+1 > ft {
+		s = ft - 1
+	}
+	return ft - s - 1
+}
+
+func (d *rangeDecoder) decodeBin(bits uint) uint32 {
+	return d.decode(1 << bits)
+}
+
+func (d *rangeDecoder) update(fl, fh, ft uint32) {
+	s := d.ext * (ft - fh)
+	d.val -= s
+	if fl > 0 {
+		d.rng = d.ext * (fh - fl)
+	} else {
+		d.rng -= s
+	}
+	d.normalize()
+}
+
+func (d *rangeDecoder) bitLogp(logp uint) bool {
+	s := d.rng >> logp
+	v := d.val < s
+	if v {
+		d.rng = s
+	} else {
+		d.val -= s
+		d.rng -= s
+	}
+	d.normalize()
+	return v
+}
+
+func (d *rangeDecoder) icdf(icdf []uint8, ftb uint) int {
+	s, r := d.rng, d.rng>>ftb
+	var t uint32
+	k := -1
+	for {
+		k++
+		t, s = s, r*uint32(icdf[k])
+		if d.val >= s {
+			break
+		}
+	}
+	d.val -= s
+	d.rng = t - s
+	d.normalize()
+	return k
+}
+
+func (d *rangeDecoder) uint(ft uint32) uint32 {
+	ft--
+	ftb := bits.Len32(ft)
+	if ftb > uintBits {
+		ftb -= uintBits
+		t := (ft >> uint(ftb)) + 1
+		s := d.decode(t)
+		d.update(s, s+1, t)
+		return s<<uint(ftb) | d.bits(ftb)
+	}
+	s := d.decode(ft + 1)
+	d.update(s, s+1, ft+1)
+	return s
+}
+
+func (d *rangeDecoder) bits(n int) uint32 {
+	for d.endBits < n {
+		d.endWindow |= d.readByteFromEnd() << uint(d.endBits)
+		d.endBits += 8
+	}
+	v := d.endWindow & (1<<uint(n) - 1)
+	d.endWindow >>= uint(n)
+	d.endBits -= n
+	d.nbitsTotal += n
+	return v
+}
+
+// laplace is ec_laplace_decode
+func (d *rangeDecoder) laplace(fs, decay uint32) int {
+	val := 0
+	fm := d.decodeBin(15)
+	var fl uint32
+	if fm >= fs {
+		val++
+		fl = fs
+		fs = (32768-2*16-fs)*(16384-decay)>>15 + 1
+		for fs > 1 && fm >= fl+2*fs {
+			fs *= 2
+			fl += fs
+			fs = (fs-2)*decay>>15 + 1
+			val++
+		}
+		if fs <= 1 {
+			di := (fm - fl) >> 1
+			val += int(di)
+			fl += 2 * di
+		}
+		if fm < fl+fs {
+			val = -val
+		} else {
+			fl += fs
+		}
+	}
+	fh := fl + fs
+	if fh > 32768 {
+		fh = 32768
+	}
+	d.update(fl, fh, 32768)
+	return val
+}
+
+func (d *rangeDecoder) tell() int {
+	return d.nbitsTotal - bits.Len32(d.rng)
+}
+
+// tellFrac is ec_tell_frac, the same as the encoder's
+func (d *rangeDecoder) tellFrac() int {
+	l := bits.Len32(d.rng)
+	r := d.rng >> uint(l-16)
+	for i := 0; i < 3; i++ {
+		r = r * r >> 15
+		b := int(r >> 16)
+		l = l<<1 | b
+		r >>= uint(b)
+	}
+	return d.nbitsTotal<<3 - l
+}
+
+// every kind of symbol mixed at random reads back the same, with the
+// same count of bits on both sides
+func TestRangeCoder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	type symbol struct {
+		kind int
+		v    int
+		ft   uint32
+	}
+	for n := 0; n < 200; n++ {
+		buf := make([]byte, 1+rnd.Intn(200))
+		e := newRangeEncoder(buf)
+		var syms []symbol
+		var tells []int
+		// stop well before the end, done needs a few bits too
+		for e.tell()+64 < 8*len(buf) {
+			s := symbol{kind: rnd.Intn(5)}
+			switch s.kind {
+			case 0:
+				s.ft = uint32(1 + rnd.Intn(15))
+				s.v = boolInt(rnd.Intn(4) == 0)
+				e.bitLogp(s.v == 1, uint(s.ft))
+			case 1:
+				s.v = rnd.Intn(len(trimICDF))
+				e.icdf(s.v, trimICDF, 7)
+			case 2:
+				s.ft = uint32(2 + rnd.Intn(1<<uint(1+rnd.Intn(24))))
+				s.v = rnd.Intn(int(s.ft))
+				e.uint(uint32(s.v), s.ft)
+			case 3:
+				s.ft = uint32(1 + rnd.Intn(16))
+				s.v = rnd.Intn(1 << s.ft)
+				e.bits(uint32(s.v), int(s.ft))
+			case 4:
+				band := rnd.Intn(nbBands)
+				s.ft = uint32(band)
+				s.v = e.laplace(rnd.Intn(41)-20, intraProbModel[2*band]<<7, intraProbModel[2*band+1]<<6)
+			}
+			syms = append(syms, s)
+			tells = append(tells, e.tell())
+		}
+		if !e.done() {
+			t.Fatalf("frame %d: overflow", n)
+		}
+		d := newRangeDecoder(buf)
+		for i, s := range syms {
+			var v int
+			switch s.kind {
+			case 0:
+				v = boolInt(d.bitLogp(uint(s.ft)))
+			case 1:
+				v = d.icdf(trimICDF, 7)
+			case 2:
+				v = int(d.uint(s.ft))
+			case 3:
+				v = int(d.bits(int(s.ft)))
+			case 4:
+				v = d.laplace(intraProbModel[2*s.ft]<<7, intraProbModel[2*s.ft+1]<<6)
+			}
+			if v != s.v {
+				t.Fatalf("frame %d symbol %d of kind %d: %d, want %d", n, i, s.kind, v, s.v)
+			}
+			if d.tell() != tells[i] {
+				t.Fatalf("frame %d symbol %d: tell %d, want %d", n, i, d.tell(), tells[i])
+			}
+		}
+	}
+}
+
+func TestRangeCoderOverflow(t *testing.T) {
+	e := newRangeEncoder(make([]byte, 2))
+	for i := 0; i < 4; i++ {
+		e.uint(1000, 1<<12)
+	}
+	if e.done() {
+		t.Fatal("48 bits fit in 2 bytes")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/RTSPtoWebRTC/nal"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtpPacket is a video RTP packet of a camera with its time on the stream
+// timeline
+type rtpPacket struct {
+	*rtp.Packet
+	Time time.Duration
+}
+
+// rtpForwarder sends the RTP packets of the camera to a WebRTC track as
+// they are. Only SSRC and payload type (by the track), sequence numbers and
+// timestamps are rewritten, the timestamps follow the clock of the other
+// tracks. The parameter sets are put before keyframes of cameras that only
+// have them in the SDP, viewers start with a keyframe.
+type rtpForwarder struct {
+	idx      int8
+	codec    av.CodecData
+	track    *fanout.Track
+	started  bool
+	seq      uint16 // added to the sequence numbers of the camera
+	lastSeq  uint16
+	paramsTS uint32 // timestamp of the last in-band parameter sets
+	big      int    // packets over the MTU, fragmented again
+}
+
+// passthroughMTU is the biggest payload sent to the viewers, the one of
+// the packetizers of the tracks. Bigger packets don't fit in the buffers
+// of pion's interceptors.
+const passthroughMTU = 1200
+
+// rtpForwardable reports whether the RTP payloads of the camera can be sent to browsers
+func rtpForwardable(t av.CodecType) bool {
+	return t == av.H264 || t == av.H265
+}
+
+func newRTPForwarder(idx int8, c av.CodecData, streamID string) *rtpForwarder {
+	mime := webrtc.MimeTypeH264
+	if c.Type() == av.H265 {
+		mime = webrtc.MimeTypeH265
+	}
+	return &rtpForwarder{
+		idx:   idx,
+		codec: c,
+		track: fanout.New(webrtc.RTPCodecCapability{
+			MimeType:    mime,
+			ClockRate:   90000,
+			SDPFmtpLine: trackFmtp(c),
+		}, nil, "pion-rtsp-video", streamID),
+		lastSeq: uint16(rand.Uint32()),
+	}
+}
+
+func (f *rtpForwarder) keyFrame(payload []byte) (start, params bool) {
+	if f.codec.Type() == av.H265 {
+		return nal.HEVCRTPKeyFrame(payload)
+	}
+	return nal.H264RTPKeyFrame(payload)
+}
+
+// params is a payload of the parameter sets of the codec, for cameras that
+// only have them in the SDP
+func (f *rtpForwarder) params() []byte {
+	switch c := f.codec.(type) {
+	case h264parser.CodecData:
+		return nal.H264ParamsPayload(c.SPS(), c.PPS())
+	case h265parser.CodecData:
+		return nal.HEVCParamsPayload(c.VPS(), c.SPS(), c.PPS())
+	}
+	return nil
+}
+
+// write sends a packet of the camera, wall is the wall clock of its time
+func (f *rtpForwarder) write(p rtpPacket, wall time.Time) error {
+	if f.started {
+		if d := int16(p.SequenceNumber + f.seq - f.lastSeq); d > 1000 || d < -1000 {
+			// the camera session restarted
+			f.started = false
+		}
+	}
+	start, params := f.keyFrame(p.Payload)
+	if !f.started {
+		if !start {
+			return nil
+		}
+		// carry on the numbering of the previous packets
+		f.seq = f.lastSeq + 1 - p.SequenceNumber
+		f.started = true
+	}
+	ts := f.track.RTPTime(wall)
+	if params {
+		f.paramsTS = p.Timestamp
+	} else if start && f.paramsTS != p.Timestamp {
+		if pp := f.params(); pp != nil {
+			err := f.send(&rtp.Packet{Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: p.SequenceNumber + f.seq,
+				Timestamp:      ts,
+			}, Payload: pp}, true)
+			if err != nil {
+				return err
+			}
+			// the packets of the camera come one later from now on
+			f.seq++
+		}
+	}
+	payloads := [][]byte{p.Payload}
+	if len(p.Payload) > passthroughMTU {
+		if f.big == 0 {
+			log.Println("RTP passthrough: camera packets are bigger than the WebRTC MTU, fragmenting them", len(p.Payload))
+		}
+		f.big++
+		payloads = f.split(p.Payload)
+	}
+	for i, payload := range payloads {
+		last := i == len(payloads)-1
+		err := f.send(&rtp.Packet{Header: rtp.Header{
+			Version:        2,
+			Marker:         p.Marker && last,
+			SequenceNumber: p.SequenceNumber + f.seq,
+			Timestamp:      ts,
+		}, Payload: payload}, start && i == 0)
+		if err != nil {
+			return err
+		}
+		if !last {
+			// the packets of the camera come one later from now on
+			f.seq++
+		}
+	}
+	return nil
+}
+
+// split fragments a payload bigger than passthroughMTU
+func (f *rtpForwarder) split(payload []byte) [][]byte {
+	if f.codec.Type() == av.H265 {
+		return nal.HEVCRTPSplit(payload, passthroughMTU)
+	}
+	return nal.H264RTPSplit(payload, passthroughMTU)
+}
+
+func (f *rtpForwarder) send(p *rtp.Packet, key bool) error {
+	if int16(p.SequenceNumber-f.lastSeq) > 0 {
+		f.lastSeq = p.SequenceNumber
+	}
+	return f.track.WriteRTP(p, key)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/vdk/av"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// testLoopback sends the track to a local PeerConnection, the packets it
+// receives come on the channel once the connection is up
+func testLoopback(t *testing.T, track *fanout.Track) <-chan *rtp.Packet {
+	send, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { send.Close() })
+	recv, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { recv.Close() })
+	if _, err = send.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	pkts := make(chan *rtp.Packet, 100)
+	recv.OnTrack(func(r *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			p, _, err := r.ReadRTP()
+			if err != nil {
+				return
+			}
+			pkts <- p
+		}
+	})
+	connected := make(chan struct{})
+	send.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	// without trickle, the candidates are in the descriptions
+	exchange := func(from, to *webrtc.PeerConnection, desc webrtc.SessionDescription) {
+		promise := webrtc.GatheringCompletePromise(from)
+		if err := from.SetLocalDescription(desc); err != nil {
+			t.Fatal(err)
+		}
+		<-promise
+		if err := to.SetRemoteDescription(*from.LocalDescription()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := send.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(send, recv, offer)
+	answer, err := recv.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(recv, send, answer)
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no connection")
+	}
+	return pkts
+}
+
+// the forwarder starts with a keyframe and puts the parameter sets of the
+// SDP before the keyframes without them. The packets are numbered on across
+// them and across a restart of the camera, the timestamps follow the
+// stream timeline.
+func TestRTPForwarder(t *testing.T) {
+	f := newRTPForwarder(0, testH264(t), "test")
+	pkts := testLoopback(t, f.track)
+	params := f.params()
+	inBand := append([]byte{0x78, 0, 9, 0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64}, 0, 4, 0x68, 0xee, 0x3c, 0x80)
+	idr, fuStart, fuEnd, slice := []byte{0x65, 0x88}, []byte{0x7c, 0x85, 0x88}, []byte{0x7c, 0x45, 0x88}, []byte{0x41, 0x9a}
+
+	// whole seconds, the timestamps of the times are exact
+	start := time.Unix(time.Now().Unix(), 0)
+	type sent struct {
+		payload []byte
+		at      time.Duration
+	}
+	var want []sent
+	for _, c := range []struct {
+		seq     uint16
+		ts      uint32 // of the camera
+		at      time.Duration
+		payload []byte
+		params  bool // put before it
+		dropped bool
+	}{
+		{65530, 1000, 0, slice, false, true}, // before the first keyframe
+		{65531, 4600, 40 * time.Millisecond, idr, true, false},
+		{65532, 8200, 80 * time.Millisecond, slice, false, false},
+		{65533, 11800, 120 * time.Millisecond, fuStart, true, false},
+		{65534, 11800, 120 * time.Millisecond, fuEnd, false, false},
+		{65535, 15400, 160 * time.Millisecond, inBand, false, false},
+		{0, 15400, 160 * time.Millisecond, idr, false, false}, // after the in-band parameter sets
+		{1, 19000, 200 * time.Millisecond, slice, false, false},
+		{30000, 500, 240 * time.Millisecond, slice, false, true}, // the camera restarted
+		{30001, 4100, 280 * time.Millisecond, idr, true, false},
+		{30002, 7700, 320 * time.Millisecond, slice, false, false},
+	} {
+		p := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: c.seq, Timestamp: c.ts}, Payload: c.payload}
+		if err := f.write(rtpPacket{Packet: p, Time: c.at}, start.Add(c.at)); err != nil {
+			t.Fatal(err)
+		}
+		if c.params {
+			want = append(want, sent{params, c.at})
+		}
+		if !c.dropped {
+			want = append(want, sent{c.payload, c.at})
+		}
+	}
+
+	var first *rtp.Packet
+	for i, w := range want {
+		var p *rtp.Packet
+		select {
+		case p = <-pkts:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d missing", i)
+		}
+		if first == nil {
+			first = p
+		}
+		if string(p.Payload) != string(w.payload) {
+			t.Errorf("packet %d is % x, want % x", i, p.Payload, w.payload)
+		}
+		if seq := p.SequenceNumber - first.SequenceNumber; seq != uint16(i) {
+			t.Errorf("packet %d numbered %d after the first", i, seq)
+		}
+		if ts, d := p.Timestamp-first.Timestamp, uint32((w.at-want[0].at)*90/time.Millisecond); ts != d {
+			t.Errorf("packet %d timestamp %d after the first, want %d", i, ts, d)
+		}
+	}
+}
+
+// a passthrough stream is depacketized as long as a viewer needs it or
+// none watches
+func TestRTPCastDemux(t *testing.T) {
+	const suuid = "passthrough-test"
+	s := testStream(t, suuid, []av.CodecData{testH264(t)})
+	s.RTPPassthrough = true
+	Config.mutex.Lock()
+	Config.Streams[suuid] = s
+	Config.mutex.Unlock()
+	p := &rtp.Packet{Payload: []byte{0x41, 0x9a}}
+
+	if !Config.rtpCast(suuid, p, 0) {
+		t.Error("not depacketized without viewers")
+	}
+	rtpUUID, _, r := Config.clAdLive(suuid, webrtcAudio, true)
+	defer Config.clDe(suuid, rtpUUID)
+	if Config.rtpCast(suuid, p, 0) {
+		t.Error("depacketized for a passthrough viewer")
+	}
+	if pck := <-r; string(pck.Payload) != string(p.Payload) {
+		t.Errorf("passthrough viewer got % x", pck.Payload)
+	}
+	cuuid, _, _ := Config.clAdLive(suuid, webrtcAudio, false)
+	if !Config.rtpCast(suuid, p, 0) {
+		t.Error("not depacketized for a viewer of the frames")
+	}
+	Config.clDe(suuid, cuuid)
+	if Config.rtpCast(suuid, p, 0) {
+		t.Error("depacketized after the viewer of the frames left")
+	}
+}
+
+// the parameter sets reach the depacketizer when only passthrough viewers
+// watch
+func TestRTPVCL(t *testing.T) {
+	for _, c := range []struct {
+		codec   av.CodecType
+		payload []byte
+		vcl     bool
+	}{
+		{av.H264, []byte{0x65, 0x88}, true},
+		{av.H264, []byte{0x41, 0x9a}, true},
+		{av.H264, []byte{0x7c, 0x85, 0x88}, true}, // FU-A
+		{av.H264, []byte{0x67, 0x4d}, false},
+		{av.H264, []byte{0x68, 0xee}, false},
+		{av.H264, []byte{0x78, 0, 2, 0x67, 0x4d}, false}, // STAP-A
+		{av.H264, []byte{0x06, 0x05}, false},             // SEI
+		{av.H265, []byte{0x26, 0x01, 0xaf}, true},
+		{av.H265, []byte{0x02, 0x01, 0xd0}, true},
+		{av.H265, []byte{0x62, 0x01, 0x93, 0xaf}, true}, // FU
+		{av.H265, []byte{0x40, 0x01, 0x0c}, false},
+		{av.H265, []byte{0x60, 0x01, 0, 2, 0x40, 0x01}, false}, // AP
+	} {
+		s := &RTSPStream{videoCodec: c.codec}
+		if vcl := s.rtpVCL(c.payload); vcl != c.vcl {
+			t.Errorf("%v % x: VCL %v, want %v", c.codec, c.payload, vcl, c.vcl)
+		}
+	}
+}
+
+// camera packets over the MTU are fragmented again, the packets after them
+// are numbered on
+func TestRTPForwarderMTU(t *testing.T) {
+	f := newRTPForwarder(0, testH264(t), "test")
+	pkts := testLoopback(t, f.track)
+	idr := make([]byte, 3000)
+	idr[0] = 0x65
+	params := append([]byte{0x78, 0, 9, 0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64}, 0, 4, 0x68, 0xee, 0x3c, 0x80)
+	slice := []byte{0x41, 0x9a}
+	start := time.Now()
+	for i, payload := range [][]byte{params, idr, slice} {
+		p := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(100 + i), Timestamp: 9000, Marker: i > 0}, Payload: payload}
+		if err := f.write(rtpPacket{Packet: p}, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []*rtp.Packet
+	for len(got) < 5 {
+		select {
+		case p := <-pkts:
+			got = append(got, p)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d packets, want 5", len(got))
+		}
+	}
+	var rebuilt []byte
+	for i, p := range got {
+		if d := p.SequenceNumber - got[0].SequenceNumber; d != uint16(i) {
+			t.Errorf("packet %d numbered %d after the first", i, d)
+		}
+		if len(p.Payload) > passthroughMTU {
+			t.Errorf("packet %d: %d bytes", i, len(p.Payload))
+		}
+		if i >= 1 && i <= 3 {
+			if p.Payload[0]&0x1F != 28 {
+				t.Errorf("packet %d isn't a FU-A", i)
+			}
+			if p.Marker != (i == 3) {
+				t.Errorf("packet %d: marker %v", i, p.Marker)
+			}
+			rebuilt = append(rebuilt, p.Payload[2:]...)
+		}
+	}
+	if string(rebuilt) != string(idr[1:]) {
+		t.Error("the fragments don't rebuild the IDR")
+	}
+	if string(got[4].Payload) != string(slice) {
+		t.Errorf("packet after the fragments is % x", got[4].Payload)
+	}
+}
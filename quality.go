@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/webrtc/v3"
+)
+
+// A camera with a sub-stream is a group of two streams, the main one and
+// the sub one ("sub" in the config of the main stream). A WebRTC viewer of
+// the group switches between them with RTPSender.ReplaceTrack, the new
+// tracks start from their last keyframe and go on with the SSRC and the
+// sequence numbers of the old ones. The client picks the quality on the
+// control channel, or leaves it to the bandwidth estimate: the viewer
+// goes to the sub-stream once the main one is down to its keyframes, and
+// back when the estimate has room for the main one again.
+const (
+	qualityAuto = "auto"
+	qualityMain = "main"
+	qualitySub  = "sub"
+)
+
+// qualityRetry is how long an automatic switch waits after a failed one
+const qualityRetry = 30 * time.Second
+
+// setGroup finds the group of the stream, a viewer of the main stream
+// starts in auto, one of the sub-stream stays on it
+func (s *WebRTCStreamer) setGroup(suuid string) {
+	s.main, s.sub = Config.grGe(suuid)
+	switch suuid {
+	case "":
+	case s.main:
+		s.quality = qualityAuto
+	case s.sub:
+		s.quality = qualitySub
+	}
+}
+
+// current returns the quality the viewer gets, empty without a group
+func (s *WebRTCStreamer) current() string {
+	switch {
+	case s.main == "":
+		return ""
+	case s.hub.suuid == s.sub:
+		return qualitySub
+	default:
+		return qualityMain
+	}
+}
+
+// qualities returns the qualities the client can request
+func (s *WebRTCStreamer) qualities() []string {
+	if s.main == "" {
+		return nil
+	}
+	return []string{qualityAuto, qualityMain, qualitySub}
+}
+
+// setQuality applies a quality request of the client
+func (s *WebRTCStreamer) setQuality(quality string) error {
+	if s.main == "" {
+		return fmt.Errorf("WebRTC quality %q not available", quality)
+	}
+	switch quality {
+	case qualityAuto:
+		s.quality = quality
+		s.retry = time.Time{}
+		return nil
+	case qualityMain, qualitySub:
+	default:
+		return fmt.Errorf("WebRTC unknown quality %q", quality)
+	}
+	if quality != s.current() {
+		if err := s.switchQuality(quality); err != nil {
+			return err
+		}
+	}
+	s.quality = quality
+	return nil
+}
+
+// adaptQuality switches a viewer in auto to the quality its estimate can
+// take, on the report tick after the level of the video is set
+func (s *WebRTCStreamer) adaptQuality(now time.Time) {
+	if s.quality != qualityAuto || now.Before(s.retry) {
+		return
+	}
+	var next string
+	switch s.current() {
+	case qualityMain:
+		if s.bwe.level == fanout.Full {
+			return
+		}
+		if s.bwe.level < fanout.KeyOnly {
+			// an on demand sub-stream needs time to connect
+			Config.RunIFNotRun(s.sub)
+			return
+		}
+		s.mainRate = s.bwe.rates[fanout.Full]
+		next = qualitySub
+	case qualitySub:
+		estimate := s.bwe.estimate()
+		if s.bwe.level != fanout.Full || estimate == 0 || float64(estimate) < s.mainRate*recoveryHeadroom {
+			s.upgrade = time.Time{}
+			return
+		}
+		if s.upgrade.IsZero() {
+			s.upgrade = now
+		}
+		if now.Sub(s.upgrade) < recoveryHold {
+			return
+		}
+		next = qualityMain
+	}
+	s.upgrade = time.Time{}
+	if err := s.switchQuality(next); err != nil {
+		log.Println("WebRTC quality", next, err)
+		s.retry = now.Add(qualityRetry)
+		return
+	}
+	s.sendStats()
+}
+
+// switchQuality moves the senders of the viewer to the tracks of the
+// stream of the quality
+func (s *WebRTCStreamer) switchQuality(quality string) error {
+	suuid := s.main
+	if quality == qualitySub {
+		suuid = s.sub
+	}
+	Config.RunIFNotRun(suuid)
+	hub, switched, err := joinHub(suuid)
+	if err != nil {
+		return err
+	}
+	codecs, tracks := hub.snapshot()
+	for idx, track := range tracks {
+		if track == nil || int(idx) >= len(codecs) {
+			continue
+		}
+		if err := checkOffer(s.offer, codecs[idx]); err != nil {
+			hub.leave(switched)
+			return err
+		}
+	}
+	pairs, unused := pairTracks(s.senders, s.tracks, tracks)
+	if len(unused) > 0 {
+		hub.leave(switched)
+		return fmt.Errorf("WebRTC %s has no %s track", suuid, s.tracks[unused[0]].Kind())
+	}
+	senders, err := retarget(s.senders, s.tracks, tracks, pairs, s.silenced)
+	if err != nil {
+		hub.leave(switched)
+		return err
+	}
+	log.Println("WebRTC viewer switched", s.hub.suuid, "to", suuid)
+	s.hub.leave(s.switched)
+	s.hub = hub
+	s.switched = switched
+	s.tracks = tracks
+	s.senders = senders
+	s.bwe.reset()
+	s.prefill()
+	s.sendState(true)
+	return nil
+}
+
+// pairTracks pairs the senders of the current tracks with the tracks of
+// another stream of the same kind, in the order of the indexes. It returns
+// the index of the current track of every paired one and the indexes of
+// the senders left without a track.
+func pairTracks(senders map[int8]*webrtc.RTPSender, current, tracks map[int8]*fanout.Track) (map[int8]int8, []int8) {
+	var from, to []int8
+	for idx := range senders {
+		from = append(from, idx)
+	}
+	for idx, track := range tracks {
+		if track != nil {
+			to = append(to, idx)
+		}
+	}
+	to = sortIdx(to)
+	pairs := make(map[int8]int8)
+	var unused []int8
+	for _, idx := range sortIdx(from) {
+		paired := false
+		for _, next := range to {
+			if _, taken := pairs[next]; taken {
+				continue
+			}
+			if tracks[next].Kind() == current[idx].Kind() {
+				pairs[next] = idx
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			unused = append(unused, idx)
+		}
+	}
+	return pairs, unused
+}
+
+// retarget switches the senders to the tracks they are paired with, all
+// of them go back to the current tracks when one fails. The senders of
+// silenced tracks stay detached. It returns the senders by the index of
+// their new tracks.
+func retarget(senders map[int8]*webrtc.RTPSender, current, tracks map[int8]*fanout.Track, pairs map[int8]int8,
+	silenced func(*fanout.Track) bool) (map[int8]*webrtc.RTPSender, error) {
+	next := make(map[int8]*webrtc.RTPSender)
+	previous := make(map[*webrtc.RTPSender]webrtc.TrackLocal)
+	var order []int8
+	for idx := range pairs {
+		order = append(order, idx)
+	}
+	for _, idx := range sortIdx(order) {
+		sender := senders[pairs[idx]]
+		next[idx] = sender
+		var want webrtc.TrackLocal
+		if silenced == nil || !silenced(tracks[idx]) {
+			want = tracks[idx]
+		}
+		if sender.Track() == want {
+			continue
+		}
+		previous[sender] = sender.Track()
+		if err := sender.ReplaceTrack(want); err != nil {
+			for sender, track := range previous {
+				if err := sender.ReplaceTrack(track); err != nil {
+					log.Println("WebRTC switch track back", err)
+				}
+			}
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// sortIdx sorts track indexes
+func sortIdx(idx []int8) []int8 {
+	sort.Slice(idx, func(i, j int) bool { return idx[i] < idx[j] })
+	return idx
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+func testVideoTrack(id string) *fanout.Track {
+	return fanout.New(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, &codecs.H264Payloader{}, id, "test")
+}
+
+func testAudioTrack(id string) *fanout.Track {
+	return fanout.New(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, &codecs.OpusPayloader{}, id, "test")
+}
+
+// testSenders adds the tracks to a PeerConnection, the senders are not
+// started so their tracks are replaced right away
+func testSenders(t *testing.T, tracks map[int8]*fanout.Track) map[int8]*webrtc.RTPSender {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	senders := make(map[int8]*webrtc.RTPSender)
+	for idx, track := range tracks {
+		if senders[idx], err = pc.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return senders
+}
+
+func TestPairTracks(t *testing.T) {
+	video, audio := testVideoTrack("video"), testAudioTrack("audio")
+	for _, c := range []struct {
+		name    string
+		current map[int8]*fanout.Track
+		tracks  map[int8]*fanout.Track
+		pairs   map[int8]int8
+		unused  []int8
+	}{
+		{
+			"same layout",
+			map[int8]*fanout.Track{0: video, 1: audio},
+			map[int8]*fanout.Track{0: testVideoTrack("v"), 1: testAudioTrack("a")},
+			map[int8]int8{0: 0, 1: 1}, nil,
+		},
+		{
+			"by kind",
+			map[int8]*fanout.Track{0: video, 1: audio},
+			map[int8]*fanout.Track{0: testAudioTrack("a"), 1: testVideoTrack("v")},
+			map[int8]int8{1: 0, 0: 1}, nil,
+		},
+		{
+			"in the order of the indexes",
+			map[int8]*fanout.Track{0: video, 3: testVideoTrack("v3")},
+			map[int8]*fanout.Track{5: testVideoTrack("v5"), 2: testVideoTrack("v2")},
+			map[int8]int8{2: 0, 5: 3}, nil,
+		},
+		{
+			"no audio in the other stream",
+			map[int8]*fanout.Track{0: video, 1: audio},
+			map[int8]*fanout.Track{0: testVideoTrack("v"), 1: nil},
+			map[int8]int8{0: 0}, []int8{1},
+		},
+		{
+			"more tracks in the other stream",
+			map[int8]*fanout.Track{0: video},
+			map[int8]*fanout.Track{0: testAudioTrack("a"), 1: testVideoTrack("v1"), 2: testVideoTrack("v2")},
+			map[int8]int8{1: 0}, nil,
+		},
+		{
+			"nothing of the same kind",
+			map[int8]*fanout.Track{0: video, 1: audio},
+			map[int8]*fanout.Track{0: testVideoTrack("v")},
+			map[int8]int8{0: 0}, []int8{1},
+		},
+	} {
+		senders := testSenders(t, c.current)
+		pairs, unused := pairTracks(senders, c.current, c.tracks)
+		if !reflect.DeepEqual(pairs, c.pairs) || !reflect.DeepEqual(unused, c.unused) {
+			t.Errorf("%s: pairs %v unused %v, want %v and %v", c.name, pairs, unused, c.pairs, c.unused)
+		}
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	video, audio := testVideoTrack("video"), testAudioTrack("audio")
+	current := map[int8]*fanout.Track{0: video, 1: audio}
+	nextVideo, nextAudio := testVideoTrack("next video"), testAudioTrack("next audio")
+	tracks := map[int8]*fanout.Track{0: nextAudio, 1: nextVideo}
+
+	senders := testSenders(t, current)
+	next, err := retarget(senders, current, tracks, map[int8]int8{1: 0, 0: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next[1] != senders[0] || next[0] != senders[1] || len(next) != 2 {
+		t.Errorf("senders by the new indexes %v, want 1: %p and 0: %p", next, senders[0], senders[1])
+	}
+	if senders[0].Track() != nextVideo || senders[1].Track() != nextAudio {
+		t.Error("the senders don't have the new tracks")
+	}
+
+	// silenced tracks are detached
+	senders = testSenders(t, current)
+	silenced := func(track *fanout.Track) bool { return track == nextAudio }
+	if _, err := retarget(senders, current, tracks, map[int8]int8{1: 0, 0: 1}, silenced); err != nil {
+		t.Fatal(err)
+	}
+	if senders[0].Track() != nextVideo || senders[1].Track() != nil {
+		t.Error("silenced audio not detached")
+	}
+}
+
+func TestRetargetRollback(t *testing.T) {
+	video, audio := testVideoTrack("video"), testAudioTrack("audio")
+	current := map[int8]*fanout.Track{0: video, 1: audio}
+	senders := testSenders(t, current)
+
+	// the audio sender can't take the video track of index 1, the video
+	// sender already switched to the track of index 0 goes back
+	tracks := map[int8]*fanout.Track{0: testVideoTrack("next video"), 1: testVideoTrack("other video")}
+	next, err := retarget(senders, current, tracks, map[int8]int8{0: 0, 1: 1}, nil)
+	if err != webrtc.ErrRTPSenderNewTrackHasIncorrectKind || next != nil {
+		t.Fatalf("%v %v, want %v", next, err, webrtc.ErrRTPSenderNewTrackHasIncorrectKind)
+	}
+	if senders[0].Track() != video || senders[1].Track() != audio {
+		t.Error("the senders are not back on the current tracks")
+	}
+}
@@ -19,13 +19,18 @@ type Player struct {
 	DisableAudio  bool
 	VideoMedia    *sdp.Media
 	AudioMedia    *sdp.Media
+	VideoFormat   *Format
+	AudioFormat   *Format
 	OnVideoPacket func(*Player, *rtp.Packet) error
 	OnAudioPacket func(*Player, *rtp.Packet) error
+	// OnSenderReport gets the RTCP sender reports of the video (or audio) track
+	OnSenderReport func(p *Player, video bool, sr SenderReport)
 
 	base    string
 	session string
 
 	media        []sdp.Media
+	formats      []Format
 	videoID      int
 	audioID      int
 	startVideoTS int64
@@ -88,6 +93,7 @@ func (s *Player) Run(c *Client, stop chan struct{}) error {
 				ch = lo
 			}
 			s.VideoMedia = m
+			s.VideoFormat = s.format(i)
 			s.videoID = ch
 			ch += 2
 
@@ -110,6 +116,7 @@ func (s *Player) Run(c *Client, stop chan struct{}) error {
 				ch = lo
 			}
 			s.AudioMedia = m
+			s.AudioFormat = s.format(i)
 			s.audioID = ch
 			ch += 2
 		}
@@ -133,7 +140,7 @@ func (s *Player) Run(c *Client, stop chan struct{}) error {
 		if time.Since(timer) > 25*time.Second {
 			_, err = c.Request(s.base, "OPTIONS", http.Header{"Require": {"implicit-play"}})
 			if err != nil {
-				return fmt.Errorf("RTSP Client RTP keep-alive", err)
+				return fmt.Errorf("RTSP Client RTP keep-alive: %s", err)
 			}
 			timer = time.Now()
 		}
@@ -171,6 +178,16 @@ func (s *Player) Run(c *Client, stop chan struct{}) error {
 						return err
 					}
 				}
+			case s.videoID + 1, s.audioID + 1:
+				if s.OnSenderReport != nil {
+					b, err := r.Read()
+					if err != nil {
+						return fmt.Errorf("read rtcp packet failed: %v", err)
+					}
+					if sr, ok := parseSenderReport(b); ok {
+						s.OnSenderReport(s, r.Channel == s.videoID+1, sr)
+					}
+				}
 			default:
 				//log.Println("Unsuported Intervaled data packet", int(content[1]), content[offset:end])
 				// See RFC2326 section 10.12:
@@ -272,9 +289,19 @@ func (s *Player) describe(c *Client) ([]sdp.Media, error) {
 	// }
 	// s.description = &d
 	_, medias := sdp.Parse(body)
+	s.formats = ParseFormats(body)
 	return medias, nil
 }
 
+// format returns the payload format of the i-th media, an empty one
+// when it couldn't be parsed
+func (s *Player) format(i int) *Format {
+	if i < len(s.formats) {
+		return &s.formats[i]
+	}
+	return &Format{PayloadType: -1, Fmtp: map[string]string{}}
+}
+
 func (s *Player) setup(c *Client, control, transport string) (string, error) {
 	h := make(http.Header)
 	if s.session != "" {
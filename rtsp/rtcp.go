@@ -0,0 +1,43 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ntpEpoch is the NTP time 0
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SenderReport is the clock mapping of a RTCP sender report (RFC 3550 6.4.1),
+// the camera captured the RTP timestamp RTPTime at its wall clock NTPTime
+type SenderReport struct {
+	NTPTime time.Time
+	RTPTime uint32
+}
+
+// parseSenderReport returns the sender report of a compound RTCP packet
+func parseSenderReport(b []byte) (SenderReport, bool) {
+	for len(b) >= 4 {
+		if b[0]>>6 != 2 {
+			break
+		}
+		size := 4 * (int(binary.BigEndian.Uint16(b[2:])) + 1)
+		if size > len(b) {
+			break
+		}
+		if b[1] == 200 && size >= 28 {
+			return SenderReport{
+				NTPTime: NTPTime(binary.BigEndian.Uint64(b[8:])),
+				RTPTime: binary.BigEndian.Uint32(b[16:]),
+			}, true
+		}
+		b = b[size:]
+	}
+	return SenderReport{}, false
+}
+
+// NTPTime converts a 64 bits NTP timestamp
+func NTPTime(ntp uint64) time.Time {
+	sec, frac := ntp>>32, ntp&0xFFFFFFFF
+	return ntpEpoch.Add(time.Duration(sec)*time.Second + time.Duration(frac*uint64(time.Second)>>32))
+}
@@ -0,0 +1,89 @@
+package rtsp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Format is the RTP payload format of a media description, the rtpmap and
+// fmtp details that sdp.Parse doesn't keep.
+type Format struct {
+	PayloadType int
+	Encoding    string // rtpmap encoding name, upper case
+	ClockRate   int
+	Channels    int
+	Fmtp        map[string]string // parameter names in lower case
+}
+
+// ParseFormats returns a Format for every audio and video media of the
+// SDP, in the same order as sdp.Parse returns them. Only the first payload
+// type of a media is described.
+func ParseFormats(content string) []Format {
+	var formats []Format
+	var f *Format
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		typ, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch typ {
+		case "m":
+			fields := strings.Fields(val)
+			if len(fields) == 0 || (fields[0] != "audio" && fields[0] != "video") {
+				f = nil
+				continue
+			}
+			formats = append(formats, Format{PayloadType: -1, Fmtp: map[string]string{}})
+			f = &formats[len(formats)-1]
+			if len(fields) >= 4 {
+				if pt, err := strconv.Atoi(fields[3]); err == nil {
+					f.PayloadType = pt
+				}
+			}
+		case "a":
+			if f == nil {
+				continue
+			}
+			key, attr, ok := strings.Cut(val, ":")
+			if !ok {
+				continue
+			}
+			pt, attr, _ := strings.Cut(attr, " ")
+			if n, err := strconv.Atoi(pt); err != nil || (f.PayloadType >= 0 && n != f.PayloadType) {
+				continue
+			}
+			switch key {
+			case "rtpmap":
+				// <encoding name>/<clock rate>[/<encoding parameters>]
+				v := strings.Split(strings.TrimSpace(attr), "/")
+				f.Encoding = strings.ToUpper(v[0])
+				if len(v) > 1 {
+					f.ClockRate, _ = strconv.Atoi(v[1])
+				}
+				if len(v) > 2 {
+					f.Channels, _ = strconv.Atoi(v[2])
+				}
+			case "fmtp":
+				for _, p := range strings.Split(attr, ";") {
+					k, v, _ := strings.Cut(p, "=")
+					k = strings.ToLower(strings.TrimSpace(k))
+					if k != "" {
+						f.Fmtp[k] = strings.TrimSpace(v)
+					}
+				}
+			}
+		}
+	}
+	return formats
+}
+
+// FmtpInt returns an integer fmtp parameter, def when missing or invalid
+func (f *Format) FmtpInt(key string, def int) int {
+	if v, ok := f.Fmtp[key]; ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
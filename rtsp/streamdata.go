@@ -18,18 +18,33 @@ type StreamData struct {
 // the packet use the reader internal buffer and becomes
 // invalid in the next read operation
 func (r *StreamData) RTPRead(p *rtp.Packet) error {
+	b, err := r.Read()
+	if err != nil {
+		return err
+	}
+	err = p.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read returns the payload, it uses the reader internal buffer
+// as RTPRead
+func (r *StreamData) Read() ([]byte, error) {
 	if r.r > 0 {
-		return fmt.Errorf("message content has already been read")
+		return nil, fmt.Errorf("message content has already been read")
 	}
 
 	var err error
 	size := r.length
 	if size > 65535 || size < 4 {
-		return fmt.Errorf("incorrect RTP packet size %d", size)
+		return nil, fmt.Errorf("incorrect RTP packet size %d", size)
 	}
 	// Using bufio.Reader internal buffer
 	if size > r.reader.Size() {
-		return bufio.ErrBufferFull
+		return nil, bufio.ErrBufferFull
 	}
 	var b []byte
 	for {
@@ -38,19 +53,14 @@ func (r *StreamData) RTPRead(p *rtp.Packet) error {
 			continue
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		break
 	}
 
 	r.reader.Discard(size)
 	r.r = size
-	err = p.Unmarshal(b[:len(b):len(b)])
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return b[:len(b):len(b)], nil
 }
 
 func (r *StreamData) Close() error {
@@ -13,28 +13,48 @@ var (
 	ErrorStreamExitNoVideoOnStream = errors.New("Stream Exit No Video On Stream")
 	ErrorStreamExitRtspDisconnect  = errors.New("Stream Exit Rtsp Disconnect")
 	ErrorStreamExitNoViewer        = errors.New("Stream Exit On Demand No Viewer")
+	ErrorWebRTCSourceNoMedia       = errors.New("WebRTC Source Without H264 Or Opus")
+	ErrorWebRTCSourceDisconnect    = errors.New("WebRTC Source Disconnect")
+	ErrorWHIPPublishDisconnect     = errors.New("WHIP Publish Disconnect")
+	ErrorWHIPNoStream              = errors.New("WHIP Stream Not Found")
+	ErrorWHIPToken                 = errors.New("WHIP Invalid Token")
+	ErrorWHIPPublished             = errors.New("WHIP Stream Already Published")
+	ErrorWebRTCSessionOver         = errors.New("WebRTC Session Over")
+	ErrorWebRTCOtherPeer           = errors.New("WebRTC Offer Of Another PeerConnection")
+	ErrorWebRTCRestartBusy         = errors.New("WebRTC Session Busy, ICE Restart Not Taken")
+	ErrorWebRTCServerOffers        = errors.New("WebRTC The Server Offers In This Session, Send An Answer")
 )
 
 func serveStreams() {
 	for k, v := range Config.Streams {
-		if !v.OnDemand {
+		if !v.OnDemand && v.WHIPToken == "" {
 			go RTSPWorkerLoop(k, v.URL, v.OnDemand, v.DisableAudio, v.Debug)
 		}
+		if v.Publish != "" {
+			go WHIPPublishLoop(k, v.Publish, v.stop)
+		}
 	}
 }
 func RTSPWorkerLoop(name, url string, OnDemand, DisableAudio, Debug bool) {
 	defer Config.RunUnlock(name)
 	for {
 		log.Println("Stream Try Connect", name)
-		err := RTSPWorker(name, url, OnDemand, DisableAudio, Debug)
+		var err error
+		if isWHEPURL(url) {
+			err = WHEPWorker(name, url, OnDemand, DisableAudio)
+		} else {
+			err = RTSPWorker(name, url, OnDemand, DisableAudio, Debug)
+		}
 		if err != nil {
 			log.Println(err)
 			Config.LastError = err
 		}
 		if OnDemand && !Config.HasViewer(name) {
 			log.Println(ErrorStreamExitNoViewer)
+			Config.stSet(name, streamOffline)
 			return
 		}
+		Config.stSet(name, streamReconnecting)
 		time.Sleep(1 * time.Second)
 	}
 }
@@ -90,9 +110,10 @@ func RTSPWorker(name, url string, OnDemand, DisableAudio, Debug bool) error {
 	}()
 
 	p := rtsp.Player{
-		DisableAudio:  DisableAudio,
-		OnVideoPacket: s.onVideoPacket,
-		OnAudioPacket: s.onAudioPacket,
+		DisableAudio:   DisableAudio,
+		OnVideoPacket:  s.onVideoPacket,
+		OnAudioPacket:  s.onAudioPacket,
+		OnSenderReport: s.onSenderReport,
 	}
 
 	errC <- p.Run(c, stop)
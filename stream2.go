@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"math"
 	"time"
 
+	"github.com/deepch/RTSPtoWebRTC/aac"
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/RTSPtoWebRTC/av1"
+	"github.com/deepch/RTSPtoWebRTC/mjpeg"
 	"github.com/deepch/RTSPtoWebRTC/nal"
 	"github.com/deepch/RTSPtoWebRTC/rtsp"
+	"github.com/deepch/RTSPtoWebRTC/vpx"
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec"
 	"github.com/deepch/vdk/codec/aacparser"
@@ -44,7 +50,22 @@ type RTSPStream struct {
 	PreAudioTS        int64
 	PreVideoTS        int64
 	PreSequenceNumber int
-	FPS               int
+	FPS               int // from SDP, used when the SPS has no timing info
+	videoInfo         nal.VideoInfo
+	jpeg              mjpeg.Depacketizer
+	aac               aac.Depacketizer
+	latm              *aac.LATMDepacketizer // MP4A-LATM instead of MPEG4-GENERIC
+	samples           audio.Depacketizer    // G.722, G.726 and L16
+	frames            frameDepacketizer     // VP8, VP9 and AV1
+	clock             mediaClock
+	videoTime         time.Duration // of the video packet being demuxed
+}
+
+// frameDepacketizer rebuilds the frames of the codecs without parameter sets
+type frameDepacketizer interface {
+	Push(payload []byte, marker bool) (frame []byte, key bool, err error)
+	Lost()
+	Size() (int, int)
 }
 
 func (s *RTSPStream) setupCodec(p *rtsp.Player) error {
@@ -81,7 +102,28 @@ func (s *RTSPStream) setupCodec(p *rtsp.Player) error {
 			} else {
 				s.codecVideo = h265parser.CodecData{}
 			}
+			s.FPS = m.FPS
 			s.videoCodec = av.H265
+		} else if m.Type == av.JPEG || m.PayloadType == 26 {
+			// the size is only known from the first frame
+			s.codecVideo = mjpeg.CodecData{}
+			s.FPS = m.FPS
+			s.videoCodec = av.JPEG
+		} else if f := p.VideoFormat; f != nil && (f.Encoding == "VP8" || f.Encoding == "VP9" || f.Encoding == "AV1") {
+			// the size is only known from the first keyframe
+			switch f.Encoding {
+			case "VP8":
+				s.frames = &vpx.VP8Depacketizer{}
+				s.codecVideo = vpx.CodecData{CodecType_: av.VP8}
+			case "VP9":
+				s.frames = &vpx.VP9Depacketizer{}
+				s.codecVideo = vpx.CodecData{CodecType_: av.VP9}
+			case "AV1":
+				s.frames = &av1.Depacketizer{}
+				s.codecVideo = av1.CodecData{}
+			}
+			s.FPS = m.FPS
+			s.videoCodec = s.codecVideo.Type()
 		} else {
 			return fmt.Errorf("SDP Video Codec Type Not Supported %s", m.Type)
 		}
@@ -91,14 +133,31 @@ func (s *RTSPStream) setupCodec(p *rtsp.Player) error {
 
 	m = p.AudioMedia
 	if m != nil {
-		switch m.Type {
-		case av.AAC:
+		switch {
+		case p.AudioFormat != nil && p.AudioFormat.Encoding == "MP4A-LATM":
+			s.codecAudio, err = s.setupLATM(p.AudioFormat)
+			if err != nil {
+				log.Printf("audio MP4A-LATM bad config: %v", err)
+			}
+			if m.TimeScale == 0 {
+				m.TimeScale = p.AudioFormat.ClockRate
+			}
+		case m.Type == av.AAC:
 			s.codecAudio, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(m.Config)
 			if err != nil {
 				// return fmt.Errorf("audio AAC bad config: %#v", err)
 				log.Printf("audio AAC bad config: %#v", err)
 			}
-		case av.OPUS:
+			if p.AudioFormat != nil {
+				s.aac.Config, err = aac.NewAUConfig(p.AudioFormat.Fmtp)
+				if err != nil {
+					log.Printf("audio AAC bad fmtp: %v", err)
+					s.codecAudio = nil
+				}
+			} else {
+				s.aac.Config = aac.AUConfig{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+			}
+		case m.Type == av.OPUS:
 			var cl av.ChannelLayout
 			switch m.ChannelCount {
 			case 1:
@@ -109,15 +168,12 @@ func (s *RTSPStream) setupCodec(p *rtsp.Player) error {
 				cl = av.CH_MONO
 			}
 			s.codecAudio = codec.NewOpusCodecData(m.TimeScale, cl)
-		case av.PCM_MULAW:
+		case m.Type == av.PCM_MULAW:
 			s.codecAudio = codec.NewPCMMulawCodecData()
-		case av.PCM_ALAW:
+		case m.Type == av.PCM_ALAW:
 			s.codecAudio = codec.NewPCMAlawCodecData()
-		case av.PCM:
-			s.codecAudio = codec.NewPCMCodecData()
 		default:
-			// return fmt.Errorf("audio Codec %s not supported", m.Type)
-			log.Printf("audio Codec %s not supported", m.Type)
+			s.codecAudio = s.setupSampleAudio(p)
 		}
 		if s.codecAudio != nil {
 			s.CodecData = append(s.CodecData, s.codecAudio)
@@ -136,6 +192,9 @@ func (s *RTSPStream) setupCodec(p *rtsp.Player) error {
 		// Generic 720p 3xAntenna PTZ Yoosee: SPS and PPS incorrect in SDP
 		Config.coNilAd(s.name, s.CodecData)
 	}
+	if len(s.sps) > 0 {
+		s.updateVideoInfo()
+	}
 
 	return nil
 }
@@ -164,7 +223,26 @@ func (s *RTSPStream) onVideoPacket(player *rtsp.Player, p *rtp.Packet) error {
 	if s.PreSequenceNumber != 0 && int(p.SequenceNumber)-s.PreSequenceNumber != 1 {
 		log.Println("drop packet", int(p.SequenceNumber)-1)
 	}
+	if s.frames != nil && s.PreSequenceNumber != 0 && p.SequenceNumber != uint16(s.PreSequenceNumber+1) {
+		// the frame can't be rebuilt without the lost packets
+		s.frames.Lost()
+	}
 	s.PreSequenceNumber = int(p.SequenceNumber)
+	s.videoTime = s.clock.time(true, p.Timestamp, 90000)
+	if !Config.rtpCast(s.name, p, s.videoTime) && s.videoReady() && s.rtpVCL(p.Payload) {
+		// only RTP passthrough viewers, the depacketizer can rest. It still
+		// takes the parameter sets, e.g. of a new resolution. A fragment
+		// it was rebuilding won't be completed.
+		s.BufferRtpPacket.Reset()
+		if key, _ := s.rtpKeyFrame(p.Payload); key {
+			if !s.keyTest.Stop() {
+				<-s.keyTest.C
+			}
+			s.keyTest.Reset(20 * time.Second)
+		}
+		s.PreVideoTS = int64(p.Timestamp)
+		return nil
+	}
 	if s.BufferRtpPacket.Len() > 4048576 {
 		log.Println("Big Buffer Flush")
 		s.BufferRtpPacket.Truncate(0)
@@ -177,6 +255,10 @@ func (s *RTSPStream) onVideoPacket(player *rtsp.Player, p *rtp.Packet) error {
 		retmap = s.demuxH265(p.Payload, timestamp)
 	} else if s.videoCodec == av.H264 {
 		retmap = s.demuxH264(p.Payload, timestamp)
+	} else if s.videoCodec == av.JPEG {
+		retmap = s.demuxJPEG(p.Payload, p.Marker, timestamp)
+	} else if s.frames != nil {
+		retmap = s.demuxFrame(p.Payload, p.Marker, timestamp)
 	}
 
 	if len(retmap) > 0 {
@@ -195,6 +277,39 @@ func (s *RTSPStream) onVideoPacket(player *rtsp.Player, p *rtp.Packet) error {
 	return nil
 }
 
+// videoReady reports whether the parameter sets of H264/H265 are known,
+// it is false for the other codecs as they can't be forwarded as RTP
+func (s *RTSPStream) videoReady() bool {
+	switch s.videoCodec {
+	case av.H264:
+		return len(s.sps) > 0 && len(s.pps) > 0
+	case av.H265:
+		return len(s.vps) > 0 && len(s.sps) > 0 && len(s.pps) > 0
+	}
+	return false
+}
+
+// rtpVCL reports whether a payload only carries picture data, single NAL
+// units of slices or their fragments
+func (s *RTSPStream) rtpVCL(payload []byte) bool {
+	if len(payload) == 0 {
+		return true
+	}
+	if s.videoCodec == av.H265 {
+		t := nal.Unit(payload).HEVCType()
+		return t < nal.HEVCTypeVPS || t == nal.HEVCTypeFU
+	}
+	t := payload[0] & 0x1F
+	return t >= 1 && t <= 5 || t == 28
+}
+
+func (s *RTSPStream) rtpKeyFrame(payload []byte) (start, params bool) {
+	if s.videoCodec == av.H265 {
+		return nal.HEVCRTPKeyFrame(payload)
+	}
+	return nal.H264RTPKeyFrame(payload)
+}
+
 func (s *RTSPStream) demuxH265(payload []byte, timestamp int64) (retmap []*av.Packet) {
 
 	nalus, _ := h264parser.SplitNALUs(payload)
@@ -213,7 +328,7 @@ func (s *RTSPStream) demuxH265(payload []byte, timestamp int64) (retmap []*av.Pa
 				Idx:             s.videoIDX,
 				IsKeyFrame:      false,
 				Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-				Time:            time.Duration(timestamp/90) * time.Millisecond,
+				Time:            s.videoTime,
 			})
 		case h265parser.NAL_UNIT_VPS:
 			s.CodecUpdateVPS(nalu)
@@ -232,6 +347,9 @@ func (s *RTSPStream) demuxH265(payload []byte, timestamp int64) (retmap []*av.Pa
 				r[1] = nalu[1]
 				r[0] = (nalu[0] & 0x81) | (naluType << 1)
 				s.BufferRtpPacket.Write(nalu[3:])
+			} else if s.BufferRtpPacket.Len() == 0 {
+				// the start of the NAL unit is lost
+				break
 			} else if se == 1 {
 				s.BufferRtpPacket.Write(nalu[3:])
 				retmap = append(retmap, &av.Packet{
@@ -240,8 +358,9 @@ func (s *RTSPStream) demuxH265(payload []byte, timestamp int64) (retmap []*av.Pa
 					Idx:             s.videoIDX,
 					IsKeyFrame:      naluType == h265parser.NAL_UNIT_CODED_SLICE_IDR_W_RADL,
 					Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-					Time:            time.Duration(timestamp/90) * time.Millisecond,
+					Time:            s.videoTime,
 				})
+				s.BufferRtpPacket.Reset()
 			} else {
 				s.BufferRtpPacket.Write(nalu[3:])
 			}
@@ -277,7 +396,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 				Idx:             s.videoIDX,
 				IsKeyFrame:      false,
 				Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-				Time:            time.Duration(timestamp/90) * time.Millisecond,
+				Time:            s.videoTime,
 			})
 		case 5: // VCL
 			retmap = append(retmap, &av.Packet{
@@ -286,7 +405,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 				Idx:             s.videoIDX,
 				IsKeyFrame:      true,
 				Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-				Time:            time.Duration(timestamp/90) * time.Millisecond,
+				Time:            s.videoTime,
 			})
 		case 7: // Sequence parameter set
 			s.CodecUpdateSPS(nalu)
@@ -309,7 +428,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 						Idx:             s.videoIDX,
 						IsKeyFrame:      false,
 						Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-						Time:            time.Duration(timestamp/90) * time.Millisecond,
+						Time:            s.videoTime,
 					})
 				case 5:
 					retmap = append(retmap, &av.Packet{
@@ -318,7 +437,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 						Idx:             s.videoIDX,
 						IsKeyFrame:      true,
 						Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
-						Time:            time.Duration(timestamp/90) * time.Millisecond,
+						Time:            s.videoTime,
 					})
 				case 7:
 					s.CodecUpdateSPS(nalu)
@@ -362,7 +481,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 							Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
 							Idx:             s.videoIDX,
 							IsKeyFrame:      false,
-							Time:            time.Duration(timestamp/90) * time.Millisecond,
+							Time:            s.videoTime,
 						})
 					case 5:
 						retmap = append(retmap, &av.Packet{
@@ -371,7 +490,7 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 							Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
 							Idx:             s.videoIDX,
 							IsKeyFrame:      true,
-							Time:            time.Duration(timestamp/90) * time.Millisecond,
+							Time:            s.videoTime,
 						})
 					case 7: // Sequence parameter set
 						s.CodecUpdateSPS(nalu)
@@ -391,6 +510,60 @@ func (s *RTSPStream) demuxH264(payload []byte, timestamp int64) (retmap []*av.Pa
 	return retmap
 }
 
+func (s *RTSPStream) demuxJPEG(payload []byte, marker bool, timestamp int64) (retmap []*av.Packet) {
+	frame, err := s.jpeg.Push(payload, marker)
+	if err != nil {
+		log.Println("JPEG depacketizer", err)
+		return nil
+	}
+	if frame == nil {
+		return nil
+	}
+	if w, h := s.jpeg.Size(); w != s.codecVideo.Width() || h != s.codecVideo.Height() {
+		log.Println("Codec Update JPEG", w, "x", h)
+		s.codecVideo = mjpeg.CodecData{Width_: w, Height_: h}
+		s.CodecData[int(s.videoIDX)] = s.codecVideo
+		Config.coAd(s.name, s.CodecData)
+	}
+	return append(retmap, &av.Packet{
+		Data:            frame,
+		CompositionTime: time.Duration(1) * time.Millisecond,
+		Idx:             s.videoIDX,
+		IsKeyFrame:      true,
+		Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
+		Time:            s.videoTime,
+	})
+}
+
+func (s *RTSPStream) demuxFrame(payload []byte, marker bool, timestamp int64) (retmap []*av.Packet) {
+	frame, key, err := s.frames.Push(payload, marker)
+	if err != nil {
+		log.Println(s.videoCodec, "depacketizer", err)
+		return nil
+	}
+	if frame == nil {
+		return nil
+	}
+	if w, h := s.frames.Size(); w != s.codecVideo.Width() || h != s.codecVideo.Height() {
+		log.Println("Codec Update", s.videoCodec, w, "x", h)
+		if s.videoCodec == av.AV1 {
+			s.codecVideo = av1.CodecData{Width_: w, Height_: h}
+		} else {
+			s.codecVideo = vpx.CodecData{CodecType_: s.videoCodec, Width_: w, Height_: h}
+		}
+		s.CodecData[int(s.videoIDX)] = s.codecVideo
+		Config.coAd(s.name, s.CodecData)
+	}
+	return append(retmap, &av.Packet{
+		Data:            frame,
+		CompositionTime: time.Duration(1) * time.Millisecond,
+		Idx:             s.videoIDX,
+		IsKeyFrame:      key,
+		Duration:        time.Duration(float32(timestamp-s.PreVideoTS)/90) * time.Millisecond,
+		Time:            s.videoTime,
+	})
+}
+
 func (s *RTSPStream) CodecUpdateSPS(val []byte) {
 	if s.videoCodec != av.H264 && s.videoCodec != av.H265 {
 		return
@@ -434,6 +607,7 @@ func (s *RTSPStream) CodecUpdateSPS(val []byte) {
 	// 	s.CodecData = append(s.CodecData, codecData)
 	// }
 	Config.coAd(s.name, s.CodecData)
+	s.updateVideoInfo()
 }
 
 func (s *RTSPStream) CodecUpdatePPS(val []byte) {
@@ -479,6 +653,7 @@ func (s *RTSPStream) CodecUpdatePPS(val []byte) {
 	// 	s.CodecData = append(s.CodecData, codecData)
 	// }
 	Config.coAd(s.name, s.CodecData)
+	s.updateVideoInfo()
 }
 
 func (s *RTSPStream) CodecUpdateVPS(val []byte) {
@@ -512,6 +687,50 @@ func (s *RTSPStream) CodecUpdateVPS(val []byte) {
 	// 	s.CodecData = append(s.CodecData, codecData)
 	// }
 	Config.coAd(s.name, s.CodecData)
+	s.updateVideoInfo()
+}
+
+// updateVideoInfo parses the current SPS (and VPS for H265) and publishes
+// the result on the stream. The viewers are notified of the new parameter
+// sets by Config.coAd, this only keeps the summary up to date.
+func (s *RTSPStream) updateVideoInfo() {
+	var info nal.VideoInfo
+	switch s.videoCodec {
+	case av.H264:
+		sps, err := nal.ParseSPS(s.sps)
+		if err != nil {
+			log.Println("Parse SPS Error", err)
+			return
+		}
+		info = sps.Info()
+	case av.H265:
+		sps, err := nal.ParseHEVCSPS(s.sps)
+		if err != nil {
+			log.Println("Parse SPS Error", err)
+			return
+		}
+		info = sps.Info()
+		if info.FPS == 0 && len(s.vps) > 0 {
+			if vps, err := nal.ParseHEVCVPS(s.vps); err == nil {
+				info.FPS = vps.FPS()
+			}
+		}
+	default:
+		return
+	}
+	if info.FPS == 0 {
+		info.FPS = float64(s.FPS)
+	}
+	if info == s.videoInfo {
+		return
+	}
+	if s.videoInfo.Codec != "" {
+		log.Println("Video Parameters Changed", s.name, s.videoInfo, "->", info)
+	} else {
+		log.Println("Video Parameters", s.name, info)
+	}
+	s.videoInfo = info
+	Config.inAd(s.name, info)
 }
 
 //binSize
@@ -533,79 +752,49 @@ func (s *RTSPStream) onAudioPacket(player *rtsp.Player, p *rtp.Packet) error {
 	if s.PreAudioTS == 0 {
 		s.PreAudioTS = int64(p.Timestamp)
 	}
-	nalus, _ := h264parser.SplitNALUs(p.Payload)
+	// the frames start at the time of the packet, on the timeline of the video
+	at := s.clock.time(false, p.Timestamp, s.AudioTimeScale)
 	var retmap []*av.Packet
-	for _, nalu := range nalus {
-		var duration time.Duration
-		switch s.audioCodec {
-		case av.PCM_MULAW:
-			duration = time.Duration(len(nalu)) * time.Second / time.Duration(s.AudioTimeScale)
-			s.AudioTimeLine += duration
-			data := make([]byte, len(nalu))
-			copy(data, nalu)
-			retmap = append(retmap, &av.Packet{
-				Data:            data,
-				CompositionTime: time.Duration(1) * time.Millisecond,
-				Duration:        duration,
-				Idx:             s.audioIDX,
-				IsKeyFrame:      false,
-				Time:            s.AudioTimeLine,
-			})
-		case av.PCM_ALAW:
-			duration = time.Duration(len(nalu)) * time.Second / time.Duration(s.AudioTimeScale)
-			s.AudioTimeLine += duration
-			data := make([]byte, len(nalu))
-			copy(data, nalu)
-			retmap = append(retmap, &av.Packet{
-				Data:            data,
-				CompositionTime: time.Duration(1) * time.Millisecond,
-				Duration:        duration,
-				Idx:             s.audioIDX,
-				IsKeyFrame:      false,
-				Time:            s.AudioTimeLine,
-			})
-		case av.OPUS:
-			duration = time.Duration(20) * time.Millisecond
-			s.AudioTimeLine += duration
-			data := make([]byte, len(nalu))
-			copy(data, nalu)
-			retmap = append(retmap, &av.Packet{
-				Data:            data,
-				CompositionTime: time.Duration(1) * time.Millisecond,
-				Duration:        duration,
-				Idx:             s.audioIDX,
-				IsKeyFrame:      false,
-				Time:            s.AudioTimeLine,
-			})
-		case av.AAC:
-			auHeadersLength := uint16(0) | (uint16(nalu[0]) << 8) | uint16(nalu[1])
-			auHeadersCount := auHeadersLength >> 4
-			framesPayloadOffset := 2 + int(auHeadersCount)<<1
-			auHeaders := nalu[2:framesPayloadOffset]
-			framesPayload := nalu[framesPayloadOffset:]
-			for i := 0; i < int(auHeadersCount); i++ {
-				auHeader := uint16(0) | (uint16(auHeaders[0]) << 8) | uint16(auHeaders[1])
-				frameSize := auHeader >> 3
-				frame := framesPayload[:frameSize]
-				auHeaders = auHeaders[2:]
-				framesPayload = framesPayload[frameSize:]
-				if _, _, _, _, err := aacparser.ParseADTSHeader(frame); err == nil {
-					frame = frame[7:]
-				}
-				duration = time.Duration((float32(1024)/float32(s.AudioTimeScale))*1000*1000*1000) * time.Nanosecond
-				//duration = time.Duration((float32(1024)/float32(s.AudioTimeScale))*1000) * time.Millisecond
-				s.AudioTimeLine += duration
-				data := make([]byte, len(frame))
-				copy(data, frame)
-				retmap = append(retmap, &av.Packet{
-					Data:            data,
-					CompositionTime: time.Duration(1) * time.Millisecond,
-					Duration:        duration,
-					Idx:             s.audioIDX,
-					IsKeyFrame:      false,
-					Time:            s.AudioTimeLine,
-				})
+	switch s.audioCodec {
+	case av.PCM_MULAW, av.PCM_ALAW:
+		// one byte per sample
+		duration := time.Duration(len(p.Payload)) * time.Second / time.Duration(s.AudioTimeScale)
+		s.AudioTimeLine = at
+		retmap = append(retmap, s.audioPacket(p.Payload, duration))
+	case av.OPUS:
+		s.AudioTimeLine = at
+		retmap = append(retmap, s.audioPacket(p.Payload, time.Duration(20)*time.Millisecond))
+	case av.PCM, audio.G722, audio.G726:
+		if data := s.samples.Push(p.Payload); data != nil {
+			duration, _ := s.samples.Codec.PacketDuration(data)
+			// frames are cut across packets, the timeline only follows
+			// the packets after a gap
+			if d := s.AudioTimeLine - at; d > 2*duration || d < -2*duration {
+				s.AudioTimeLine = at
+			}
+			retmap = append(retmap, s.audioPacket(data, duration))
+		}
+	case av.AAC:
+		var frames [][]byte
+		if s.latm != nil {
+			frames, err = s.latm.Push(p.Payload, p.Marker)
+			s.updateLATM()
+		} else {
+			frames, err = s.aac.Push(p.Payload, p.Marker)
+		}
+		if err != nil {
+			log.Println("AAC depacketizer", err)
+		}
+		duration := time.Duration(1024) * time.Second / time.Duration(s.AudioTimeScale)
+		if len(frames) > 0 {
+			s.AudioTimeLine = at
+		}
+		for _, frame := range frames {
+			frame = aac.StripADTS(frame)
+			if len(frame) == 0 {
+				continue
 			}
+			retmap = append(retmap, s.audioPacket(frame, duration))
 		}
 	}
 	if len(retmap) > 0 {
@@ -623,3 +812,95 @@ func (s *RTSPStream) onAudioPacket(player *rtsp.Player, p *rtp.Packet) error {
 	}
 	return nil
 }
+
+//audioPacket copies a frame starting at the audio timeline into a packet
+//and advances the timeline
+func (s *RTSPStream) audioPacket(frame []byte, duration time.Duration) *av.Packet {
+	data := make([]byte, len(frame))
+	copy(data, frame)
+	pck := &av.Packet{
+		Data:            data,
+		CompositionTime: time.Duration(1) * time.Millisecond,
+		Duration:        duration,
+		Idx:             s.audioIDX,
+		IsKeyFrame:      false,
+		Time:            s.AudioTimeLine,
+	}
+	s.AudioTimeLine += duration
+	return pck
+}
+
+//onSenderReport maps the timestamps of a track to the wall clock of the camera
+func (s *RTSPStream) onSenderReport(player *rtsp.Player, video bool, sr rtsp.SenderReport) {
+	s.clock.report(video, sr)
+}
+
+//setupSampleAudio creates the codec of G.722, G.726 and L16 streams,
+//nil for other formats
+func (s *RTSPStream) setupSampleAudio(p *rtsp.Player) av.AudioCodecData {
+	f := p.AudioFormat
+	if f == nil {
+		f = &rtsp.Format{PayloadType: p.AudioMedia.PayloadType}
+	}
+	c, ok, err := audio.NewCodecData(f.PayloadType, f.Encoding, f.ClockRate, f.Channels)
+	if !ok {
+		// return fmt.Errorf("audio Codec %s not supported", m.Type)
+		log.Printf("audio Codec %s not supported", f.Encoding)
+		return nil
+	}
+	if err != nil {
+		log.Println("audio Codec", err)
+		return nil
+	}
+	s.samples = audio.Depacketizer{Codec: c}
+	return c
+}
+
+//setupLATM reads the MP4A-LATM fmtp, when the configuration is sent
+//in-band a codec is guessed from the rtpmap until the first one arrives
+func (s *RTSPStream) setupLATM(f *rtsp.Format) (av.AudioCodecData, error) {
+	s.latm = &aac.LATMDepacketizer{CPresent: f.FmtpInt("cpresent", 1) != 0}
+	if config, err := hex.DecodeString(f.Fmtp["config"]); err == nil && len(config) > 0 {
+		c, err := aac.ParseStreamMuxConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		s.latm.Config = c
+		return aacparser.NewCodecDataFromMPEG4AudioConfig(c.Config)
+	} else if !s.latm.CPresent {
+		return nil, fmt.Errorf("missing config")
+	}
+	channels := f.Channels
+	if channels == 0 {
+		channels = 1
+	}
+	return aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:    aacparser.AOT_AAC_LC,
+		SampleRate:    f.ClockRate,
+		ChannelConfig: uint(channels),
+	})
+}
+
+//updateLATM switches to the configuration received in-band when it differs
+func (s *RTSPStream) updateLATM() {
+	if s.latm.Config == nil {
+		return
+	}
+	c := s.latm.Config.Config
+	if cur, ok := s.codecAudio.(aacparser.CodecData); ok && cur.Config.ObjectType == c.ObjectType &&
+		cur.Config.SampleRate == c.SampleRate && cur.Config.ChannelConfig == c.ChannelConfig {
+		return
+	}
+	codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfig(c)
+	if err != nil {
+		log.Println("Codec Update AAC", err)
+		return
+	}
+	log.Println("Codec Update AAC", c.ObjectType, c.SampleRate, c.ChannelConfig)
+	s.codecAudio = codecData
+	if c.SampleRate > 0 {
+		s.AudioTimeScale = int64(c.SampleRate)
+	}
+	s.CodecData[int(s.audioIDX)] = s.codecAudio
+	Config.coAd(s.name, s.CodecData)
+}
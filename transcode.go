@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/aac"
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/RTSPtoWebRTC/opus"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+// audioPolicy returns the audio codec a viewer needs instead of the codec
+// of the stream, 0 when it plays the stream codec as it is
+type audioPolicy func(av.CodecType) av.CodecType
+
+// webrtcAudio converts what browsers can't play over WebRTC to codecs every
+// browser takes: AAC to Opus, which keeps its bandwidth, and the narrowband
+// G.726 and L16 to PCMA
+func webrtcAudio(t av.CodecType) av.CodecType {
+	switch t {
+	case av.AAC:
+		return av.OPUS
+	case av.PCM, audio.G726:
+		return av.PCM_ALAW
+	}
+	return 0
+}
+
+// mseAudio converts G.711, G.726 and L16 to AAC, the only audio of our fMP4
+func mseAudio(t av.CodecType) av.CodecType {
+	switch t {
+	case av.PCM_ALAW, av.PCM_MULAW, av.PCM, audio.G726:
+		return av.AAC
+	}
+	return 0
+}
+
+// audioTranscoder converts the audio of a stream to another codec. One is
+// shared by all the viewers of a stream that need the same codec, it only
+// runs while one of them is connected. It converts in its own goroutine,
+// the streams and their viewers don't wait for the codecs under the
+// ConfigST lock.
+type audioTranscoder struct {
+	codec    av.AudioCodecData // output
+	dec      audio.Decoder
+	channels int
+	rs       *audio.Resampler
+	enc      audio.Encoder
+	err      error // it can't be done, the viewers get no audio
+
+	// only used by the goroutine
+	started bool
+	in      time.Duration // expected time of the next input packet
+	out     time.Duration // time of the next output packet
+	errs    int
+
+	// with the ConfigST lock held
+	pkts  chan av.Packet // nil until the goroutine runs
+	done  chan struct{}
+	drops int
+}
+
+// transcoderQueue is the number of packets waiting for a transcoder, the
+// audio is dropped while it can't keep up
+const transcoderQueue = 64
+
+// feed queues a packet of the stream, the first one starts the goroutine.
+// The converted packets go to the viewers needing them. The caller holds
+// the lock.
+func (tc *audioTranscoder) feed(suuid string, target av.CodecType, pck av.Packet) {
+	if tc.pkts == nil {
+		tc.pkts = make(chan av.Packet, transcoderQueue)
+		tc.done = make(chan struct{})
+		go tc.run(suuid, target, tc.done)
+	}
+	select {
+	case tc.pkts <- pck:
+	default:
+		if tc.drops == 0 {
+			log.Println("Audio transcode", suuid, "can't keep up, dropping audio")
+		}
+		tc.drops++
+	}
+}
+
+func (tc *audioTranscoder) run(suuid string, target av.CodecType, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case pck := <-tc.pkts:
+			if pkts := tc.push(pck); len(pkts) > 0 {
+				Config.castConverted(suuid, target, tc, pkts)
+			}
+		}
+	}
+}
+
+// stop ends the goroutine, the caller holds the lock
+func (tc *audioTranscoder) stop() {
+	if tc.done != nil {
+		close(tc.done)
+		tc.done = nil
+	}
+}
+
+func newAudioTranscoder(src av.CodecData, target av.CodecType) (*audioTranscoder, error) {
+	ac, ok := src.(av.AudioCodecData)
+	if !ok {
+		return nil, fmt.Errorf("transcode: %s is not audio", audio.TypeName(src.Type()))
+	}
+	tc := &audioTranscoder{}
+	rate, channels := ac.SampleRate(), ac.ChannelLayout().Count()
+	switch src.Type() {
+	case av.AAC:
+		c, ok := src.(aacparser.CodecData)
+		if !ok {
+			return nil, fmt.Errorf("transcode: unexpected AAC codec data %T", src)
+		}
+		dec, err := aac.NewDecoder(c.Config)
+		if err != nil {
+			return nil, err
+		}
+		// the core sample rate, SBR isn't decoded
+		rate = dec.SampleRate()
+		tc.dec = dec
+	case av.PCM_ALAW:
+		tc.dec = audio.G711Decoder{ALaw: true}
+	case av.PCM_MULAW:
+		tc.dec = audio.G711Decoder{}
+	case av.PCM:
+		tc.dec = audio.L16Decoder{Channels: channels}
+	case audio.G726:
+		c, ok := src.(audio.CodecData)
+		if !ok {
+			return nil, fmt.Errorf("transcode: unexpected G.726 codec data %T", src)
+		}
+		dec, err := audio.NewG726Decoder(c)
+		if err != nil {
+			return nil, err
+		}
+		tc.dec = dec
+	default:
+		return nil, fmt.Errorf("transcode: no decoder for %s", audio.TypeName(src.Type()))
+	}
+
+	outRate := rate
+	switch target {
+	case av.PCM_ALAW:
+		tc.codec = codec.NewPCMAlawCodecData()
+		tc.enc = &audio.G711Encoder{ALaw: true, Size: 160}
+		outRate, tc.channels = 8000, 1
+	case av.PCM_MULAW:
+		tc.codec = codec.NewPCMMulawCodecData()
+		tc.enc = &audio.G711Encoder{Size: 160}
+		outRate, tc.channels = 8000, 1
+	case av.OPUS:
+		enc, err := opus.NewEncoder(64000)
+		if err != nil {
+			return nil, err
+		}
+		tc.codec = codec.NewOpusCodecData(opus.SampleRate, av.CH_MONO)
+		tc.enc = enc
+		outRate, tc.channels = opus.SampleRate, 1
+	case av.AAC:
+		tc.channels = channels
+		if tc.channels > 2 {
+			tc.channels = 2
+		}
+		bitrate := 32000
+		if outRate > 16000 {
+			bitrate = 64000
+		}
+		enc, err := aac.NewEncoder(outRate, tc.channels, bitrate*tc.channels)
+		if err != nil {
+			// not an AAC sample rate
+			outRate = 48000
+			if enc, err = aac.NewEncoder(outRate, tc.channels, 64000*tc.channels); err != nil {
+				return nil, err
+			}
+		}
+		tc.codec, err = aacparser.NewCodecDataFromMPEG4AudioConfig(enc.Config())
+		if err != nil {
+			return nil, err
+		}
+		tc.enc = enc
+	default:
+		return nil, fmt.Errorf("transcode: no encoder for %s", audio.TypeName(target))
+	}
+	tc.rs = audio.NewResampler(rate, outRate, tc.channels)
+	log.Printf("Audio transcode %s %d Hz %d ch to %s %d Hz %d ch", audio.TypeName(src.Type()), rate, channels,
+		audio.TypeName(target), outRate, tc.channels)
+	return tc, nil
+}
+
+// push converts a packet, the encoders buffer samples so it returns zero
+// or more packets
+func (tc *audioTranscoder) push(pck av.Packet) []av.Packet {
+	if !tc.started || pck.Time-tc.in > time.Second || tc.in-pck.Time > time.Second {
+		// first packet or a gap in the stream, the output follows it
+		tc.out = pck.Time
+		tc.started = true
+	}
+	tc.in = pck.Time + pck.Duration
+
+	pcm, err := tc.dec.Decode(pck.Data)
+	if err != nil {
+		if tc.errs == 0 {
+			log.Println("Audio transcode decode", err)
+		}
+		tc.errs++
+		return nil
+	}
+	pcm = tc.rs.Process(audio.Downmix(pcm, tc.channels))
+	frames, err := tc.enc.Encode(pcm)
+	if err != nil {
+		if tc.errs == 0 {
+			log.Println("Audio transcode encode", err)
+		}
+		tc.errs++
+		return nil
+	}
+	pkts := make([]av.Packet, 0, len(frames))
+	for _, f := range frames {
+		d, err := tc.codec.PacketDuration(f)
+		if err != nil {
+			continue
+		}
+		pkts = append(pkts, av.Packet{Idx: pck.Idx, Data: f, Time: tc.out, Duration: d})
+		tc.out += d
+	}
+	return pkts
+}
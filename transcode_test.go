@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/aac"
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+// G.726 cameras are played as PCMA over WebRTC and as AAC with MSE
+func TestTranscodeG726(t *testing.T) {
+	g726, err := audio.NewG726CodecData("G726-32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := StreamST{Codecs: []av.CodecData{testH264(t), g726}, tc: make(map[av.CodecType]*audioTranscoder)}
+	for _, c := range []struct {
+		name   string
+		policy audioPolicy
+		target av.CodecType
+		pkts   int // out of a second
+	}{
+		{"WebRTC", webrtcAudio, av.PCM_ALAW, 50},
+		{"MSE", mseAudio, av.AAC, 7}, // 1024 samples a frame
+	} {
+		codecs := s.viewerCodecs(s.Codecs, c.policy)
+		if codecs[0].Type() != av.H264 || codecs[1].Type() != c.target {
+			t.Fatalf("%s: codecs %v %v", c.name, codecs[0].Type(), audio.TypeName(codecs[1].Type()))
+		}
+		_, tc := s.audioTarget(1, c.policy)
+		if tc.err != nil {
+			t.Fatalf("%s: %v", c.name, tc.err)
+		}
+		var out []av.Packet
+		start := 5 * time.Second
+		for i := 0; i < 50; i++ {
+			// 20 ms alternating between the biggest positive and negative code words
+			data := make([]byte, 80)
+			for j := range data {
+				data[j] = 0x87
+			}
+			out = append(out, tc.push(av.Packet{Idx: 1, Data: data, Time: start + time.Duration(i)*20*time.Millisecond, Duration: 20 * time.Millisecond})...)
+		}
+		if len(out) != c.pkts {
+			t.Fatalf("%s: %d packets, want %d", c.name, len(out), c.pkts)
+		}
+		next := start
+		for i, p := range out {
+			if p.Idx != 1 || p.Time != next {
+				t.Errorf("%s: packet %d track %d at %v, want %v", c.name, i, p.Idx, p.Time, next)
+			}
+			next += p.Duration
+		}
+		if tc.errs != 0 {
+			t.Errorf("%s: %d errors", c.name, tc.errs)
+		}
+	}
+}
+
+// AAC cameras are played as 48 kHz Opus over WebRTC
+func TestTranscodeAAC(t *testing.T) {
+	enc, err := aac.NewEncoder(44100, 2, 128000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := aacparser.NewCodecDataFromMPEG4AudioConfig(enc.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := StreamST{Codecs: []av.CodecData{testH264(t), src}, tc: make(map[av.CodecType]*audioTranscoder)}
+	codecs := s.viewerCodecs(s.Codecs, webrtcAudio)
+	if codecs[1].Type() != av.OPUS || codecs[1].(av.AudioCodecData).SampleRate() != 48000 {
+		t.Fatalf("codec %v", audio.TypeName(codecs[1].Type()))
+	}
+	_, tc := s.audioTarget(1, webrtcAudio)
+	if tc.err != nil {
+		t.Fatal(tc.err)
+	}
+	pcm := [][]float32{make([]float32, 44100), make([]float32, 44100)}
+	for i := range pcm[0] {
+		pcm[0][i] = float32(0.3 * math.Sin(2*math.Pi*440*float64(i)/44100))
+		pcm[1][i] = float32(0.3 * math.Sin(2*math.Pi*1000*float64(i)/44100))
+	}
+	aus, err := enc.Encode(pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []av.Packet
+	start := 5 * time.Second
+	for i, au := range aus {
+		d := time.Duration(i) * 1024 * time.Second / 44100
+		out = append(out, tc.push(av.Packet{Idx: 1, Data: au, Time: start + d, Duration: 1024 * time.Second / 44100})...)
+	}
+	// the 43 whole AAC frames of a second, 49 of Opus
+	if len(aus) != 43 || len(out) != 49 {
+		t.Fatalf("%d packets out of %d", len(out), len(aus))
+	}
+	for i, p := range out {
+		if p.Idx != 1 || p.Time != start+time.Duration(i)*20*time.Millisecond || p.Duration != 20*time.Millisecond {
+			t.Errorf("packet %d track %d at %v for %v", i, p.Idx, p.Time, p.Duration)
+		}
+		if len(p.Data) != 160 || p.Data[0] != 0xf8 {
+			t.Errorf("packet %d of %d bytes, toc %#x", i, len(p.Data), p.Data[0])
+		}
+	}
+	if tc.errs != 0 {
+		t.Errorf("%d errors", tc.errs)
+	}
+}
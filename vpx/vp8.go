@@ -0,0 +1,67 @@
+package vpx
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/rtp/codecs"
+)
+
+// VP8Depacketizer rebuilds the VP8 frames of a RTP session.
+// Packets are expected in order.
+type VP8Depacketizer struct {
+	frame   []byte
+	started bool
+	width   int
+	height  int
+}
+
+// Push adds the payload of a RTP packet, it returns the frame once the
+// packet with the marker bit is received.
+func (d *VP8Depacketizer) Push(payload []byte, marker bool) (frame []byte, key bool, err error) {
+	var p codecs.VP8Packet
+	if _, err := p.Unmarshal(payload); err != nil {
+		d.started = false
+		return nil, false, err
+	}
+	if p.S == 1 && p.PID == 0 {
+		d.frame = d.frame[:0]
+		d.started = true
+	}
+	if !d.started {
+		// waiting for the start of a frame
+		return nil, false, nil
+	}
+	d.frame = append(d.frame, p.Payload...)
+	if !marker {
+		return nil, false, nil
+	}
+	d.started = false
+	if len(d.frame) < 3 {
+		return nil, false, ErrShortFrame
+	}
+	frame = make([]byte, len(d.frame))
+	copy(frame, d.frame)
+
+	// frame tag: show_frame, version and P bits, then the first partition size
+	key = frame[0]&0x01 == 0
+	if key {
+		// start code and the 14 bit sizes of RFC 6386 9.1
+		if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+			return nil, false, ErrShortFrame
+		}
+		d.width = int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff)
+		d.height = int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff)
+	}
+	return frame, key, nil
+}
+
+// Lost drops the frame being rebuilt after a lost packet, the next one
+// starts with its first partition
+func (d *VP8Depacketizer) Lost() {
+	d.started = false
+}
+
+// Size of the last keyframe
+func (d *VP8Depacketizer) Size() (int, int) {
+	return d.width, d.height
+}
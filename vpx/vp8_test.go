@@ -0,0 +1,45 @@
+package vpx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp/codecs"
+)
+
+// vp8Key is the frame tag of a shown keyframe and its start code with the
+// 640x480 size (RFC 6386 9.1), vp8Inter the tag of an inter frame
+var (
+	vp8Key   = []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}
+	vp8Inter = []byte{0x11, 0x02, 0x00}
+)
+
+func TestVP8(t *testing.T) {
+	payloader := &codecs.VP8Payloader{EnablePictureID: true}
+	d := &VP8Depacketizer{}
+
+	key := testFrame(vp8Key, 1000)
+	frame, isKey := push(t, d, payloader.Payload(200, key))
+	if !bytes.Equal(frame, key) || !isKey {
+		t.Errorf("keyframe: %d bytes key %v, want %d bytes", len(frame), isKey, len(key))
+	}
+	if w, h := d.Size(); w != 640 || h != 480 {
+		t.Errorf("size %dx%d, want 640x480", w, h)
+	}
+
+	inter := testFrame(vp8Inter, 500)
+	frame, isKey = push(t, d, payloader.Payload(200, inter))
+	if !bytes.Equal(frame, inter) || isKey {
+		t.Errorf("inter frame: %d bytes key %v, want %d bytes", len(frame), isKey, len(inter))
+	}
+
+	testLoss(t, d, inter, payloader.Payload(200, inter))
+
+	// a keyframe without its start code
+	if _, _, err := d.Push(payloader.Payload(200, testFrame([]byte{0x10, 0x02, 0x00}, 10))[0], true); err != ErrShortFrame {
+		t.Errorf("keyframe without start code: error %v, want %v", err, ErrShortFrame)
+	}
+	if _, _, err := d.Push(nil, true); err == nil {
+		t.Error("empty payload: no error")
+	}
+}
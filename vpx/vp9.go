@@ -0,0 +1,103 @@
+package vpx
+
+import (
+	"github.com/pion/rtp/codecs"
+)
+
+// VP9Depacketizer rebuilds the VP9 pictures of a RTP session, a picture
+// ends with the marker bit. Spatial layers aren't supported, packets are
+// expected in order.
+type VP9Depacketizer struct {
+	frame   []byte
+	started bool
+	width   int
+	height  int
+}
+
+// Push adds the payload of a RTP packet, it returns the picture once the
+// packet with the marker bit is received.
+func (d *VP9Depacketizer) Push(payload []byte, marker bool) (frame []byte, key bool, err error) {
+	var p codecs.VP9Packet
+	if _, err := p.Unmarshal(payload); err != nil {
+		d.started = false
+		return nil, false, err
+	}
+	if p.B && !d.started {
+		d.frame = d.frame[:0]
+		d.started = true
+	}
+	if !d.started {
+		// waiting for the start of a picture
+		return nil, false, nil
+	}
+	if p.V && p.Y && len(p.Width) > 0 {
+		// scalability structure, the sizes of the spatial layers
+		d.width, d.height = int(p.Width[0]), int(p.Height[0])
+	}
+	d.frame = append(d.frame, p.Payload...)
+	if !marker {
+		return nil, false, nil
+	}
+	d.started = false
+	if len(d.frame) == 0 {
+		return nil, false, ErrShortFrame
+	}
+	frame = make([]byte, len(d.frame))
+	copy(frame, d.frame)
+	// the P bit of the payload descriptor isn't reliable, some senders never set it
+	if w, h, ok := vp9Size(frame); ok {
+		d.width, d.height = w, h
+		key = true
+	}
+	return frame, key, nil
+}
+
+// Lost drops the picture being rebuilt after a lost packet, the next one
+// starts with its B bit
+func (d *VP9Depacketizer) Lost() {
+	d.started = false
+}
+
+// Size of the last keyframe
+func (d *VP9Depacketizer) Size() (int, int) {
+	return d.width, d.height
+}
+
+// vp9Size reads the frame size of the uncompressed header of a keyframe
+// (VP9 bitstream specification 6.2)
+func vp9Size(b []byte) (width, height int, ok bool) {
+	r := &bitReader{b: b}
+	if r.u(2) != 2 { // frame_marker
+		return 0, 0, false
+	}
+	profile := r.u(1)
+	profile |= r.u(1) << 1
+	if profile == 3 {
+		r.u(1) // reserved_zero
+	}
+	if r.u(1) == 1 { // show_existing_frame
+		return 0, 0, false
+	}
+	if r.u(1) != 0 { // frame_type is not KEY_FRAME
+		return 0, 0, false
+	}
+	r.u(2)                   // show_frame, error_resilient_mode
+	if r.u(24) != 0x498342 { // frame_sync_code
+		return 0, 0, false
+	}
+	// color_config
+	if profile >= 2 {
+		r.u(1) // ten_or_twelve_bit
+	}
+	if r.u(3) != 7 { // color_space is not CS_RGB
+		r.u(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.u(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.u(1) // reserved_zero
+	}
+	width = int(r.u(16)) + 1
+	height = int(r.u(16)) + 1
+	return width, height, !r.eof()
+}
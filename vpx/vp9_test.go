@@ -0,0 +1,46 @@
+package vpx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp/codecs"
+)
+
+// vp9Key is the start of the uncompressed header of a profile 0 shown
+// keyframe, 1280x720 with the BT.709 color space (VP9 bitstream 6.2)
+var vp9Key = []byte{
+	0x82,             // frame_marker, profile, show_existing_frame, frame_type, show_frame, error_resilient_mode
+	0x49, 0x83, 0x42, // frame_sync_code
+	0x40, 0x4f, 0xf0, 0x2c, 0xf0, // color_space 2, color_range, width-1 1279 and height-1 719
+}
+
+func TestVP9(t *testing.T) {
+	payloader := &codecs.VP9Payloader{InitialPictureIDFn: func() uint16 { return 0 }}
+	d := &VP9Depacketizer{}
+
+	key := testFrame(vp9Key, 1000)
+	frame, isKey := push(t, d, payloader.Payload(200, key))
+	if !bytes.Equal(frame, key) || !isKey {
+		t.Errorf("keyframe: %d bytes key %v, want %d bytes", len(frame), isKey, len(key))
+	}
+	if w, h := d.Size(); w != 1280 || h != 720 {
+		t.Errorf("size %dx%d, want 1280x720", w, h)
+	}
+
+	// frame_type 1
+	inter := testFrame([]byte{0x86}, 500)
+	frame, isKey = push(t, d, payloader.Payload(200, inter))
+	if !bytes.Equal(frame, inter) || isKey {
+		t.Errorf("inter frame: %d bytes key %v, want %d bytes", len(frame), isKey, len(inter))
+	}
+	if w, h := d.Size(); w != 1280 || h != 720 {
+		t.Errorf("size %dx%d after an inter frame, want 1280x720", w, h)
+	}
+
+	testLoss(t, d, inter, payloader.Payload(200, inter))
+
+	if _, _, err := d.Push(nil, true); err == nil {
+		t.Error("empty payload: no error")
+	}
+}
@@ -0,0 +1,51 @@
+// Package vpx rebuilds VP8 (RFC 7741) and VP9 frames from RTP payloads
+package vpx
+
+import (
+	"errors"
+
+	"github.com/deepch/vdk/av"
+)
+
+var ErrShortFrame = errors.New("vpx: frame too short")
+
+// CodecData of a VP8 or VP9 stream, the size comes from the last keyframe
+type CodecData struct {
+	CodecType_ av.CodecType
+	Width_     int
+	Height_    int
+}
+
+func (c CodecData) Type() av.CodecType {
+	return c.CodecType_
+}
+
+func (c CodecData) Width() int {
+	return c.Width_
+}
+
+func (c CodecData) Height() int {
+	return c.Height_
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+// u reads n bits, zeros past the end
+func (r *bitReader) u(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if k := r.pos >> 3; k < len(r.b) {
+			v |= uint(r.b[k]>>(7-r.pos&7)) & 1
+		}
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) eof() bool {
+	return r.pos > len(r.b)*8
+}
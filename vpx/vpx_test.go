@@ -0,0 +1,77 @@
+package vpx
+
+import (
+	"bytes"
+	"testing"
+)
+
+// depacketizer is the VP8 or VP9 one
+type depacketizer interface {
+	Push(payload []byte, marker bool) ([]byte, bool, error)
+	Lost()
+	Size() (int, int)
+}
+
+// push sends the payloads of a frame, the last one with the marker, and
+// returns the frame of the last one
+func push(t *testing.T, d depacketizer, payloads [][]byte) ([]byte, bool) {
+	var frame []byte
+	var key bool
+	for i, p := range payloads {
+		f, k, err := d.Push(p, i == len(payloads)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != nil && i != len(payloads)-1 {
+			t.Fatal("frame before the marker")
+		}
+		frame, key = f, k
+	}
+	return frame, key
+}
+
+// testFrame returns the frame header followed by size bytes of data
+func testFrame(header []byte, size int) []byte {
+	frame := append([]byte{}, header...)
+	for i := 0; i < size; i++ {
+		frame = append(frame, byte(i*7))
+	}
+	return frame
+}
+
+// testLoss checks the depacketizer across the loss of the first, a middle
+// and the last packet of a frame, the stream calls Lost at every gap. The
+// next frame comes after each loss.
+func testLoss(t *testing.T, d depacketizer, frame []byte, payloads [][]byte) {
+	n := len(payloads)
+	if n < 3 {
+		t.Fatalf("%d payloads", n)
+	}
+	for _, c := range []struct {
+		name     string
+		received [][][]byte // the packets between the gaps
+		gap      bool       // before the next frame
+	}{
+		{"first packet lost", [][][]byte{nil, payloads[1:]}, false},
+		{"middle packet lost", [][][]byte{payloads[:1], payloads[2:]}, false},
+		{"last packet lost", [][][]byte{payloads[:n-1]}, true},
+	} {
+		for i, received := range c.received {
+			if i > 0 {
+				d.Lost()
+			}
+			for _, p := range received {
+				last := &p[0] == &payloads[n-1][0]
+				if f, _, err := d.Push(p, last); f != nil || err != nil {
+					t.Errorf("%s: frame %d bytes, error %v", c.name, len(f), err)
+				}
+			}
+		}
+		if c.gap {
+			d.Lost()
+		}
+		if f, _ := push(t, d, payloads); !bytes.Equal(f, frame) {
+			t.Errorf("%s: next frame %d bytes, want %d", c.name, len(f), len(frame))
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// webrtcSession carries the tracks of several streams over one
+// PeerConnection for grid views, one ICE session and one DTLS handshake
+// whatever the number of cameras. The server offers: adding or removing a
+// stream is a new offer the client answers. The media of a stream is the
+// MediaStream with its uuid as id, the offers also map their mids to the
+// stream uuids. Replacing a stream switches its senders to the tracks of
+// another one without renegotiation.
+type webrtcSession struct {
+	*WebRTCStreamer                            // the signaling and the PeerConnection
+	streams         map[string]*WebRTCStreamer // sharing the PeerConnection, by uuid
+	requests        chan Request
+	switches        chan *WebRTCStreamer // track switches of the hubs
+}
+
+// sessionRequests bounds the stream requests waiting for the session
+const sessionRequests = 64
+
+func newWebRTCSession(send func(Response) error) *webrtcSession {
+	return &webrtcSession{
+		WebRTCStreamer: newWebRTCStreamer(send, false),
+		streams:        make(map[string]*WebRTCStreamer),
+		requests:       make(chan Request, sessionRequests),
+		switches:       make(chan *WebRTCStreamer),
+	}
+}
+
+// wsSession is the signaling of a webrtcSession, the session ends with the
+// WebSocket
+func wsSession(ws *websocket.Conn) {
+	defer ws.Close()
+
+	s := newWebRTCSession(wsSender(ws))
+	go s.run()
+	defer close(s.stop)
+	for {
+		var request Request
+		err := websocket.JSON.Receive(ws, &request)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("websocket.JSON.Receive", err)
+			}
+			return
+		}
+		switch request.Type {
+		case "add", "remove", "replace":
+			if !s.request(request) {
+				s.reply(Response{Type: request.Type, Stream: request.Stream, Error: "Too Many Requests"})
+			}
+		case "answer":
+			if !s.takeAnswer(request.Sdp) {
+				log.Println("WebRTC answer without an offer")
+			}
+		case "candidate":
+			if request.Candidate != nil {
+				s.candidate(*request.Candidate)
+			}
+		}
+	}
+}
+
+// request queues a stream request, false when too many are waiting
+func (s *webrtcSession) request(r Request) bool {
+	select {
+	case s.requests <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *webrtcSession) reply(r Response) {
+	if err := s.send(r); err != nil {
+		log.Println("WebRTC signaling", err)
+	}
+}
+
+func (s *webrtcSession) run() {
+	defer close(s.done)
+	err := s.connect()
+	if err != nil {
+		log.Println(err)
+		s.reply(Response{Type: "webrtc", Error: err.Error()})
+		return
+	}
+	defer s.close()
+	defer func() {
+		for _, st := range s.streams {
+			s.leave(st)
+		}
+	}()
+
+	reports := time.NewTicker(time.Second)
+	defer reports.Stop()
+	for {
+		renegotiate := false
+		select {
+		case <-s.stop:
+			return
+		case state := <-s.stateC:
+			s.setState(state)
+		case <-s.up:
+			s.up, s.ready = nil, true
+			for _, st := range s.streams {
+				st.ready = true
+				st.prefill()
+			}
+		case <-s.grace.C:
+			if s.lost() {
+				log.Println("disconnected ICE connection")
+				return
+			}
+		case c := <-s.candidates:
+			s.addCandidate(c)
+		case now := <-reports.C:
+			for _, st := range s.streams {
+				st.report(now)
+				st.protect()
+			}
+		case st := <-s.switches:
+			suuid := st.hub.suuid
+			if s.streams[suuid] != st {
+				// removed in the meantime
+				continue
+			}
+			if err := st.update(); err != nil {
+				log.Println("WebRTC codec change", suuid, err)
+				s.reply(Response{Type: "webrtc", Stream: suuid, Error: err.Error()})
+				renegotiate = s.remove(suuid) == nil
+			}
+		case r := <-s.requests:
+			// the waiting requests share the offer
+			renegotiate = s.handle(r)
+			for pending := true; pending; {
+				select {
+				case r := <-s.requests:
+					renegotiate = s.handle(r) || renegotiate
+				default:
+					pending = false
+				}
+			}
+		}
+		if renegotiate {
+			if err := s.propose(s.mids, s.checkAnswer); err != nil {
+				log.Println("WebRTC session renegotiation", err)
+				s.reply(Response{Type: "webrtc", Error: err.Error()})
+				return
+			}
+			// the tracks of the added streams are bound
+			for _, st := range s.streams {
+				st.prefill()
+			}
+		}
+	}
+}
+
+// handle applies a stream request, it tells whether it needs a new offer
+func (s *webrtcSession) handle(r Request) bool {
+	var err error
+	renegotiate := false
+	switch r.Type {
+	case "add":
+		err = s.add(r.Stream)
+		renegotiate = err == nil
+	case "remove":
+		err = s.remove(r.Stream)
+		renegotiate = err == nil
+	case "replace":
+		renegotiate, err = s.replace(r.Replace, r.Stream)
+		if err == nil && !renegotiate {
+			s.reply(Response{Type: "streams", Streams: s.mids()})
+		}
+	}
+	if err != nil {
+		log.Println("WebRTC session", r.Type, r.Stream, err)
+		s.reply(Response{Type: r.Type, Stream: r.Stream, Error: err.Error()})
+	}
+	return renegotiate
+}
+
+// join returns a stream sharing the PeerConnection with the tracks of its
+// hub, they are checked against the last answer of the client
+func (s *webrtcSession) join(suuid string) (*WebRTCStreamer, error) {
+	if _, ok := s.streams[suuid]; ok {
+		return nil, errors.New("Stream Already In The Session")
+	}
+	if !Config.ext(suuid) {
+		return nil, errors.New("Stream Not Found")
+	}
+	Config.RunIFNotRun(suuid)
+	hub, switched, err := joinHub(suuid)
+	if err != nil {
+		return nil, err
+	}
+	st := newWebRTCStreamer(s.send, false)
+	st.pc = s.pc
+	st.offer = s.offer
+	st.hub = hub
+	st.switched = switched
+	st.fec = Config.fecGe(suuid)
+	st.ready = s.ready
+	codecs, tracks := hub.snapshot()
+	st.tracks = tracks
+	for idx := range tracks {
+		if s.offer == "" || int(idx) >= len(codecs) {
+			continue
+		}
+		if err := checkOffer(s.offer, codecs[idx]); err != nil {
+			s.leave(st)
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// leave ends a stream of the session
+func (s *webrtcSession) leave(st *WebRTCStreamer) {
+	close(st.stop)
+	st.hub.leave(st.switched)
+}
+
+// follow passes the track switches of a stream to the session
+func (s *webrtcSession) follow(st *WebRTCStreamer) {
+	for {
+		select {
+		case <-st.switched:
+			select {
+			case s.switches <- st:
+			case <-st.stop:
+				return
+			}
+		case <-st.stop:
+			return
+		}
+	}
+}
+
+func (s *webrtcSession) add(suuid string) error {
+	st, err := s.join(suuid)
+	if err != nil {
+		return err
+	}
+	st.senders, err = s.addTracks(st.tracks, true)
+	if err != nil {
+		s.leave(st)
+		return err
+	}
+	s.streams[suuid] = st
+	go s.follow(st)
+	return nil
+}
+
+func (s *webrtcSession) remove(suuid string) error {
+	st, ok := s.streams[suuid]
+	if !ok {
+		return errors.New("Stream Not In The Session")
+	}
+	for _, sender := range st.senders {
+		if err := s.pc.RemoveTrack(sender); err != nil {
+			log.Println("WebRTC remove track", err)
+		}
+	}
+	delete(s.streams, suuid)
+	s.leave(st)
+	return nil
+}
+
+// replace switches the senders of a stream to the tracks of another one,
+// by kind. A new offer is only needed for the senders the other stream has
+// no track for, they are removed. Its tracks without a sender aren't sent.
+func (s *webrtcSession) replace(old, suuid string) (bool, error) {
+	st, ok := s.streams[old]
+	if !ok {
+		return false, errors.New("Stream Not In The Session")
+	}
+	next, err := s.join(suuid)
+	if err != nil {
+		return false, err
+	}
+
+	pairs, unused := pairTracks(st.senders, st.tracks, next.tracks)
+	next.senders, err = retarget(st.senders, st.tracks, next.tracks, pairs, nil)
+	if err != nil {
+		s.leave(next)
+		return false, err
+	}
+	for _, idx := range unused {
+		if err := s.pc.RemoveTrack(st.senders[idx]); err != nil {
+			log.Println("WebRTC remove track", err)
+		}
+	}
+
+	next.prefill()
+	delete(s.streams, old)
+	s.leave(st)
+	s.streams[suuid] = next
+	go s.follow(next)
+	log.Println("WebRTC session switched", old, "to", suuid)
+	return len(unused) > 0, nil
+}
+
+// mids maps the mids of the senders to their stream uuids
+func (s *webrtcSession) mids() map[string]string {
+	mids := make(map[string]string)
+	for _, t := range s.pc.GetTransceivers() {
+		for suuid, st := range s.streams {
+			for _, sender := range st.senders {
+				if t.Sender() == sender && t.Mid() != "" {
+					mids[t.Mid()] = suuid
+				}
+			}
+		}
+	}
+	return mids
+}
+
+// checkAnswer checks the answer against the tracks of every stream, it has
+// the codecs of the streams added later. It answers every mid of the offer.
+func (s *webrtcSession) checkAnswer(sdp string) error {
+	answered := make(map[string]bool)
+	for _, mid := range sdpMids(sdp) {
+		answered[mid] = true
+	}
+	for mid, suuid := range s.mids() {
+		if !answered[mid] {
+			return fmt.Errorf("WebRTC answer without the mid %s of stream %s", mid, suuid)
+		}
+	}
+	for _, st := range s.streams {
+		if err := st.checkAnswer(sdp); err != nil {
+			return err
+		}
+	}
+	s.offer = sdp
+	return nil
+}
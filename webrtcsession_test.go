@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// testSession runs a session, its replies are sent on the channel
+func testSession(t *testing.T) (*webrtcSession, chan Response) {
+	replies := make(chan Response, 16)
+	s := newWebRTCSession(func(r Response) error {
+		replies <- r
+		return nil
+	})
+	go s.run()
+	t.Cleanup(func() {
+		s.end()
+		<-s.done
+	})
+	return s, replies
+}
+
+// testReply returns the next reply of a session
+func testReply(t *testing.T, replies chan Response) Response {
+	select {
+	case r := <-replies:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reply")
+	}
+	return Response{}
+}
+
+// testOfferReply returns the next offer of a session
+func testOfferReply(t *testing.T, replies chan Response) Response {
+	r := testReply(t, replies)
+	if r.Type != "offer" || r.Error != "" {
+		t.Fatalf("reply %q %q, want an offer", r.Type, r.Error)
+	}
+	return r
+}
+
+// testAnswer answers an offer with the PeerConnection, the answer has all
+// its candidates
+func testAnswer(t *testing.T, pc *webrtc.PeerConnection, offer string) string {
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-promise
+	return pc.LocalDescription().SDP
+}
+
+// sessionSenders returns the tracks of the senders of a session by mid
+func sessionSenders(s *webrtcSession) map[string]*webrtc.RTPSender {
+	senders := make(map[string]*webrtc.RTPSender)
+	for _, t := range s.pc.GetTransceivers() {
+		if t.Sender() != nil && t.Sender().Track() != nil {
+			senders[t.Mid()] = t.Sender()
+		}
+	}
+	return senders
+}
+
+// midOf returns the mid of a stream in the mids of an offer
+func midOf(t *testing.T, streams map[string]string, suuid string) string {
+	for mid, s := range streams {
+		if s == suuid {
+			return mid
+		}
+	}
+	t.Fatalf("stream %s not in %v", suuid, streams)
+	return ""
+}
+
+func TestWebRTCSession(t *testing.T) {
+	testWebRTC(t)
+	for _, suuid := range []string{"session-a", "session-b", "session-c", "session-d"} {
+		testStream(t, suuid, []av.CodecData{testH264(t)})
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, replies := testSession(t)
+
+	s.request(Request{Type: "add", Stream: "session-a"})
+	first := testOfferReply(t, replies)
+	s.takeAnswer(testAnswer(t, pc, first.Sdp))
+	pcA := s.pc
+
+	// the second stream is a new offer of the same PeerConnection
+	s.request(Request{Type: "add", Stream: "session-b"})
+	second := testOfferReply(t, replies)
+	if s.pc != pcA || !samePeerConnection(first.Sdp, second.Sdp) {
+		t.Fatal("second stream on another PeerConnection")
+	}
+	if len(second.Streams) != 2 || midOf(t, second.Streams, "session-a") != midOf(t, first.Streams, "session-a") {
+		t.Errorf("mids %v after %v", second.Streams, first.Streams)
+	}
+	s.takeAnswer(testAnswer(t, pc, second.Sdp))
+	midB := midOf(t, second.Streams, "session-b")
+
+	// replaced without an offer, the sender stays and its track changes
+	before := sessionSenders(s)
+	s.request(Request{Type: "replace", Replace: "session-b", Stream: "session-c"})
+	r := testReply(t, replies)
+	if r.Type != "streams" || r.Error != "" {
+		t.Fatalf("reply %q %q, want the streams", r.Type, r.Error)
+	}
+	if r.Streams[midB] != "session-c" {
+		t.Errorf("mids %v, want %s for session-c", r.Streams, midB)
+	}
+	after := sessionSenders(s)
+	if after[midB] != before[midB] {
+		t.Error("the sender of the replaced stream changed")
+	}
+	if after[midB].Track() == nil || after[midB].Track().StreamID() != "session-c" {
+		t.Errorf("sender track of stream %q, want session-c", after[midB].Track().StreamID())
+	}
+
+	// the mid of a removed stream is taken by the next one
+	s.request(Request{Type: "remove", Stream: "session-c"})
+	removed := testOfferReply(t, replies)
+	if _, ok := removed.Streams[midB]; ok || len(removed.Streams) != 1 {
+		t.Errorf("mids %v after removing the stream of mid %s", removed.Streams, midB)
+	}
+	s.takeAnswer(testAnswer(t, pc, removed.Sdp))
+	s.request(Request{Type: "add", Stream: "session-d"})
+	added := testOfferReply(t, replies)
+	if mid := midOf(t, added.Streams, "session-d"); mid != midB {
+		t.Errorf("session-d at mid %s, want the free mid %s", mid, midB)
+	}
+	if n, want := len(sdpMids(added.Sdp)), len(sdpMids(second.Sdp)); n != want {
+		t.Errorf("%d media in the offer, want %d", n, want)
+	}
+	s.takeAnswer(testAnswer(t, pc, added.Sdp))
+	select {
+	case r := <-replies:
+		t.Errorf("reply %q %q after the answer", r.Type, r.Error)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebRTCSessionAnswerMid(t *testing.T) {
+	testWebRTC(t)
+	for _, suuid := range []string{"session-mid-a", "session-mid-b"} {
+		testStream(t, suuid, []av.CodecData{testH264(t)})
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, replies := testSession(t)
+
+	s.request(Request{Type: "add", Stream: "session-mid-a"})
+	s.request(Request{Type: "add", Stream: "session-mid-b"})
+	offer := testOfferReply(t, replies)
+	if len(offer.Streams) != 2 {
+		t.Fatalf("mids %v, want both streams in one offer", offer.Streams)
+	}
+	// the answer without its last media
+	answer := testAnswer(t, pc, offer.Sdp)
+	answer = answer[:strings.LastIndex(answer, "m=video ")]
+	s.takeAnswer(answer)
+	r := testReply(t, replies)
+	if r.Type != "webrtc" || !strings.Contains(r.Error, "mid") {
+		t.Errorf("reply %q %q, want the missing mid", r.Type, r.Error)
+	}
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Error("session still running after a wrong answer")
+	}
+}
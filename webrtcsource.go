@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/rtsp"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// webrtcSource feeds the tracks a PeerConnection receives into a stream,
+// their RTP is depacketized like the one of a camera. The tracks are read
+// in their own goroutines, the mutex serializes them for the stream.
+type webrtcSource struct {
+	pc *webrtc.PeerConnection
+
+	// asks the sender for a keyframe, the GOP cache of the stream is
+	// checked too. Only at the start of a track when nil.
+	pli chan struct{}
+
+	mutex  sync.Mutex
+	stream RTSPStream
+	player rtsp.Player // the negotiated media for the stream codecs
+
+	once sync.Once
+	done chan struct{}
+	errC chan error
+}
+
+func newWebRTCSource(name string, pc *webrtc.PeerConnection, pli chan struct{}) *webrtcSource {
+	s := &webrtcSource{
+		pc:  pc,
+		pli: pli,
+		stream: RTSPStream{
+			name:            name,
+			BufferRtpPacket: bytes.NewBuffer([]byte{}),
+			videoIDX:        -1,
+			audioIDX:        -2,
+			AudioTimeScale:  48000,
+			keyTest:         time.NewTimer(20 * time.Second),
+		},
+		done: make(chan struct{}),
+		errC: make(chan error, 1),
+	}
+	pc.OnTrack(s.read)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.fail(ErrorWebRTCSourceDisconnect)
+		}
+	})
+	go func() {
+		select {
+		case <-s.stream.keyTest.C:
+			s.fail(ErrorStreamExitNoVideoOnStream)
+		case <-s.done:
+			s.stream.keyTest.Stop()
+		}
+	}()
+	return s
+}
+
+// setMedia takes the media the sender announces tracks for in its session
+// description and the answer accepted, H264 has its parameter sets in-band
+func (s *webrtcSource) setMedia(sender, answer string) error {
+	offered := strings.Split(sender, "\nm=")[1:]
+	for i, m := range strings.Split(answer, "\nm=")[1:] {
+		switch {
+		case strings.HasPrefix(m, "video 0 "), strings.HasPrefix(m, "audio 0 "), strings.Contains(m, "a=inactive"):
+			// rejected
+		case i >= len(offered) || !strings.Contains(offered[i], "a=msid:") && !strings.Contains(offered[i], "a=ssrc:"):
+			// no track to send
+		case strings.HasPrefix(m, "video "):
+			s.player.VideoMedia = &sdp.Media{AVType: "video", Type: av.H264}
+		case strings.HasPrefix(m, "audio "):
+			s.player.AudioMedia = &sdp.Media{AVType: "audio", Type: av.OPUS, TimeScale: 48000, ChannelCount: 1}
+		}
+	}
+	if s.player.VideoMedia == nil && s.player.AudioMedia == nil {
+		return ErrorWebRTCSourceNoMedia
+	}
+	return nil
+}
+
+// read depacketizes a track into the stream
+func (s *webrtcSource) read(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	video := track.Kind() == webrtc.RTPCodecTypeVideo
+	if video {
+		go s.requestKeyframes(uint32(track.SSRC()))
+	}
+	go func() {
+		for {
+			packets, _, err := receiver.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range packets {
+				if sr, ok := pkt.(*rtcp.SenderReport); ok {
+					s.mutex.Lock()
+					s.stream.onSenderReport(&s.player, video, rtsp.SenderReport{NTPTime: rtsp.NTPTime(sr.NTPTime), RTPTime: sr.RTPTime})
+					s.mutex.Unlock()
+				}
+			}
+		}
+	}()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if video {
+			err = s.stream.onVideoPacket(&s.player, pkt)
+		} else {
+			err = s.stream.onAudioPacket(&s.player, pkt)
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// requestKeyframes sends picture loss indications to the sender, the
+// viewers start with a keyframe. After the first one they are only sent
+// when a viewer joins or the GOP cache of the stream is empty.
+func (s *webrtcSource) requestKeyframes(ssrc uint32) {
+	var check <-chan time.Time
+	if s.pli != nil {
+		ticker := time.NewTicker(whipGOPCheck)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	send := true
+	for {
+		if send {
+			err := s.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+			if err != nil {
+				log.Println("WebRTC source PLI", err)
+			}
+		}
+		select {
+		case <-s.pli:
+			send = true
+		case <-check:
+			send = Config.gopEmpty(s.stream.name)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fail ends the source with the first error, it is read from errC
+func (s *webrtcSource) fail(err error) {
+	select {
+	case s.errC <- err:
+	default:
+	}
+	s.close()
+}
+
+// close ends the source and closes the PeerConnection
+func (s *webrtcSource) close() {
+	s.once.Do(func() {
+		close(s.done)
+		if err := s.pc.Close(); err != nil {
+			log.Println("WebRTC source close", err)
+		}
+	})
+}
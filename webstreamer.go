@@ -1,16 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
-
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/audio"
+	"github.com/deepch/RTSPtoWebRTC/av1"
+	"github.com/deepch/RTSPtoWebRTC/fanout"
+	"github.com/deepch/RTSPtoWebRTC/nal"
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
-	"golang.org/x/net/websocket"
 )
 
 var webRTCAPI *webrtc.API
@@ -23,9 +33,75 @@ func InitWebRTC(portMin, portMax uint16, hostIP []string) error {
 	if err != nil {
 		return err
 	}
+	// not default codecs of pion, they are only answered to browsers offering them
+	feedback := []webrtc.RTCPFeedback{
+		{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"},
+	}
+	for pt, mime := range map[webrtc.PayloadType]string{117: webrtc.MimeTypeH265, 45: webrtc.MimeTypeAV1} {
+		err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mime, ClockRate: 90000, RTCPFeedback: feedback},
+			PayloadType:        pt,
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return err
+		}
+	}
+	// H264 profiles of cameras pion has no default for (Main, Constrained
+	// High, High 4:4:4), browsers offering them would get them removed
+	for pt, plid := range map[webrtc.PayloadType]string{104: "4d001f", 106: "640c1f", 112: "f4001f"} {
+		err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + plid,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: pt,
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return err
+		}
+	}
 
+	// RED for the ULPFEC of pion's default codecs, see fec.go
+	err = m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: fanout.MimeTypeRED, ClockRate: 90000},
+		PayloadType:        115,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return err
+	}
+
+	// the default interceptors, but the sender reports are sent by
+	// WebRTCStreamer from the clock of the tracks. The FEC comes first, it
+	// protects the packets as the others leave them.
 	i := &interceptor.Registry{}
-	err = webrtc.RegisterDefaultInterceptors(m, i)
+	i.Add(fanout.FECInterceptorFactory{})
+	err = webrtc.ConfigureNack(m, i)
+	if err != nil {
+		return err
+	}
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(receiver)
+	err = webrtc.ConfigureTWCCSender(m, i)
+	if err != nil {
+		return err
+	}
+
+	// the TWCC estimates of the viewers, the header extension is added to
+	// the packets before the estimator sees them
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(bweInitialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return err
+	}
+	congestionController.OnNewPeerConnection(onNewEstimator)
+	i.Add(congestionController)
+	err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
 	if err != nil {
 		return err
 	}
@@ -46,318 +122,867 @@ func InitWebRTC(portMin, portMax uint16, hostIP []string) error {
 
 	webRTCAPI = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(e))
 
-	return nil
+	return initWHIP(e)
 }
 
 type WebRTCStreamer struct {
-	WS     *websocket.Conn
-	pc     *webrtc.PeerConnection
-	tracks map[int8]*webrtc.TrackLocalStaticSample
-	codecs []av.CodecData
-	stateC chan webrtc.ICEConnectionState
+	send     func(Response) error // signaling messages to the client
+	trickle  bool                 // the client asked for the local candidates after the answer
+	pc       *webrtc.PeerConnection
+	offer    string
+	hub      *webrtcHub
+	switched chan struct{}
+	tracks   map[int8]*fanout.Track // added to the PeerConnection
+	senders  map[int8]*webrtc.RTPSender
+	stateC   chan webrtc.ICEConnectionState
+	state    webrtc.ICEConnectionState
+	grace    *time.Timer // of a lost connection
+	offers   chan string // ICE restarts
+	answers  chan string // to our offer
+	offering bool        // the server offers, the client only answers
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// the PeerConnection is connected, the senders can be prefilled
+	up    chan struct{} // closed then
+	ready bool
+
+	// trickle ICE, the remote candidates of the WebSocket and the local
+	// ones gathered before the answer is sent
+	candidates chan webrtc.ICECandidateInit
+	done       chan struct{}
+	mutex      sync.Mutex
+	answered   bool
+	pending    []*webrtc.ICECandidate
+	remote     string // the last offer of the client that was answered
+
+	// the control data channel, see control.go
+	control  *webrtc.DataChannel
+	channels chan *webrtc.DataChannel
+	commands chan controlMessage
+	source   string // state of the source last sent
+	paused   bool
+	muted    bool
+
+	bwe *congestion // level of the video, see congestion.go
+
+	// the stream group, see quality.go
+	main     string
+	sub      string
+	quality  string    // requested by the client
+	mainRate float64   // bit/s of the main stream when the viewer left it
+	upgrade  time.Time // since the estimate has room for the main stream
+	retry    time.Time // of a failed automatic switch
+
+	fec int // redundancy of the video in percent, see fec.go
+}
+
+// newWebRTCStreamer creates a WebRTC session, its answers and local
+// candidates go to send
+func newWebRTCStreamer(send func(Response) error, trickle bool) *WebRTCStreamer {
+	return &WebRTCStreamer{
+		send:       send,
+		trickle:    trickle,
+		offers:     make(chan string, 1),
+		answers:    make(chan string, 1),
+		stop:       make(chan struct{}),
+		candidates: make(chan webrtc.ICECandidateInit, 16),
+		done:       make(chan struct{}),
+		channels:   make(chan *webrtc.DataChannel, 1),
+		commands:   make(chan controlMessage, 16),
+	}
 }
 
+// run plays the stream, sdp is the offer of the client or empty for a
+// client waiting for ours
 func (s *WebRTCStreamer) run(url, sdp string) {
 	// log.Println("Enter WebRTCStreamer.run")
 	// defer log.Println("Exit WebRTCStreamer.run")
-	var err error
-
-	err = s.setup(Config.coGe(url))
+	defer close(s.done)
+	hub, switched, err := joinHub(url)
+	if err == nil {
+		err = s.setup(hub, switched, sdp)
+		if err != nil {
+			hub.leave(switched)
+		}
+	}
 	if err != nil {
 		log.Println(err)
-		return
-	}
-	var state webrtc.ICEConnectionState
-	defer func() {
-		err := s.pc.Close()
+		err = s.send(Response{Type: "webrtc", Error: err.Error()})
 		if err != nil {
-			log.Println("failed close ICE connection", err)
-		}
-		for state != webrtc.ICEConnectionStateClosed {
-			state = <-s.stateC
+			log.Println("WebRTC signaling", err)
 		}
-	}()
-
-	promise, err := s.gather(sdp)
+		return
+	}
+	// the quality switches the hub
+	defer func() { s.hub.leave(s.switched) }()
+	defer s.close()
+	s.setGroup(url)
+	s.fec = Config.fecGe(url)
+
+	if sdp == "" {
+		err = s.offerTracks()
+	} else {
+		err = s.negotiate(sdp)
+	}
 	if err != nil {
 		log.Println(err)
+		err = s.send(Response{Type: "webrtc", Error: err.Error()})
+		if err != nil {
+			log.Println("WebRTC signaling", err)
+		}
 		return
 	}
 
-	// timeout := time.NewTimer(10 * time.Second)
-	// defer timeout.Stop()
+	s.protect()
+
+	// the media is written by the hub to the shared tracks
+	reports := time.NewTicker(time.Second)
+	defer reports.Stop()
+	stats := time.NewTicker(controlStatsInterval)
+	defer stats.Stop()
 	for {
 		select {
-		// case <-timeout.C:
-		// 	log.Printf("timeout at WebRTC gather promise during offer/answer")
-		// 	return
-		case state = <-s.stateC:
-			switch state {
-			case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
-				log.Println("disconnected/failed ICE connection during offer/answer")
+		case <-s.stop:
+			return
+		case d := <-s.channels:
+			s.control = d
+			s.sendState(true)
+		case m := <-s.commands:
+			s.command(m)
+		case <-stats.C:
+			s.sendStats()
+		case state := <-s.stateC:
+			s.setState(state)
+		case <-s.up:
+			s.up, s.ready = nil, true
+			s.prefill()
+		case <-s.grace.C:
+			if s.lost() {
+				log.Println("disconnected ICE connection")
 				return
 			}
-			continue
-		case <-promise:
-			//Connected
-			// if !timeout.Stop() {
-			// 	<-timeout.C
-			// }
+		case sdp := <-s.offers:
+			// ICE restart of the browser
+			if err = s.negotiate(sdp); err != nil {
+				log.Println("WebRTC renegotiation", err)
+				err = s.send(Response{Type: "webrtc", Error: err.Error()})
+				if err != nil {
+					log.Println("WebRTC signaling", err)
+				}
+				return
+			}
+		case c := <-s.candidates:
+			s.addCandidate(c)
+		case now := <-reports.C:
+			s.report(now)
+			s.adapt(now)
+			s.adaptQuality(now)
+			s.protect()
+			s.sendState(false)
+		case <-s.switched:
+			err = s.update()
+			if err != nil {
+				log.Println("WebRTC codec change", err)
+				err = s.send(Response{Type: "webrtc", Error: err.Error()})
+				if err != nil {
+					log.Println("WebRTC signaling", err)
+				}
+				return
+			}
+			s.sendState(true)
 		}
-		break
 	}
-	resp := s.pc.LocalDescription()
+}
 
-	err = websocket.JSON.Send(s.WS, Response{Type: "webrtc", Sdp: resp.SDP})
+// negotiate answers an offer of the browser, the first one or an ICE
+// restart on the same PeerConnection
+func (s *WebRTCStreamer) negotiate(sdp string) error {
+	s.mutex.Lock()
+	s.answered = false
+	s.mutex.Unlock()
+
+	promise, err := s.answer(sdp)
 	if err != nil {
-		log.Println("websocket.JSON.Send", err)
-		// websocket is prolly broken, better close it, instead of let it retry.
-		// it might be better to do it at the original WS go routine,
-		// and launch the second go routine after signaling is done.
-		if err := s.WS.Close(); err != nil {
-			// log.Println("failed close websocket:", err)
-		}
-		return
+		return err
 	}
+	s.offer = sdp
 
-	// TODO: try to use single cid/ch
-	cid, ch := Config.clAd(url)
-	defer Config.clDe(url, cid)
-
-	var start bool
-	// timeout.Reset(10 * time.Second)
-	for {
-		switch state {
-		case webrtc.ICEConnectionStateNew, webrtc.ICEConnectionStateChecking:
-			state = <-s.stateC
-			continue
-		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
-			log.Println("disconnected ICE connection")
-			return
-		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+	if promise != nil {
+		// the browser doesn't trickle, the answer has all the candidates
+		for gathering := true; gathering; {
 			select {
-			case state = <-s.stateC:
-				continue
-			// case <-timeout.C:
-			// 	log.Println("noVideo")
-			// 	return
-			case pck := <-ch:
-				if pck.IsKeyFrame {
-					// if !timeout.Stop() {
-					// 	<-timeout.C
-					// }
-					// timeout.Reset(10 * time.Second)
-					start = true
-				}
-				if !start {
-					continue
-				}
-				// check unsupported codecs inside
-				err = s.WritePacket(&pck)
-				if err != nil {
-					log.Println("muxerWebRTC.WritePacket", err)
-					return
-				}
-				continue
+			case state := <-s.stateC:
+				s.setState(state)
+			case c := <-s.candidates:
+				s.addCandidate(c)
+			case <-promise:
+				gathering = false
 			}
-		default:
-			log.Println("unexpected ICE connection state:", state)
 		}
-		break
 	}
+	resp := s.pc.LocalDescription()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remote = sdp
+	err = s.send(Response{Type: "webrtc", Sdp: resp.SDP})
+	if err != nil {
+		return fmt.Errorf("WebRTC signaling %w", err)
+	}
+	// the candidates gathered in the meantime
+	s.answered = true
+	for _, c := range s.pending {
+		s.writeCandidate(c)
+	}
+	s.pending = nil
+	return nil
 }
 
-func (s *WebRTCStreamer) setup(codecs []av.CodecData) error {
-	var err error
+// answerTimeout is how long a client has to answer our offer
+const answerTimeout = 20 * time.Second
 
-	tracks := make(map[int8]*webrtc.TrackLocalStaticSample)
-	for i, c := range codecs {
-		var track *webrtc.TrackLocalStaticSample
-		if c.Type().IsVideo() {
-			if c.Type() == av.H264 {
-				track, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
-					MimeType: webrtc.MimeTypeH264,
-				}, "pion-rtsp-video", "pion-rtsp-video")
-				if err != nil {
-					return err
-				}
-			}
-		} else if c.Type().IsAudio() {
-			AudioCodecString := webrtc.MimeTypePCMA
-			switch c.Type() {
-			case av.PCM_ALAW:
-				AudioCodecString = webrtc.MimeTypePCMA
-			case av.PCM_MULAW:
-				AudioCodecString = webrtc.MimeTypePCMU
-			case av.OPUS:
-				AudioCodecString = webrtc.MimeTypeOpus
-			default:
-				log.Println("WebRTC Ignore Audio Track codec not supported WebRTC support only PCM_ALAW or PCM_MULAW")
-				continue
+// offerTracks sends a sendonly offer with the tracks of the stream to a
+// client that doesn't offer, the media starts once its answer is set and
+// ICE connects
+func (s *WebRTCStreamer) offerTracks() error {
+	d, err := s.pc.CreateDataChannel(controlLabel, nil)
+	if err != nil {
+		return err
+	}
+	s.openControl(d)
+	return s.propose(nil, s.checkAnswer)
+}
+
+// propose sends an offer of ours and sets the answer of the client once
+// check accepts it, streams are the stream uuids of the media of the
+// offer. The offer has all the candidates, the ones of the client may
+// follow its answer.
+func (s *WebRTCStreamer) propose(streams func() map[string]string, check func(answer string) error) error {
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	promise := webrtc.GatheringCompletePromise(s.pc)
+	err = s.pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	// remote candidates can't be added before the answer
+	var early []webrtc.ICECandidateInit
+	for gathering := true; gathering; {
+		select {
+		case state := <-s.stateC:
+			s.setState(state)
+		case c := <-s.candidates:
+			early = append(early, c)
+		case <-promise:
+			gathering = false
+		}
+	}
+	resp := Response{Type: "offer", Sdp: s.pc.LocalDescription().SDP}
+	if streams != nil {
+		resp.Streams = streams()
+	}
+	err = s.send(resp)
+	if err != nil {
+		return fmt.Errorf("WebRTC signaling %w", err)
+	}
+
+	timeout := time.NewTimer(answerTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case state := <-s.stateC:
+			s.setState(state)
+		case c := <-s.candidates:
+			early = append(early, c)
+		case <-timeout.C:
+			return fmt.Errorf("WebRTC no answer to the offer within %s", answerTimeout)
+		case sdp := <-s.answers:
+			if err := check(sdp); err != nil {
+				return err
 			}
-			track, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
-				MimeType:  AudioCodecString,
-				Channels:  uint16(c.(av.AudioCodecData).ChannelLayout().Count()),
-				ClockRate: uint32(c.(av.AudioCodecData).SampleRate()),
-			}, "pion-rtsp-audio", "pion-rtsp-audio")
+			err = s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
 			if err != nil {
 				return err
 			}
+			for _, c := range early {
+				s.addCandidate(c)
+			}
+			return nil
 		}
-		tracks[int8(i)] = track
 	}
-	if len(tracks) == 0 {
-		return fmt.Errorf("WebRTC Not Track Available")
+}
+
+// checkAnswer tells why the client can't play the tracks from its answer,
+// which has the codecs of the track switches once accepted
+func (s *WebRTCStreamer) checkAnswer(sdp string) error {
+	codecs, _ := s.hub.snapshot()
+	for idx := range s.tracks {
+		if int(idx) >= len(codecs) {
+			continue
+		}
+		if err := checkOffer(sdp, codecs[idx]); err != nil {
+			return err
+		}
 	}
+	s.offer = sdp
+	return nil
+}
 
-	c := webrtc.Configuration{
-		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+// takeAnswer passes the answer of an "answer" request to our offer, false
+// when the session doesn't wait for one
+func (s *WebRTCStreamer) takeAnswer(sdp string) bool {
+	select {
+	case s.answers <- sdp:
+		return true
+	default:
+		return false
 	}
+}
 
-	if servers := Config.GetICEServers(); len(servers) > 0 {
-		c.ICEServers = append(c.ICEServers, webrtc.ICEServer{
-			URLs:           servers,
-			Username:       Config.GetICEUsername(),
-			Credential:     Config.GetICECredential(),
-			CredentialType: webrtc.ICECredentialTypePassword,
-		})
-		log.Println("Set ICEServers", servers)
+// iceGracePeriod is how long a disconnected viewer has to come back with
+// an ICE restart before its session is closed
+var iceGracePeriod = 15 * time.Second
+
+// setState follows the ICE connection state, the grace period starts when
+// the connection is lost
+func (s *WebRTCStreamer) setState(state webrtc.ICEConnectionState) {
+	lost := s.lost()
+	s.state = state
+	switch {
+	case s.lost() && !lost:
+		log.Println("WebRTC ICE connection", state, "waiting", iceGracePeriod, "for an ICE restart")
+		s.grace.Reset(iceGracePeriod)
+	case lost && (state == webrtc.ICEConnectionStateConnected || state == webrtc.ICEConnectionStateCompleted):
+		log.Println("WebRTC ICE connection back")
+		s.grace.Stop()
+	}
+}
+
+func (s *WebRTCStreamer) lost() bool {
+	return s.state == webrtc.ICEConnectionStateDisconnected || s.state == webrtc.ICEConnectionStateFailed
+}
+
+// restart passes a new offer of the client to the running session, an ICE
+// restart of its PeerConnection. The offer of another PeerConnection (a
+// reloaded page) is ErrorWebRTCOtherPeer, it needs a session of its own.
+// The client of a session offered by the server can't offer. It never
+// waits: with an offer already queued the session is busy negotiating, and
+// the /ws reader has to pass it the candidates and answers it needs.
+func (s *WebRTCStreamer) restart(sdp string) error {
+	select {
+	case <-s.done:
+		return ErrorWebRTCSessionOver
+	default:
 	}
+	if s.offering {
+		return ErrorWebRTCServerOffers
+	}
+	s.mutex.Lock()
+	remote := s.remote
+	s.mutex.Unlock()
+	if !samePeerConnection(remote, sdp) {
+		return ErrorWebRTCOtherPeer
+	}
+	select {
+	case s.offers <- sdp:
+		return nil
+	default:
+		return ErrorWebRTCRestartBusy
+	}
+}
+
+// samePeerConnection tells whether offer comes from the PeerConnection of
+// a previous offer: same DTLS fingerprint and the media sections of the
+// previous offer in the same order. New m-lines may follow them.
+func samePeerConnection(previous, offer string) bool {
+	fingerprint := sdpAttribute(previous, "fingerprint")
+	if fingerprint == "" || sdpAttribute(offer, "fingerprint") != fingerprint {
+		return false
+	}
+	mids, offered := sdpMids(previous), sdpMids(offer)
+	if len(offered) < len(mids) {
+		return false
+	}
+	for i, mid := range mids {
+		if offered[i] != mid {
+			return false
+		}
+	}
+	return true
+}
+
+// sdpMids returns the mids of the media sections of a SDP in order
+func sdpMids(sdp string) []string {
+	var mids []string
+	for _, line := range sdpLines(sdp) {
+		if mid := strings.TrimPrefix(line, "a=mid:"); mid != line {
+			mids = append(mids, mid)
+		}
+	}
+	return mids
+}
+
+// end stops the session, it can be called more than once
+func (s *WebRTCStreamer) end() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// candidate passes a remote candidate of a "candidate" request to the
+// session, it is dropped once the session is over
+func (s *WebRTCStreamer) candidate(c webrtc.ICECandidateInit) {
+	select {
+	case s.candidates <- c:
+	case <-s.done:
+	}
+}
+
+func (s *WebRTCStreamer) addCandidate(c webrtc.ICECandidateInit) {
+	if c.Candidate == "" {
+		// end of candidates
+		return
+	}
+	if err := s.pc.AddICECandidate(c); err != nil {
+		log.Println("WebRTC remote candidate", err)
+	}
+}
+
+// sendCandidate trickles a local candidate to the browser, nil once the
+// gathering is complete. The ones gathered before the answer is sent wait
+// for it.
+func (s *WebRTCStreamer) sendCandidate(c *webrtc.ICECandidate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.answered {
+		s.pending = append(s.pending, c)
+		return
+	}
+	s.writeCandidate(c)
+}
 
+// writeCandidate is called with the mutex held
+func (s *WebRTCStreamer) writeCandidate(c *webrtc.ICECandidate) {
+	resp := Response{Type: "candidate"}
+	if c != nil {
+		init := c.ToJSON()
+		resp.Candidate = &init
+	}
+	if err := s.send(resp); err != nil {
+		log.Println("WebRTC signaling", err)
+	}
+}
+
+// setup creates the PeerConnection with the tracks of the hub for the
+// offer of the client, or for an offer of ours when it is empty
+func (s *WebRTCStreamer) setup(hub *webrtcHub, switched chan struct{}, offer string) error {
+	var err error
+
+	codecs, tracks := hub.snapshot()
+	for i, c := range codecs {
+		if tracks[int8(i)] == nil || offer == "" {
+			continue
+		}
+		if err := checkOffer(offer, c); err != nil {
+			return err
+		}
+	}
+
+	err = s.connect()
+	if err != nil {
+		return err
+	}
+	senders, err := s.addTracks(tracks, offer == "")
+	if err != nil {
+		if err := s.pc.Close(); err != nil {
+			log.Println("failed close WebRTC peer connection: ", err)
+		}
+		return err
+	}
+	s.offer = offer
+	s.hub = hub
+	s.switched = switched
+	s.tracks = tracks
+	s.senders = senders
+
+	return nil
+}
+
+// connect creates the PeerConnection without tracks
+func (s *WebRTCStreamer) connect() error {
 	if webRTCAPI == nil {
 		panic("webrtcstreamer.go: WebRTC was not initialized")
 	}
-	pc, err := webRTCAPI.NewPeerConnection(c)
+	pc, estimator, err := newViewerPeerConnection()
 	if err != nil {
 		return err
 	}
 
-	for _, track := range tracks {
-		sender, err := pc.AddTrack(track)
+	// the states are read by the session until it is done, pion doesn't
+	// wait for it afterwards, e.g. when adding the tracks failed
+	stateC := make(chan webrtc.ICEConnectionState)
+	done := s.done
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		select {
+		case stateC <- connectionState:
+		case <-done:
+		}
+	})
+	// DTLS is done, the SRTP session starts with it
+	up := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(up) })
+		}
+	})
+	pc.OnDataChannel(s.onDataChannel)
+	s.pc = pc
+	s.stateC = stateC
+	s.up = up
+	s.bwe = newCongestion(estimator)
+	s.state = webrtc.ICEConnectionStateNew
+	s.grace = time.NewTimer(iceGracePeriod)
+	s.grace.Stop()
+	return nil
+}
+
+// addTracks adds the tracks to the PeerConnection, sendonly when the offer
+// is ours. Nothing is added on error.
+func (s *WebRTCStreamer) addTracks(tracks map[int8]*fanout.Track, offering bool) (map[int8]*webrtc.RTPSender, error) {
+	senders := make(map[int8]*webrtc.RTPSender)
+	for i, track := range tracks {
+		var sender *webrtc.RTPSender
+		var err error
+		if offering && !s.freeTransceiver(track.Kind()) {
+			// the offer is ours, there is nothing to receive
+			var t *webrtc.RTPTransceiver
+			t, err = s.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+			if err == nil {
+				sender = t.Sender()
+			}
+		} else {
+			sender, err = s.pc.AddTrack(track)
+		}
 		if err != nil {
-			if err := pc.Close(); err != nil {
-				log.Println("failed close WebRTC peer connection: ", err)
+			for _, sender := range senders {
+				if err := s.pc.RemoveTrack(sender); err != nil {
+					log.Println("WebRTC remove track", err)
+				}
 			}
-			return err
+			return nil, err
 		}
 		// Read incoming RTCP packets
 		// Before these packets are returned they are processed by interceptors. For things
 		// like NACK this needs to be called.
-		go func() {
-			buf := make([]byte, 1500)
+		go func(bwe *congestion) {
 			for {
-				if _, _, err := sender.Read(buf); err != nil {
+				pkts, _, err := sender.ReadRTCP()
+				if err != nil {
 					return
 				}
+				bwe.onRTCP(pkts)
 			}
-		}()
+		}(s.bwe)
+		senders[i] = sender
 	}
-
-	stateC := make(chan webrtc.ICEConnectionState)
-	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		stateC <- connectionState
-		// element.status = connectionState
-		// if connectionState == webrtc.ICEConnectionStateDisconnected {
-		// 	element.Close()
-		// }
-	})
-	// peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-	// 	d.OnMessage(func(msg webrtc.DataChannelMessage) {
-	// 		element.ClientACK.Reset(5 * time.Second)
-	// 	})
-	// })
-	s.pc = pc
-	s.stateC = stateC
-	s.tracks = tracks
-	s.codecs = codecs
-
-	return nil
+	return senders, nil
 }
 
-func (s *WebRTCStreamer) gather(sdp string) (promise <-chan struct{}, err error) {
-	offer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  sdp,
+// freeTransceiver tells whether a removed track left a transceiver of the
+// kind, AddTrack sends on it again with its mid
+func (s *WebRTCStreamer) freeTransceiver(kind webrtc.RTPCodecType) bool {
+	for _, t := range s.pc.GetTransceivers() {
+		if t.Kind() == kind && t.Sender() == nil && t.Direction() == webrtc.RTPTransceiverDirectionInactive {
+			return true
+		}
 	}
+	return false
+}
 
-	err = s.pc.SetRemoteDescription(offer)
+// close closes the PeerConnection, its ICE state changes are read until
+// it is done. ICE that never started (no answer was set) has none.
+func (s *WebRTCStreamer) close() {
+	err := s.pc.Close()
 	if err != nil {
-		return nil, err
+		log.Println("failed close ICE connection", err)
+	}
+	for s.state != webrtc.ICEConnectionStateClosed && s.state != webrtc.ICEConnectionStateNew {
+		s.state = <-s.stateC
 	}
+}
 
-	promise = webrtc.GatheringCompletePromise(s.pc)
+// peerConnectionConfig is the configuration of the PeerConnections with
+// the ICE servers of the config
+func peerConnectionConfig() webrtc.Configuration {
+	c := webrtc.Configuration{
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+	}
 
-	answer, err := s.pc.CreateAnswer(nil)
-	if err != nil {
-		return nil, err
+	if servers := Config.GetICEServers(); len(servers) > 0 {
+		c.ICEServers = append(c.ICEServers, webrtc.ICEServer{
+			URLs:           servers,
+			Username:       Config.GetICEUsername(),
+			Credential:     Config.GetICECredential(),
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+		log.Println("Set ICEServers", servers)
 	}
+	return c
+}
 
-	err = s.pc.SetLocalDescription(answer)
-	if err != nil {
-		return nil, err
+// report sends the RTCP sender reports of the tracks, they map the RTP
+// timestamps of audio and video to the same clock for lip sync
+func (s *WebRTCStreamer) report(now time.Time) {
+	var pkts []rtcp.Packet
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		params := sender.GetParameters()
+		if track == nil || len(params.Encodings) == 0 {
+			continue
+		}
+		if sr, ok := track.SenderReport(uint32(params.Encodings[0].SSRC), now); ok {
+			pkts = append(pkts, sr)
+		}
+	}
+	if len(pkts) == 0 {
+		return
+	}
+	if err := s.pc.WriteRTCP(pkts); err != nil {
+		log.Println("WebRTC sender report", err)
 	}
+}
 
-	return promise, nil
+// prefill starts the video senders waiting for a keyframe with the packets
+// since the last one, once the PeerConnection is connected: the viewer
+// doesn't wait for the next keyframe of the camera.
+func (s *WebRTCStreamer) prefill() {
+	if !s.ready {
+		return
+	}
+	for idx, sender := range s.senders {
+		track := s.tracks[idx]
+		params := sender.GetParameters()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo || sender.Track() != track || len(params.Encodings) == 0 {
+			continue
+		}
+		track.Prefill(params.Encodings[0].SSRC)
+	}
 }
 
-func (s *WebRTCStreamer) WritePacket(pkt *av.Packet) error {
-	var err error
+// optionalCodecs are the codecs only some browsers support, by SDP encoding name
+var optionalCodecs = map[av.CodecType]string{
+	av.H265: "H265",
+	av.VP9:  "VP9",
+	av.AV1:  "AV1",
+}
 
-	track := s.tracks[pkt.Idx]
-	if track == nil {
+// checkOffer tells why the browser can't play a codec from its offer. The
+// optional codecs need to be offered, H264 needs a profile able to decode
+// the one of the camera, the other codecs are always accepted.
+func checkOffer(offer string, c av.CodecData) error {
+	name, ok := optionalCodecs[c.Type()]
+	plid := h264ProfileLevelID(c)
+	if !ok && plid == "" {
 		return nil
 	}
-
-	// element.StreamACK.Reset(10 * time.Second)
-	if len(pkt.Data) < 5 {
-		log.Println("len(pkt.Data) < 5")
+	if !ok {
+		name = "H264"
+	}
+	formats := offerFormats(offer, name)
+	if plid == "" {
+		if len(formats) == 0 {
+			return fmt.Errorf("WebRTC %s is not supported by the browser, use MSE", c.Type())
+		}
 		return nil
 	}
-	c := s.codecs[pkt.Idx]
-	switch c.Type() {
-	case av.H264:
-		nalus, _ := h264parser.SplitNALUs(pkt.Data)
-		for _, nalu := range nalus {
-			naltype := nalu[0] & 0x1f
-			if naltype == 5 {
-				codec := c.(h264parser.CodecData)
-				err = track.WriteSample(media.Sample{Data: bytes.Join([][]byte{{}, codec.SPS(), codec.PPS(), nalu}, []byte{0, 0, 0, 1}), Duration: pkt.Duration})
-				// } else if naltype == 1 {
-			} else {
-				err = track.WriteSample(media.Sample{Data: append([]byte{0, 0, 0, 1}, nalu...), Duration: pkt.Duration})
+	profile, _, _ := nal.ParseProfileLevelID(plid)
+	var offered []string
+	for _, fmtp := range formats {
+		if mode, _ := fanout.FmtpParameter(fmtp, "packetization-mode"); mode != "1" {
+			continue
+		}
+		v, _ := fanout.FmtpParameter(fmtp, "profile-level-id")
+		p, _, err := nal.ParseProfileLevelID(v)
+		if err != nil {
+			continue
+		}
+		if p.Decodes(profile) || profile == nal.H264ProfileUnknown {
+			return nil
+		}
+		offered = append(offered, p.String())
+	}
+	if len(offered) == 0 {
+		return fmt.Errorf("WebRTC H264 with packetization-mode=1 is not supported by the browser, use MSE")
+	}
+	return fmt.Errorf("WebRTC H264 %s profile (%s) of the camera can't be decoded by the browser, it offers %s, use MSE",
+		profile, plid, strings.Join(offered, ", "))
+}
+
+// offerFormats returns the fmtp lines of the formats of an encoding in a
+// SDP offer, an empty one for formats without fmtp
+func offerFormats(offer, encoding string) []string {
+	var pts []string
+	fmtps := make(map[string]string)
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		// a=rtpmap:<payload type> <encoding name>/<clock rate>
+		if rtpmap := strings.TrimPrefix(line, "a=rtpmap:"); rtpmap != line {
+			if pt, enc, ok := strings.Cut(rtpmap, " "); ok && strings.HasPrefix(strings.ToUpper(enc), encoding+"/") {
+				pts = append(pts, pt)
 			}
-			if err != nil {
-				return err
+		}
+		// a=fmtp:<payload type> <parameters>
+		if fmtp := strings.TrimPrefix(line, "a=fmtp:"); fmtp != line {
+			if pt, params, ok := strings.Cut(fmtp, " "); ok {
+				fmtps[pt] = params
 			}
 		}
-		// WritePacketSuccess = true
-		return nil
-		/*
+	}
+	formats := make([]string, len(pts))
+	for i, pt := range pts {
+		formats[i] = fmtps[pt]
+	}
+	return formats
+}
 
-			if pkt.IsKeyFrame {
-				pkt.Data = append([]byte{0, 0, 0, 1}, bytes.Join([][]byte{codec.SPS(), codec.PPS(), pkt.Data[4:]}, []byte{0, 0, 0, 1})...)
-			} else {
-				pkt.Data = pkt.Data[4:]
-			}
+// h264ProfileLevelID returns the profile-level-id of the SPS of a H264
+// stream, empty when the SPS isn't known
+func h264ProfileLevelID(c av.CodecData) string {
+	h, ok := c.(h264parser.CodecData)
+	if !ok || len(h.SPS()) == 0 {
+		return ""
+	}
+	sps, err := nal.ParseSPS(h.SPS())
+	if err != nil {
+		return ""
+	}
+	return sps.ProfileLevelID()
+}
 
-		*/
+// trackFmtp is the fmtp line of the track of a codec, H264 tracks
+// announce the profile of the camera
+func trackFmtp(c av.CodecData) string {
+	if plid := h264ProfileLevelID(c); plid != "" {
+		return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + plid
+	}
+	return ""
+}
+
+// newTrack creates the local track for a stream codec, the tracks of a
+// stream share the streamID so browsers play them in sync.
+// It returns nil when the codec can't be sent over WebRTC
+func newTrack(c av.CodecData, streamID string) *fanout.Track {
+	if c.Type().IsVideo() {
+		var payloader rtp.Payloader
+		var mime string
+		switch c.Type() {
+		case av.H264:
+			payloader, mime = &codecs.H264Payloader{}, webrtc.MimeTypeH264
+		case av.H265:
+			payloader, mime = &nal.HEVCPayloader{}, webrtc.MimeTypeH265
+		case av.VP8:
+			payloader, mime = &codecs.VP8Payloader{EnablePictureID: true}, webrtc.MimeTypeVP8
+		case av.VP9:
+			payloader, mime = &codecs.VP9Payloader{}, webrtc.MimeTypeVP9
+		case av.AV1:
+			payloader, mime = &av1.Payloader{}, webrtc.MimeTypeAV1
+		default:
+			return nil
+		}
+		return fanout.New(webrtc.RTPCodecCapability{
+			MimeType:    mime,
+			ClockRate:   90000,
+			SDPFmtpLine: trackFmtp(c),
+		}, payloader, "pion-rtsp-video", streamID)
+	}
+	AudioCodecString := webrtc.MimeTypePCMA
+	var payloader rtp.Payloader = &codecs.G711Payloader{}
+	clockRate := uint32(c.(av.AudioCodecData).SampleRate())
+	switch c.Type() {
 	case av.PCM_ALAW:
-	case av.OPUS:
+		AudioCodecString = webrtc.MimeTypePCMA
 	case av.PCM_MULAW:
-	case av.AAC:
-		//TODO: NEED ADD DECODER AND ENCODER
-		return fmt.Errorf("WebRTC Codec Not Supported")
-	case av.PCM:
-		//TODO: NEED ADD ENCODER
-		return fmt.Errorf("WebRTC Codec Not Supported")
+		AudioCodecString = webrtc.MimeTypePCMU
+	case av.OPUS:
+		AudioCodecString = webrtc.MimeTypeOpus
+		payloader = &codecs.OpusPayloader{}
+	case audio.G722:
+		// RFC 3551 keeps the 8000 clock rate of G.722 for 16 kHz audio
+		AudioCodecString = webrtc.MimeTypeG722
+		payloader = &codecs.G722Payloader{}
+		clockRate = 8000
 	default:
-		return fmt.Errorf("WebRTC Codec Not Supported")
+		log.Println("WebRTC Ignore Audio Track codec not supported WebRTC support only PCM_ALAW, PCM_MULAW, OPUS or G722")
+		return nil
 	}
+	return fanout.New(webrtc.RTPCodecCapability{
+		MimeType:  AudioCodecString,
+		Channels:  uint16(c.(av.AudioCodecData).ChannelLayout().Count()),
+		ClockRate: clockRate,
+	}, payloader, "pion-rtsp-audio", streamID)
+}
 
-	err = track.WriteSample(media.Sample{Data: pkt.Data, Duration: pkt.Duration})
+// update follows a track switch of the hub after a codec type change,
+// which works as long as the browser negotiated the new codec.
+func (s *WebRTCStreamer) update() error {
+	codecs, tracks := s.hub.snapshot()
+	for idx, sender := range s.senders {
+		track := tracks[idx]
+		if track == s.tracks[idx] || int(idx) >= len(codecs) {
+			// unchanged, or media gone and its sender stays idle
+			continue
+		}
+		c := codecs[idx]
+		if err := checkOffer(s.offer, c); err != nil {
+			return err
+		}
+		if track == nil {
+			return fmt.Errorf("WebRTC Codec Not Supported %s", c.Type())
+		}
+		if !s.silenced(track) {
+			err := sender.ReplaceTrack(track)
+			if err != nil {
+				return fmt.Errorf("WebRTC switch track to %s: %w", c.Type(), err)
+			}
+		}
+		log.Println("WebRTC switched track to", c.Type())
+		s.tracks[idx] = track
+	}
+	s.prefill()
+	return nil
+}
+
+// answer answers the offer. A client that asked for trickle ICE and
+// announces it in its offer gets it right away and the candidates as they
+// are gathered, the others once the returned promise is done.
+func (s *WebRTCStreamer) answer(sdp string) (promise <-chan struct{}, err error) {
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  sdp,
+	}
+
+	err = s.pc.SetRemoteDescription(offer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if s.trickle && strings.Contains(sdp, "a=ice-options:trickle") {
+		s.pc.OnICECandidate(s.sendCandidate)
+	} else {
+		promise = webrtc.GatheringCompletePromise(s.pc)
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	return promise, nil
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/webrtc/v3"
+)
+
+// testOffer is the offer of a browser receiving video, with or without
+// a=ice-options:trickle
+func testOffer(t *testing.T, trickle bool) string {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp := strings.Replace(offer.SDP, "a=ice-options:trickle\r\n", "", -1)
+	if trickle {
+		sdp = strings.Replace(sdp, "a=fingerprint:", "a=ice-options:trickle\r\na=fingerprint:", 1)
+	}
+	return sdp
+}
+
+func TestAnswerTrickle(t *testing.T) {
+	testWebRTC(t)
+	for _, c := range []struct {
+		name          string
+		asked, offers bool
+		trickle       bool
+	}{
+		{"not asked for", false, true, false},
+		{"asked for", true, true, true},
+		{"not in the offer", true, false, false},
+	} {
+		s := newWebRTCStreamer(func(Response) error { return nil }, c.asked)
+		if err := s.connect(); err != nil {
+			t.Fatal(err)
+		}
+		promise, err := s.answer(testOffer(t, c.offers))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if trickle := promise == nil; trickle != c.trickle {
+			t.Errorf("%s: trickle %v, want %v", c.name, trickle, c.trickle)
+		}
+		if promise != nil {
+			<-promise
+			if !strings.Contains(s.pc.LocalDescription().SDP, "a=candidate:") {
+				t.Errorf("%s: answer without candidates", c.name)
+			}
+		}
+		s.close()
+	}
+}
+
+func TestSamePeerConnection(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-promise
+	restart, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name            string
+		previous, offer string
+		same            bool
+	}{
+		{"ICE restart", offer.SDP, restart.SDP, true},
+		{"new media section", offer.SDP, more.SDP, true},
+		{"another PeerConnection", offer.SDP, testOffer(t, true), false},
+		{"media section removed", more.SDP, offer.SDP, false},
+		{"no previous offer", "", offer.SDP, false},
+	} {
+		if same := samePeerConnection(c.previous, c.offer); same != c.same {
+			t.Errorf("%s: same PeerConnection %v, want %v", c.name, same, c.same)
+		}
+	}
+}
+
+// testViewer plays a stream with a pion PeerConnection receiving video, it
+// returns the session once ICE is connected and the replies of the session
+// that follow the answer
+func testViewer(t *testing.T, suuid string) (*WebRTCStreamer, *webrtc.PeerConnection, chan Response) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	connected := make(chan struct{}, 1)
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replies := make(chan Response, 16)
+	s := newWebRTCStreamer(func(r Response) error {
+		replies <- r
+		return nil
+	}, false)
+	t.Cleanup(func() {
+		s.end()
+		<-s.done
+	})
+	go s.run(suuid, testLocalOffer(t, pc, nil))
+	testSetAnswer(t, pc, replies)
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ICE not connected")
+	}
+	return s, pc, replies
+}
+
+// testLocalOffer sets an offer of the PeerConnection, it returns it with
+// all its candidates
+func testLocalOffer(t *testing.T, pc *webrtc.PeerConnection, options *webrtc.OfferOptions) string {
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-promise
+	return pc.LocalDescription().SDP
+}
+
+// testSetAnswer sets the answer of the next reply of a session
+func testSetAnswer(t *testing.T, pc *webrtc.PeerConnection, replies chan Response) string {
+	select {
+	case r := <-replies:
+		if r.Error != "" {
+			t.Fatal(r.Error)
+		}
+		err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: r.Sdp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Sdp
+	case <-time.After(10 * time.Second):
+		t.Fatal("no answer")
+	}
+	return ""
+}
+
+// attachedSenders returns the senders of a session with their tracks
+func attachedSenders(s *WebRTCStreamer) map[*webrtc.RTPSender]webrtc.TrackLocal {
+	senders := make(map[*webrtc.RTPSender]webrtc.TrackLocal)
+	for _, sender := range s.pc.GetSenders() {
+		senders[sender] = sender.Track()
+	}
+	return senders
+}
+
+// an ICE restart within the grace period of a lost connection keeps the
+// PeerConnection, its senders and their tracks
+func TestICERestart(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "ice-restart-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	grace := iceGracePeriod
+	iceGracePeriod = 500 * time.Millisecond
+	defer func() { iceGracePeriod = grace }()
+
+	s, pc, replies := testViewer(t, suuid)
+	senders := attachedSenders(s)
+	if len(senders) == 0 {
+		t.Fatal("no senders")
+	}
+	// the connection of the viewer is lost
+	s.stateC <- webrtc.ICEConnectionStateDisconnected
+	ufrag := sdpAttribute(s.pc.LocalDescription().SDP, "ice-ufrag")
+
+	if err := s.restart(testLocalOffer(t, pc, &webrtc.OfferOptions{ICERestart: true})); err != nil {
+		t.Fatal(err)
+	}
+	answer := testSetAnswer(t, pc, replies)
+	if sdpAttribute(answer, "ice-ufrag") == ufrag {
+		t.Error("the answer to the ICE restart has the ICE credentials of the first one")
+	}
+	select {
+	case <-s.done:
+		t.Fatal("the session ended after the ICE restart")
+	case <-time.After(2 * iceGracePeriod):
+	}
+	after := attachedSenders(s)
+	if len(after) != len(senders) {
+		t.Fatalf("%d senders after the ICE restart, want %d", len(after), len(senders))
+	}
+	for sender, track := range senders {
+		if got, ok := after[sender]; !ok || got != track {
+			t.Error("sender or track changed by the ICE restart")
+		}
+	}
+}
+
+// a viewer that doesn't come back within the grace period is closed
+// a restart with one already queued is refused at once, the /ws reader
+// isn't held while the session negotiates
+func TestICERestartBusy(t *testing.T) {
+	offer := testOffer(t, false)
+	s := &WebRTCStreamer{remote: offer, offers: make(chan string, 1), done: make(chan struct{})}
+	if err := s.restart(offer); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.restart(offer); err != ErrorWebRTCRestartBusy {
+		t.Errorf("second restart: %v, want %v", err, ErrorWebRTCRestartBusy)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("second restart refused after %s", d)
+	}
+	close(s.done)
+	if err := s.restart(offer); err != ErrorWebRTCSessionOver {
+		t.Errorf("restart of an ended session: %v, want %v", err, ErrorWebRTCSessionOver)
+	}
+}
+
+func TestICEGracePeriod(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "ice-grace-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	grace := iceGracePeriod
+	iceGracePeriod = 100 * time.Millisecond
+	defer func() { iceGracePeriod = grace }()
+
+	s, _, _ := testViewer(t, suuid)
+	s.stateC <- webrtc.ICEConnectionStateDisconnected
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session is still running after the grace period")
+	}
+}
+
+// a client that doesn't offer answers the offer of the server, its own
+// offers are refused
+func TestServerOffer(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "server-offer-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	connected := make(chan struct{}, 1)
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	replies := make(chan Response, 16)
+	s := newWebRTCStreamer(func(r Response) error {
+		replies <- r
+		return nil
+	}, false)
+	s.offering = true
+	defer func() {
+		s.end()
+		<-s.done
+	}()
+	go s.run(suuid, "")
+
+	var offer Response
+	select {
+	case offer = <-replies:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no offer")
+	}
+	if offer.Type != "offer" || offer.Error != "" {
+		t.Fatalf("reply %q %q, want an offer", offer.Type, offer.Error)
+	}
+	if !strings.Contains(offer.Sdp, "a=sendonly") || !strings.Contains(offer.Sdp, "H264") {
+		t.Errorf("offer without a sendonly H264 track:\n%s", offer.Sdp)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.Sdp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-promise
+	if !s.takeAnswer(pc.LocalDescription().SDP) {
+		t.Fatal("answer not taken")
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ICE not connected")
+	}
+
+	// the offer of the client doesn't wait for the session
+	start := time.Now()
+	if err := s.restart(testOffer(t, false)); err != ErrorWebRTCServerOffers {
+		t.Errorf("offer of the client: %v, want %v", err, ErrorWebRTCServerOffers)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("offer of the client refused after %s", d)
+	}
+	select {
+	case <-s.done:
+		t.Error("the session ended with the offer of the client")
+	default:
+	}
+}
+
+// testVideoOffer is a SDP offer with H264 formats of fmtp lines, by
+// payload type from 96
+func testVideoOffer(fmtps ...string) string {
+	var b strings.Builder
+	b.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=video 9 UDP/TLS/RTP/SAVPF")
+	for i := range fmtps {
+		fmt.Fprintf(&b, " %d", 96+i)
+	}
+	b.WriteString("\r\n")
+	for i, fmtp := range fmtps {
+		fmt.Fprintf(&b, "a=rtpmap:%d H264/90000\r\n", 96+i)
+		if fmtp != "" {
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", 96+i, fmtp)
+		}
+	}
+	return b.String()
+}
+
+func testH264High(t *testing.T) av.CodecData {
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(
+		[]byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+			0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58},
+		[]byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+func TestCheckOffer(t *testing.T) {
+	const (
+		baseline            = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"
+		constrainedBaseline = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+		high                = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"
+		highMode0           = "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=64001f"
+	)
+	main, highCamera := testH264(t), testH264High(t)
+	if plid := h264ProfileLevelID(main); plid != "4d001e" {
+		t.Errorf("profile-level-id of the Main camera %q", plid)
+	}
+	if plid := h264ProfileLevelID(highCamera); plid != "640028" {
+		t.Errorf("profile-level-id of the High camera %q", plid)
+	}
+	for _, c := range []struct {
+		name   string
+		codec  av.CodecData
+		offer  string
+		errors []string // in the error
+	}{
+		{"High camera, High offered", highCamera, testVideoOffer(constrainedBaseline, high), nil},
+		{"Main camera, High offered", main, testVideoOffer(baseline, high), nil},
+		{"High camera, baseline only", highCamera, testVideoOffer(baseline, constrainedBaseline),
+			[]string{"High profile (640028)", "can't be decoded", "Baseline, Constrained Baseline", "use MSE"}},
+		{"Main camera, Constrained Baseline only", main, testVideoOffer(constrainedBaseline),
+			[]string{"Main profile (4d001e)", "offers Constrained Baseline"}},
+		{"packetization-mode 0 only", highCamera, testVideoOffer(highMode0, "profile-level-id=64001f"),
+			[]string{"packetization-mode=1 is not supported"}},
+		{"no H264", main, testVideoOffer(), []string{"packetization-mode=1 is not supported"}},
+		{"audio", codec.NewPCMAlawCodecData(), testVideoOffer(), nil},
+	} {
+		err := checkOffer(c.offer, c.codec)
+		if (err != nil) != (c.errors != nil) {
+			t.Errorf("%s: error %v", c.name, err)
+			continue
+		}
+		for _, e := range c.errors {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: %q without %q", c.name, err, e)
+			}
+		}
+	}
+}
+
+func TestOfferFormats(t *testing.T) {
+	offer := testVideoOffer("packetization-mode=1;profile-level-id=42e01f", "")
+	offer += "a=rtpmap:100 VP8/90000\r\na=rtpmap:101 h264/90000\r\na=fmtp:101 profile-level-id=640c1f\r\n"
+	formats := offerFormats(offer, "H264")
+	want := []string{"packetization-mode=1;profile-level-id=42e01f", "", "profile-level-id=640c1f"}
+	if strings.Join(formats, "|") != strings.Join(want, "|") {
+		t.Errorf("formats %q, want %q", formats, want)
+	}
+	if formats := offerFormats(offer, "VP9"); len(formats) != 0 {
+		t.Errorf("VP9 formats %q", formats)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pion "github.com/pion/webrtc/v3"
+)
+
+// whepSession is a WebRTCStreamer signaled over WHEP (WebRTC-HTTP Egress
+// Protocol): the offer is POSTed, trickle ICE and ICE restarts are PATCHed
+// as SDP fragments (RFC 8840) and DELETE ends it. The answers include all
+// the local candidates, WHEP has no way to trickle them.
+type whepSession struct {
+	id       string
+	suuid    string
+	streamer *WebRTCStreamer
+	replies  chan Response // answers and errors of the session
+
+	mutex sync.Mutex // one offer at a time
+	offer string
+	ufrag string // ICE username fragment of the offer
+	etag  string
+}
+
+// whepSessions are the running WHEP sessions by id
+var whepSessions = struct {
+	sync.Mutex
+	m map[string]*whepSession
+}{m: make(map[string]*whepSession)}
+
+// whepReplyTimeout bounds the ICE gathering of an answer
+var whepReplyTimeout = 20 * time.Second
+
+func newWHEPSession(suuid, offer string) *whepSession {
+	w := &whepSession{
+		id:      pseudoUUID(),
+		suuid:   suuid,
+		replies: make(chan Response, 1),
+		offer:   offer,
+		ufrag:   sdpAttribute(offer, "ice-ufrag"),
+	}
+	w.streamer = newWebRTCStreamer(func(r Response) error {
+		if r.Type == "webrtc" {
+			select {
+			case w.replies <- r:
+			default:
+				// nobody waits for it, e.g. a codec change error
+			}
+		}
+		return nil
+	}, false)
+	return w
+}
+
+// reply waits for the answer of the session to an offer
+func (w *whepSession) reply() (Response, error) {
+	timeout := time.NewTimer(whepReplyTimeout)
+	defer timeout.Stop()
+	select {
+	case r := <-w.replies:
+		return r, nil
+	case <-w.streamer.done:
+		select {
+		case r := <-w.replies:
+			return r, nil
+		default:
+			return Response{}, errors.New("WHEP session closed")
+		}
+	case <-timeout.C:
+		return Response{}, errors.New("WHEP answer timeout")
+	}
+}
+
+// start runs the session and waits for its answer to the offer. Without
+// one the session is stopped, no client knows it.
+func (w *whepSession) start() (Response, error) {
+	go w.streamer.run(w.suuid, w.offer)
+	r, err := w.reply()
+	if err != nil || r.Error != "" {
+		w.streamer.end()
+	}
+	return r, err
+}
+
+// close ends the session, later requests of the client don't find it
+func (w *whepSession) close() {
+	whepSessions.Lock()
+	delete(whepSessions.m, w.id)
+	whepSessions.Unlock()
+	w.streamer.end()
+}
+
+// drain drops a reply nobody waited for before a new offer
+func (w *whepSession) drain() {
+	select {
+	case <-w.replies:
+	default:
+	}
+}
+
+func (w *whepSession) location() string {
+	return "/stream/whep/" + w.suuid + "/" + w.id
+}
+
+// whepSessionGe returns the session of a PATCH or DELETE request
+func whepSessionGe(c *gin.Context) *whepSession {
+	whepSessions.Lock()
+	defer whepSessions.Unlock()
+	w, ok := whepSessions.m[c.Param("session")]
+	if !ok || w.suuid != c.Param("uuid") {
+		return nil
+	}
+	return w
+}
+
+//HTTPAPIServerWHEP starts a WHEP session with the SDP offer of the body
+func HTTPAPIServerWHEP(c *gin.Context) {
+	suuid := c.Param("uuid")
+	if !Config.ext(suuid) {
+		c.String(http.StatusNotFound, "Stream Not Found")
+		return
+	}
+	if c.ContentType() != "application/sdp" {
+		c.String(http.StatusUnsupportedMediaType, "application/sdp expected")
+		return
+	}
+	offer, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println("WHEP", err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	Config.RunIFNotRun(suuid)
+	if Config.coGe(suuid) == nil {
+		log.Println("Stream Codec Not Found")
+		c.String(http.StatusServiceUnavailable, "Stream Codec Not Found")
+		return
+	}
+
+	w := newWHEPSession(suuid, string(offer))
+	r, err := w.start()
+	if err != nil {
+		log.Println(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.Error != "" {
+		c.String(http.StatusNotAcceptable, r.Error)
+		return
+	}
+	w.etag = `"` + sdpAttribute(r.Sdp, "ice-ufrag") + `"`
+
+	whepSessions.Lock()
+	whepSessions.m[w.id] = w
+	whepSessions.Unlock()
+	go func() {
+		<-w.streamer.done
+		whepSessions.Lock()
+		delete(whepSessions.m, w.id)
+		whepSessions.Unlock()
+	}()
+
+	c.Header("Location", w.location())
+	c.Header("ETag", w.etag)
+	c.Data(http.StatusCreated, "application/sdp", []byte(r.Sdp))
+}
+
+//HTTPAPIServerWHEPPatch takes remote candidates, or restarts ICE when the
+//SDP fragment has new ICE credentials
+func HTTPAPIServerWHEPPatch(c *gin.Context) {
+	w := whepSessionGe(c)
+	if w == nil {
+		c.String(http.StatusNotFound, "Session Not Found")
+		return
+	}
+	if c.ContentType() != "application/trickle-ice-sdpfrag" {
+		c.String(http.StatusUnsupportedMediaType, "application/trickle-ice-sdpfrag expected")
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println("WHEP", err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	frag := string(body)
+	ufrag, pwd := sdpAttribute(frag, "ice-ufrag"), sdpAttribute(frag, "ice-pwd")
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if m := c.GetHeader("If-Match"); m != "" && m != "*" && m != w.etag {
+		c.Status(http.StatusPreconditionFailed)
+		return
+	}
+	if ufrag == "" || ufrag == w.ufrag {
+		for _, candidate := range sdpCandidates(frag) {
+			w.streamer.candidate(candidate)
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	// ICE restart
+	offer := restartOffer(w.offer, ufrag, pwd)
+	w.drain()
+	if err := w.streamer.restart(offer); err != nil {
+		if err == ErrorWebRTCSessionOver {
+			c.String(http.StatusNotFound, "Session Not Found")
+			return
+		}
+		log.Println("WHEP", err)
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	r, err := w.reply()
+	if err != nil {
+		log.Println(err)
+		// the client can't know the state of the session, it ends once
+		// it has answered
+		w.close()
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.Error != "" {
+		w.close()
+		c.String(http.StatusNotAcceptable, r.Error)
+		return
+	}
+	w.offer, w.ufrag = offer, ufrag
+	w.etag = `"` + sdpAttribute(r.Sdp, "ice-ufrag") + `"`
+	for _, candidate := range sdpCandidates(frag) {
+		w.streamer.candidate(candidate)
+	}
+	c.Header("ETag", w.etag)
+	c.Data(http.StatusOK, "application/trickle-ice-sdpfrag", []byte(answerFragment(r.Sdp)))
+}
+
+//HTTPAPIServerWHEPDelete ends a WHEP session
+func HTTPAPIServerWHEPDelete(c *gin.Context) {
+	w := whepSessionGe(c)
+	if w == nil {
+		c.String(http.StatusNotFound, "Session Not Found")
+		return
+	}
+	w.close()
+	c.Status(http.StatusOK)
+}
+
+// sdpLines splits a SDP or a SDP fragment
+func sdpLines(sdp string) []string {
+	lines := strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return lines
+}
+
+// sdpAttribute returns the value of the first a=name: line
+func sdpAttribute(sdp, name string) string {
+	for _, line := range sdpLines(sdp) {
+		if v := strings.TrimPrefix(line, "a="+name+":"); v != line {
+			return v
+		}
+	}
+	return ""
+}
+
+// sdpCandidates returns the candidates of a SDP fragment with the media
+// section they belong to
+func sdpCandidates(frag string) []pion.ICECandidateInit {
+	var candidates []pion.ICECandidateInit
+	index := -1
+	mid := ""
+	for _, line := range sdpLines(frag) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			c := pion.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				m := mid
+				c.SDPMid = &m
+			}
+			if index >= 0 {
+				i := uint16(index)
+				c.SDPMLineIndex = &i
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// restartOffer is the previous offer with the new ICE credentials of an
+// ICE restart, the candidates come in the fragment
+func restartOffer(offer, ufrag, pwd string) string {
+	var b strings.Builder
+	for _, line := range sdpLines(offer) {
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		fmt.Fprintf(&b, "%s\r\n", line)
+	}
+	return b.String()
+}
+
+// answerFragment is the SDP fragment of an answer to an ICE restart: the
+// new ICE credentials and the candidates of every media section
+func answerFragment(answer string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", sdpAttribute(answer, "ice-ufrag"), sdpAttribute(answer, "ice-pwd"))
+	for _, line := range sdpLines(answer) {
+		if strings.HasPrefix(line, "m=") || strings.HasPrefix(line, "a=mid:") ||
+			strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates" {
+			fmt.Fprintf(&b, "%s\r\n", line)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/gin-gonic/gin"
+)
+
+// a session without answer in time is stopped, it leaves the hub of the
+// stream
+func TestWHEPReplyTimeout(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "whep-timeout-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	timeout := whepReplyTimeout
+	whepReplyTimeout = 0
+	defer func() { whepReplyTimeout = timeout }()
+
+	w := newWHEPSession(suuid, testOffer(t, false))
+	if _, err := w.start(); err == nil {
+		t.Fatal("answered without time")
+	}
+	select {
+	case <-w.streamer.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session of the timed out answer is still running")
+	}
+	webrtcHubs.Lock()
+	defer webrtcHubs.Unlock()
+	if webrtcHubs.m[suuid] != nil {
+		t.Error("the hub of the stream is still running")
+	}
+}
+
+// testWHEPRouter serves the WHEP endpoints
+func testWHEPRouter() *gin.Engine {
+	router := gin.New()
+	router.POST("/stream/whep/:uuid", HTTPAPIServerWHEP)
+	router.PATCH("/stream/whep/:uuid/:session", HTTPAPIServerWHEPPatch)
+	router.DELETE("/stream/whep/:uuid/:session", HTTPAPIServerWHEPDelete)
+	return router
+}
+
+// testWHEPRequest sends a request to the router, the header is set when it
+// isn't empty
+func testWHEPRequest(router *gin.Engine, method, path, contentType, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestWHEP(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "whep-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	router := testWHEPRouter()
+
+	if w := testWHEPRequest(router, http.MethodPost, "/stream/whep/unknown", "application/sdp", testOffer(t, false)); w.Code != http.StatusNotFound {
+		t.Errorf("POST of an unknown stream: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := testWHEPRequest(router, http.MethodPost, "/stream/whep/"+suuid, "text/plain", testOffer(t, false)); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST without SDP: status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+
+	w := testWHEPRequest(router, http.MethodPost, "/stream/whep/"+suuid, "application/sdp", testOffer(t, false))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	location, etag := w.Header().Get("Location"), w.Header().Get("ETag")
+	if !strings.HasPrefix(location, "/stream/whep/"+suuid+"/") {
+		t.Errorf("Location %q", location)
+	}
+	if want := `"` + sdpAttribute(w.Body.String(), "ice-ufrag") + `"`; etag != want {
+		t.Errorf("ETag %s, want %s", etag, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/sdp" {
+		t.Errorf("Content-Type %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "a=candidate:") {
+		t.Error("answer without candidates")
+	}
+
+	const frag = "a=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 9 typ host\r\n"
+	if w := testWHEPRequest(router, http.MethodPatch, location, "application/trickle-ice-sdpfrag", frag, "If-Match", etag); w.Code != http.StatusNoContent {
+		t.Errorf("PATCH of candidates: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := testWHEPRequest(router, http.MethodPatch, location, "application/trickle-ice-sdpfrag", frag, "If-Match", `"stale"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a stale If-Match: status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := testWHEPRequest(router, http.MethodPatch, location, "application/sdp", frag); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH without a SDP fragment: status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound} {
+		if w := testWHEPRequest(router, http.MethodDelete, location, "", ""); w.Code != status {
+			t.Errorf("DELETE: status %d, want %d", w.Code, status)
+		}
+	}
+	if w := testWHEPRequest(router, http.MethodPatch, location, "application/trickle-ice-sdpfrag", frag); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH of a deleted session: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// a session whose ICE restart failed is gone, its DELETE is a 404
+func TestWHEPRestartFailed(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "whep-restart-test"
+	testStream(t, suuid, []av.CodecData{testH264(t)})
+	router := testWHEPRouter()
+
+	w := testWHEPRequest(router, http.MethodPost, "/stream/whep/"+suuid, "application/sdp", testOffer(t, false))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	location := w.Header().Get("Location")
+
+	timeout := whepReplyTimeout
+	whepReplyTimeout = 0
+	defer func() { whepReplyTimeout = timeout }()
+	const restart = "a=ice-ufrag:restart\r\na=ice-pwd:restartrestartrestartrestart\r\n"
+	if w := testWHEPRequest(router, http.MethodPatch, location, "application/trickle-ice-sdpfrag", restart); w.Code != http.StatusInternalServerError {
+		t.Errorf("PATCH of a timed out ICE restart: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if w := testWHEPRequest(router, http.MethodDelete, location, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE after the failed ICE restart: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// signalingClient is the HTTP client of the WHEP sources and the WHIP
+// publish targets
+var signalingClient = &http.Client{Timeout: 10 * time.Second}
+
+// isWHEPURL tells whether a stream URL is a WHEP endpoint, whep:// for
+// http and wheps:// for https
+func isWHEPURL(u string) bool {
+	return strings.HasPrefix(u, "whep://") || strings.HasPrefix(u, "wheps://")
+}
+
+// whepEndpoint is the HTTP URL of a WHEP stream URL
+func whepEndpoint(u string) string {
+	if strings.HasPrefix(u, "wheps://") {
+		return "https://" + strings.TrimPrefix(u, "wheps://")
+	}
+	return "http://" + strings.TrimPrefix(u, "whep://")
+}
+
+// WHEPWorker plays a stream of another WebRTC server as a WHEP client, the
+// received tracks are depacketized into the stream like a camera
+func WHEPWorker(name, u string, OnDemand, DisableAudio bool) error {
+	if whipAPI == nil {
+		panic("whepclient.go: WebRTC was not initialized")
+	}
+	pc, err := whipAPI.NewPeerConnection(peerConnectionConfig())
+	if err != nil {
+		return err
+	}
+	src := newWebRTCSource(name, pc, nil)
+	defer src.close()
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		return err
+	}
+	if !DisableAudio {
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			return err
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	<-promise
+
+	endpoint := whepEndpoint(u)
+	resp, err := signalingClient.Post(endpoint, "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	answer, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("WHEP %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+	if location, err := resp.Location(); err == nil {
+		defer deleteSession(location)
+	}
+
+	err = src.setMedia(string(answer), string(answer))
+	if err != nil {
+		return err
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)})
+	if err != nil {
+		return err
+	}
+	log.Println("WHEP source connected", name)
+
+	clientTest := time.NewTicker(20 * time.Second)
+	defer clientTest.Stop()
+	for {
+		select {
+		case err := <-src.errC:
+			return err
+		case <-clientTest.C:
+			if OnDemand && !Config.HasViewer(name) {
+				return ErrorStreamExitNoViewer
+			}
+		}
+	}
+}
+
+// deleteSession ends a WHEP or WHIP session on the server
+func deleteSession(location *url.URL) {
+	req, err := http.NewRequest(http.MethodDelete, location.String(), nil)
+	if err != nil {
+		log.Println("DELETE", location, err)
+		return
+	}
+	resp, err := signalingClient.Do(req)
+	if err != nil {
+		log.Println("DELETE", location, err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testWHEPResponder is a WHEP endpoint answering with a pion PeerConnection
+// sending H264 at /whep/cam and nothing at /whep/empty, the offers it gets
+// and the sessions deleted are sent on offers and deleted. The session is
+// at a relative Location.
+func testWHEPResponder(t *testing.T) (*httptest.Server, *webrtc.TrackLocalStaticSample, chan string, chan string) {
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "whep-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offers, deleted := make(chan string, 10), make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && (r.URL.Path == "/whep/cam" || r.URL.Path == "/whep/empty"):
+			if r.Header.Get("Content-Type") != "application/sdp" {
+				http.Error(w, "application/sdp expected", http.StatusUnsupportedMediaType)
+				return
+			}
+			offer, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			offers <- string(offer)
+			pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			t.Cleanup(func() { pc.Close() })
+			if r.URL.Path == "/whep/cam" {
+				if _, err := pc.AddTrack(video); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			promise := webrtc.GatheringCompletePromise(pc)
+			answer, err := pc.CreateAnswer(nil)
+			if err == nil {
+				err = pc.SetLocalDescription(answer)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			<-promise
+			w.Header().Set("Location", "session/1")
+			w.Header().Set("Content-Type", "application/sdp")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(pc.LocalDescription().SDP))
+		case r.Method == http.MethodDelete:
+			deleted <- r.URL.Path
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, video, offers, deleted
+}
+
+func TestWHEPWorker(t *testing.T) {
+	testWebRTC(t)
+	srv, video, offers, _ := testWHEPResponder(t)
+	const suuid = "whep-source-test"
+	testStream(t, suuid, nil)
+	_, ch, _ := Config.clAd(suuid)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- WHEPWorker(suuid, "whep://"+strings.TrimPrefix(srv.URL, "http://")+"/whep/cam", false, true)
+	}()
+	select {
+	case offer := <-offers:
+		if !strings.Contains(offer, "m=video ") || !strings.Contains(offer, "a=recvonly") {
+			t.Errorf("offer without a receiving video:\n%s", offer)
+		}
+		if strings.Contains(offer, "m=audio ") {
+			t.Errorf("offer with audio, it is disabled:\n%s", offer)
+		}
+	case err := <-errC:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no offer")
+	}
+
+	keyframe := []byte{0, 0, 0, 1, 0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64,
+		0, 0, 0, 1, 0x68, 0xee, 0x3c, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for received := false; !received; {
+		select {
+		case pck := <-ch:
+			codecs := Config.coGe(suuid)
+			if int(pck.Idx) >= len(codecs) || codecs[pck.Idx].Type() != av.H264 {
+				t.Fatalf("packet of stream %d, codecs %v", pck.Idx, codecs)
+			}
+			if !pck.IsKeyFrame {
+				t.Error("H264 packet not a keyframe")
+			}
+			received = true
+		case <-ticker.C:
+			if err := video.WriteSample(media.Sample{Data: keyframe, Duration: 20 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+		case err := <-errC:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no packet after 10s")
+		}
+	}
+}
+
+// the session at the Location is deleted when the source ends, here as
+// soon as it is answered without media
+func TestWHEPWorkerNoMedia(t *testing.T) {
+	testWebRTC(t)
+	srv, _, _, deleted := testWHEPResponder(t)
+	const suuid = "whep-source-empty-test"
+	testStream(t, suuid, nil)
+	err := WHEPWorker(suuid, "whep://"+strings.TrimPrefix(srv.URL, "http://")+"/whep/empty", false, true)
+	if err != ErrorWebRTCSourceNoMedia {
+		t.Errorf("error %v, want %v", err, ErrorWebRTCSourceNoMedia)
+	}
+	select {
+	case path := <-deleted:
+		if path != "/whep/session/1" {
+			t.Errorf("deleted %s, want /whep/session/1", path)
+		}
+	default:
+		t.Error("session not deleted")
+	}
+}
+
+func TestWHEPWorkerRefused(t *testing.T) {
+	testWebRTC(t)
+	srv, _, _, _ := testWHEPResponder(t)
+	const suuid = "whep-source-refused-test"
+	testStream(t, suuid, nil)
+	err := WHEPWorker(suuid, "whep://"+strings.TrimPrefix(srv.URL, "http://")+"/whep/unknown", false, false)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("error %v, want the 404 of the server", err)
+	}
+}
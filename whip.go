@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// whipAPI receives the WHIP (WebRTC-HTTP Ingest Protocol) publishers and
+// the WHEP sources. Only H264 and Opus are negotiated, their RTP is
+// depacketized into av.Packets like the one of a camera.
+var whipAPI *webrtc.API
+
+// whipGOPCheck is how often the GOP cache of a published stream is checked,
+// the publisher is asked for a keyframe when it is empty. WebRTC encoders
+// only send them on demand.
+const whipGOPCheck = time.Second
+
+func initWHIP(e webrtc.SettingEngine) error {
+	m := &webrtc.MediaEngine{}
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for pt, plid := range map[webrtc.PayloadType]string{102: "42001f", 108: "42e01f", 104: "4d001f", 106: "640c1f", 112: "64001f"} {
+		err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + plid,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: pt,
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return err
+		}
+	}
+	err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return err
+	}
+
+	i := &interceptor.Registry{}
+	err = webrtc.RegisterDefaultInterceptors(m, i)
+	if err != nil {
+		return err
+	}
+	whipAPI = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(e))
+	return nil
+}
+
+// whipPublisher is a WHIP session publishing a stream
+type whipPublisher struct {
+	id    string
+	suuid string
+	src   *webrtcSource
+	pli   chan struct{}
+}
+
+// whipPublishers are the running WHIP sessions by id
+var whipPublishers = struct {
+	sync.Mutex
+	m map[string]*whipPublisher
+}{m: make(map[string]*whipPublisher)}
+
+// whipError answers a WHIP request refused for the stream
+func whipError(c *gin.Context, err error) {
+	switch err {
+	case ErrorWHIPNoStream:
+		c.String(http.StatusNotFound, err.Error())
+	case ErrorWHIPToken:
+		c.Header("WWW-Authenticate", "Bearer")
+		c.String(http.StatusUnauthorized, err.Error())
+	case ErrorWHIPPublished:
+		c.String(http.StatusConflict, err.Error())
+	default:
+		c.String(http.StatusBadRequest, err.Error())
+	}
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+//HTTPAPIServerWHIP publishes a stream with the SDP offer of the body
+func HTTPAPIServerWHIP(c *gin.Context) {
+	suuid := c.Param("uuid")
+	if err := Config.whipAu(suuid, bearerToken(c)); err != nil {
+		whipError(c, err)
+		return
+	}
+	if c.ContentType() != "application/sdp" {
+		c.String(http.StatusUnsupportedMediaType, "application/sdp expected")
+		return
+	}
+	offer, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println("WHIP", err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	p := &whipPublisher{
+		id:    pseudoUUID(),
+		suuid: suuid,
+		pli:   make(chan struct{}, 1),
+	}
+	if err := Config.whipAd(suuid, p.id, bearerToken(c), p.pli); err != nil {
+		whipError(c, err)
+		return
+	}
+	whipPublishers.Lock()
+	whipPublishers.m[p.id] = p
+	whipPublishers.Unlock()
+	answer, err := p.start(string(offer))
+	if err != nil {
+		log.Println("WHIP", err)
+		if p.src != nil {
+			p.src.close()
+		} else {
+			whipPublishers.Lock()
+			delete(whipPublishers.m, p.id)
+			whipPublishers.Unlock()
+			Config.whipDe(suuid, p.id)
+		}
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Println("WHIP publisher of", suuid)
+
+	c.Header("Location", "/stream/whip/"+suuid+"/"+p.id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+//HTTPAPIServerWHIPDelete ends a WHIP session
+func HTTPAPIServerWHIPDelete(c *gin.Context) {
+	if err := Config.whipAu(c.Param("uuid"), bearerToken(c)); err != nil {
+		whipError(c, err)
+		return
+	}
+	whipPublishers.Lock()
+	p, ok := whipPublishers.m[c.Param("session")]
+	whipPublishers.Unlock()
+	if !ok || p.suuid != c.Param("uuid") {
+		c.String(http.StatusNotFound, "Session Not Found")
+		return
+	}
+	p.src.close()
+	c.Status(http.StatusOK)
+}
+
+// start answers the offer, the answer has all the candidates
+func (p *whipPublisher) start(offer string) (string, error) {
+	if whipAPI == nil {
+		panic("whip.go: WebRTC was not initialized")
+	}
+	pc, err := whipAPI.NewPeerConnection(peerConnectionConfig())
+	if err != nil {
+		return "", err
+	}
+	p.src = newWebRTCSource(p.suuid, pc, p.pli)
+	go func() {
+		<-p.src.done
+		whipPublishers.Lock()
+		delete(whipPublishers.m, p.id)
+		whipPublishers.Unlock()
+		Config.whipDe(p.suuid, p.id)
+		select {
+		case err := <-p.src.errC:
+			log.Println("WHIP publisher of", p.suuid, "gone", err)
+		default:
+			log.Println("WHIP publisher of", p.suuid, "gone")
+		}
+	}()
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+	promise := webrtc.GatheringCompletePromise(pc)
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return "", err
+	}
+	<-promise
+	if err := p.src.setMedia(offer, answer.SDP); err != nil {
+		return "", err
+	}
+	return pc.LocalDescription().SDP, nil
+}
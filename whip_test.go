@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testWHIPRouter serves the WHIP endpoints
+func testWHIPRouter() *gin.Engine {
+	router := gin.New()
+	router.POST("/stream/whip/:uuid", HTTPAPIServerWHIP)
+	router.DELETE("/stream/whip/:uuid/:session", HTTPAPIServerWHIPDelete)
+	return router
+}
+
+// testPublisher is a pion PeerConnection sending H264 and Opus samples, its
+// offer has all the candidates
+func testPublisher(t *testing.T) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, *webrtc.TrackLocalStaticSample, string) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "whip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "whip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range []webrtc.TrackLocal{video, audio} {
+		if _, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pc, video, audio, testLocalOffer(t, pc, nil)
+}
+
+func TestWHIPErrors(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "whip-errors-test"
+	s := testStream(t, suuid, nil)
+	s.WHIPToken = "secret"
+	Config.mutex.Lock()
+	Config.Streams[suuid] = s
+	Config.mutex.Unlock()
+	router := testWHIPRouter()
+
+	_, _, _, offer := testPublisher(t)
+	for _, c := range []struct {
+		name, path string
+		header     []string
+		status     int
+	}{
+		{"no token", "/stream/whip/" + suuid, nil, http.StatusUnauthorized},
+		{"wrong token", "/stream/whip/" + suuid, []string{"Authorization", "Bearer wrong"}, http.StatusUnauthorized},
+		{"not a bearer token", "/stream/whip/" + suuid, []string{"Authorization", "Basic secret"}, http.StatusUnauthorized},
+		{"unknown stream", "/stream/whip/unknown", []string{"Authorization", "Bearer secret"}, http.StatusNotFound},
+	} {
+		w := testWHEPRequest(router, http.MethodPost, c.path, "application/sdp", offer, c.header...)
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.status)
+		}
+		if c.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: WWW-Authenticate %q", c.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	w := testWHEPRequest(router, http.MethodPost, "/stream/whip/"+suuid, "application/sdp", offer, "Authorization", "Bearer secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("first publisher: status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/stream/whip/"+suuid+"/") {
+		t.Fatalf("Location %q", location)
+	}
+	_, _, _, second := testPublisher(t)
+	if w := testWHEPRequest(router, http.MethodPost, "/stream/whip/"+suuid, "application/sdp", second, "Authorization", "Bearer secret"); w.Code != http.StatusConflict {
+		t.Errorf("second publisher: status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if w := testWHEPRequest(router, http.MethodDelete, location, "", "", "Authorization", "Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("DELETE with a wrong token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := testWHEPRequest(router, http.MethodDelete, location, "", "", "Authorization", "Bearer secret"); w.Code != http.StatusOK {
+		t.Errorf("DELETE: status %d, want %d", w.Code, http.StatusOK)
+	}
+	// the next publisher is taken once the first one is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := testWHEPRequest(router, http.MethodPost, "/stream/whip/"+suuid, "application/sdp", second, "Authorization", "Bearer secret")
+		if w.Code == http.StatusCreated {
+			break
+		}
+		if w.Code != http.StatusConflict || time.Now().After(deadline) {
+			t.Fatalf("publisher after DELETE: status %d, want %d", w.Code, http.StatusCreated)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWHIPPublisher(t *testing.T) {
+	testWebRTC(t)
+	const suuid = "whip-publisher-test"
+	s := testStream(t, suuid, nil)
+	s.WHIPToken = "secret"
+	Config.mutex.Lock()
+	Config.Streams[suuid] = s
+	Config.mutex.Unlock()
+
+	pc, video, audio, offer := testPublisher(t)
+	w := testWHEPRequest(testWHIPRouter(), http.MethodPost, "/stream/whip/"+suuid, "application/sdp", offer, "Authorization", "Bearer secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		t.Fatal(err)
+	}
+	_, ch, _ := Config.clAd(suuid)
+
+	// SPS, PPS and IDR slice of a keyframe, an Opus frame of 20 ms
+	keyframe := []byte{0, 0, 0, 1, 0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64,
+		0, 0, 0, 1, 0x68, 0xee, 0x3c, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+	opus := []byte{0xfc, 0xff, 0xfe}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	var gotVideo, gotAudio bool
+	for !gotVideo || !gotAudio {
+		select {
+		case pck := <-ch:
+			codecs := Config.coGe(suuid)
+			if int(pck.Idx) >= len(codecs) {
+				t.Fatalf("packet of stream %d, %d codecs", pck.Idx, len(codecs))
+			}
+			switch codecs[pck.Idx].Type() {
+			case av.H264:
+				if !pck.IsKeyFrame {
+					t.Error("H264 packet not a keyframe")
+				}
+				gotVideo = true
+			case av.OPUS:
+				if string(pck.Data) != string(opus) {
+					t.Errorf("Opus packet % x, want % x", pck.Data, opus)
+				}
+				gotAudio = true
+			}
+		case <-ticker.C:
+			if err := video.WriteSample(media.Sample{Data: keyframe, Duration: 20 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+			if err := audio.WriteSample(media.Sample{Data: opus, Duration: 20 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatalf("video %v, audio %v after 10s", gotVideo, gotAudio)
+		}
+	}
+}
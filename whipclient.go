@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// the reconnection delays of a WHIP publish target, doubled after every
+// failure and reset after a session that lasted longer than the maximum
+const (
+	whipBackoffMin = time.Second
+	whipBackoffMax = time.Minute
+)
+
+// WHIPPublishLoop pushes a stream to a WHIP endpoint, the session is
+// reconnected with backoff when it fails. It ends when stop is closed or
+// the stream is no longer published to the endpoint.
+func WHIPPublishLoop(suuid, endpoint string, stop <-chan struct{}) {
+	backoff := whipBackoffMin
+	for {
+		if Config.puGe(suuid) != endpoint {
+			log.Println("WHIP publish", suuid, "to", endpoint, "removed")
+			return
+		}
+		Config.RunIFNotRun(suuid)
+		start := time.Now()
+		err := WHIPPublish(suuid, endpoint, stop)
+		if time.Since(start) > whipBackoffMax {
+			backoff = whipBackoffMin
+		}
+		log.Println("WHIP publish", suuid, "to", endpoint, err, "retry in", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			log.Println("WHIP publish", suuid, "to", endpoint, "stopped")
+			return
+		}
+		backoff *= 2
+		if backoff > whipBackoffMax {
+			backoff = whipBackoffMax
+		}
+	}
+}
+
+// WHIPPublish runs one WHIP session, the tracks are the shared ones of
+// the WebRTC viewers of the stream. The session is deleted when stop is
+// closed.
+func WHIPPublish(suuid, endpoint string, stop <-chan struct{}) error {
+	hub, switched, err := joinHub(suuid)
+	if err != nil {
+		return err
+	}
+	defer hub.leave(switched)
+	s := newWebRTCStreamer(nil, false)
+	defer close(s.done)
+	err = s.setup(hub, switched, "")
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	promise := webrtc.GatheringCompletePromise(s.pc)
+	err = s.pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	for gathering := true; gathering; {
+		select {
+		case state := <-s.stateC:
+			s.setState(state)
+		case <-promise:
+			gathering = false
+		}
+	}
+
+	resp, err := signalingClient.Post(endpoint, "application/sdp", strings.NewReader(s.pc.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	answer, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("WHIP %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+	if location, err := resp.Location(); err == nil {
+		defer deleteSession(location)
+	}
+	// the codecs the server takes, for the track switches
+	s.offer = string(answer)
+	err = s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)})
+	if err != nil {
+		return err
+	}
+	log.Println("WHIP publishing", suuid, "to", endpoint)
+
+	reports := time.NewTicker(time.Second)
+	defer reports.Stop()
+	for {
+		select {
+		case state := <-s.stateC:
+			s.setState(state)
+			if state == webrtc.ICEConnectionStateClosed {
+				return ErrorWHIPPublishDisconnect
+			}
+		case <-s.up:
+			s.up, s.ready = nil, true
+			s.prefill()
+		case <-s.grace.C:
+			if s.lost() {
+				return ErrorWHIPPublishDisconnect
+			}
+		case <-stop:
+			return nil
+		case now := <-reports.C:
+			s.report(now)
+		case <-s.switched:
+			err = s.update()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/webrtc/v3"
+)
+
+var testWebRTCOnce sync.Once
+
+// testWebRTC initializes WebRTC once for the tests, without the ICE servers
+// of the config
+func testWebRTC(t *testing.T) {
+	var err error
+	testWebRTCOnce.Do(func() {
+		Config.mutex.Lock()
+		Config.Server.ICEServers = nil
+		Config.mutex.Unlock()
+		err = InitWebRTC(0, 0, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testWHIPReceiver is a WHIP endpoint answering with a pion PeerConnection,
+// the sessions it creates and deletes are sent on posted and deleted
+func testWHIPReceiver(t *testing.T) (*httptest.Server, chan string, chan string) {
+	posted, deleted := make(chan string, 10), make(chan string, 10)
+	var n int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			offer, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			t.Cleanup(func() { pc.Close() })
+			err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			answer, err := pc.CreateAnswer(nil)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			promise := webrtc.GatheringCompletePromise(pc)
+			if err = pc.SetLocalDescription(answer); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			<-promise
+			n++
+			session := "/session/" + strconv.Itoa(n)
+			posted <- session
+			w.Header().Set("Location", session)
+			w.Header().Set("Content-Type", "application/sdp")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(pc.LocalDescription().SDP))
+		case http.MethodDelete:
+			deleted <- r.URL.Path
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, posted, deleted
+}
+
+// testStream adds a stream of the codecs to the config, it is removed at
+// the end of the test
+func testStream(t *testing.T, suuid string, codecs []av.CodecData) StreamST {
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+	s := StreamST{
+		Codecs: codecs,
+		Cl:     make(map[string]viewer),
+		gop:    newGOPCache(),
+		tc:     make(map[av.CodecType]*audioTranscoder),
+		stop:   make(chan struct{}),
+	}
+	Config.Streams[suuid] = s
+	t.Cleanup(func() { Config.stDe(suuid) })
+	return s
+}
+
+func testH264(t *testing.T) av.CodecData {
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(
+		[]byte{0x67, 0x4d, 0x00, 0x1e, 0x95, 0xa8, 0x28, 0x0f, 0x64},
+		[]byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+func TestWHIPPublishRemoved(t *testing.T) {
+	testWebRTC(t)
+	srv, posted, deleted := testWHIPReceiver(t)
+	const suuid = "whip-publish-test"
+	s := testStream(t, suuid, []av.CodecData{testH264(t)})
+	s.Publish = srv.URL
+	Config.mutex.Lock()
+	Config.Streams[suuid] = s
+	Config.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		WHIPPublishLoop(suuid, srv.URL, s.stop)
+		close(done)
+	}()
+	var session string
+	select {
+	case session = <-posted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no WHIP session")
+	}
+	Config.stDe(suuid)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publish loop didn't stop with the stream")
+	}
+	select {
+	case path := <-deleted:
+		if path != session {
+			t.Errorf("deleted %s, want %s", path, session)
+		}
+	default:
+		t.Errorf("session %s not deleted", session)
+	}
+	if Config.ext(suuid) {
+		t.Errorf("stream %s not removed", suuid)
+	}
+}
+
+func TestStDe(t *testing.T) {
+	const suuid = "stop-test"
+	s := testStream(t, suuid, nil)
+	Config.stDe(suuid)
+	select {
+	case <-s.stop:
+	default:
+		t.Error("not stopped after the stream was removed")
+	}
+	// a source still running doesn't bring it back
+	Config.coAd(suuid, []av.CodecData{testH264(t)})
+	Config.inAd(suuid, Config.inGe(suuid))
+	if Config.ext(suuid) {
+		t.Errorf("stream %s back after its removal", suuid)
+	}
+}